@@ -0,0 +1,269 @@
+package fscommon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allspace/csmgr/util"
+)
+
+//append-only audit log of file operations: who, what operation, which path, bytes and result
+//front-ends record operations on FileSystemImpl, a FileObject records its reads and writes when it's released
+//records are written as JSON lines or tab separated text, the file is rotated by size
+//operations without a client, e.g. uploads of rotated audit logs, are not recorded
+
+const (
+	AUDIT_FORMAT_JSON = "json"
+	AUDIT_FORMAT_TEXT = "text"
+
+	DEFAULT_AUDIT_MAX_SIZE  = 100 * 1024 * 1024
+	DEFAULT_AUDIT_MAX_FILES = 10
+)
+
+type AuditRecord struct {
+	Time      string `json:"time"`
+	Client    string `json:"client"`
+	RequestId string `json:"request_id,omitempty"`
+	Op        string `json:"op"`
+	Path      string `json:"path"`
+	Target    string `json:"target,omitempty"` //new path of rename
+	Bytes     int64  `json:"bytes"`
+	Result    string `json:"result"`
+	Errno     int    `json:"errno"`
+}
+
+func (me *AuditRecord) text() string {
+	return strings.Join([]string{me.Time, me.Client, me.RequestId, me.Op, me.Path, me.Target,
+		fmt.Sprint(me.Bytes), me.Result, fmt.Sprint(me.Errno)}, "\t")
+}
+
+type AuditLog struct {
+	path     string
+	format   string
+	maxSize  int64
+	maxFiles int //rotated files kept locally
+
+	file *os.File
+	size int64
+
+	fs     FileSystemImpl //rotated files are uploaded if it's set
+	prefix string
+
+	mtx sync.Mutex
+}
+
+func NewAuditLog(path string, format string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	if format != AUDIT_FORMAT_JSON && format != AUDIT_FORMAT_TEXT {
+		return nil, fmt.Errorf("unknown audit log format %s", format)
+	}
+	if maxSize <= 0 {
+		maxSize = DEFAULT_AUDIT_MAX_SIZE
+	}
+	if maxFiles <= 0 {
+		maxFiles = DEFAULT_AUDIT_MAX_FILES
+	}
+	me := &AuditLog{
+		path:     path,
+		format:   format,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := me.open(); err != nil {
+		return nil, err
+	}
+	return me, nil
+}
+
+//upload rotated files into the bucket under the prefix, e.g. .audit/
+func (me *AuditLog) SetUploader(fs FileSystemImpl, prefix string) {
+	me.mtx.Lock()
+	me.fs = fs
+	me.prefix = prefix
+	me.mtx.Unlock()
+}
+
+func (me *AuditLog) open() error {
+	f, err := os.OpenFile(me.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	me.file = f
+	me.size = fi.Size()
+	return nil
+}
+
+func (me *AuditLog) Write(rec *AuditRecord) {
+	var buf []byte
+	if me.format == AUDIT_FORMAT_JSON {
+		var err error
+		if buf, err = json.Marshal(rec); err != nil {
+			dlog.Errorf("Failed to encode audit record: %s", err)
+			return
+		}
+	} else {
+		buf = []byte(rec.text())
+	}
+	buf = append(buf, '\n')
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	if me.file == nil {
+		return
+	}
+	if me.size > 0 && me.size+int64(len(buf)) > me.maxSize {
+		me.rotate()
+		if me.file == nil {
+			return
+		}
+	}
+	n, err := me.file.Write(buf)
+	me.size += int64(n)
+	if err != nil {
+		dlog.Errorf("Failed to write audit log: %s", err)
+	}
+}
+
+//rename the current file with a timestamp suffix and start a new one
+func (me *AuditLog) rotate() {
+	me.file.Close()
+	me.file = nil
+	rotated := me.path + "." + time.Now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(me.path, rotated); err != nil {
+		dlog.Errorf("Failed to rotate audit log: %s", err)
+		rotated = ""
+	}
+	if err := me.open(); err != nil {
+		dlog.Errorf("Failed to open audit log: %s", err)
+	}
+
+	//remove old files
+	files, _ := filepath.Glob(me.path + ".*")
+	sort.Strings(files)
+	for len(files) > me.maxFiles {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+
+	if len(rotated) > 0 && me.fs != nil {
+		go uploadAuditLog(me.fs, rotated, me.prefix+filepath.Base(rotated))
+	}
+}
+
+func uploadAuditLog(fs FileSystemImpl, local string, remote string) {
+	in, err := os.Open(local)
+	if err != nil {
+		dlog.Errorf("Failed to open audit log %s: %s", local, err)
+		return
+	}
+	defer in.Close()
+
+	fo, ok := fs.Create(remote, uint32(os.O_WRONLY|os.O_CREATE|os.O_TRUNC), NewAttr(GetLastPathComp(remote), S_IFREG))
+	if ok < 0 {
+		dlog.Errorf("Failed to create %s for audit log: %s", remote, ErrorString(ok))
+		return
+	}
+	defer fo.Release()
+
+	buf := make([]byte, 1024*1024)
+	var offset int64
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			if ok := fo.Write(buf[:n], offset); ok < 0 {
+				dlog.Errorf("Failed to upload audit log %s: %s", local, ErrorString(ok))
+				return
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			dlog.Errorf("Failed to read audit log %s: %s", local, err)
+			return
+		}
+	}
+	dlog.Infof("Uploaded audit log %s to %s", local, remote)
+}
+
+func (me *AuditLog) Close() error {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	if me.file == nil {
+		return nil
+	}
+	err := me.file.Close()
+	me.file = nil
+	return err
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+var curAudit *AuditLog
+var auditMtx sync.RWMutex
+
+//audit is off until StartAudit is called
+func StartAudit(log *AuditLog) {
+	auditMtx.Lock()
+	curAudit = log
+	auditMtx.Unlock()
+}
+
+func StopAudit() {
+	auditMtx.Lock()
+	log := curAudit
+	curAudit = nil
+	auditMtx.Unlock()
+	if log != nil {
+		log.Close()
+	}
+}
+
+//record an operation of the client in ctx, rc is the result, negative for a failure
+func Audit(ctx context.Context, op string, path string, bytes int64, rc int) {
+	auditRecord(ClientOf(ctx), util.RequestIdOf(ctx), op, path, "", bytes, rc)
+}
+
+func AuditRename(ctx context.Context, path string, target string, rc int) {
+	auditRecord(ClientOf(ctx), util.RequestIdOf(ctx), "rename", path, target, 0, rc)
+}
+
+func auditRecord(client string, reqId string, op string, path string, target string, bytes int64, rc int) {
+	if len(client) == 0 {
+		return
+	}
+	auditMtx.RLock()
+	log := curAudit
+	auditMtx.RUnlock()
+	if log == nil {
+		return
+	}
+
+	rec := &AuditRecord{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Client:    client,
+		RequestId: reqId,
+		Op:        op,
+		Path:      path,
+		Target:    target,
+		Bytes:     bytes,
+		Result:    "ok",
+	}
+	if rc < 0 {
+		rec.Result = ErrorString(rc)
+		rec.Errno = rc
+	}
+	log.Write(rec)
+}
@@ -5,7 +5,6 @@ import (
 )
 
 import (
-	"log"
 	"time"
 )
 
@@ -41,7 +40,9 @@ func (me *DirCache) Remove(key string) {
 	delete(me.dcache, key)
 }
 
-func (me *DirCache) Get(key string) (*DirItem, bool) {
+func (me *DirCache) Get(key string) (di *DirItem, ok bool) {
+	defer func() { metricDirCache.Inc(cacheResult(ok)) }()
+
 	it, ok := me.dcache[key]
 	if ok == false {
 		return nil, ok
@@ -95,6 +96,8 @@ type CacheBuffer struct {
 	distWriteList map[int64]int
 	EvtOnFull     CacheFullEvent
 
+	pending int64 //data length reported as pending upload
+
 	mtx sync.Mutex
 }
 
@@ -117,6 +120,20 @@ func (me *CacheBuffer) ResetOffset(offset int64) {
 	me.BaseOffset = offset
 	me.FullOffset = offset
 	me.MaxOffset = offset
+	me.trackPending()
+}
+
+//update pending upload bytes of write buffers
+func (me *CacheBuffer) trackPending() {
+	n := int64(me.GetDataLen())
+	metricPendingUpload.Add(float64(n - me.pending))
+	me.pending = n
+}
+
+//data of the buffer has been uploaded, e.g. by flush
+func (me *CacheBuffer) MarkUploaded() {
+	metricPendingUpload.Add(float64(-me.pending))
+	me.pending = 0
 }
 
 func (me *CacheBuffer) GetDataLen() int {
@@ -151,6 +168,7 @@ func (me *CacheBuffer) Read(data []byte, offset int64) int {
 
 func (me *CacheBuffer) Write(data []byte, offset int64) int {
 	var blkCount int = 0
+	defer me.trackPending()
 
 	remainN := len(data)
 	curData := data
@@ -161,7 +179,7 @@ func (me *CacheBuffer) Write(data []byte, offset int64) int {
 		start := int(curOffset - me.BaseOffset)
 		freeN := me.BufferLen - start
 		if freeN <= 0 {
-			log.Printf("There must be something wrong: BaseOffset = %d\n", curOffset)
+			dlog.Errorf("There must be something wrong: BaseOffset = %d", curOffset)
 			return EIO
 		}
 		copyN := 0
@@ -211,7 +229,7 @@ func (me *CacheBuffer) Write(data []byte, offset int64) int {
 			//ok := me.io.PutBuffer(name, me.Buffer[0:dLen])
 			ok := me.EvtOnFull(me.Buffer[0:dLen], me.BaseOffset)
 			if ok < 0 { //we cannot move forward if buffer cannot be uploaded
-				log.Println("Failed to execute EvtOnFull handler.")
+				dlog.Errorf("Failed to execute EvtOnFull handler.")
 				return ok
 			}
 
@@ -0,0 +1,404 @@
+package fscommon
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//end-to-end checksums of object data
+//objects are checksummed in blocks of CHECKSUM_BLOCK_SIZE, the digests of the blocks are saved in the meta data of the object,
+//the upload of a whole object is sent with Content-MD5 for the storage to verify it
+//a read is extended to whole blocks, they are verified by the policy of driver key ChecksumVerify:
+//off, warn (mismatches are logged) or fail (EIO, it's not retried)
+//verified blocks are kept for a while, so that small reads in a block don't read and verify it again, see BlockCache
+//a multipart upload adds the checksums of its parts in order, see ChecksumWriter, they are saved when it completes
+//an object with too many blocks for meta data is refused by fail, it's written without checksums by others with a warning
+const (
+	META_CHECKSUM = "checksum" //algorithm:block size:base64 of the digests of the blocks
+
+	CHECKSUM_CRC32C = "crc32c"
+	CHECKSUM_SHA256 = "sha256"
+
+	CHECKSUM_BLOCK_SIZE = FILE_BLOCK_SIZE
+	CHECKSUM_MAX_VALUE  = 1024 //of the digests in meta data
+	CHECKSUM_CACHE_TIME = 5    //seconds verified blocks are kept
+
+	VERIFY_OFF  = "off"
+	VERIFY_WARN = "warn"
+	VERIFY_FAIL = "fail"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Checksummer struct {
+	alg    string
+	verify string
+}
+
+//create from driver config, see csmgr/factory.go for the keys, it's nil if checksums are off
+func NewChecksummer(cfg map[string]string) (*Checksummer, int) {
+	alg := strings.ToLower(cfg["Checksum"])
+	if len(alg) == 0 || alg == "none" {
+		return nil, 0
+	}
+	if alg != CHECKSUM_CRC32C && alg != CHECKSUM_SHA256 {
+		dlog.Errorf("Unknown checksum algorithm: %s", alg)
+		return nil, EINVAL
+	}
+	me := &Checksummer{alg: alg, verify: VERIFY_FAIL}
+	if val := strings.ToLower(cfg["ChecksumVerify"]); len(val) > 0 {
+		if val != VERIFY_OFF && val != VERIFY_WARN && val != VERIFY_FAIL {
+			dlog.Errorf("Unknown checksum verification policy: %s", val)
+			return nil, EINVAL
+		}
+		me.verify = val
+	}
+	return me, 0
+}
+
+func newHash(alg string) hash.Hash {
+	switch alg {
+	case CHECKSUM_CRC32C:
+		return crc32.New(crc32cTable)
+	case CHECKSUM_SHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+func digest(alg string, data []byte) ([]byte, bool) {
+	h := newHash(alg)
+	if h == nil {
+		return nil, false
+	}
+	h.Write(data)
+	return h.Sum(nil), true
+}
+
+func (me *Checksummer) Algorithm() string {
+	return me.alg
+}
+
+//base64 of the digest of data, the format of x-amz-checksum-* headers
+func (me *Checksummer) Sum(data []byte) string {
+	sum, _ := digest(me.alg, data)
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+//value saved in meta data, see ChecksumWriter.Value
+func (me *Checksummer) Value(data []byte) (string, int) {
+	w := me.NewWriter()
+	w.Write(data)
+	return w.Value()
+}
+
+//an object is written without checksums, ok is the error of Value
+//it's refused if it's too big for them and the checks are strict, otherwise a warning is logged
+func (me *Checksummer) Unchecked(name string, ok int) int {
+	if ok == EFBIG && me.Strict() {
+		dlog.Errorf("Refused to write %s, checksums of its blocks don't fit in meta data", name)
+		return EFBIG
+	}
+	dlog.Warnf("%s is written without checksums: %s", name, ErrorString(ok))
+	return 0
+}
+
+//blocks of a read from offset of n bytes, the end may be after the end of the object
+func (me *Checksummer) BlockRange(offset int64, n int64) (int64, int64) {
+	start := offset / CHECKSUM_BLOCK_SIZE * CHECKSUM_BLOCK_SIZE
+	end := (offset + n + CHECKSUM_BLOCK_SIZE - 1) / CHECKSUM_BLOCK_SIZE * CHECKSUM_BLOCK_SIZE
+	return start, end
+}
+
+//verify data read from offset of an object of size bytes against the checksums in its meta data
+//offset is at a block boundary, a block at the end of data is verified if it's whole or the last one of the object
+//objects without checksums pass, and so do partial reads of old objects with a checksum of the whole object
+func (me *Checksummer) Verify(name string, value string, data []byte, offset int64, size int64) int {
+	if me == nil || me.verify == VERIFY_OFF || len(value) == 0 {
+		return 0
+	}
+	sums := parseBlockSums(value)
+	if sums == nil {
+		dlog.Warnf("Invalid checksum of %s: %s", name, value)
+		return 0
+	}
+	blockSize := sums.blockSize
+	if blockSize == 0 {
+		blockSize = size
+	}
+	if blockSize <= 0 || offset%blockSize != 0 {
+		return 0
+	}
+	for off := int64(0); off < int64(len(data)); off += blockSize {
+		end := off + blockSize
+		if end > int64(len(data)) {
+			if offset+int64(len(data)) != size {
+				break
+			}
+			end = int64(len(data))
+		}
+		i := int((offset + off) / blockSize)
+		sum, _ := digest(sums.alg, data[off:end])
+		if (i+1)*len(sum) > len(sums.sums) || !bytes.Equal(sum, sums.sums[i*len(sum):(i+1)*len(sum)]) {
+			if me.verify == VERIFY_WARN {
+				dlog.Warnf("Checksum mismatch of %s, block at %d", name, offset+off)
+				continue
+			}
+			dlog.Errorf("Checksum mismatch of %s, block at %d", name, offset+off)
+			return EIO
+		}
+	}
+	return 0
+}
+
+//read whole blocks of an object by get, verify them and copy the range of dest from them
+//get returns the checksums in meta data and the size of the object with the data
+//blocks read for a smaller range are kept in cache, it may be nil
+func (me *Checksummer) ReadBlocks(cache *BlockCache, name string, dest []byte, offset int64,
+	get func(buf []byte, start int64) (n int, value string, size int64)) int {
+	if n, ok := cache.Get(name, dest, offset); ok {
+		return n
+	}
+	start, end := me.BlockRange(offset, int64(len(dest)))
+	whole := start == offset && end == offset+int64(len(dest))
+	buf := dest
+	if !whole {
+		buf = make([]byte, end-start)
+	}
+	n, value, size := get(buf, start)
+	if n <= 0 {
+		return n
+	}
+	if ok := me.Verify(name, value, buf[:n], start, size); ok < 0 {
+		return ok
+	}
+	if whole {
+		return n
+	}
+	cache.Put(name, buf[:n], start, size)
+	if int64(n) <= offset-start {
+		return 0
+	}
+	return copy(dest, buf[offset-start:n])
+}
+
+//verified blocks of the last read of a file, see Checksummer.ReadBlocks
+//they are dropped after CHECKSUM_CACHE_TIME, or when the object is written by the same FileIO
+type BlockCache struct {
+	name  string
+	start int64
+	data  []byte
+	size  int64 //of the object, -1 if it's unknown
+	time  time.Time
+	mtx   sync.Mutex
+}
+
+//copy the range from the cached blocks, it's false if they don't cover it
+func (me *BlockCache) Get(name string, dest []byte, offset int64) (int, bool) {
+	if me == nil {
+		return 0, false
+	}
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	if me.data == nil || me.name != strings.TrimPrefix(name, "/") || time.Since(me.time) > CHECKSUM_CACHE_TIME*time.Second {
+		return 0, false
+	}
+	end := me.start + int64(len(me.data))
+	if offset < me.start || offset > end {
+		return 0, false
+	}
+	//a read after the end of the object is covered by the last block
+	if offset+int64(len(dest)) > end && end != me.size {
+		return 0, false
+	}
+	return copy(dest, me.data[offset-me.start:]), true
+}
+
+func (me *BlockCache) Put(name string, data []byte, start int64, size int64) {
+	if me == nil {
+		return
+	}
+	me.mtx.Lock()
+	me.name, me.data, me.start, me.size, me.time = strings.TrimPrefix(name, "/"), data, start, size, time.Now()
+	me.mtx.Unlock()
+}
+
+//drop blocks of an object which is written
+func (me *BlockCache) Forget(name string) {
+	if me == nil {
+		return
+	}
+	me.mtx.Lock()
+	if me.name == strings.TrimPrefix(name, "/") {
+		me.name, me.data = "", nil
+	}
+	me.mtx.Unlock()
+}
+
+//checksums of the blocks of an object from meta data
+type blockSums struct {
+	alg       string
+	blockSize int64 //0 for a checksum of the whole object
+	sums      []byte
+}
+
+func parseBlockSums(value string) *blockSums {
+	fields := strings.Split(value, ":")
+	me := &blockSums{alg: fields[0]}
+	if len(fields) == 3 {
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || n <= 0 {
+			return nil
+		}
+		me.blockSize = n
+	} else if len(fields) != 2 {
+		return nil
+	}
+	sums, err := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+	sum, ok := digest(me.alg, nil)
+	if err != nil || !ok || len(sums)%len(sum) != 0 {
+		return nil
+	}
+	me.sums = sums
+	return me
+}
+
+//checksums of the blocks of an object which is written in order, e.g. by a multipart upload
+type ChecksumWriter struct {
+	alg    string
+	h      hash.Hash
+	n      int64 //bytes of the block being written
+	size   int64
+	sums   []byte
+	failed bool
+}
+
+func (me *Checksummer) NewWriter() *ChecksumWriter {
+	return &ChecksumWriter{alg: me.alg, h: newHash(me.alg)}
+}
+
+func (me *ChecksumWriter) Write(data []byte) {
+	for len(data) > 0 {
+		n := CHECKSUM_BLOCK_SIZE - me.n
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+		me.h.Write(data[:n])
+		me.n += n
+		me.size += n
+		data = data[n:]
+		if me.n == CHECKSUM_BLOCK_SIZE {
+			me.sums = me.h.Sum(me.sums)
+			me.h.Reset()
+			me.n = 0
+		}
+	}
+}
+
+//bytes written
+func (me *ChecksumWriter) Size() int64 {
+	return me.size
+}
+
+//add n blocks of an object from offset with their checksums in value, e.g. for a copy of them
+//it's false if the writer is not at a block boundary or the object has no checksums of the blocks
+func (me *ChecksumWriter) AddBlocks(value string, offset int64, n int) bool {
+	src := parseBlockSums(value)
+	if me.n != 0 || src == nil || src.alg != me.alg || src.blockSize != CHECKSUM_BLOCK_SIZE || offset%CHECKSUM_BLOCK_SIZE != 0 {
+		return false
+	}
+	size := me.h.Size()
+	first := int(offset / CHECKSUM_BLOCK_SIZE)
+	if (first+n)*size > len(src.sums) {
+		return false
+	}
+	me.sums = append(me.sums, src.sums[first*size:(first+n)*size]...)
+	me.size += int64(n) * CHECKSUM_BLOCK_SIZE
+	return true
+}
+
+//checksums of the object are not known, e.g. a part is copied from an object without them
+func (me *ChecksumWriter) Fail() {
+	me.failed = true
+}
+
+//value saved in meta data
+//it's EIO if checksums of the object are not known, and EFBIG if the object has too many blocks
+func (me *ChecksumWriter) Value() (string, int) {
+	if me.failed {
+		return "", EIO
+	}
+	sums := me.sums
+	if me.n > 0 {
+		sums = me.h.Sum(append([]byte(nil), sums...))
+	}
+	val := base64.StdEncoding.EncodeToString(sums)
+	if len(val) > CHECKSUM_MAX_VALUE {
+		return "", EFBIG
+	}
+	return fmt.Sprintf("%s:%d:%s", me.alg, CHECKSUM_BLOCK_SIZE, val), 0
+}
+
+//the checks are enabled and objects are verified on read
+func (me *Checksummer) Verifying() bool {
+	return me != nil && me.verify != VERIFY_OFF
+}
+
+//the check fails a request, or it's only logged
+func (me *Checksummer) Strict() bool {
+	return me != nil && me.verify == VERIFY_FAIL
+}
+
+//value of Content-MD5 header
+func ContentMD5(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+//ETag of an object uploaded by one request, hex of MD5 without quotes
+//it's not MD5 with SSE-KMS or SSE-C
+func DataETag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//ETag of a multipart upload from ETags of its parts, MD5 of the binary MD5s followed by the number of parts
+//it's empty if an ETag of a part is not MD5
+func MultipartETag(etags []string) string {
+	h := md5.New()
+	for _, etag := range etags {
+		sum, err := hex.DecodeString(TrimETag(etag))
+		if err != nil || len(sum) != md5.Size {
+			return ""
+		}
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(etags))
+}
+
+func TrimETag(etag string) string {
+	return strings.ToLower(strings.Trim(etag, "\""))
+}
+
+//size of the whole object in a Content-Range header, e.g. "bytes 0-99/1000", -1 if it's unknown
+func RangeTotal(contentRange string) int64 {
+	idx := strings.LastIndex(contentRange, "/")
+	if idx < 0 {
+		return -1
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(contentRange[idx+1:]), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
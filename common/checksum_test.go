@@ -0,0 +1,123 @@
+package fscommon
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChecksumBlocks(t *testing.T) {
+	sum, _ := NewChecksummer(map[string]string{"Checksum": CHECKSUM_CRC32C})
+	data := randomData(2*CHECKSUM_BLOCK_SIZE+100, 9)
+	value, _ := sum.Value(data)
+	size := int64(len(data))
+
+	//reads of whole blocks and of the last one
+	for _, r := range [][2]int64{{0, size}, {CHECKSUM_BLOCK_SIZE, CHECKSUM_BLOCK_SIZE}, {2 * CHECKSUM_BLOCK_SIZE, 100}} {
+		if ok := sum.Verify("a", value, data[r[0]:r[0]+r[1]], r[0], size); ok < 0 {
+			t.Fatalf("Verify %d bytes at %d: %d", r[1], r[0], ok)
+		}
+	}
+	bad := append([]byte(nil), data[CHECKSUM_BLOCK_SIZE:2*CHECKSUM_BLOCK_SIZE]...)
+	bad[10] ^= 1
+	if ok := sum.Verify("a", value, bad, CHECKSUM_BLOCK_SIZE, size); ok != EIO {
+		t.Fatalf("Verify of a changed block: %d, expected EIO", ok)
+	}
+	if start, end := sum.BlockRange(CHECKSUM_BLOCK_SIZE+10, 20); start != CHECKSUM_BLOCK_SIZE || end != 2*CHECKSUM_BLOCK_SIZE {
+		t.Fatalf("BlockRange: %d-%d", start, end)
+	}
+
+	//blocks copied from another object keep their checksums
+	w := sum.NewWriter()
+	if !w.AddBlocks(value, 0, 2) {
+		t.Fatal("AddBlocks failed")
+	}
+	w.Write(data[2*CHECKSUM_BLOCK_SIZE:])
+	if val, _ := w.Value(); val != value {
+		t.Fatalf("checksums with copied blocks: %s, expected %s", val, value)
+	}
+	w = sum.NewWriter()
+	w.Write(data[:10])
+	if w.AddBlocks(value, CHECKSUM_BLOCK_SIZE, 1) {
+		t.Fatal("blocks are added out of line")
+	}
+
+	//checksums of a whole object from older versions
+	old := CHECKSUM_CRC32C + ":" + sum.Sum(data)
+	if ok := sum.Verify("a", old, data, 0, size); ok < 0 {
+		t.Fatalf("Verify of a whole object: %d", ok)
+	}
+	if ok := sum.Verify("a", old, data[:100], 0, size); ok < 0 {
+		t.Fatalf("Verify of a part of an object: %d", ok)
+	}
+}
+
+func TestChecksumTooManyBlocks(t *testing.T) {
+	strict, _ := NewChecksummer(map[string]string{"Checksum": CHECKSUM_SHA256})
+	warn, _ := NewChecksummer(map[string]string{"Checksum": CHECKSUM_SHA256, "ChecksumVerify": VERIFY_WARN})
+	w := strict.NewWriter()
+	block := make([]byte, CHECKSUM_BLOCK_SIZE)
+	for i := 0; i < CHECKSUM_MAX_VALUE/32; i++ {
+		w.Write(block)
+	}
+	if _, ok := w.Value(); ok != EFBIG {
+		t.Fatalf("Value of %d bytes: %d, expected EFBIG", w.Size(), ok)
+	}
+	if ok := strict.Unchecked("a", EFBIG); ok != EFBIG {
+		t.Errorf("a strict write without checksums: %d, expected EFBIG", ok)
+	}
+	if ok := warn.Unchecked("a", EFBIG); ok != 0 {
+		t.Errorf("a write without checksums: %d", ok)
+	}
+}
+
+func TestChecksumBlockCache(t *testing.T) {
+	sum, _ := NewChecksummer(map[string]string{"Checksum": CHECKSUM_CRC32C})
+	data := randomData(CHECKSUM_BLOCK_SIZE+100, 10)
+	value, _ := sum.Value(data)
+	size := int64(len(data))
+	reads := 0
+	get := func(buf []byte, start int64) (int, string, int64) {
+		reads++
+		return copy(buf, data[start:]), value, size
+	}
+
+	//small reads in a block read and verify it once
+	var cache BlockCache
+	dest := make([]byte, 4096)
+	for off := int64(0); off < 4*4096; off += 4096 {
+		if n := sum.ReadBlocks(&cache, "a", dest, off, get); n != len(dest) || !bytes.Equal(dest, data[off:off+4096]) {
+			t.Fatalf("read at %d: n = %d, data mismatch", off, n)
+		}
+	}
+	//the last block is partial
+	if n := sum.ReadBlocks(&cache, "a", dest, size-50, get); n != 50 || !bytes.Equal(dest[:n], data[size-50:]) {
+		t.Fatalf("read at the end: n = %d, data mismatch", n)
+	}
+	if n := sum.ReadBlocks(&cache, "a", dest, size-10, get); n != 10 {
+		t.Fatalf("read at the end from cache: n = %d", n)
+	}
+	if reads != 2 {
+		t.Fatalf("%d reads, expected 2", reads)
+	}
+
+	//blocks of a written object are dropped
+	cache.Forget("/a")
+	sum.ReadBlocks(&cache, "a", dest, 0, get)
+	if reads != 3 {
+		t.Fatalf("%d reads after the object is written, expected 3", reads)
+	}
+
+	//a changed block is not kept
+	bad := append([]byte(nil), data...)
+	bad[10] ^= 1
+	cache.Forget("a")
+	getBad := func(buf []byte, start int64) (int, string, int64) {
+		return copy(buf, bad[start:]), value, size
+	}
+	if n := sum.ReadBlocks(&cache, "a", dest, 0, getBad); n != EIO {
+		t.Fatalf("read of a changed block: %d, expected EIO", n)
+	}
+	if _, ok := cache.Get("a", dest, 0); ok {
+		t.Fatal("a changed block is kept")
+	}
+}
@@ -0,0 +1,706 @@
+package fscommon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//transparent compression of files matching patterns
+//data is compressed in segments of COMPRESS_SEGMENT_SIZE, so that a file is appended with new segments
+//and the segments it has are kept, see CompressWriter
+//a segment is compressed in frames of COMPRESS_FRAME_SIZE, each frame on its own,
+//so that a ranged read decompresses only the frames it covers
+//object layout: segment 0 | segment 1 | ..., the last segment has the table of the segments before it
+//segment layout: frame 0 | frame 1 | ... | index | table | footer
+//index has the compressed size of each frame, 4 bytes each
+//table has the end of each segment before, in the object and in uncompressed data, 8 bytes each, it's empty but in the last segment
+//footer has the magic, codec, frame size, number of frames and table entries, uncompressed sizes of the segment and the object
+//an empty object has no footer, an object without the magic is read as it is
+const (
+	COMPRESS_MAGIC        = "CSZ2"
+	COMPRESS_FRAME_SIZE   = 256 * 1024
+	COMPRESS_SEGMENT_SIZE = FILE_BLOCK_SIZE
+	COMPRESS_FOOTER_SIZE  = 40
+
+	COMPRESS_GZIP = "gzip"
+	COMPRESS_ZSTD = "zstd"
+)
+
+type compressCodec struct {
+	id         byte
+	levels     [3]int //min, max and default
+	compress   func(data []byte, level int) ([]byte, error)
+	decompress func(frame []byte) ([]byte, error)
+}
+
+//codecs by name
+var compressCodecs = map[string]*compressCodec{
+	COMPRESS_GZIP: &compressCodec{id: 1, levels: [3]int{gzip.HuffmanOnly, gzip.BestCompression, gzip.DefaultCompression},
+		compress: gzipFrame, decompress: gunzipFrame},
+	COMPRESS_ZSTD: &compressCodec{id: 2, levels: [3]int{1, 22, 3}, compress: zstdFrame, decompress: unzstdFrame},
+}
+
+func gzipFrame(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipFrame(frame []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+//zstd encoders by level and the decoder are shared, they are safe for concurrent use
+var zstdCodec struct {
+	encoders map[int]*zstd.Encoder
+	decoder  *zstd.Decoder
+	mtx      sync.Mutex
+}
+
+func zstdFrame(data []byte, level int) ([]byte, error) {
+	zstdCodec.mtx.Lock()
+	enc := zstdCodec.encoders[level]
+	if enc == nil {
+		var err error
+		enc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			zstdCodec.mtx.Unlock()
+			return nil, err
+		}
+		if zstdCodec.encoders == nil {
+			zstdCodec.encoders = make(map[int]*zstd.Encoder)
+		}
+		zstdCodec.encoders[level] = enc
+	}
+	zstdCodec.mtx.Unlock()
+	return enc.EncodeAll(data, nil), nil
+}
+
+func unzstdFrame(frame []byte) ([]byte, error) {
+	zstdCodec.mtx.Lock()
+	dec := zstdCodec.decoder
+	if dec == nil {
+		var err error
+		dec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			zstdCodec.mtx.Unlock()
+			return nil, err
+		}
+		zstdCodec.decoder = dec
+	}
+	zstdCodec.mtx.Unlock()
+	return dec.DecodeAll(frame, nil)
+}
+
+func codecById(id byte) *compressCodec {
+	for _, codec := range compressCodecs {
+		if codec.id == id {
+			return codec
+		}
+	}
+	return nil
+}
+
+//compression settings of a mount, from driver config, see csmgr/factory.go for the keys
+type Compressor struct {
+	codec    *compressCodec
+	level    int
+	patterns []string
+	names    *NameCipher //keys are decrypted before they are matched, nil if names are not encrypted
+}
+
+//it's nil if compression is off
+func NewCompressor(cfg map[string]string) (*Compressor, int) {
+	name := strings.ToLower(cfg["Compression"])
+	if len(name) == 0 || name == "none" {
+		return nil, 0
+	}
+	codec, ok := compressCodecs[name]
+	if !ok {
+		dlog.Errorf("Compression %s is not supported", name)
+		return nil, EINVAL
+	}
+	me := &Compressor{codec: codec, level: codec.levels[2]}
+	if val := cfg["CompressionLevel"]; len(val) > 0 {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < codec.levels[0] || n > codec.levels[1] {
+			dlog.Errorf("Invalid compression level of %s: %s", name, val)
+			return nil, EINVAL
+		}
+		me.level = n
+	}
+	for _, pattern := range strings.Split(cfg["CompressionPatterns"], ",") {
+		if pattern = strings.Trim(strings.TrimSpace(pattern), "/"); len(pattern) > 0 {
+			me.patterns = append(me.patterns, pattern)
+		}
+	}
+	if len(me.patterns) == 0 {
+		me.patterns = []string{"*"}
+	}
+	return me, 0
+}
+
+//patterns are matched with plain paths of encrypted keys, see NameCryptFS
+func (me *Compressor) SetNames(names *NameCipher) {
+	if me != nil {
+		me.names = names
+	}
+}
+
+//check if an object is compressed, helper objects follow their files
+func (me *Compressor) Match(key string) bool {
+	if me.names != nil {
+		key = me.names.PlainPath(key)
+	}
+	key, _ = helperFile(key)
+	for _, pattern := range me.patterns {
+		if MatchPath(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+//compress data written to an object in segments
+//Write returns segments which are complete, Close returns the last one with the table of segments
+type CompressWriter struct {
+	comp  *Compressor
+	table []int64 //ends of segments written, in the object and in uncompressed data
+	end   int64   //of the object
+	size  int64   //uncompressed size of the object
+	buf   []byte  //uncompressed data of the segment being built
+}
+
+func (me *Compressor) NewWriter() *CompressWriter {
+	return &CompressWriter{comp: me}
+}
+
+//a segment is complete when more data is written after it's full, so that the last one is left to Close
+func (me *CompressWriter) Write(data []byte) ([]byte, error) {
+	var out []byte
+	for len(data) > 0 {
+		if len(me.buf) == COMPRESS_SEGMENT_SIZE {
+			seg, err := me.segment(false)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, seg...)
+		}
+		if me.buf == nil {
+			me.buf = make([]byte, 0, COMPRESS_SEGMENT_SIZE)
+		}
+		n := copy(me.buf[len(me.buf):cap(me.buf)], data)
+		me.buf = me.buf[:len(me.buf)+n]
+		data = data[n:]
+	}
+	return out, nil
+}
+
+//nothing is returned if nothing is written
+func (me *CompressWriter) Close() ([]byte, error) {
+	if len(me.buf) == 0 {
+		return nil, nil
+	}
+	return me.segment(true)
+}
+
+func (me *CompressWriter) segment(last bool) ([]byte, error) {
+	var buf bytes.Buffer
+	var index []byte
+	var n [8]byte
+	frames := 0
+	for off := 0; off < len(me.buf); off += COMPRESS_FRAME_SIZE {
+		end := off + COMPRESS_FRAME_SIZE
+		if end > len(me.buf) {
+			end = len(me.buf)
+		}
+		frame, err := me.comp.codec.compress(me.buf[off:end], me.comp.level)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(frame)
+		binary.BigEndian.PutUint32(n[:4], uint32(len(frame)))
+		index = append(index, n[:4]...)
+		frames++
+	}
+	buf.Write(index)
+	entries := 0
+	if last {
+		for _, val := range me.table {
+			binary.BigEndian.PutUint64(n[:], uint64(val))
+			buf.Write(n[:])
+		}
+		entries = len(me.table) / 2
+	}
+
+	footer := make([]byte, COMPRESS_FOOTER_SIZE)
+	copy(footer, COMPRESS_MAGIC)
+	footer[4] = me.comp.codec.id
+	binary.BigEndian.PutUint32(footer[8:], COMPRESS_FRAME_SIZE)
+	binary.BigEndian.PutUint32(footer[12:], uint32(frames))
+	binary.BigEndian.PutUint32(footer[16:], uint32(entries))
+	binary.BigEndian.PutUint64(footer[24:], uint64(len(me.buf)))
+	binary.BigEndian.PutUint64(footer[32:], uint64(me.size+int64(len(me.buf))))
+	buf.Write(footer)
+
+	me.end += int64(buf.Len())
+	me.size += int64(len(me.buf))
+	me.table = append(me.table, me.end, me.size)
+	me.buf = me.buf[:0]
+	return buf.Bytes(), nil
+}
+
+//a segment of a compressed object, codec and frames are loaded with the footer
+type compressSegment struct {
+	start     int64 //in the object
+	end       int64 //in the object, after the footer
+	dataStart int64 //in uncompressed data
+	dataEnd   int64 //in uncompressed data
+
+	codec     *compressCodec
+	frameSize int64
+	offsets   []int64 //of frames in the object, with the offset of the index at the end
+}
+
+//segments of a compressed object, the frames of a segment are loaded when it's read first
+type compressIndex struct {
+	size     int64 //uncompressed size
+	segments []*compressSegment
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//FileIO wrapper which compresses objects on PutBuffer and decompresses them on GetBuffer
+//it goes outside CryptIO, data is compressed before it's encrypted
+//sizes reported by GetAttr and ListFile are uncompressed sizes
+type CompressIO struct {
+	io   FileIO
+	comp *Compressor
+
+	indexes map[string]*compressIndex //nil for objects which are not compressed
+	mtx     sync.Mutex
+}
+
+func NewCompressIO(io FileIO, comp *Compressor) *CompressIO {
+	return &CompressIO{io: io, comp: comp, indexes: make(map[string]*compressIndex)}
+}
+
+//the wrapped FileIO, for driver specific operations
+func (me *CompressIO) Base() FileIO {
+	return me.io
+}
+
+func (me *CompressIO) Match(name string) bool {
+	return me.comp.Match(name)
+}
+
+//drop the cached index of an object
+func (me *CompressIO) Forget(name string) {
+	me.mtx.Lock()
+	delete(me.indexes, name)
+	me.mtx.Unlock()
+}
+
+//index of an object of size bytes, nil for an object which is not compressed
+func (me *CompressIO) loadIndex(ctx context.Context, name string, size int64) (*compressIndex, int) {
+	me.mtx.Lock()
+	idx, ok := me.indexes[name]
+	me.mtx.Unlock()
+	if ok {
+		return idx, 0
+	}
+
+	idx, rc := me.readIndex(ctx, name, size)
+	if rc < 0 {
+		return nil, rc
+	}
+	me.mtx.Lock()
+	me.indexes[name] = idx
+	me.mtx.Unlock()
+	return idx, 0
+}
+
+//the last segment has the table of the others
+func (me *CompressIO) readIndex(ctx context.Context, name string, size int64) (*compressIndex, int) {
+	if size < COMPRESS_FOOTER_SIZE {
+		return nil, 0
+	}
+	last, total, table, rc := me.readSegment(ctx, name, size)
+	if rc < 0 || last == nil {
+		return nil, rc
+	}
+	idx := &compressIndex{size: total}
+	var start, dataStart int64
+	for i := 0; i < len(table); i += 2 {
+		if table[i] <= start || table[i+1] <= dataStart {
+			dlog.Errorf("Can't decompress %s: invalid segment table", name)
+			return nil, EIO
+		}
+		idx.segments = append(idx.segments, &compressSegment{start: start, end: table[i], dataStart: dataStart, dataEnd: table[i+1]})
+		start, dataStart = table[i], table[i+1]
+	}
+	if last.start != start || last.dataStart != dataStart {
+		dlog.Errorf("Can't decompress %s: invalid segment table", name)
+		return nil, EIO
+	}
+	idx.segments = append(idx.segments, last)
+	return idx, 0
+}
+
+//read the footer, frame index and table of the segment which ends at end
+//the uncompressed size of the object up to the end of the segment is returned with it, nil if there is no footer
+func (me *CompressIO) readSegment(ctx context.Context, name string, end int64) (*compressSegment, int64, []int64, int) {
+	io := IOWithContext(me.io)
+	footer := make([]byte, COMPRESS_FOOTER_SIZE)
+	n := readFull(ctx, io, name, footer, end-COMPRESS_FOOTER_SIZE)
+	if n < 0 {
+		return nil, 0, nil, n
+	}
+	if n < COMPRESS_FOOTER_SIZE || string(footer[:4]) != COMPRESS_MAGIC {
+		return nil, 0, nil, 0
+	}
+	seg := &compressSegment{
+		end:       end,
+		codec:     codecById(footer[4]),
+		frameSize: int64(binary.BigEndian.Uint32(footer[8:])),
+	}
+	frames := int64(binary.BigEndian.Uint32(footer[12:]))
+	entries := int64(binary.BigEndian.Uint32(footer[16:]))
+	size := int64(binary.BigEndian.Uint64(footer[24:]))
+	total := int64(binary.BigEndian.Uint64(footer[32:]))
+	indexOff := end - COMPRESS_FOOTER_SIZE - frames*4 - entries*16
+	if seg.codec == nil || seg.frameSize <= 0 || indexOff < 0 || size > total || (size+seg.frameSize-1)/seg.frameSize != frames {
+		dlog.Errorf("Can't decompress %s: unsupported codec or invalid footer", name)
+		return nil, 0, nil, EIO
+	}
+
+	buf := make([]byte, frames*4+entries*16)
+	if n = readFull(ctx, io, name, buf, indexOff); n != len(buf) {
+		if n >= 0 {
+			n = EIO
+		}
+		return nil, 0, nil, n
+	}
+	seg.offsets = make([]int64, frames+1)
+	for i := int64(0); i < frames; i++ {
+		seg.offsets[i+1] = seg.offsets[i] + int64(binary.BigEndian.Uint32(buf[i*4:]))
+	}
+	seg.start = indexOff - seg.offsets[frames]
+	if seg.start < 0 {
+		dlog.Errorf("Can't decompress %s: invalid frame index", name)
+		return nil, 0, nil, EIO
+	}
+	for i := range seg.offsets {
+		seg.offsets[i] += seg.start
+	}
+	seg.dataStart, seg.dataEnd = total-size, total
+	table := make([]int64, entries*2)
+	for i := range table {
+		table[i] = int64(binary.BigEndian.Uint64(buf[frames*4+int64(i)*8:]))
+	}
+	return seg, total, table, 0
+}
+
+//load the footer and frames of a segment from the table, when it's read first
+func (me *CompressIO) loadSegment(ctx context.Context, name string, seg *compressSegment) (*compressSegment, int) {
+	me.mtx.Lock()
+	loaded := seg.offsets != nil
+	me.mtx.Unlock()
+	if loaded {
+		return seg, 0
+	}
+	s, _, _, rc := me.readSegment(ctx, name, seg.end)
+	if rc < 0 {
+		return nil, rc
+	}
+	if s == nil || s.start != seg.start || s.dataStart != seg.dataStart || s.dataEnd != seg.dataEnd {
+		dlog.Errorf("Can't decompress %s: invalid segment at %d", name, seg.start)
+		return nil, EIO
+	}
+	me.mtx.Lock()
+	seg.codec, seg.frameSize, seg.offsets = s.codec, s.frameSize, s.offsets
+	me.mtx.Unlock()
+	return s, 0
+}
+
+//writer of data appended to an object, segments of the object are kept
+//keep is the size of the object before the new segments, it's 0 if the object is not compressed,
+//its data must be written again then
+func (me *CompressIO) AppendWriter(ctx context.Context, name string) (w *CompressWriter, keep int64, rc int) {
+	w = me.comp.NewWriter()
+	fi, rc := IOWithContext(me.io).GetAttrCtx(ctx, name)
+	if rc == ENOENT {
+		return w, 0, 0
+	}
+	if rc < 0 {
+		return nil, 0, rc
+	}
+	me.Forget(name)
+	idx, rc := me.loadIndex(ctx, name, fi.Size())
+	if rc < 0 {
+		return nil, 0, rc
+	}
+	if idx == nil {
+		return w, 0, 0
+	}
+	for _, seg := range idx.segments {
+		w.table = append(w.table, seg.end, seg.dataEnd)
+	}
+	w.end, w.size = fi.Size(), idx.size
+	return w, fi.Size(), 0
+}
+
+func (me *CompressIO) PutBuffer(name string, data []byte) int {
+	return me.PutBufferCtx(context.Background(), name, data)
+}
+
+//the uncompressed size is saved in meta data, so that listings don't have to read the footer
+func (me *CompressIO) PutBufferCtx(ctx context.Context, name string, data []byte) int {
+	io := IOWithContext(me.io)
+	me.Forget(name)
+	if !me.comp.Match(name) {
+		return io.PutBufferCtx(ctx, name, data)
+	}
+
+	w := me.comp.NewWriter()
+	buf, err := w.Write(data)
+	if err == nil {
+		var last []byte
+		last, err = w.Close()
+		buf = append(buf, last...)
+	}
+	if err != nil {
+		dlog.Errorf("Failed to compress %s: %s", name, err)
+		return EIO
+	}
+	ctx = WithObjectMeta(ctx, name, ObjectMeta{META_SIZE: strconv.Itoa(len(data))})
+	rc := io.PutBufferCtx(ctx, name, buf)
+	if rc > 0 {
+		return len(data)
+	}
+	return rc
+}
+
+func (me *CompressIO) GetBuffer(name string, dest []byte, offset int64) int {
+	return me.GetBufferCtx(context.Background(), name, dest, offset)
+}
+
+//only the frames covering the range are read and decompressed
+//a cached index may be outdated if the object is written by another client, it's loaded again once
+func (me *CompressIO) GetBufferCtx(ctx context.Context, name string, dest []byte, offset int64) int {
+	if !me.comp.Match(name) {
+		return IOWithContext(me.io).GetBufferCtx(ctx, name, dest, offset)
+	}
+	n := me.getBuffer(ctx, name, dest, offset)
+	if n == EIO {
+		me.Forget(name)
+		n = me.getBuffer(ctx, name, dest, offset)
+	}
+	return n
+}
+
+func (me *CompressIO) getBuffer(ctx context.Context, name string, dest []byte, offset int64) int {
+	if len(dest) == 0 {
+		return 0
+	}
+	io := IOWithContext(me.io)
+	me.mtx.Lock()
+	idx, ok := me.indexes[name]
+	me.mtx.Unlock()
+	if !ok {
+		fi, rc := io.GetAttrCtx(ctx, name)
+		if rc < 0 {
+			return rc
+		}
+		if idx, rc = me.loadIndex(ctx, name, fi.Size()); rc < 0 {
+			return rc
+		}
+	}
+	if idx == nil {
+		return io.GetBufferCtx(ctx, name, dest, offset)
+	}
+	if offset >= idx.size {
+		return 0
+	}
+	if int64(len(dest)) > idx.size-offset {
+		dest = dest[:idx.size-offset]
+	}
+
+	copied := 0
+	i := sort.Search(len(idx.segments), func(i int) bool { return idx.segments[i].dataEnd > offset })
+	for ; i < len(idx.segments) && copied < len(dest); i++ {
+		seg, rc := me.loadSegment(ctx, name, idx.segments[i])
+		if rc < 0 {
+			return rc
+		}
+		n := me.readFrames(ctx, name, seg, dest[copied:], offset+int64(copied))
+		if n < 0 {
+			return n
+		}
+		copied += n
+	}
+	return copied
+}
+
+//read from the frames of a segment, until dest is full or the end of the segment
+func (me *CompressIO) readFrames(ctx context.Context, name string, seg *compressSegment, dest []byte, offset int64) int {
+	if int64(len(dest)) > seg.dataEnd-offset {
+		dest = dest[:seg.dataEnd-offset]
+	}
+	first := (offset - seg.dataStart) / seg.frameSize
+	last := (offset - seg.dataStart + int64(len(dest)) - 1) / seg.frameSize
+	buf := make([]byte, seg.offsets[last+1]-seg.offsets[first])
+	if n := readFull(ctx, IOWithContext(me.io), name, buf, seg.offsets[first]); n != len(buf) {
+		if n >= 0 {
+			n = EIO
+		}
+		return n
+	}
+
+	copied := 0
+	skip := offset - seg.dataStart - first*seg.frameSize
+	for i := first; i <= last; i++ {
+		frame := buf[seg.offsets[i]-seg.offsets[first] : seg.offsets[i+1]-seg.offsets[first]]
+		data, err := seg.codec.decompress(frame)
+		if err != nil || skip >= int64(len(data)) {
+			dlog.Errorf("Failed to decompress frame %d of segment at %d of %s: %v", i, seg.start, name, err)
+			return EIO
+		}
+		copied += copy(dest[copied:], data[skip:])
+		skip = 0
+	}
+	if copied < len(dest) {
+		dlog.Errorf("Failed to decompress segment at %d of %s: frames are short", seg.start, name)
+		return EIO
+	}
+	return copied
+}
+
+//report the uncompressed size of a regular file, di has the size of the object under CompressIO
+//the size saved in meta data is used, the footer is read only for objects written without it
+func (me *CompressIO) plainAttr(ctx context.Context, name string, di *DirItem) int {
+	if di == nil || di.DiType != S_IFREG || !me.comp.Match(name) {
+		return 0
+	}
+	if size, ok := di.DataSize(); ok {
+		di.DiSize = size
+		return 0
+	}
+	idx, ok := me.loadIndex(ctx, name, di.DiSize)
+	if ok < 0 {
+		return ok
+	}
+	if idx != nil {
+		di.DiSize = idx.size
+	}
+	return 0
+}
+
+func (me *CompressIO) plainInfo(ctx context.Context, name string, fi os.FileInfo) (os.FileInfo, int) {
+	di, ok := fi.(*DirItem)
+	if !ok || di == nil {
+		return fi, 0
+	}
+	plain := *di
+	if rc := me.plainAttr(ctx, name, &plain); rc < 0 {
+		return nil, rc
+	}
+	return &plain, 0
+}
+
+func (me *CompressIO) GetAttr(path string) (os.FileInfo, int) {
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+//the index is loaded again, the object may have been changed
+func (me *CompressIO) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	fi, ok := IOWithContext(me.io).GetAttrCtx(ctx, path)
+	if ok < 0 {
+		return fi, ok
+	}
+	me.Forget(path)
+	return me.plainInfo(ctx, path, fi)
+}
+
+func (me *CompressIO) ListFile(path string) ([]os.FileInfo, int) {
+	return me.ListFileCtx(context.Background(), path)
+}
+
+func (me *CompressIO) ListFileCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
+	fis, ok := IOWithContext(me.io).ListFileCtx(ctx, path)
+	prefix := strings.Trim(path, "/")
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	for i, fi := range fis {
+		if fi == nil {
+			continue
+		}
+		//drivers return either keys or base names
+		name := prefix + GetLastPathComp(fi.Name())
+		me.Forget(name)
+		plain, rc := me.plainInfo(ctx, name, fi)
+		if rc < 0 {
+			return nil, rc
+		}
+		fis[i] = plain
+	}
+	return fis, ok
+}
+
+func (me *CompressIO) ZeroFile(name string) int {
+	return me.ZeroFileCtx(context.Background(), name)
+}
+
+func (me *CompressIO) ZeroFileCtx(ctx context.Context, name string) int {
+	me.Forget(name)
+	return IOWithContext(me.io).ZeroFileCtx(ctx, name)
+}
+
+func (me *CompressIO) Unlink(path string) int {
+	return me.UnlinkCtx(context.Background(), path)
+}
+
+func (me *CompressIO) UnlinkCtx(ctx context.Context, path string) int {
+	me.Forget(path)
+	return IOWithContext(me.io).UnlinkCtx(ctx, path)
+}
+
+func (me *CompressIO) GetMeta(name string) (ObjectMeta, int) {
+	return me.GetMetaCtx(context.Background(), name)
+}
+
+func (me *CompressIO) GetMetaCtx(ctx context.Context, name string) (ObjectMeta, int) {
+	return IOWithContext(me.io).GetMetaCtx(ctx, name)
+}
+
+func (me *CompressIO) SetMeta(name string, meta ObjectMeta) int {
+	return me.SetMetaCtx(context.Background(), name, meta)
+}
+
+func (me *CompressIO) SetMetaCtx(ctx context.Context, name string, meta ObjectMeta) int {
+	return IOWithContext(me.io).SetMetaCtx(ctx, name, meta)
+}
@@ -0,0 +1,96 @@
+package fscommon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strconv"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	comp, ok := NewCompressor(map[string]string{"Compression": COMPRESS_GZIP, "CompressionPatterns": "*.log"})
+	if ok < 0 {
+		t.Fatalf("NewCompressor: %d", ok)
+	}
+	mem := newMemIO()
+	zio := NewCompressIO(mem, comp)
+
+	//compressible data over a few frames
+	data := bytes.Repeat(randomData(1000, 3), 3*COMPRESS_FRAME_SIZE/1000+7)
+	if n := zio.PutBuffer("a.log", data); n != len(data) {
+		t.Fatalf("PutBuffer: %d", n)
+	}
+	obj := mem.objects["a.log"]
+	if len(obj) >= len(data) {
+		t.Fatalf("object is not compressed: %d bytes", len(obj))
+	}
+	footer := obj[len(obj)-COMPRESS_FOOTER_SIZE:]
+	frames := int(binary.BigEndian.Uint32(footer[12:]))
+	if string(footer[:4]) != COMPRESS_MAGIC || frames != (len(data)+COMPRESS_FRAME_SIZE-1)/COMPRESS_FRAME_SIZE ||
+		binary.BigEndian.Uint64(footer[32:]) != uint64(len(data)) {
+		t.Fatalf("invalid footer: %x", footer)
+	}
+	if size := mem.metas["a.log"][META_SIZE]; size != strconv.Itoa(len(data)) {
+		t.Fatalf("size in meta data: %s", size)
+	}
+
+	if fi, ok := zio.GetAttr("a.log"); ok < 0 || fi.Size() != int64(len(data)) {
+		t.Fatalf("GetAttr: %d, size = %d", ok, fi.Size())
+	}
+	checkRanges(t, zio, "a.log", data, [][2]int{
+		{0, len(data)},
+		{COMPRESS_FRAME_SIZE - 10, 20},
+		{COMPRESS_FRAME_SIZE, 2 * COMPRESS_FRAME_SIZE},
+		{len(data) - 5, 10},
+	})
+
+	//files not matching patterns are stored as they are
+	zio.PutBuffer("a.txt", data[:100])
+	if !bytes.Equal(mem.objects["a.txt"], data[:100]) {
+		t.Fatal("a.txt is compressed")
+	}
+}
+
+func TestCompressSegments(t *testing.T) {
+	comp, ok := NewCompressor(map[string]string{"Compression": COMPRESS_ZSTD, "CompressionLevel": "5"})
+	if ok < 0 {
+		t.Fatalf("NewCompressor: %d", ok)
+	}
+	if _, ok := NewCompressor(map[string]string{"Compression": COMPRESS_ZSTD, "CompressionLevel": "23"}); ok != EINVAL {
+		t.Fatalf("NewCompressor with level 23: %d, expected EINVAL", ok)
+	}
+	mem := newMemIO()
+	zio := NewCompressIO(mem, comp)
+
+	data := bytes.Repeat(randomData(1000, 7), 2*COMPRESS_SEGMENT_SIZE/1000+300)
+	zio.PutBuffer("a", data)
+	ranges := [][2]int{
+		{0, len(data)},
+		{COMPRESS_SEGMENT_SIZE - 10, 20},
+		{COMPRESS_SEGMENT_SIZE - COMPRESS_FRAME_SIZE, 2 * COMPRESS_SEGMENT_SIZE},
+		{len(data) - 5, 10},
+	}
+	checkRanges(t, zio, "a", data, ranges)
+
+	//segments are appended, those of the object are kept as they are
+	ctx := context.Background()
+	more := bytes.Repeat(randomData(1000, 8), COMPRESS_SEGMENT_SIZE/1000+10)
+	w, keep, ok := zio.AppendWriter(ctx, "a")
+	if ok < 0 || keep != int64(len(mem.objects["a"])) {
+		t.Fatalf("AppendWriter: %d, keep = %d", ok, keep)
+	}
+	obj := append([]byte(nil), mem.objects["a"]...)
+	buf, _ := w.Write(more)
+	last, _ := w.Close()
+	mem.objects["a"] = append(append(obj, buf...), last...)
+	zio.Forget("a")
+	data = append(data, more...)
+	checkRanges(t, zio, "a", data, append(ranges, [2]int{len(data) - len(more) - 10, 20}))
+
+	//an object which is not compressed is written again
+	mem.PutBuffer("b", data[:100])
+	if _, keep, ok := zio.AppendWriter(ctx, "b"); ok < 0 || keep != 0 {
+		t.Fatalf("AppendWriter of an object which is not compressed: %d, keep = %d", ok, keep)
+	}
+}
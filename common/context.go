@@ -0,0 +1,241 @@
+package fscommon
+
+import (
+	"context"
+	"os"
+)
+
+//context-aware variants of FileSystemImpl, FileImpl and FileIO
+//front-ends pass the context of a request, so that backend requests are canceled
+//when the client goes away or the deadline is exceeded
+//a canceled request returns ECANCELED, an expired one returns ETIMEDOUT
+//drivers which don't implement them are adapted, the context is checked before each call
+
+type FileIOCtx interface {
+	PutBufferCtx(ctx context.Context, name string, data []byte) int
+	GetBufferCtx(ctx context.Context, name string, dest []byte, offset int64) int
+	GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int)
+	ListFileCtx(ctx context.Context, path string) ([]os.FileInfo, int)
+	ZeroFileCtx(ctx context.Context, name string) int
+	UnlinkCtx(ctx context.Context, path string) int
+	GetMetaCtx(ctx context.Context, name string) (ObjectMeta, int)
+	SetMetaCtx(ctx context.Context, name string, meta ObjectMeta) int
+}
+
+//writes are buffered and uploaded in background, only the foreground part is bound to the context
+type FileImplCtx interface {
+	ReadCtx(ctx context.Context, dest []byte, off int64) int
+	WriteCtx(ctx context.Context, data []byte, off int64) int
+	FlushCtx(ctx context.Context) int
+	TruncateCtx(ctx context.Context, size uint64) int
+}
+
+type FileSystemImplCtx interface {
+	ReadDirCtx(ctx context.Context, path string) ([]os.FileInfo, int)
+	GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int)
+	OpenCtx(ctx context.Context, path string, flags uint32) (*FileObject, int)
+	CreateCtx(ctx context.Context, path string, flags uint32, attr *DirItem) (*FileObject, int)
+	UnlinkCtx(ctx context.Context, path string) int
+	MkdirCtx(ctx context.Context, path string, mode uint32) int
+	RmdirCtx(ctx context.Context, path string) int
+	RemoveAllCtx(ctx context.Context, path string) int
+}
+
+//error code of a done context, 0 if it is not done yet
+func CtxErrno(ctx context.Context) int {
+	switch ctx.Err() {
+	case nil:
+		return 0
+	case context.DeadlineExceeded:
+		return ETIMEDOUT
+	}
+	return ECANCELED
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//Adapters
+///////////////////////////////////////////////////////////////////////////////
+
+func IOWithContext(io FileIO) FileIOCtx {
+	if cio, ok := io.(FileIOCtx); ok {
+		return cio
+	}
+	return ioCtx{io}
+}
+
+type ioCtx struct {
+	io FileIO
+}
+
+func (me ioCtx) PutBufferCtx(ctx context.Context, name string, data []byte) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.io.PutBuffer(name, data)
+}
+
+func (me ioCtx) GetBufferCtx(ctx context.Context, name string, dest []byte, offset int64) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.io.GetBuffer(name, dest, offset)
+}
+
+func (me ioCtx) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return nil, ok
+	}
+	return me.io.GetAttr(path)
+}
+
+func (me ioCtx) ListFileCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return nil, ok
+	}
+	return me.io.ListFile(path)
+}
+
+func (me ioCtx) ZeroFileCtx(ctx context.Context, name string) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.io.ZeroFile(name)
+}
+
+func (me ioCtx) UnlinkCtx(ctx context.Context, path string) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.io.Unlink(path)
+}
+
+func (me ioCtx) GetMetaCtx(ctx context.Context, name string) (ObjectMeta, int) {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return nil, ok
+	}
+	return me.io.GetMeta(name)
+}
+
+func (me ioCtx) SetMetaCtx(ctx context.Context, name string, meta ObjectMeta) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.io.SetMeta(name, meta)
+}
+
+//a file may implement ReadCtx only, e.g. by FileImplBase
+func FileWithContext(f FileImpl) FileImplCtx {
+	if cf, ok := f.(FileImplCtx); ok {
+		return cf
+	}
+	return fileCtx{f}
+}
+
+type fileCtx struct {
+	f FileImpl
+}
+
+func (me fileCtx) ReadCtx(ctx context.Context, dest []byte, off int64) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	if r, ok := me.f.(interface {
+		ReadCtx(ctx context.Context, dest []byte, off int64) int
+	}); ok {
+		return r.ReadCtx(ctx, dest, off)
+	}
+	return me.f.Read(dest, off)
+}
+
+func (me fileCtx) WriteCtx(ctx context.Context, data []byte, off int64) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.f.Write(data, off)
+}
+
+func (me fileCtx) FlushCtx(ctx context.Context) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	if f, ok := me.f.(interface {
+		FlushCtx(ctx context.Context) int
+	}); ok {
+		return f.FlushCtx(ctx)
+	}
+	return me.f.Flush()
+}
+
+func (me fileCtx) TruncateCtx(ctx context.Context, size uint64) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.f.Truncate(size)
+}
+
+func FsWithContext(fs FileSystemImpl) FileSystemImplCtx {
+	if cfs, ok := fs.(FileSystemImplCtx); ok {
+		return cfs
+	}
+	return fsCtx{fs}
+}
+
+type fsCtx struct {
+	fs FileSystemImpl
+}
+
+func (me fsCtx) ReadDirCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return nil, ok
+	}
+	return me.fs.ReadDir(path)
+}
+
+func (me fsCtx) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return nil, ok
+	}
+	return me.fs.GetAttr(path)
+}
+
+func (me fsCtx) OpenCtx(ctx context.Context, path string, flags uint32) (*FileObject, int) {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return nil, ok
+	}
+	return me.fs.Open(path, flags)
+}
+
+func (me fsCtx) CreateCtx(ctx context.Context, path string, flags uint32, attr *DirItem) (*FileObject, int) {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return nil, ok
+	}
+	return me.fs.Create(path, flags, attr)
+}
+
+func (me fsCtx) UnlinkCtx(ctx context.Context, path string) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.fs.Unlink(path)
+}
+
+func (me fsCtx) MkdirCtx(ctx context.Context, path string, mode uint32) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.fs.Mkdir(path, mode)
+}
+
+func (me fsCtx) RmdirCtx(ctx context.Context, path string) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.fs.Rmdir(path)
+}
+
+func (me fsCtx) RemoveAllCtx(ctx context.Context, path string) int {
+	if ok := CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.fs.RemoveAll(path)
+}
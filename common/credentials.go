@@ -0,0 +1,399 @@
+package fscommon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//credential provider chain of backend requests
+//providers are tried in order, the first one returning credentials is used until the process exits
+//temporary credentials are refreshed by the same provider before they expire
+//providers: static (KEY_ID/KEY_DATA), env, shared (credentials file), web_identity, process
+//for aliyun, a role without a token file is assumed by AssumeRole with the credentials of the chain, see sts.go
+const (
+	CRED_VENDOR_AWS    = "aws"
+	CRED_VENDOR_ALIYUN = "aliyun"
+
+	DEFAULT_CRED_CHAIN        = "static,env,shared,web_identity,process"
+	DEFAULT_CRED_PROFILE      = "default"
+	DEFAULT_CRED_DURATION     = 3600 //seconds of temporary credentials
+	DEFAULT_CRED_SESSION_NAME = "csmgr"
+
+	CRED_REFRESH_WINDOW = 5 * time.Minute //refresh temporary credentials before they expire
+)
+
+type Credential struct {
+	KeyId    string
+	KeyData  string
+	Token    string    //security token of temporary credentials
+	Expires  time.Time //zero if it never expires
+	Provider string
+}
+
+func (me *Credential) expiring() bool {
+	return !me.Expires.IsZero() && time.Now().Add(CRED_REFRESH_WINDOW).After(me.Expires)
+}
+
+type CredentialProvider interface {
+	Name() string
+	//nil, nil if the provider is not configured
+	Retrieve() (*Credential, error)
+}
+
+//names of environment variables and files of a vendor
+type credVendor struct {
+	keyIdEnv, keyDataEnv, tokenEnv string
+	fileEnv, profileEnv            string
+	roleArnEnv, tokenFileEnv       string
+	sessionNameEnv, oidcArnEnv     string
+	file                           string //relative to home
+}
+
+var credVendors = map[string]*credVendor{
+	CRED_VENDOR_AWS: &credVendor{
+		keyIdEnv:       "AWS_ACCESS_KEY_ID",
+		keyDataEnv:     "AWS_SECRET_ACCESS_KEY",
+		tokenEnv:       "AWS_SESSION_TOKEN",
+		fileEnv:        "AWS_SHARED_CREDENTIALS_FILE",
+		profileEnv:     "AWS_PROFILE",
+		roleArnEnv:     "AWS_ROLE_ARN",
+		tokenFileEnv:   "AWS_WEB_IDENTITY_TOKEN_FILE",
+		sessionNameEnv: "AWS_ROLE_SESSION_NAME",
+		file:           ".aws/credentials",
+	},
+	CRED_VENDOR_ALIYUN: &credVendor{
+		keyIdEnv:       "ALIBABA_CLOUD_ACCESS_KEY_ID",
+		keyDataEnv:     "ALIBABA_CLOUD_ACCESS_KEY_SECRET",
+		tokenEnv:       "ALIBABA_CLOUD_SECURITY_TOKEN",
+		fileEnv:        "ALIBABA_CLOUD_CREDENTIALS_FILE",
+		profileEnv:     "ALIBABA_CLOUD_PROFILE",
+		roleArnEnv:     "ALIBABA_CLOUD_ROLE_ARN",
+		tokenFileEnv:   "ALIBABA_CLOUD_OIDC_TOKEN_FILE",
+		sessionNameEnv: "ALIBABA_CLOUD_ROLE_SESSION_NAME",
+		oidcArnEnv:     "ALIBABA_CLOUD_OIDC_PROVIDER_ARN",
+		file:           ".alibabacloud/credentials",
+	},
+}
+
+type CredentialChain struct {
+	providers []CredentialProvider
+	cur       CredentialProvider //the provider in use
+	cred      *Credential
+
+	mtx sync.Mutex
+}
+
+//create the chain from driver config, see csmgr/factory.go for the keys
+//keys of the config override environment variables of the vendor
+func NewCredentialChain(cfg map[string]string, vendor string, keyId string, keyData string) (*CredentialChain, int) {
+	cv := credVendors[vendor]
+	if cv == nil {
+		dlog.Errorf("Unknown credential vendor %s.", vendor)
+		return nil, EINVAL
+	}
+	get := func(key string, env string) string {
+		if val := cfg[key]; len(val) > 0 {
+			return val
+		}
+		if len(env) > 0 {
+			return os.Getenv(env)
+		}
+		return ""
+	}
+
+	sessionName := get("RoleSessionName", cv.sessionNameEnv)
+	if len(sessionName) == 0 {
+		sessionName = DEFAULT_CRED_SESSION_NAME
+	}
+	duration, err := strconv.Atoi(cfg["CredentialsDuration"])
+	if err != nil || duration <= 0 {
+		duration = DEFAULT_CRED_DURATION
+	}
+
+	chain := cfg["Credentials"]
+	if len(chain) == 0 {
+		chain = DEFAULT_CRED_CHAIN
+	}
+	me := &CredentialChain{}
+	for _, name := range strings.Split(chain, ",") {
+		var p CredentialProvider
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+			continue
+		case "static":
+			p = &staticCredProvider{cred: Credential{KeyId: keyId, KeyData: keyData}}
+		case "env":
+			p = &envCredProvider{vendor: cv}
+		case "shared":
+			file := get("CredentialsFile", cv.fileEnv)
+			if len(file) == 0 {
+				if home, err := os.UserHomeDir(); err == nil {
+					file = filepath.Join(home, cv.file)
+				}
+			}
+			profile := get("CredentialsProfile", cv.profileEnv)
+			if len(profile) == 0 {
+				profile = DEFAULT_CRED_PROFILE
+			}
+			p = &sharedCredProvider{file: file, profile: profile}
+		case "web_identity":
+			p = &webIdentityCredProvider{
+				vendor:      vendor,
+				endpoint:    cfg["StsEndpoint"],
+				region:      cfg["Region"],
+				roleArn:     get("RoleArn", cv.roleArnEnv),
+				tokenFile:   get("WebIdentityTokenFile", cv.tokenFileEnv),
+				oidcArn:     get("OidcProviderArn", cv.oidcArnEnv),
+				sessionName: sessionName,
+				duration:    duration,
+			}
+		case "process":
+			p = &processCredProvider{command: cfg["CredentialsCommand"]}
+		default:
+			dlog.Errorf("Unknown credential provider %s.", name)
+			return nil, EINVAL
+		}
+		me.providers = append(me.providers, p)
+	}
+
+	roleArn := get("RoleArn", cv.roleArnEnv)
+	if vendor == CRED_VENDOR_ALIYUN && len(roleArn) > 0 && len(get("WebIdentityTokenFile", cv.tokenFileEnv)) == 0 {
+		me.providers = []CredentialProvider{&aliyunStsCredProvider{
+			source:      &CredentialChain{providers: me.providers},
+			endpoint:    cfg["StsEndpoint"],
+			roleArn:     roleArn,
+			sessionName: sessionName,
+			duration:    duration,
+		}}
+	}
+	return me, 0
+}
+
+//current credentials, refreshed if they are about to expire
+//cached credentials are still used if a refresh fails before they expire
+func (me *CredentialChain) Get() (*Credential, error) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	if me.cred != nil && !me.cred.expiring() {
+		return me.cred, nil
+	}
+
+	cred, err := me.retrieve()
+	if err != nil {
+		if me.cred != nil && time.Now().Before(me.cred.Expires) {
+			dlog.Warnf("Failed to refresh credentials from %s, the current ones expire at %s: %s",
+				me.cur.Name(), me.cred.Expires.Format(time.RFC3339), err)
+			return me.cred, nil
+		}
+		return nil, err
+	}
+	if me.cred == nil || me.cred.Provider != cred.Provider {
+		dlog.Infof("Using credentials from %s.", cred.Provider)
+	} else {
+		dlog.Debugf("Credentials from %s are refreshed, they expire at %s.", cred.Provider, cred.Expires.Format(time.RFC3339))
+	}
+	me.cred = cred
+	return cred, nil
+}
+
+//true if the credentials should be retrieved again
+func (me *CredentialChain) Expired() bool {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	return me.cred == nil || me.cred.expiring()
+}
+
+func (me *CredentialChain) retrieve() (*Credential, error) {
+	if me.cur != nil {
+		cred, err := me.cur.Retrieve()
+		if err == nil && cred == nil {
+			err = fmt.Errorf("no credentials found")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", me.cur.Name(), err)
+		}
+		cred.Provider = me.cur.Name()
+		return cred, nil
+	}
+	for _, p := range me.providers {
+		cred, err := p.Retrieve()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", p.Name(), err)
+		}
+		if cred != nil {
+			cred.Provider = p.Name()
+			me.cur = p
+			return cred, nil
+		}
+	}
+	return nil, fmt.Errorf("no credentials found")
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+type staticCredProvider struct {
+	cred Credential
+}
+
+func (me *staticCredProvider) Name() string {
+	return "static"
+}
+
+func (me *staticCredProvider) Retrieve() (*Credential, error) {
+	if len(me.cred.KeyId) == 0 || len(me.cred.KeyData) == 0 {
+		return nil, nil
+	}
+	cred := me.cred
+	cred.Provider = me.Name()
+	return &cred, nil
+}
+
+type envCredProvider struct {
+	vendor *credVendor
+}
+
+func (me *envCredProvider) Name() string {
+	return "env"
+}
+
+func (me *envCredProvider) Retrieve() (*Credential, error) {
+	cred := &Credential{
+		KeyId:    os.Getenv(me.vendor.keyIdEnv),
+		KeyData:  os.Getenv(me.vendor.keyDataEnv),
+		Token:    os.Getenv(me.vendor.tokenEnv),
+		Provider: me.Name(),
+	}
+	if len(cred.KeyId) == 0 || len(cred.KeyData) == 0 {
+		return nil, nil
+	}
+	return cred, nil
+}
+
+//ini file with a section for each profile, e.g. ~/.aws/credentials
+//key names of AWS (aws_access_key_id) and Aliyun (access_key_id) are both accepted
+type sharedCredProvider struct {
+	file    string
+	profile string
+}
+
+func (me *sharedCredProvider) Name() string {
+	return "shared"
+}
+
+func (me *sharedCredProvider) Retrieve() (*Credential, error) {
+	if len(me.file) == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(me.file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cred := &Credential{Provider: me.Name()}
+	found := false
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(strings.TrimPrefix(line[1:len(line)-1], "profile "))
+			if section == me.profile {
+				found = true
+			}
+			continue
+		}
+		if section != me.profile {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		val := strings.TrimSpace(kv[1])
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "aws_access_key_id", "access_key_id":
+			cred.KeyId = val
+		case "aws_secret_access_key", "access_key_secret":
+			cred.KeyData = val
+		case "aws_session_token", "security_token":
+			cred.Token = val
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found || len(cred.KeyId) == 0 || len(cred.KeyData) == 0 {
+		return nil, nil
+	}
+	return cred, nil
+}
+
+//external command printing credentials as JSON, the format of AWS credential_process
+//{"AccessKeyId": "...", "SecretAccessKey": "...", "SessionToken": "...", "Expiration": "2006-01-02T15:04:05Z"}
+//Aliyun names AccessKeySecret and SecurityToken are accepted too
+type processCredProvider struct {
+	command string
+}
+
+func (me *processCredProvider) Name() string {
+	return "process"
+}
+
+func (me *processCredProvider) Retrieve() (*Credential, error) {
+	if len(me.command) == 0 {
+		return nil, nil
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", me.command)
+	} else {
+		cmd = exec.Command("sh", "-c", me.command)
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s: %s", me.command, err)
+	}
+
+	var resp struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		AccessKeySecret string
+		SessionToken    string
+		SecurityToken   string
+		Expiration      string
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("invalid output of %s: %s", me.command, err)
+	}
+	cred := &Credential{
+		KeyId:    resp.AccessKeyId,
+		KeyData:  resp.SecretAccessKey + resp.AccessKeySecret,
+		Token:    resp.SessionToken + resp.SecurityToken,
+		Provider: me.Name(),
+	}
+	if len(cred.KeyId) == 0 || len(cred.KeyData) == 0 {
+		return nil, fmt.Errorf("no keys in output of %s", me.command)
+	}
+	if len(resp.Expiration) > 0 {
+		if cred.Expires, err = time.Parse(time.RFC3339, resp.Expiration); err != nil {
+			return nil, fmt.Errorf("invalid expiration %s", resp.Expiration)
+		}
+	}
+	return cred, nil
+}
@@ -0,0 +1,660 @@
+package fscommon
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//client-side encryption of object data
+//data is encrypted in segments of CRYPT_SEGMENT_SIZE, each segment has its own data key,
+//which is wrapped by the master key and saved in the segment header
+//all segments of an object have a random id of the file, a segment is encrypted with the id and its index,
+//so that an object appended by a multipart upload keeps its whole segments by multipart copies
+//a segment is encrypted in chunks by AES-256-GCM, so that a ranged read decrypts only the chunks it covers
+//object layout: segment 0 | segment 1 | ..., all segments but the last one are whole
+//segment layout: header | chunk 0 | chunk 1 | ...
+//header: magic, chunk size, segment size, id of the master key, id of the file, wrapped data key (nonce | key | tag)
+//chunk: nonce | data | tag, the id of the file, the indexes of the segment and the chunk, whether the chunk ends
+//the segment and whether the segment ends the object are authenticated, so chunks and segments can't be reordered,
+//truncated or spliced in from other objects
+//the plain text size is saved in meta data too, a read of an object of another size fails, see META_CRYPT_SIZE
+//an empty object has no header, an object without the magic is refused unless plain text is allowed for migration
+const (
+	META_CRYPT_SIZE = "crypt-size" //plain text size of an encrypted object, other layers may set META_SIZE on top
+
+	CRYPT_MAGIC        = "CSE3"
+	CRYPT_CHUNK_SIZE   = 64 * 1024
+	CRYPT_SEGMENT_SIZE = FILE_BLOCK_SIZE //a part of an append is a whole segment
+
+	CRYPT_KEY_SIZE       = 32
+	CRYPT_ID_SIZE        = 16
+	CRYPT_NONCE_SIZE     = 12
+	CRYPT_TAG_SIZE       = 16
+	CRYPT_CHUNK_OVERHEAD = CRYPT_NONCE_SIZE + CRYPT_TAG_SIZE
+	CRYPT_HEADER_SIZE    = cryptPrefixSize + CRYPT_NONCE_SIZE + CRYPT_KEY_SIZE + CRYPT_TAG_SIZE
+
+	cryptPrefixSize    = 16 + CRYPT_ID_SIZE
+	cryptChunkStride   = CRYPT_CHUNK_SIZE + CRYPT_CHUNK_OVERHEAD
+	cryptSegmentStride = CRYPT_HEADER_SIZE + CRYPT_SEGMENT_SIZE/CRYPT_CHUNK_SIZE*cryptChunkStride
+)
+
+//plain text size of an encrypted object
+func CryptPlainSize(size int64) int64 {
+	n := size / cryptSegmentStride * CRYPT_SEGMENT_SIZE
+	if rem := size % cryptSegmentStride; rem > CRYPT_HEADER_SIZE {
+		body := rem - CRYPT_HEADER_SIZE
+		n += body / cryptChunkStride * CRYPT_CHUNK_SIZE
+		if rem := body % cryptChunkStride; rem > CRYPT_CHUNK_OVERHEAD {
+			n += rem - CRYPT_CHUNK_OVERHEAD
+		}
+	}
+	return n
+}
+
+//size of an encrypted object with plain text of size bytes
+func CryptCipherSize(size int64) int64 {
+	n := size / CRYPT_SEGMENT_SIZE * cryptSegmentStride
+	if rem := size % CRYPT_SEGMENT_SIZE; rem > 0 {
+		chunks := (rem + CRYPT_CHUNK_SIZE - 1) / CRYPT_CHUNK_SIZE
+		n += CRYPT_HEADER_SIZE + rem + chunks*CRYPT_CHUNK_OVERHEAD
+	}
+	return n
+}
+
+//report the plain text size of a regular file from the object size
+func CryptPlainAttr(di *DirItem) {
+	if di != nil && di.DiType == S_IFREG {
+		di.DiSize = CryptPlainSize(di.DiSize)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+//master key, data keys of objects are wrapped by it
+type CryptKey struct {
+	id    []byte //first 4 bytes of SHA-256 of the key, to tell a wrong key from corrupted data
+	aead  cipher.AEAD
+	names *NameCipher
+	dedup []byte //key of chunk hashes, see DedupIO
+	plain bool   //objects which are not encrypted are read as plain text
+}
+
+func NewCryptKey(key []byte) (*CryptKey, error) {
+	if len(key) != CRYPT_KEY_SIZE {
+		return nil, fmt.Errorf("master key must be %d bytes", CRYPT_KEY_SIZE)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	names, err := NewNameCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &CryptKey{id: sum[:4], aead: aead, names: names, dedup: deriveKey(key, "csmgr dedup")}, nil
+}
+
+//cipher of object names, see NameCryptFS
+func (me *CryptKey) NameCipher() *NameCipher {
+	return me.names
+}
+
+//read objects which are not encrypted as plain text, for migration of a bucket written without encryption
+//otherwise reading them fails, so that objects replaced by someone without the key are not served
+func (me *CryptKey) AllowPlain(allow bool) {
+	me.plain = allow
+}
+
+func (me *CryptKey) PlainAllowed() bool {
+	return me.plain
+}
+
+//the key file has 32 bytes, raw or in hex or base64, e.g. head -c 32 /dev/urandom | base64 > master.key
+func LoadCryptKey(path string) (*CryptKey, error) {
+	buf, err := loadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewCryptKey(buf)
+}
+
+//read a key file of 32 bytes, raw or in hex or base64
+func loadKeyFile(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != CRYPT_KEY_SIZE {
+		text := strings.TrimSpace(string(buf))
+		if key, err := hex.DecodeString(text); err == nil {
+			buf = key
+		} else if key, err := base64.StdEncoding.DecodeString(text); err == nil {
+			buf = key
+		}
+	}
+	return buf, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//header fields before the wrapped data key, they are authenticated with it
+func (me *CryptKey) headerPrefix(id []byte) []byte {
+	buf := make([]byte, cryptPrefixSize, CRYPT_HEADER_SIZE)
+	copy(buf, CRYPT_MAGIC)
+	binary.BigEndian.PutUint32(buf[4:], CRYPT_CHUNK_SIZE)
+	binary.BigEndian.PutUint32(buf[8:], CRYPT_SEGMENT_SIZE)
+	copy(buf[12:], me.id)
+	copy(buf[16:], id)
+	return buf
+}
+
+//data key of a segment and id of the file from its header
+func (me *CryptKey) openHeader(header []byte) (cipher.AEAD, []byte, error) {
+	if len(header) < CRYPT_HEADER_SIZE || string(header[:4]) != CRYPT_MAGIC {
+		return nil, nil, fmt.Errorf("not encrypted")
+	}
+	id := header[16:cryptPrefixSize]
+	prefix := me.headerPrefix(id)
+	if !bytes.Equal(header[12:16], prefix[12:16]) {
+		return nil, nil, fmt.Errorf("encrypted by another master key")
+	}
+	if !bytes.Equal(header[:16], prefix[:16]) {
+		return nil, nil, fmt.Errorf("unsupported header")
+	}
+	nonce := header[cryptPrefixSize : cryptPrefixSize+CRYPT_NONCE_SIZE]
+	key, err := me.aead.Open(nil, nonce, header[cryptPrefixSize+CRYPT_NONCE_SIZE:CRYPT_HEADER_SIZE], prefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid header")
+	}
+	aead, err := newAEAD(key)
+	return aead, append([]byte(nil), id...), err
+}
+
+//random id of a file, all segments of its object have it
+func NewFileID() ([]byte, error) {
+	id := make([]byte, CRYPT_ID_SIZE)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+//encrypt data into segments of the file id from index seg on, and append them to dst
+//each segment has a new data key, last tells whether data ends the object
+//data must be whole segments, except at the end of an object
+func (me *CryptKey) Encrypt(dst []byte, id []byte, seg int64, data []byte, last bool) ([]byte, error) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > CRYPT_SEGMENT_SIZE {
+			n = CRYPT_SEGMENT_SIZE
+		}
+		w, err := me.NewWriter(id, seg, last && n == len(data))
+		if err != nil {
+			return nil, err
+		}
+		dst = w.Seal(append(dst, w.Header()...), data[:n], true)
+		data = data[n:]
+		seg++
+	}
+	return dst, nil
+}
+
+//encrypt a segment with a new data key
+type CryptWriter struct {
+	aead   cipher.AEAD
+	header []byte
+	id     []byte
+	seg    int64
+	last   bool //the segment ends the object
+	index  int64
+}
+
+//writer of segment seg of the file id, last tells whether the segment ends the object
+func (me *CryptKey) NewWriter(id []byte, seg int64, last bool) (*CryptWriter, error) {
+	key := make([]byte, CRYPT_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := me.headerPrefix(id)
+	nonce := make([]byte, CRYPT_NONCE_SIZE)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	header = me.aead.Seal(header, nonce, key, header[:cryptPrefixSize])
+	return &CryptWriter{aead: aead, header: header, id: id, seg: seg, last: last}, nil
+}
+
+//header of the segment, it goes before the first chunk
+func (me *CryptWriter) Header() []byte {
+	return me.header
+}
+
+//encrypt data as the next chunks and append them to dst
+//data must be whole chunks, except in the last call, which ends the segment with final set
+func (me *CryptWriter) Seal(dst []byte, data []byte, final bool) []byte {
+	nonce := make([]byte, CRYPT_NONCE_SIZE)
+	for len(data) > 0 {
+		n := len(data)
+		if n > CRYPT_CHUNK_SIZE {
+			n = CRYPT_CHUNK_SIZE
+		}
+		rand.Read(nonce)
+		dst = append(dst, nonce...)
+		final := final && n == len(data)
+		dst = me.aead.Seal(dst, nonce, data[:n], chunkAD(me.id, me.seg, me.index, final, final && me.last))
+		data = data[n:]
+		me.index++
+	}
+	return dst
+}
+
+//id of the file, indexes of the segment and the chunk, whether the chunk ends the segment,
+//and whether it ends the object
+func chunkAD(id []byte, seg int64, index int64, final bool, last bool) []byte {
+	ad := make([]byte, CRYPT_ID_SIZE+17)
+	copy(ad, id)
+	binary.BigEndian.PutUint64(ad[CRYPT_ID_SIZE:], uint64(seg))
+	binary.BigEndian.PutUint64(ad[CRYPT_ID_SIZE+8:], uint64(index))
+	if final {
+		ad[CRYPT_ID_SIZE+16] |= 1
+	}
+	if last {
+		ad[CRYPT_ID_SIZE+16] |= 2
+	}
+	return ad
+}
+
+func openChunk(aead cipher.AEAD, ad []byte, chunk []byte, dst []byte) ([]byte, error) {
+	if len(chunk) < CRYPT_CHUNK_OVERHEAD {
+		return nil, fmt.Errorf("truncated chunk")
+	}
+	return aead.Open(dst, chunk[:CRYPT_NONCE_SIZE], chunk[CRYPT_NONCE_SIZE:], ad)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//FileIO wrapper which encrypts objects on PutBuffer and decrypts them on GetBuffer
+//it goes outside RetryIO, so that each request for a header or chunks is retried on its own
+//sizes reported by GetAttr and ListFile are plain text sizes
+type CryptIO struct {
+	io  FileIO
+	key *CryptKey
+
+	objects map[string]*cryptObject
+	mtx     sync.Mutex
+}
+
+//an object being read, data keys of segments are loaded when they are read first
+type cryptObject struct {
+	size  int64  //of the encrypted object
+	plain bool   //not encrypted, read when plain text is allowed
+	id    []byte //of the file, from the header of the first segment
+	aeads map[int64]cipher.AEAD
+}
+
+func NewCryptIO(io FileIO, key *CryptKey) *CryptIO {
+	return &CryptIO{io: io, key: key, objects: make(map[string]*cryptObject)}
+}
+
+//the wrapped FileIO, for driver specific operations
+func (me *CryptIO) Base() FileIO {
+	return me.io
+}
+
+func (me *CryptIO) Key() *CryptKey {
+	return me.key
+}
+
+//drop the cached data keys of an object, it must be called when the object is written without CryptIO
+func (me *CryptIO) Forget(name string) {
+	me.mtx.Lock()
+	delete(me.objects, name)
+	me.mtx.Unlock()
+}
+
+//the object to read, its size is needed to tell the last chunk of a segment
+func (me *CryptIO) object(ctx context.Context, name string) (*cryptObject, int) {
+	me.mtx.Lock()
+	obj := me.objects[name]
+	me.mtx.Unlock()
+	if obj != nil {
+		return obj, 0
+	}
+	fi, ok := IOWithContext(me.io).GetAttrCtx(ctx, name)
+	if ok < 0 {
+		return nil, ok
+	}
+	var meta ObjectMeta
+	if di, ok := fi.(*DirItem); ok && di != nil {
+		meta = di.DiMeta
+	}
+	return me.open(ctx, name, fi.Size(), meta)
+}
+
+//id of the file of an encrypted object, nil for an object in plain text or an empty one
+func (me *CryptIO) FileID(ctx context.Context, name string) ([]byte, int) {
+	obj, ok := me.object(ctx, name)
+	if ok < 0 {
+		return nil, ok
+	}
+	return obj.id, 0
+}
+
+//check the header of an object with size bytes, and its plain text size if meta has it
+//an object without the magic is refused, unless plain text is allowed
+func (me *CryptIO) open(ctx context.Context, name string, size int64, meta ObjectMeta) (*cryptObject, int) {
+	me.mtx.Lock()
+	obj := me.objects[name]
+	me.mtx.Unlock()
+	if obj != nil && obj.size == size {
+		return obj, 0
+	}
+
+	obj = &cryptObject{size: size, aeads: make(map[int64]cipher.AEAD)}
+	if size > 0 {
+		header := make([]byte, CRYPT_HEADER_SIZE)
+		n := readFull(ctx, IOWithContext(me.io), name, header, 0)
+		if n < 0 {
+			return nil, n
+		}
+		if n < CRYPT_HEADER_SIZE || string(header[:4]) != CRYPT_MAGIC {
+			if !me.key.plain {
+				dlog.Errorf("Refused to read %s, it's not encrypted", name)
+				return nil, EIO
+			}
+			obj.plain = true
+		} else {
+			aead, id, err := me.key.openHeader(header)
+			if err != nil {
+				dlog.Errorf("Can't decrypt %s: %s", name, err)
+				return nil, EIO
+			}
+			if val, ok := meta[META_CRYPT_SIZE]; ok && val != strconv.FormatInt(CryptPlainSize(size), 10) {
+				dlog.Errorf("Can't decrypt %s: %d bytes of plain text, %s expected", name, CryptPlainSize(size), val)
+				return nil, EIO
+			}
+			obj.id = id
+			obj.aeads[0] = aead
+		}
+	}
+	me.mtx.Lock()
+	me.objects[name] = obj
+	me.mtx.Unlock()
+	return obj, 0
+}
+
+//data key of a segment, from the header at the beginning of the segment
+func (me *CryptIO) segmentKey(ctx context.Context, name string, obj *cryptObject, seg int64) (cipher.AEAD, int) {
+	me.mtx.Lock()
+	aead := obj.aeads[seg]
+	me.mtx.Unlock()
+	if aead != nil {
+		return aead, 0
+	}
+	header := make([]byte, CRYPT_HEADER_SIZE)
+	n := readFull(ctx, IOWithContext(me.io), name, header, seg*cryptSegmentStride)
+	if n < 0 {
+		return nil, n
+	}
+	aead, id, err := me.key.openHeader(header[:n])
+	if err == nil && !bytes.Equal(id, obj.id) {
+		err = fmt.Errorf("segment of another file")
+	}
+	if err != nil {
+		dlog.Errorf("Can't decrypt segment %d of %s: %s", seg, name, err)
+		return nil, EIO
+	}
+	me.mtx.Lock()
+	obj.aeads[seg] = aead
+	me.mtx.Unlock()
+	return aead, 0
+}
+
+//objects may be returned in pieces, read until dest is full or the end of the object
+func readFull(ctx context.Context, io FileIOCtx, name string, dest []byte, offset int64) int {
+	total := 0
+	for total < len(dest) {
+		n := io.GetBufferCtx(ctx, name, dest[total:], offset+int64(total))
+		if n < 0 {
+			return n
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+	}
+	return total
+}
+
+func (me *CryptIO) PutBuffer(name string, data []byte) int {
+	return me.PutBufferCtx(context.Background(), name, data)
+}
+
+//the plain text size is saved in meta data, so that listings don't have to compute it
+func (me *CryptIO) PutBufferCtx(ctx context.Context, name string, data []byte) int {
+	io := IOWithContext(me.io)
+	me.Forget(name)
+	ctx = WithObjectMeta(ctx, name, ObjectMeta{META_SIZE: strconv.Itoa(len(data)), META_CRYPT_SIZE: strconv.Itoa(len(data))})
+	if len(data) == 0 {
+		return io.PutBufferCtx(ctx, name, data)
+	}
+
+	var buf []byte
+	id, err := NewFileID()
+	if err == nil {
+		buf, err = me.key.Encrypt(make([]byte, 0, CryptCipherSize(int64(len(data)))), id, 0, data, true)
+	}
+	if err != nil {
+		dlog.Errorf("Failed to encrypt %s: %s", name, err)
+		return EIO
+	}
+	rc := io.PutBufferCtx(ctx, name, buf)
+	if rc > 0 {
+		return len(data)
+	}
+	return rc
+}
+
+func (me *CryptIO) GetBuffer(name string, dest []byte, offset int64) int {
+	return me.GetBufferCtx(context.Background(), name, dest, offset)
+}
+
+//only the chunks covering the range are read and decrypted
+//a cached object may be outdated if it's written by another client, it's loaded again once
+func (me *CryptIO) GetBufferCtx(ctx context.Context, name string, dest []byte, offset int64) int {
+	n := me.getBuffer(ctx, name, dest, offset)
+	if n == EIO {
+		me.Forget(name)
+		n = me.getBuffer(ctx, name, dest, offset)
+	}
+	return n
+}
+
+func (me *CryptIO) getBuffer(ctx context.Context, name string, dest []byte, offset int64) int {
+	if len(dest) == 0 {
+		return 0
+	}
+	obj, ok := me.object(ctx, name)
+	if ok < 0 {
+		return ok
+	}
+	if obj.plain {
+		return IOWithContext(me.io).GetBufferCtx(ctx, name, dest, offset)
+	}
+	size := CryptPlainSize(obj.size)
+	if offset >= size {
+		return 0
+	}
+	if int64(len(dest)) > size-offset {
+		dest = dest[:size-offset]
+	}
+
+	copied := 0
+	for copied < len(dest) {
+		pos := offset + int64(copied)
+		seg := pos / CRYPT_SEGMENT_SIZE
+		segSize := size - seg*CRYPT_SEGMENT_SIZE
+		if segSize > CRYPT_SEGMENT_SIZE {
+			segSize = CRYPT_SEGMENT_SIZE
+		}
+		n := me.readSegment(ctx, name, obj, seg, segSize, seg*CRYPT_SEGMENT_SIZE+segSize == size, dest[copied:], pos-seg*CRYPT_SEGMENT_SIZE)
+		if n < 0 {
+			return n
+		}
+		copied += n
+	}
+	return copied
+}
+
+//read from a segment with size bytes of plain text, until dest is full or the end of the segment
+//end tells whether the segment ends the object
+func (me *CryptIO) readSegment(ctx context.Context, name string, obj *cryptObject, seg int64, size int64, end bool, dest []byte, offset int64) int {
+	aead, ok := me.segmentKey(ctx, name, obj, seg)
+	if ok < 0 {
+		return ok
+	}
+	if int64(len(dest)) > size-offset {
+		dest = dest[:size-offset]
+	}
+	first := offset / CRYPT_CHUNK_SIZE
+	last := (offset + int64(len(dest)) - 1) / CRYPT_CHUNK_SIZE
+	chunks := (size + CRYPT_CHUNK_SIZE - 1) / CRYPT_CHUNK_SIZE
+	lastSize := size - last*CRYPT_CHUNK_SIZE
+	if lastSize > CRYPT_CHUNK_SIZE {
+		lastSize = CRYPT_CHUNK_SIZE
+	}
+	buf := make([]byte, (last-first)*cryptChunkStride+CRYPT_CHUNK_OVERHEAD+lastSize)
+	n := readFull(ctx, IOWithContext(me.io), name, buf, seg*cryptSegmentStride+CRYPT_HEADER_SIZE+first*cryptChunkStride)
+	if n < 0 {
+		return n
+	}
+	if n < len(buf) {
+		dlog.Errorf("Failed to decrypt segment %d of %s: truncated", seg, name)
+		return EIO
+	}
+
+	copied := 0
+	skip := int(offset - first*CRYPT_CHUNK_SIZE)
+	chunk := make([]byte, 0, CRYPT_CHUNK_SIZE)
+	for index := first; index <= last; index++ {
+		m := len(buf)
+		if m > cryptChunkStride {
+			m = cryptChunkStride
+		}
+		final := index == chunks-1
+		data, err := openChunk(aead, chunkAD(obj.id, seg, index, final, final && end), buf[:m], chunk[:0])
+		if err != nil {
+			dlog.Errorf("Failed to decrypt chunk %d of segment %d of %s: %s", index, seg, name, err)
+			return EIO
+		}
+		buf = buf[m:]
+		copied += copy(dest[copied:], data[skip:])
+		skip = 0
+	}
+	return copied
+}
+
+//plain text sizes are computed from object sizes
+//objects in plain text are told by their headers, when they are allowed
+func (me *CryptIO) plainInfo(ctx context.Context, name string, fi os.FileInfo) os.FileInfo {
+	di, ok := fi.(*DirItem)
+	if !ok || di == nil || di.DiType != S_IFREG {
+		return fi
+	}
+	if me.key.plain {
+		if obj, ok := me.open(ctx, name, di.DiSize, di.DiMeta); ok < 0 || obj.plain {
+			return fi
+		}
+	}
+	plain := *di
+	CryptPlainAttr(&plain)
+	return &plain
+}
+
+func (me *CryptIO) GetAttr(path string) (os.FileInfo, int) {
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+func (me *CryptIO) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	fi, ok := IOWithContext(me.io).GetAttrCtx(ctx, path)
+	if ok < 0 {
+		return fi, ok
+	}
+	return me.plainInfo(ctx, path, fi), ok
+}
+
+func (me *CryptIO) ListFile(path string) ([]os.FileInfo, int) {
+	return me.ListFileCtx(context.Background(), path)
+}
+
+func (me *CryptIO) ListFileCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
+	fis, ok := IOWithContext(me.io).ListFileCtx(ctx, path)
+	prefix := strings.Trim(path, "/")
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	for i, fi := range fis {
+		if fi != nil {
+			fis[i] = me.plainInfo(ctx, prefix+GetLastPathComp(fi.Name()), fi)
+		}
+	}
+	return fis, ok
+}
+
+func (me *CryptIO) ZeroFile(name string) int {
+	return me.ZeroFileCtx(context.Background(), name)
+}
+
+func (me *CryptIO) ZeroFileCtx(ctx context.Context, name string) int {
+	me.Forget(name)
+	return IOWithContext(me.io).ZeroFileCtx(ctx, name)
+}
+
+func (me *CryptIO) Unlink(path string) int {
+	return me.UnlinkCtx(context.Background(), path)
+}
+
+func (me *CryptIO) UnlinkCtx(ctx context.Context, path string) int {
+	me.Forget(path)
+	return IOWithContext(me.io).UnlinkCtx(ctx, path)
+}
+
+func (me *CryptIO) GetMeta(name string) (ObjectMeta, int) {
+	return me.GetMetaCtx(context.Background(), name)
+}
+
+func (me *CryptIO) GetMetaCtx(ctx context.Context, name string) (ObjectMeta, int) {
+	return IOWithContext(me.io).GetMetaCtx(ctx, name)
+}
+
+func (me *CryptIO) SetMeta(name string, meta ObjectMeta) int {
+	return me.SetMetaCtx(context.Background(), name, meta)
+}
+
+func (me *CryptIO) SetMetaCtx(ctx context.Context, name string, meta ObjectMeta) int {
+	return IOWithContext(me.io).SetMetaCtx(ctx, name, meta)
+}
@@ -0,0 +1,298 @@
+package fscommon
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//objects in memory, meta data added to writes is saved with them
+type memIO struct {
+	objects map[string][]byte
+	metas   map[string]ObjectMeta
+	mtx     sync.Mutex
+}
+
+func newMemIO() *memIO {
+	return &memIO{objects: make(map[string][]byte), metas: make(map[string]ObjectMeta)}
+}
+
+func (me *memIO) PutBufferCtx(ctx context.Context, name string, data []byte) int {
+	name = strings.TrimPrefix(name, "/")
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	me.objects[name] = append([]byte(nil), data...)
+	me.metas[name] = ObjectMetaOf(ctx, name)
+	return len(data)
+}
+
+func (me *memIO) GetBufferCtx(ctx context.Context, name string, dest []byte, offset int64) int {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	data, ok := me.objects[strings.TrimPrefix(name, "/")]
+	if !ok {
+		return ENOENT
+	}
+	if offset >= int64(len(data)) {
+		return 0
+	}
+	return copy(dest, data[offset:])
+}
+
+func (me *memIO) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	name := strings.TrimPrefix(path, "/")
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	data, ok := me.objects[name]
+	if !ok {
+		return nil, ENOENT
+	}
+	return &DirItem{DiName: GetLastPathComp(name), DiSize: int64(len(data)), DiType: S_IFREG,
+		DiMeta: make(ObjectMeta).Merge(me.metas[name])}, 0
+}
+
+func (me *memIO) ListFileCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
+	prefix := strings.Trim(path, "/") + "/"
+	me.mtx.Lock()
+	var names []string
+	for name := range me.objects {
+		if strings.HasPrefix(name, prefix) && !strings.Contains(name[len(prefix):], "/") {
+			names = append(names, name)
+		}
+	}
+	me.mtx.Unlock()
+	var fis []os.FileInfo
+	for _, name := range names {
+		fi, _ := me.GetAttrCtx(ctx, name)
+		fis = append(fis, fi)
+	}
+	return fis, 0
+}
+
+func (me *memIO) ZeroFileCtx(ctx context.Context, name string) int {
+	return me.PutBufferCtx(ctx, name, nil)
+}
+
+func (me *memIO) UnlinkCtx(ctx context.Context, path string) int {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	delete(me.objects, strings.TrimPrefix(path, "/"))
+	return 0
+}
+
+func (me *memIO) GetMetaCtx(ctx context.Context, name string) (ObjectMeta, int) {
+	fi, ok := me.GetAttrCtx(ctx, name)
+	if ok < 0 {
+		return nil, ok
+	}
+	return fi.(*DirItem).DiMeta, 0
+}
+
+func (me *memIO) SetMetaCtx(ctx context.Context, name string, meta ObjectMeta) int {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	name = strings.TrimPrefix(name, "/")
+	me.metas[name] = make(ObjectMeta).Merge(me.metas[name]).Merge(meta).Compact()
+	return 0
+}
+
+func (me *memIO) PutBuffer(name string, data []byte) int {
+	return me.PutBufferCtx(context.Background(), name, data)
+}
+
+func (me *memIO) GetBuffer(name string, dest []byte, offset int64) int {
+	return me.GetBufferCtx(context.Background(), name, dest, offset)
+}
+
+func (me *memIO) GetAttr(path string) (os.FileInfo, int) {
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+func (me *memIO) ListFile(path string) ([]os.FileInfo, int) {
+	return me.ListFileCtx(context.Background(), path)
+}
+
+func (me *memIO) ZeroFile(name string) int {
+	return me.ZeroFileCtx(context.Background(), name)
+}
+
+func (me *memIO) Unlink(path string) int {
+	return me.UnlinkCtx(context.Background(), path)
+}
+
+func (me *memIO) GetMeta(name string) (ObjectMeta, int) {
+	return me.GetMetaCtx(context.Background(), name)
+}
+
+func (me *memIO) SetMeta(name string, meta ObjectMeta) int {
+	return me.SetMetaCtx(context.Background(), name, meta)
+}
+
+func randomData(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func testCryptKey(t *testing.T) *CryptKey {
+	key, err := NewCryptKey(bytes.Repeat([]byte{7}, CRYPT_KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+//read ranges across chunks and segments, and compare them with data
+func checkRanges(t *testing.T, io FileIO, name string, data []byte, ranges [][2]int) {
+	for _, r := range ranges {
+		dest := make([]byte, r[1])
+		n := io.GetBuffer(name, dest, int64(r[0]))
+		end := r[0] + r[1]
+		if end > len(data) {
+			end = len(data)
+		}
+		if n != end-r[0] || !bytes.Equal(dest[:n], data[r[0]:end]) {
+			t.Fatalf("read %d bytes at %d of %s: n = %d, data mismatch", r[1], r[0], name, n)
+		}
+	}
+}
+
+func TestCryptSizes(t *testing.T) {
+	key := testCryptKey(t)
+	for _, n := range []int64{0, 1, CRYPT_CHUNK_SIZE - 1, CRYPT_CHUNK_SIZE, CRYPT_CHUNK_SIZE + 1,
+		CRYPT_SEGMENT_SIZE - 1, CRYPT_SEGMENT_SIZE, CRYPT_SEGMENT_SIZE + 1, 2*CRYPT_SEGMENT_SIZE + CRYPT_CHUNK_SIZE} {
+		buf, err := key.Encrypt(nil, make([]byte, CRYPT_ID_SIZE), 0, make([]byte, n), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(buf)) != CryptCipherSize(n) {
+			t.Errorf("CryptCipherSize(%d) = %d, encrypted size = %d", n, CryptCipherSize(n), len(buf))
+		}
+		if CryptPlainSize(int64(len(buf))) != n {
+			t.Errorf("CryptPlainSize(%d) = %d, expected %d", len(buf), CryptPlainSize(int64(len(buf))), n)
+		}
+	}
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	mem := newMemIO()
+	cio := NewCryptIO(mem, testCryptKey(t))
+	data := randomData(2*CRYPT_SEGMENT_SIZE+3*CRYPT_CHUNK_SIZE+100, 1)
+	if n := cio.PutBuffer("/a/b", data); n != len(data) {
+		t.Fatalf("PutBuffer: %d", n)
+	}
+	if size := mem.metas["a/b"][META_CRYPT_SIZE]; size != strconv.Itoa(len(data)) {
+		t.Fatalf("size in meta data: %s", size)
+	}
+	fi, ok := cio.GetAttr("/a/b")
+	if ok < 0 || fi.Size() != int64(len(data)) {
+		t.Fatalf("GetAttr: %d, size = %d", ok, fi.Size())
+	}
+	checkRanges(t, cio, "/a/b", data, [][2]int{
+		{0, len(data)},
+		{CRYPT_CHUNK_SIZE - 10, 20},
+		{CRYPT_SEGMENT_SIZE - 10, 20},
+		{CRYPT_SEGMENT_SIZE - CRYPT_CHUNK_SIZE, 2*CRYPT_SEGMENT_SIZE + CRYPT_CHUNK_SIZE},
+		{len(data) - 50, 100},
+		{len(data), 10},
+	})
+
+	//whole segments are kept when the object is assembled again, like by multipart copies of an append
+	id, ok := cio.FileID(context.Background(), "a/b")
+	if ok < 0 || len(id) != CRYPT_ID_SIZE {
+		t.Fatalf("FileID: %d", ok)
+	}
+	second, err := cio.Key().Encrypt(nil, id, 1, data[CRYPT_SEGMENT_SIZE:], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.objects["a/b"] = append(append([]byte(nil), mem.objects["a/b"][:CryptCipherSize(CRYPT_SEGMENT_SIZE)]...), second...)
+	cio.Forget("a/b")
+	checkRanges(t, cio, "a/b", data, [][2]int{{0, len(data)}, {CRYPT_SEGMENT_SIZE - 10, 20}})
+}
+
+func TestCryptTampered(t *testing.T) {
+	mem := newMemIO()
+	key := testCryptKey(t)
+	cio := NewCryptIO(mem, key)
+	data := randomData(3*CRYPT_CHUNK_SIZE, 2)
+	cio.PutBuffer("a", data)
+	obj := mem.objects["a"]
+
+	//a segment truncated at a chunk boundary
+	mem.objects["a"] = obj[:CRYPT_HEADER_SIZE+2*cryptChunkStride]
+	cio.Forget("a")
+	if n := cio.GetBuffer("a", make([]byte, 10), CRYPT_CHUNK_SIZE); n != EIO {
+		t.Errorf("read of a truncated object: %d, expected EIO", n)
+	}
+
+	//chunks in another order
+	swapped := append([]byte(nil), obj...)
+	copy(swapped[CRYPT_HEADER_SIZE:], obj[CRYPT_HEADER_SIZE+cryptChunkStride:CRYPT_HEADER_SIZE+2*cryptChunkStride])
+	copy(swapped[CRYPT_HEADER_SIZE+cryptChunkStride:], obj[CRYPT_HEADER_SIZE:CRYPT_HEADER_SIZE+cryptChunkStride])
+	mem.objects["a"] = swapped
+	cio.Forget("a")
+	if n := cio.GetBuffer("a", make([]byte, 10), 0); n != EIO {
+		t.Errorf("read of reordered chunks: %d, expected EIO", n)
+	}
+}
+
+func TestCryptSegmentsTampered(t *testing.T) {
+	mem := newMemIO()
+	cio := NewCryptIO(mem, testCryptKey(t))
+	data := randomData(3*CRYPT_SEGMENT_SIZE, 3)
+	cio.PutBuffer("a", data)
+	cio.PutBuffer("b", data)
+	obj, other := mem.objects["a"], mem.objects["b"]
+	stride := int(cryptSegmentStride)
+
+	tampered := map[string][]byte{
+		//the last segment dropped, meta data of the size is dropped too
+		"truncated": obj[:2*stride],
+		//segments in another order
+		"reordered": append(append(append([]byte(nil), obj[stride:2*stride]...), obj[:stride]...), obj[2*stride:]...),
+		//a segment of another file at the same position
+		"spliced": append(append(append([]byte(nil), obj[:stride]...), other[stride:2*stride]...), obj[2*stride:]...),
+	}
+	for name, buf := range tampered {
+		mem.objects["a"] = buf
+		delete(mem.metas, "a")
+		cio.Forget("a")
+		dest := make([]byte, len(data))
+		if n := cio.GetBuffer("a", dest, 0); n != EIO {
+			t.Errorf("read of %s segments: %d, expected EIO", name, n)
+		}
+	}
+
+	//the size in meta data doesn't match
+	mem.objects["a"] = obj[:2*stride]
+	mem.metas["a"] = ObjectMeta{META_CRYPT_SIZE: strconv.Itoa(len(data))}
+	cio.Forget("a")
+	if n := cio.GetBuffer("a", make([]byte, 10), 0); n != EIO {
+		t.Errorf("read of a truncated object with its size in meta data: %d, expected EIO", n)
+	}
+}
+
+func TestCryptPlain(t *testing.T) {
+	mem := newMemIO()
+	key := testCryptKey(t)
+	data := []byte("written without encryption")
+	mem.PutBuffer("a", data)
+
+	cio := NewCryptIO(mem, key)
+	if n := cio.GetBuffer("a", make([]byte, 100), 0); n != EIO {
+		t.Fatalf("read of an object in plain text: %d, expected EIO", n)
+	}
+
+	key.AllowPlain(true)
+	cio = NewCryptIO(mem, key)
+	checkRanges(t, cio, "a", data, [][2]int{{0, 100}, {5, 3}})
+	if fi, ok := cio.GetAttr("a"); ok < 0 || fi.Size() != int64(len(data)) {
+		t.Fatalf("GetAttr of an object in plain text: %d, size = %d", ok, fi.Size())
+	}
+}
@@ -0,0 +1,82 @@
+package fscommon
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+//meta data which describes the data of an object rather than the file, e.g. checksums and sizes
+//it's dropped when the object is written again, and kept when other meta data is updated
+//wrappers of FileIO pass it to drivers with the context of a write, see WithObjectMeta
+const (
+	META_SIZE = "size" //size of file data, for objects which are stored in another size, e.g. encrypted
+)
+
+var dataMetaKeys = []string{META_CHECKSUM, META_SIZE, META_CRYPT_SIZE}
+
+//remove meta data of the old data before the object is written again
+func (me ObjectMeta) DropDataMeta() ObjectMeta {
+	for _, key := range dataMetaKeys {
+		delete(me, key)
+	}
+	return me
+}
+
+//keep meta data of the data from src, when other meta data of the object is replaced
+func (me ObjectMeta) KeepDataMeta(src ObjectMeta) ObjectMeta {
+	for _, key := range dataMetaKeys {
+		if val, ok := src[key]; ok {
+			me[key] = val
+		} else {
+			delete(me, key)
+		}
+	}
+	return me
+}
+
+//size of file data saved with the object, see META_SIZE
+func (me *DirItem) DataSize() (int64, bool) {
+	val, ok := me.DiMeta[META_SIZE]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+type objectMetaKey struct{}
+
+type objectMetaCtx struct {
+	name   string
+	meta   ObjectMeta
+	parent *objectMetaCtx
+}
+
+//add meta data of the object name to a write with the context
+//keys added by outer wrappers are kept, e.g. the size of file data is set by the outermost wrapper
+func WithObjectMeta(ctx context.Context, name string, meta ObjectMeta) context.Context {
+	parent, _ := ctx.Value(objectMetaKey{}).(*objectMetaCtx)
+	return context.WithValue(ctx, objectMetaKey{}, &objectMetaCtx{name: strings.TrimPrefix(name, "/"), meta: meta, parent: parent})
+}
+
+//meta data added to a write of the object name, nil if there is not any
+func ObjectMetaOf(ctx context.Context, name string) ObjectMeta {
+	name = strings.TrimPrefix(name, "/")
+	var md ObjectMeta
+	for mc, _ := ctx.Value(objectMetaKey{}).(*objectMetaCtx); mc != nil; mc = mc.parent {
+		if mc.name != name {
+			continue
+		}
+		if md == nil {
+			md = make(ObjectMeta)
+		}
+		md.Merge(mc.meta)
+	}
+	return md
+}
@@ -0,0 +1,652 @@
+package fscommon
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//deduplication of file data by content-defined chunking
+//a file is split into chunks at positions given by a rolling hash of its content, so that an insert or
+//a change only affects the chunks around it, chunks are stored once under DEDUP_CHUNK_PREFIX by their hashes
+//the file object keeps a manifest of its chunks instead of the data, it replaces the $slice$ layout
+//manifest layout: header | entry 0 | entry 1 | ...
+//header has the magic and file size, an entry has the hash and size of a chunk
+//an empty object has no header, an object without the magic is read as it is
+//each chunk has a reference count in an object next to it, references are added before a manifest is saved
+//and released after it's replaced or deleted, so a failure may leak chunks but never drops a chunk in use
+//reference counts are updated under locks of the process, a bucket in dedup mode should be written by one mount
+//with client-side encryption, chunk hashes are keyed by the master key, so they don't leak the content
+const (
+	DEDUP_MAGIC        = "CSD1"
+	DEDUP_CHUNK_PREFIX = "$chunk$/"
+	DEDUP_HEADER_SIZE  = 16
+	DEDUP_ENTRY_SIZE   = sha256.Size + 4
+
+	DEDUP_MIN_CHUNK = 512 * 1024
+	DEDUP_MAX_CHUNK = 4 * 1024 * 1024
+
+	dedupMask = 1<<20 - 1 //average chunk is about 1M over the minimum
+)
+
+//random values of bytes for the gear hash, they must never change, or chunks are not shared any more
+var dedupGear [256]uint64
+
+//reference counts of chunks are updated under these locks, by the first byte of hashes
+var dedupLocks [256]sync.Mutex
+
+func init() {
+	//splitmix64 with a fixed seed
+	seed := uint64(0x6373676d72646564)
+	for i := range dedupGear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		dedupGear[i] = z ^ (z >> 31)
+	}
+}
+
+//length of the first chunk of data
+func dedupChunkLen(data []byte) int {
+	if len(data) <= DEDUP_MIN_CHUNK {
+		return len(data)
+	}
+	end := len(data)
+	if end > DEDUP_MAX_CHUNK {
+		end = DEDUP_MAX_CHUNK
+	}
+	var h uint64
+	for i := DEDUP_MIN_CHUNK; i < end; i++ {
+		h = (h << 1) + dedupGear[data[i]]
+		if h&dedupMask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
+
+type dedupChunk struct {
+	hash [sha256.Size]byte
+	size int64
+}
+
+type dedupManifest struct {
+	size    int64
+	chunks  []dedupChunk
+	offsets []int64 //of chunks in the file, with the file size at the end
+}
+
+func newDedupManifest(chunks []dedupChunk) *dedupManifest {
+	me := &dedupManifest{chunks: chunks, offsets: make([]int64, len(chunks)+1)}
+	for i, c := range chunks {
+		me.offsets[i+1] = me.offsets[i] + c.size
+	}
+	me.size = me.offsets[len(chunks)]
+	return me
+}
+
+func (me *dedupManifest) encode() []byte {
+	buf := make([]byte, DEDUP_HEADER_SIZE+len(me.chunks)*DEDUP_ENTRY_SIZE)
+	copy(buf, DEDUP_MAGIC)
+	binary.BigEndian.PutUint64(buf[8:], uint64(me.size))
+	entry := buf[DEDUP_HEADER_SIZE:]
+	for _, c := range me.chunks {
+		copy(entry, c.hash[:])
+		binary.BigEndian.PutUint32(entry[sha256.Size:], uint32(c.size))
+		entry = entry[DEDUP_ENTRY_SIZE:]
+	}
+	return buf
+}
+
+//nil if it's not a manifest
+func decodeDedupManifest(buf []byte) *dedupManifest {
+	if len(buf) < DEDUP_HEADER_SIZE || string(buf[:4]) != DEDUP_MAGIC || (len(buf)-DEDUP_HEADER_SIZE)%DEDUP_ENTRY_SIZE != 0 {
+		return nil
+	}
+	chunks := make([]dedupChunk, (len(buf)-DEDUP_HEADER_SIZE)/DEDUP_ENTRY_SIZE)
+	entry := buf[DEDUP_HEADER_SIZE:]
+	for i := range chunks {
+		copy(chunks[i].hash[:], entry)
+		chunks[i].size = int64(binary.BigEndian.Uint32(entry[sha256.Size:]))
+		entry = entry[DEDUP_ENTRY_SIZE:]
+	}
+	me := newDedupManifest(chunks)
+	if me.size != int64(binary.BigEndian.Uint64(buf[8:])) {
+		return nil
+	}
+	return me
+}
+
+func dedupChunkName(hash [sha256.Size]byte) string {
+	return DEDUP_CHUNK_PREFIX + hex.EncodeToString(hash[:])
+}
+
+//only file objects are deduplicated, helper objects are stored as they are
+func dedupFile(name string) bool {
+	_, helper := helperFile(name)
+	return !helper
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//FileIO wrapper which stores files as manifests of deduplicated chunks
+//it goes outside CompressIO and CryptIO, manifests and chunks are compressed and encrypted as other objects
+//chunks of a deleted file are released by the file system, see DedupRefs
+type DedupIO struct {
+	io      FileIO
+	hashKey []byte //nil for SHA-256 of chunks
+
+	manifests map[string]*dedupManifest //nil for objects which are not manifests
+	mtx       sync.Mutex
+}
+
+//key is the master key of client-side encryption, nil if it's off
+func NewDedupIO(io FileIO, key *CryptKey) *DedupIO {
+	me := &DedupIO{io: io, manifests: make(map[string]*dedupManifest)}
+	if key != nil {
+		me.hashKey = key.dedup
+	}
+	return me
+}
+
+//the wrapped FileIO, for driver specific operations
+func (me *DedupIO) Base() FileIO {
+	return me.io
+}
+
+//drop the cached manifest of an object
+func (me *DedupIO) Forget(name string) {
+	me.mtx.Lock()
+	delete(me.manifests, name)
+	me.mtx.Unlock()
+}
+
+func (me *DedupIO) sum(data []byte) [sha256.Size]byte {
+	var h hash.Hash
+	if me.hashKey != nil {
+		h = hmac.New(sha256.New, me.hashKey)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(data)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+//load a whole object, the manifest is nil if it's not one, size is the size of the object
+func (me *DedupIO) loadManifest(ctx context.Context, name string) (*dedupManifest, int64, int) {
+	io := IOWithContext(me.io)
+	fi, rc := io.GetAttrCtx(ctx, name)
+	if rc < 0 {
+		return nil, 0, rc
+	}
+	size := fi.Size()
+	if size < DEDUP_HEADER_SIZE {
+		return nil, size, 0
+	}
+	header := make([]byte, DEDUP_HEADER_SIZE)
+	n := readFull(ctx, io, name, header, 0)
+	if n < 0 {
+		return nil, 0, n
+	}
+	if n < DEDUP_HEADER_SIZE || string(header[:4]) != DEDUP_MAGIC {
+		return nil, size, 0
+	}
+
+	buf := make([]byte, size)
+	if n = readFull(ctx, io, name, buf, 0); n != len(buf) {
+		if n >= 0 {
+			n = EIO
+		}
+		return nil, 0, n
+	}
+	m := decodeDedupManifest(buf)
+	if m == nil {
+		dlog.Errorf("Invalid chunk manifest of %s", name)
+		return nil, 0, EIO
+	}
+	return m, size, 0
+}
+
+//cached manifest for reads
+func (me *DedupIO) manifest(ctx context.Context, name string) (*dedupManifest, int) {
+	me.mtx.Lock()
+	m, ok := me.manifests[name]
+	me.mtx.Unlock()
+	if ok {
+		return m, 0
+	}
+	m, _, rc := me.loadManifest(ctx, name)
+	if rc < 0 {
+		return nil, rc
+	}
+	me.mtx.Lock()
+	me.manifests[name] = m
+	me.mtx.Unlock()
+	return m, 0
+}
+
+//the file size is saved in meta data too, see META_SIZE
+func (me *DedupIO) saveManifest(ctx context.Context, name string, m *dedupManifest) int {
+	me.Forget(name)
+	ctx = WithObjectMeta(ctx, name, ObjectMeta{META_SIZE: strconv.FormatInt(m.size, 10)})
+	rc := IOWithContext(me.io).PutBufferCtx(ctx, name, m.encode())
+	if rc < 0 {
+		return rc
+	}
+	me.mtx.Lock()
+	me.manifests[name] = m
+	me.mtx.Unlock()
+	return 0
+}
+
+func (me *DedupIO) refCount(ctx context.Context, hash [sha256.Size]byte) (int64, int) {
+	buf := make([]byte, 20)
+	n := IOWithContext(me.io).GetBufferCtx(ctx, dedupChunkName(hash)+".ref", buf, 0)
+	if n == ENOENT {
+		return 0, 0
+	}
+	if n < 0 {
+		return 0, n
+	}
+	count, err := strconv.ParseInt(strings.TrimSpace(string(buf[:n])), 10, 64)
+	if err != nil {
+		dlog.Errorf("Invalid reference count of chunk %s: %s", dedupChunkName(hash), err)
+		return 0, EIO
+	}
+	return count, 0
+}
+
+//add count references to a chunk, it's uploaded if it's not referenced yet
+func (me *DedupIO) ref(ctx context.Context, hash [sha256.Size]byte, data []byte, count int64) int {
+	io := IOWithContext(me.io)
+	name := dedupChunkName(hash)
+	dedupLocks[hash[0]].Lock()
+	defer dedupLocks[hash[0]].Unlock()
+
+	n, rc := me.refCount(ctx, hash)
+	if rc < 0 {
+		return rc
+	}
+	if n <= 0 {
+		if rc := io.PutBufferCtx(ctx, name, data); rc < 0 {
+			return rc
+		}
+	}
+	if rc := io.PutBufferCtx(ctx, name+".ref", []byte(strconv.FormatInt(n+count, 10))); rc < 0 {
+		return rc
+	}
+	return 0
+}
+
+//release count references of a chunk, it's deleted with the last one
+func (me *DedupIO) unref(ctx context.Context, hash [sha256.Size]byte, count int64) int {
+	io := IOWithContext(me.io)
+	name := dedupChunkName(hash)
+	dedupLocks[hash[0]].Lock()
+	defer dedupLocks[hash[0]].Unlock()
+
+	n, rc := me.refCount(ctx, hash)
+	if rc < 0 {
+		return rc
+	}
+	if n > count {
+		return io.PutBufferCtx(ctx, name+".ref", []byte(strconv.FormatInt(n-count, 10)))
+	}
+	if rc := io.UnlinkCtx(ctx, name); rc < 0 && rc != ENOENT {
+		return rc
+	}
+	if rc := io.UnlinkCtx(ctx, name+".ref"); rc < 0 && rc != ENOENT {
+		return rc
+	}
+	return 0
+}
+
+//split data into chunks and add references to them, chunks repeated in data are referenced once per use
+func (me *DedupIO) storeChunks(ctx context.Context, data []byte) ([]dedupChunk, int) {
+	var chunks []dedupChunk
+	first := make(map[[sha256.Size]byte][]byte)
+	counts := make(map[[sha256.Size]byte]int64)
+	for len(data) > 0 {
+		n := dedupChunkLen(data)
+		c := dedupChunk{hash: me.sum(data[:n]), size: int64(n)}
+		if _, ok := first[c.hash]; !ok {
+			first[c.hash] = data[:n]
+		}
+		counts[c.hash]++
+		chunks = append(chunks, c)
+		data = data[n:]
+	}
+
+	added := make([]dedupChunk, 0, len(counts))
+	for hash, count := range counts {
+		if rc := me.ref(ctx, hash, first[hash], count); rc < 0 {
+			//references added so far are released
+			for _, c := range added {
+				me.unref(ctx, c.hash, counts[c.hash])
+			}
+			return nil, rc
+		}
+		added = append(added, dedupChunk{hash: hash})
+	}
+	return chunks, 0
+}
+
+//release references of chunks, failures are logged, the chunks leak then
+func (me *DedupIO) releaseChunks(ctx context.Context, chunks []dedupChunk) {
+	counts := make(map[[sha256.Size]byte]int64)
+	for _, c := range chunks {
+		counts[c.hash]++
+	}
+	for hash, count := range counts {
+		if rc := me.unref(ctx, hash, count); rc < 0 {
+			dlog.Warnf("Failed to release chunk %s: %d", dedupChunkName(hash), rc)
+		}
+	}
+}
+
+func (me *DedupIO) PutBuffer(name string, data []byte) int {
+	return me.PutBufferCtx(context.Background(), name, data)
+}
+
+//chunks of the old data are released after the new manifest is saved
+func (me *DedupIO) PutBufferCtx(ctx context.Context, name string, data []byte) int {
+	io := IOWithContext(me.io)
+	me.Forget(name)
+	if !dedupFile(name) {
+		return io.PutBufferCtx(ctx, name, data)
+	}
+
+	old, _, rc := me.loadManifest(ctx, name)
+	if rc < 0 && rc != ENOENT {
+		return rc
+	}
+	if len(data) == 0 {
+		rc = io.PutBufferCtx(ctx, name, data)
+	} else {
+		chunks, ok := me.storeChunks(ctx, data)
+		if ok < 0 {
+			return ok
+		}
+		if rc = me.saveManifest(ctx, name, newDedupManifest(chunks)); rc < 0 {
+			me.releaseChunks(ctx, chunks)
+		}
+	}
+	if rc < 0 {
+		return rc
+	}
+	if old != nil {
+		me.releaseChunks(ctx, old.chunks)
+	}
+	return len(data)
+}
+
+func (me *DedupIO) Append(name string, data []byte) int {
+	return me.AppendCtx(context.Background(), name, data)
+}
+
+//append data to a file, only the last chunk is read and split again with data
+//an object which is not a manifest is converted to one
+func (me *DedupIO) AppendCtx(ctx context.Context, name string, data []byte) int {
+	io := IOWithContext(me.io)
+	m, size, rc := me.loadManifest(ctx, name)
+	if rc < 0 && rc != ENOENT {
+		return rc
+	}
+	if m == nil && size > 0 {
+		buf := make([]byte, size, size+int64(len(data)))
+		if n := readFull(ctx, io, name, buf, 0); n != len(buf) {
+			if n >= 0 {
+				n = EIO
+			}
+			return n
+		}
+		if rc := me.PutBufferCtx(ctx, name, append(buf, data...)); rc < 0 {
+			return rc
+		}
+		return len(data)
+	}
+	if m == nil {
+		m = newDedupManifest(nil)
+	}
+
+	keep := m.chunks
+	tail := data
+	if len(keep) > 0 {
+		last := keep[len(keep)-1]
+		keep = keep[:len(keep)-1]
+		tail = make([]byte, last.size, last.size+int64(len(data)))
+		if n := readFull(ctx, io, dedupChunkName(last.hash), tail, 0); n != len(tail) {
+			if n >= 0 || n == ENOENT {
+				dlog.Errorf("Chunk %s of %s is missing or truncated", dedupChunkName(last.hash), name)
+				n = EIO
+			}
+			return n
+		}
+		tail = append(tail, data...)
+	}
+
+	added, rc := me.storeChunks(ctx, tail)
+	if rc < 0 {
+		return rc
+	}
+	chunks := make([]dedupChunk, 0, len(keep)+len(added))
+	chunks = append(append(chunks, keep...), added...)
+	if rc := me.saveManifest(ctx, name, newDedupManifest(chunks)); rc < 0 {
+		me.releaseChunks(ctx, added)
+		return rc
+	}
+	me.releaseChunks(ctx, m.chunks[len(keep):])
+	return len(data)
+}
+
+func (me *DedupIO) GetBuffer(name string, dest []byte, offset int64) int {
+	return me.GetBufferCtx(context.Background(), name, dest, offset)
+}
+
+//a cached manifest may be outdated if the file is written by another client, it's loaded again once
+func (me *DedupIO) GetBufferCtx(ctx context.Context, name string, dest []byte, offset int64) int {
+	if !dedupFile(name) {
+		return IOWithContext(me.io).GetBufferCtx(ctx, name, dest, offset)
+	}
+	n := me.getBuffer(ctx, name, dest, offset)
+	if n == EIO {
+		me.Forget(name)
+		n = me.getBuffer(ctx, name, dest, offset)
+	}
+	return n
+}
+
+func (me *DedupIO) getBuffer(ctx context.Context, name string, dest []byte, offset int64) int {
+	io := IOWithContext(me.io)
+	m, rc := me.manifest(ctx, name)
+	if rc < 0 {
+		return rc
+	}
+	if m == nil {
+		return io.GetBufferCtx(ctx, name, dest, offset)
+	}
+
+	//the first chunk covering offset
+	lo, hi := 0, len(m.chunks)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if m.offsets[mid+1] <= offset {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	copied := 0
+	for i := lo; i < len(m.chunks) && copied < len(dest); i++ {
+		start := offset + int64(copied) - m.offsets[i]
+		end := m.chunks[i].size
+		if room := start + int64(len(dest)-copied); room < end {
+			end = room
+		}
+		n := readFull(ctx, io, dedupChunkName(m.chunks[i].hash), dest[copied:copied+int(end-start)], start)
+		if n < 0 && n != ENOENT {
+			return n
+		}
+		if n != int(end-start) {
+			dlog.Errorf("Chunk %s of %s is missing or truncated", dedupChunkName(m.chunks[i].hash), name)
+			return EIO
+		}
+		copied += n
+	}
+	return copied
+}
+
+//set the file size of a manifest, di has the size of the object as it's read through me.io
+//the size saved in meta data is used, the header is read only for manifests written without it
+func (me *DedupIO) fileSize(ctx context.Context, name string, di *DirItem) int {
+	if di.DiType != S_IFREG || di.DiSize < DEDUP_HEADER_SIZE || !dedupFile(name) {
+		return 0
+	}
+	if size, ok := di.DataSize(); ok {
+		di.DiSize = size
+		return 0
+	}
+	header := make([]byte, DEDUP_HEADER_SIZE)
+	n := readFull(ctx, IOWithContext(me.io), name, header, 0)
+	if n < 0 {
+		return n
+	}
+	if n == DEDUP_HEADER_SIZE && string(header[:4]) == DEDUP_MAGIC {
+		di.DiSize = int64(binary.BigEndian.Uint64(header[8:]))
+	}
+	return 0
+}
+
+func (me *DedupIO) plainInfo(ctx context.Context, name string, fi os.FileInfo) (os.FileInfo, int) {
+	di, ok := fi.(*DirItem)
+	if !ok || di == nil {
+		return fi, 0
+	}
+	plain := *di
+	if rc := me.fileSize(ctx, name, &plain); rc < 0 {
+		return nil, rc
+	}
+	return &plain, 0
+}
+
+func (me *DedupIO) GetAttr(path string) (os.FileInfo, int) {
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+//the manifest is loaded again, the file may have been changed
+func (me *DedupIO) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	fi, ok := IOWithContext(me.io).GetAttrCtx(ctx, path)
+	if ok < 0 {
+		return fi, ok
+	}
+	me.Forget(path)
+	return me.plainInfo(ctx, path, fi)
+}
+
+func (me *DedupIO) ListFile(path string) ([]os.FileInfo, int) {
+	return me.ListFileCtx(context.Background(), path)
+}
+
+func (me *DedupIO) ListFileCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
+	fis, ok := IOWithContext(me.io).ListFileCtx(ctx, path)
+	prefix := strings.Trim(path, "/")
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	for i, fi := range fis {
+		if fi == nil {
+			continue
+		}
+		//drivers return either keys or base names
+		name := prefix + GetLastPathComp(fi.Name())
+		me.Forget(name)
+		plain, rc := me.plainInfo(ctx, name, fi)
+		if rc < 0 {
+			return nil, rc
+		}
+		fis[i] = plain
+	}
+	return fis, ok
+}
+
+func (me *DedupIO) ZeroFile(name string) int {
+	return me.ZeroFileCtx(context.Background(), name)
+}
+
+func (me *DedupIO) ZeroFileCtx(ctx context.Context, name string) int {
+	if !dedupFile(name) {
+		me.Forget(name)
+		return IOWithContext(me.io).ZeroFileCtx(ctx, name)
+	}
+	return me.PutBufferCtx(ctx, name, nil)
+}
+
+func (me *DedupIO) Unlink(path string) int {
+	return me.UnlinkCtx(context.Background(), path)
+}
+
+//chunks are not released here, see DedupRefs
+func (me *DedupIO) UnlinkCtx(ctx context.Context, path string) int {
+	me.Forget(path)
+	return IOWithContext(me.io).UnlinkCtx(ctx, path)
+}
+
+func (me *DedupIO) GetMeta(name string) (ObjectMeta, int) {
+	return me.GetMetaCtx(context.Background(), name)
+}
+
+func (me *DedupIO) GetMetaCtx(ctx context.Context, name string) (ObjectMeta, int) {
+	return IOWithContext(me.io).GetMetaCtx(ctx, name)
+}
+
+func (me *DedupIO) SetMeta(name string, meta ObjectMeta) int {
+	return me.SetMetaCtx(context.Background(), name, meta)
+}
+
+func (me *DedupIO) SetMetaCtx(ctx context.Context, name string, meta ObjectMeta) int {
+	return IOWithContext(me.io).SetMetaCtx(ctx, name, meta)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+//references of files to chunks, loaded before the files are deleted and released after that
+//file systems delete file objects on their own, so DedupIO doesn't know when it happens
+type DedupRefs struct {
+	io     *DedupIO
+	chunks []dedupChunk
+}
+
+//add references of a file, objects which are not manifests have none
+func (me *DedupIO) AddRefs(ctx context.Context, refs *DedupRefs, name string) int {
+	if !dedupFile(name) || strings.HasSuffix(name, "/") {
+		return 0
+	}
+	m, _, rc := me.loadManifest(ctx, name)
+	if rc == ENOENT {
+		return 0
+	}
+	if rc < 0 {
+		return rc
+	}
+	me.Forget(name)
+	if m != nil {
+		refs.io = me
+		refs.chunks = append(refs.chunks, m.chunks...)
+	}
+	return 0
+}
+
+func (me *DedupRefs) Release(ctx context.Context) {
+	if me.io != nil {
+		me.io.releaseChunks(ctx, me.chunks)
+	}
+}
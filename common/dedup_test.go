@@ -0,0 +1,102 @@
+package fscommon
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//offsets where data is split into chunks
+func dedupCuts(t *testing.T, data []byte) []int {
+	var cuts []int
+	for off := 0; off < len(data); {
+		n := dedupChunkLen(data[off:])
+		if n < DEDUP_MIN_CHUNK && off+n != len(data) || n > DEDUP_MAX_CHUNK {
+			t.Fatalf("chunk of %d bytes at %d", n, off)
+		}
+		off += n
+		cuts = append(cuts, off)
+	}
+	return cuts
+}
+
+func TestDedupChunks(t *testing.T) {
+	data := randomData(16*1024*1024, 4)
+	cuts := dedupCuts(t, data)
+
+	//chunks after an insert are the same as before
+	shifted := dedupCuts(t, append(randomData(1000, 5), data...))
+	same := make(map[int]bool)
+	for _, off := range cuts {
+		same[off] = true
+	}
+	i := 0
+	for i < len(shifted) && !same[shifted[i]-1000] {
+		i++
+	}
+	if i > 2 {
+		t.Fatalf("chunks don't get in line after an insert: %v, %v", cuts, shifted)
+	}
+	for j := i; j < len(shifted); j++ {
+		if !same[shifted[j]-1000] {
+			t.Fatalf("chunks don't stay in line after an insert: %v, %v", cuts, shifted)
+		}
+	}
+}
+
+func TestDedupManifest(t *testing.T) {
+	m := newDedupManifest([]dedupChunk{{hash: [32]byte{1}, size: 100}, {hash: [32]byte{2}, size: 50}})
+	d := decodeDedupManifest(m.encode())
+	if d == nil || d.size != 150 || len(d.chunks) != 2 || d.chunks[1] != m.chunks[1] || d.offsets[1] != 100 {
+		t.Fatalf("decoded manifest: %+v", d)
+	}
+	buf := m.encode()
+	buf[8] = 1
+	if decodeDedupManifest(buf) != nil {
+		t.Fatal("manifest with a wrong size is decoded")
+	}
+}
+
+func TestDedupRefs(t *testing.T) {
+	mem := newMemIO()
+	dio := NewDedupIO(mem, nil)
+	data := randomData(3*1024*1024, 6)
+	dio.PutBuffer("a", data)
+	dio.PutBuffer("b", data)
+	checkRanges(t, dio, "b", data, [][2]int{{0, len(data)}, {DEDUP_MIN_CHUNK - 10, 20}})
+	if fi, ok := dio.GetAttr("b"); ok < 0 || fi.Size() != int64(len(data)) {
+		t.Fatalf("GetAttr: %d, size = %d", ok, fi.Size())
+	}
+	//listings take the file size from meta data
+	if size := mem.metas["b"][META_SIZE]; size != strconv.Itoa(len(data)) {
+		t.Fatalf("size in meta data: %s", size)
+	}
+
+	chunks := func() (n int) {
+		for name := range mem.objects {
+			if strings.HasPrefix(name, DEDUP_CHUNK_PREFIX) && !strings.HasSuffix(name, ".ref") {
+				n++
+			}
+		}
+		return n
+	}
+	shared := chunks()
+	m, _ := dio.manifest(context.Background(), "a")
+	if shared != len(m.chunks) {
+		t.Fatalf("%d chunks are stored for %d chunks of a file", shared, len(m.chunks))
+	}
+
+	//chunks are released with the last file referring to them
+	for i, name := range []string{"a", "b"} {
+		refs := &DedupRefs{}
+		if rc := dio.AddRefs(context.Background(), refs, name); rc < 0 {
+			t.Fatalf("AddRefs: %d", rc)
+		}
+		mem.Unlink(name)
+		refs.Release(context.Background())
+		if n := chunks(); (i == 0 && n != shared) || (i == 1 && n != 0) {
+			t.Fatalf("%d chunks are left after %s is deleted", n, name)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package fscommon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+//typed error for logging and for front-ends
+//interfaces still return int codes, FsError carries the context of a failure
+type FsError struct {
+	Errno     int    //negative errno, e.g. ENOENT
+	Op        string //operation, e.g. "open", "PutObject"
+	Path      string
+	Err       error //backend error, may be nil
+	Retryable bool  //the operation may succeed if it is retried
+}
+
+var errorStrings = map[int]string{
+	EPERM:        "operation not permitted",
+	ENOENT:       "no such file or directory",
+	EIO:          "input/output error",
+	E2BIG:        "argument list too long",
+	EBADF:        "bad file descriptor",
+	EAGAIN:       "resource temporarily unavailable",
+	ENOMEM:       "cannot allocate memory",
+	EACCES:       "permission denied",
+	EBUSY:        "device or resource busy",
+	EEXIST:       "file exists",
+	EXDEV:        "invalid cross-device link",
+	ENOTDIR:      "not a directory",
+	EISDIR:       "is a directory",
+	EINVAL:       "invalid argument",
+	EFBIG:        "file too large",
+	ENOSPC:       "no space left on device",
+	EROFS:        "read-only file system",
+	ENAMETOOLONG: "file name too long",
+	ENOSYS:       "function not implemented",
+	ENOTEMPTY:    "directory not empty",
+	ENODATA:      "no data available",
+	ENOTSUP:      "operation not supported",
+	ETIMEDOUT:    "connection timed out",
+	ECANCELED:    "operation canceled",
+}
+
+func NewError(errno int, op string, path string, err error) *FsError {
+	return &FsError{
+		Errno:     errno,
+		Op:        op,
+		Path:      path,
+		Err:       err,
+		Retryable: errno == EAGAIN || errno == ETIMEDOUT,
+	}
+}
+
+func ErrorString(errno int) string {
+	if msg, ok := errorStrings[errno]; ok {
+		return msg
+	}
+	return fmt.Sprintf("unknown error %d", errno)
+}
+
+func (me *FsError) Error() string {
+	msg := ErrorString(me.Errno)
+	if len(me.Path) > 0 {
+		msg = me.Path + ": " + msg
+	}
+	if len(me.Op) > 0 {
+		msg = me.Op + " " + msg
+	}
+	if me.Err != nil {
+		msg += ": " + me.Err.Error()
+	}
+	return msg
+}
+
+func (me *FsError) Unwrap() error {
+	return me.Err
+}
+
+//so that errors.Is(err, os.ErrNotExist) works
+func (me *FsError) Is(target error) bool {
+	return target != nil && target == osError(me.Errno)
+}
+
+//standard os error, nil if there is no one for the code
+func osError(errno int) error {
+	switch errno {
+	case ENOENT:
+		return os.ErrNotExist
+	case EEXIST:
+		return os.ErrExist
+	case EPERM, EACCES:
+		return os.ErrPermission
+	case EINVAL:
+		return os.ErrInvalid
+	}
+	return nil
+}
+
+//error for callers which check errors with os.IsNotExist and friends, e.g. webdav
+func (me *FsError) OsError() error {
+	if err := osError(me.Errno); err != nil {
+		return &os.PathError{Op: me.Op, Path: me.Path, Err: err}
+	}
+	return me
+}
+
+func (me *FsError) HttpStatus() int {
+	return HttpStatus(me.Errno)
+}
+
+func (me *FsError) FtpCode() int {
+	return FtpCode(me.Errno)
+}
+
+//convert an int code to error, nil for success
+func ErrorCode(code int) error {
+	if code >= 0 {
+		return nil
+	}
+	return NewError(code, "", "", nil).OsError()
+}
+
+//get errno from an error, EIO for unknown errors
+func ErrnoOf(err error) int {
+	if err == nil {
+		return 0
+	}
+	var fe *FsError
+	if errors.As(err, &fe) {
+		return fe.Errno
+	}
+	switch {
+	case os.IsNotExist(err):
+		return ENOENT
+	case os.IsExist(err):
+		return EEXIST
+	case os.IsPermission(err):
+		return EACCES
+	case os.IsTimeout(err):
+		return ETIMEDOUT
+	}
+	return EIO
+}
+
+func IsRetryable(err error) bool {
+	var fe *FsError
+	if errors.As(err, &fe) {
+		return fe.Retryable
+	}
+	return false
+}
+
+//interfaces return int codes, so drivers report backend errors to the context of an operation
+//the retry layer tells transient failures from permanent ones by the last error reported
+type errorTraceKey struct{}
+
+type ErrorTrace struct {
+	last *FsError
+	mtx  sync.Mutex
+}
+
+func WithErrorTrace(ctx context.Context) (context.Context, *ErrorTrace) {
+	trace := &ErrorTrace{}
+	return context.WithValue(ctx, errorTraceKey{}, trace), trace
+}
+
+//report an error of a backend request, nothing is done if ctx has no trace
+func ReportError(ctx context.Context, fe *FsError) {
+	if trace, ok := ctx.Value(errorTraceKey{}).(*ErrorTrace); ok {
+		trace.mtx.Lock()
+		trace.last = fe
+		trace.mtx.Unlock()
+	}
+}
+
+//the last error reported, nil if there is none
+func (me *ErrorTrace) Last() *FsError {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	return me.last
+}
+
+//HTTP status code for WebDAV responses
+func HttpStatus(errno int) int {
+	switch errno {
+	case OK:
+		return 200
+	case EINVAL:
+		return 400 //Bad Request
+	case EPERM, EACCES, EROFS:
+		return 403 //Forbidden
+	case ENOENT, ENODATA:
+		return 404 //Not Found
+	case EEXIST:
+		return 405 //Method Not Allowed, same as MKCOL on an existing resource
+	case ENOTDIR, EISDIR, ENOTEMPTY, EXDEV:
+		return 409 //Conflict
+	case E2BIG, EFBIG:
+		return 413 //Payload Too Large
+	case ENAMETOOLONG:
+		return 414 //URI Too Long
+	case EBUSY:
+		return 423 //Locked
+	case ENOSYS, ENOTSUP:
+		return 501 //Not Implemented
+	case EAGAIN:
+		return 503 //Service Unavailable
+	case ETIMEDOUT:
+		return 504 //Gateway Timeout
+	case ENOSPC:
+		return 507 //Insufficient Storage
+	}
+	return 500
+}
+
+//FTP reply code, see RFC 959
+func FtpCode(errno int) int {
+	switch errno {
+	case OK:
+		return 250 //Requested file action okay, completed
+	case EAGAIN, ETIMEDOUT:
+		return 421 //Service not available, closing control connection
+	case EBUSY:
+		return 450 //Requested file action not taken, file unavailable
+	case EINVAL:
+		return 501 //Syntax error in parameters or arguments
+	case ENOSYS, ENOTSUP:
+		return 502 //Command not implemented
+	case ENOENT, EPERM, EACCES, ENOTDIR, EISDIR, ENOTEMPTY, EROFS:
+		return 550 //Requested action not taken, file unavailable
+	case ENOSPC, EFBIG:
+		return 552 //Requested file action aborted, exceeded storage allocation
+	case EEXIST, ENAMETOOLONG:
+		return 553 //Requested action not taken, file name not allowed
+	}
+	return 451 //Requested action aborted, local error in processing
+}
+
+//error codes of cloud storage services which mean the request is throttled
+var throttlingCodes = map[string]bool{
+	"SlowDown":                               true,
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestThrottled":                       true,
+	"RequestLimitExceeded":                   true,
+	"TooManyRequests":                        true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+	"ServerBusy":                             true,
+}
+
+//classify a backend error by HTTP status code and vendor error code
+//status is 0 if there is no response, e.g. connection reset
+func ErrnoFromHttp(status int, code string) (errno int, retryable bool) {
+	if throttlingCodes[code] {
+		return EAGAIN, true
+	}
+	switch code {
+	case "NoSuchKey", "NoSuchBucket", "NoSuchUpload", "NotFound":
+		return ENOENT, false
+	case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "RequestTimeTooSkewed":
+		return EACCES, false
+	case "EntityTooLarge":
+		return EFBIG, false
+	case "KeyTooLongError", "InvalidObjectName":
+		return ENAMETOOLONG, false
+	case "RequestTimeout":
+		return ETIMEDOUT, true
+	case "InternalError":
+		return EIO, true
+	}
+
+	switch {
+	case status == 0:
+		return EIO, true
+	case status == 401 || status == 403:
+		return EACCES, false
+	case status == 404:
+		return ENOENT, false
+	case status == 405:
+		return ENOTSUP, false
+	case status == 409:
+		return EEXIST, false
+	case status == 400 || status == 416:
+		return EINVAL, false
+	case status == 429 || status == 503:
+		return EAGAIN, true
+	case status == 501:
+		return ENOSYS, false
+	case status == 504:
+		return ETIMEDOUT, true
+	case status >= 500:
+		return EIO, true
+	}
+	return EIO, false
+}
+
+//transport errors which are worth a retry
+func IsTransientNetError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, s := range []string{"connection reset", "broken pipe", "EOF", "timeout", "connection refused"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package fscommon
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestErrnoMapping(t *testing.T) {
+	cases := []struct {
+		errno int
+		sys   syscall.Errno
+		http  int
+		ftp   int
+	}{
+		{ENOENT, syscall.ENOENT, 404, 550},
+		{EACCES, syscall.EACCES, 403, 550},
+		{EPERM, syscall.EPERM, 403, 550},
+		{EEXIST, syscall.EEXIST, 405, 553},
+		{ENOTEMPTY, syscall.ENOTEMPTY, 409, 550},
+		{EINVAL, syscall.EINVAL, 400, 501},
+		{EFBIG, syscall.EFBIG, 413, 552},
+		{ENOSPC, syscall.ENOSPC, 507, 552},
+		{ENAMETOOLONG, syscall.ENAMETOOLONG, 414, 553},
+		{ENOTSUP, syscall.ENOTSUP, 501, 502},
+		{EAGAIN, syscall.EAGAIN, 503, 421},
+		{ETIMEDOUT, syscall.ETIMEDOUT, 504, 421},
+		{EBUSY, syscall.EBUSY, 423, 450},
+		{EIO, syscall.EIO, 500, 451},
+	}
+	for _, c := range cases {
+		//int codes are passed to fuse as negative errno
+		if syscall.Errno(-c.errno) != c.sys {
+			t.Errorf("errno %d: expected %d", c.errno, -int(c.sys))
+		}
+		fe := NewError(c.errno, "open", "a", nil)
+		if fe.HttpStatus() != c.http {
+			t.Errorf("errno %d: http %d, expected %d", c.errno, fe.HttpStatus(), c.http)
+		}
+		if fe.FtpCode() != c.ftp {
+			t.Errorf("errno %d: ftp %d, expected %d", c.errno, fe.FtpCode(), c.ftp)
+		}
+	}
+	if HttpStatus(OK) != 200 || FtpCode(OK) != 250 {
+		t.Error("wrong codes for OK")
+	}
+	if FtpCode(-1000) != 451 || HttpStatus(-1000) != 500 {
+		t.Error("wrong codes for unknown errno")
+	}
+}
+
+func TestErrnoOf(t *testing.T) {
+	if !os.IsNotExist(ErrorCode(ENOENT)) || ErrnoOf(ErrorCode(ENOENT)) != ENOENT {
+		t.Error("ENOENT is not kept")
+	}
+	if ErrnoOf(NewError(ENOSPC, "write", "a", nil)) != ENOSPC {
+		t.Error("ENOSPC is not kept")
+	}
+	if ErrorCode(0) != nil || ErrnoOf(nil) != 0 {
+		t.Error("success is not nil")
+	}
+}
@@ -1,17 +1,28 @@
 package fscommon
 
 import (
-	"log"
+	"context"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var readBufferSize int64 = 1024 * 1024
+
+//size of read buffers allocated later, open files keep their buffers
+func SetReadBufferSize(size int64) {
+	if size > 0 {
+		atomic.StoreInt64(&readBufferSize, size)
+	}
+}
+
 type FSImplBase struct {
 	BucketName    string
 	DirCache      *DirCache
 	NotExistCache *DirCache //avoid flag files being checked too frequently
 	FileMgr       *FileInstanceMgr
+	Quota         *QuotaMgr //nil if usage is not tracked
 }
 
 func (me *FSImplBase) Init(bucketName string) {
@@ -21,7 +32,17 @@ func (me *FSImplBase) Init(bucketName string) {
 	me.FileMgr = NewFileInstanceMgr()
 }
 
+//set quota manager for StatFs and quota check, reconciliation is started here
+func (me *FSImplBase) SetQuota(quota *QuotaMgr) {
+	me.Quota = quota
+	me.FileMgr.SetQuota(quota)
+	quota.Start()
+}
+
 func (me *FSImplBase) StatFs(name string) (*FsInfo, int) {
+	if me.Quota != nil {
+		return me.Quota.StatFs(), 0
+	}
 	return &FsInfo{
 		Blocks: 1024 * 1024 * 1024,
 		Bfree:  1024 * 1024 * 1024,
@@ -58,12 +79,22 @@ func (me *FSImplBase) GetAttr(path string) (os.FileInfo, int) {
 	return nil, 0
 }
 
+//GetAttr from caches, with a span for the lookup
+func (me *FSImplBase) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	_, span := StartSpan(ctx, "dircache.get", "path", path)
+	di, ok := me.GetAttr(path)
+	span.SetAttr("hit", di != nil || ok != 0)
+	span.End(0)
+	return di, ok
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
 type FileImplBase struct {
 	FileName  string
 	FileLen   int64
 	OpenFlags uint32
+	Attr      DirItem //POSIX attributes
 
 	File         ISliceFile
 	AppendBuffer *CacheBuffer
@@ -75,13 +106,25 @@ type FileImplBase struct {
 
 //no IO should be involved in this release function
 func (me *FileImplBase) Release() int {
+	if me.AppendBuffer != nil {
+		me.AppendBuffer.MarkUploaded()
+	}
 	return 0
 }
 
 func (me *FileImplBase) Utimens(Mtime *time.Time) int {
+	if Mtime != nil {
+		me.Attr.DiMtime = *Mtime
+	}
 	return 0
 }
 
+func (me *FileImplBase) SetAttr(attr *DirItem) {
+	if attr != nil {
+		me.Attr = *attr
+	}
+}
+
 func (me *FileImplBase) Truncate(size uint64) int {
 	ok := me.File.Truncate(size)
 	if ok < 0 {
@@ -107,28 +150,34 @@ func (me *FileImplBase) Append(data []byte, offset int64) int {
 }
 
 func (me *FileImplBase) GetInfo() os.FileInfo {
-	return &DirItem{
-		DiName:  me.FileName,
-		DiSize:  me.FileLen,
-		DiMtime: time.Now(),
-		DiType:  S_IFREG,
+	di := me.Attr
+	di.DiName = me.FileName
+	di.DiSize = me.FileLen
+	di.DiType = S_IFREG
+	if di.DiMtime.IsZero() {
+		di.DiMtime = time.Now()
 	}
+	return &di
 }
 
 func (me *FileImplBase) Read(dest []byte, offset int64) int {
+	return me.ReadCtx(context.Background(), dest, offset)
+}
+
+func (me *FileImplBase) ReadCtx(ctx context.Context, dest []byte, offset int64) int {
 
 	remainLen := len(dest)
 	curOffset := offset
 	curDest := dest
 
-	log.Printf("FileImplBase::Read %s is called: offset = %d, length = %d.", me.FileName, offset, len(dest))
+	dlog.Debugf("FileImplBase::Read %s is called: offset = %d, length = %d.", me.FileName, offset, len(dest))
 	//log.Printf("File length: %d", me.File.GetLength())
 	//offset falls into base file, or even later
 	if curOffset < me.File.GetLength() {
-		n := me.bufferRead(curDest, curOffset)
+		n := me.bufferRead(ctx, curDest, curOffset)
 		//n := me.File.Read(curDest, curOffset)
 		if n < 0 {
-			log.Printf("me.File.Read returns %d", n)
+			dlog.Debugf("me.File.Read returns %d", n)
 			return n
 		}
 		remainLen -= n
@@ -138,7 +187,7 @@ func (me *FileImplBase) Read(dest []byte, offset int64) int {
 
 	//offset falls into append buffer scope
 	if remainLen > 0 && me.AppendBuffer != nil && curOffset >= me.AppendBuffer.BaseOffset {
-		log.Printf("Read append buffer: curOffset=%d, remainLen=%d", curOffset, remainLen)
+		dlog.Debugf("Read append buffer: curOffset=%d, remainLen=%d", curOffset, remainLen)
 
 		n := me.AppendBuffer.Read(curDest, curOffset)
 		remainLen -= n
@@ -146,18 +195,18 @@ func (me *FileImplBase) Read(dest []byte, offset int64) int {
 		curDest = curDest[n:]
 	}
 
-	log.Printf("Read returns data length: %d", (len(dest) - remainLen))
+	dlog.Debugf("Read returns data length: %d", (len(dest) - remainLen))
 	return (len(dest) - remainLen)
 }
 
-func (me *FileImplBase) bufferRead(dest []byte, offset int64) int {
-	log.Printf("FileImplBase::bufferRead: offset %d", offset)
+func (me *FileImplBase) bufferRead(ctx context.Context, dest []byte, offset int64) int {
+	dlog.Debugf("FileImplBase::bufferRead: offset %d", offset)
 
 	//allocate buffer if not yet
 	if me.ReadBuffer == nil {
 		me.buffAllocMtx.Lock()
 		if me.ReadBuffer == nil {
-			me.ReadBuffer = NewCacheBuffer(-1, nil, 1024*1024)
+			me.ReadBuffer = NewCacheBuffer(-1, nil, int(atomic.LoadInt64(&readBufferSize)))
 		}
 		me.buffAllocMtx.Unlock()
 	}
@@ -166,6 +215,13 @@ func (me *FileImplBase) bufferRead(dest []byte, offset int64) int {
 	remainLen := len(dest)
 	curOffset := offset
 	curDest := dest
+	missed := false
+
+	ctx, span := StartSpan(ctx, "cache.read", "offset", offset, "size", len(dest))
+	defer func() {
+		span.SetAttr("hit", !missed)
+		span.End(0)
+	}()
 
 	//try to read from buffer
 read_buffer:
@@ -186,10 +242,19 @@ read_buffer:
 
 	//load data into buffer
 	if remainLen > 0 {
-		log.Printf("FileImplBase::bufferRead reads data from remote %d.", len(me.ReadBuffer.Buffer))
+		dlog.Debugf("FileImplBase::bufferRead reads data from remote %d.", len(me.ReadBuffer.Buffer))
+		if !missed {
+			metricReadCache.Inc("miss")
+			missed = true
+		}
 		//need sync
 		me.ReadBuffer.mtx.Lock()
-		n := me.File.Read(me.ReadBuffer.Buffer, curOffset)
+		var n int
+		if sf, ok := me.File.(ISliceFileCtx); ok {
+			n = sf.ReadCtx(ctx, me.ReadBuffer.Buffer, curOffset)
+		} else {
+			n = me.File.Read(me.ReadBuffer.Buffer, curOffset)
+		}
 		me.ReadBuffer.mtx.Unlock()
 		//log.Printf("me.File.Read returns offset %d length %d", curOffset, n)
 		if n < 0 {
@@ -207,6 +272,9 @@ read_buffer:
 		goto read_buffer
 	}
 
+	if !missed {
+		metricReadCache.Inc("hit")
+	}
 	//log.Printf("FileImplBase::bufferRead returns data length %d", len(dest)-remainLen)
 	return len(dest) - remainLen
 }
@@ -1,7 +1,7 @@
 package fscommon
 
 import (
-	"log"
+	"context"
 	"os"
 	"runtime"
 	"sync"
@@ -18,6 +18,7 @@ type FileInstance struct {
 
 type FileInstanceMgr struct {
 	fileInstList map[string]*FileInstance
+	quota        *QuotaMgr //for quota check, may be nil
 	mtx          sync.Mutex
 }
 
@@ -27,6 +28,14 @@ type FileObject struct {
 	fileInst  *FileInstance
 	fileName  string
 	openFlags uint32
+
+	//reads and writes are audited when the file object is released
+	client     string //client of the first read or write
+	readBytes  int64
+	writeBytes int64
+	readErr    int //last error
+	writeErr   int
+	auditMtx   sync.Mutex
 }
 
 func NewFileInstanceMgr() *FileInstanceMgr {
@@ -35,6 +44,10 @@ func NewFileInstanceMgr() *FileInstanceMgr {
 	}
 }
 
+func (me *FileInstanceMgr) SetQuota(quota *QuotaMgr) {
+	me.quota = quota
+}
+
 func (me *FileInstanceMgr) GetFileInfo(name string) (os.FileInfo, bool) {
 	me.mtx.Lock()
 	defer me.mtx.Unlock()
@@ -48,6 +61,20 @@ func (me *FileInstanceMgr) GetFileInfo(name string) (os.FileInfo, bool) {
 	return fi.file.GetInfo(), true
 }
 
+//update POSIX attributes of an open file, so that they won't be overwritten at flush
+func (me *FileInstanceMgr) SetFileAttr(name string, attr *DirItem) bool {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	fi, ok := me.fileInstList[name]
+	if ok == false {
+		return false
+	}
+
+	fi.file.SetAttr(attr)
+	return true
+}
+
 func (me *FileInstanceMgr) GetInstance(name string) (*FileObject, int) {
 	me.mtx.Lock()
 	defer me.mtx.Unlock()
@@ -91,6 +118,7 @@ func (me *FileInstanceMgr) Allocate(fs FileSystemImpl, name string) (*FileObject
 		return nil, rc
 	}
 	fi.file = file
+	metricOpenFiles.Add(1)
 
 	return &FileObject{
 		fileMgr:  me,
@@ -106,7 +134,7 @@ func (me *FileInstanceMgr) Release(name string) int {
 	fi, ok := me.fileInstList[name]
 	if ok == false {
 		me.mtx.Unlock()
-		return -1
+		return ENOENT
 	}
 
 	var needGC bool = false
@@ -114,6 +142,7 @@ func (me *FileInstanceMgr) Release(name string) int {
 	if fi.refCount == 0 {
 		fi.file.Release() //no IO should be involved in this release function
 		delete(me.fileInstList, name)
+		metricOpenFiles.Add(-1)
 		needGC = true
 	}
 	me.mtx.Unlock()
@@ -165,7 +194,7 @@ func (me *FileInstance) ReleaseWLock(fo *FileObject) {
 ///////////////////////////////////////////////////////////////////////////////
 func (me *FileObject) Open(path string, flags uint32) int {
 	if me.fileInst == nil {
-		return -1
+		return EBADF
 	}
 	ok := me.fileInst.file.Open(path, flags)
 	if ok != 0 {
@@ -179,28 +208,92 @@ func (me *FileObject) Open(path string, flags uint32) int {
 	return 0
 }
 
+func (me *FileObject) Name() string {
+	return me.fileName
+}
+
+//count bytes and errors of a read or write for the audit log
+func (me *FileObject) account(ctx context.Context, write bool, n int) {
+	me.auditMtx.Lock()
+	if len(me.client) == 0 {
+		me.client = ClientOf(ctx)
+	}
+	if write {
+		if n < 0 {
+			me.writeErr = n
+		} else {
+			me.writeBytes += int64(n)
+		}
+	} else {
+		if n < 0 {
+			me.readErr = n
+		} else {
+			me.readBytes += int64(n)
+		}
+	}
+	me.auditMtx.Unlock()
+}
+
+func (me *FileObject) audit(flush int) {
+	me.auditMtx.Lock()
+	defer me.auditMtx.Unlock()
+	if me.readBytes > 0 || me.readErr < 0 {
+		auditRecord(me.client, "", "read", me.fileName, "", me.readBytes, me.readErr)
+	}
+	//data is uploaded at flush, so a failed flush fails the write
+	if flush < 0 && me.writeErr == 0 && me.writeBytes > 0 {
+		me.writeErr = flush
+	}
+	if me.writeBytes > 0 || me.writeErr < 0 {
+		auditRecord(me.client, "", "write", me.fileName, "", me.writeBytes, me.writeErr)
+	}
+}
+
 func (me *FileObject) Release() {
+	me.ReleaseCtx(context.Background())
+}
+
+//pending data is uploaded with the context, it returns the result of the upload
+func (me *FileObject) ReleaseCtx(ctx context.Context) int {
 	if me.fileInst == nil {
-		return
+		return 0
 	}
-	me.fileInst.file.Flush()
+	flush := FileWithContext(me.fileInst.file).FlushCtx(ctx)
+	me.audit(flush)
 	me.fileInst.ReleaseWLock(me) //maybe we should release lock in function flush which is called by close
 	me.fileMgr.Release(me.fileName)
 	me.fileInst = nil
+	return flush
 }
 
 func (me *FileObject) Read(data []byte, offset int64) int {
+	return me.ReadCtx(context.Background(), data, offset)
+}
+
+func (me *FileObject) ReadCtx(ctx context.Context, data []byte, offset int64) int {
 	if me.fileInst == nil {
-		log.Println("Invalid file instance handle.")
-		return -1
+		dlog.Errorf("Invalid file instance handle.")
+		return EBADF
 	}
-	return me.fileInst.file.Read(data, offset)
+	n := FileWithContext(me.fileInst.file).ReadCtx(ctx, data, offset)
+	me.account(ctx, false, n)
+	return n
 }
 
 func (me *FileObject) Write(data []byte, offset int64) int {
+	return me.WriteCtx(context.Background(), data, offset)
+}
+
+func (me *FileObject) WriteCtx(ctx context.Context, data []byte, offset int64) int {
+	n := me.writeCtx(ctx, data, offset)
+	me.account(ctx, true, n)
+	return n
+}
+
+func (me *FileObject) writeCtx(ctx context.Context, data []byte, offset int64) int {
 	if me.fileInst == nil {
-		log.Println("There must be something wrong with file open.")
-		return -1
+		dlog.Errorf("There must be something wrong with file open.")
+		return EBADF
 	}
 
 	//only one client can hold write access to a file
@@ -208,17 +301,32 @@ func (me *FileObject) Write(data []byte, offset int64) int {
 	//this test is deferred so that clients which open file with wrong flags can still work
 	rc := me.fileInst.TryGetWLock(me)
 	if rc == false {
-		log.Println("Failed to get write lock.")
+		dlog.Warnf("Failed to get write lock.")
 		return EPERM //permission denined
 	}
 
-	return me.fileInst.file.Write(data, offset)
+	//only data written beyond end of file is counted
+	file := FileWithContext(me.fileInst.file)
+	quota := me.fileMgr.quota
+	if quota == nil {
+		return file.WriteCtx(ctx, data, offset)
+	}
+	size := me.fileInst.file.GetInfo().Size()
+	if ok := quota.Check(me.fileName, offset+int64(len(data))-size); ok < 0 {
+		dlog.Warnf("No space left for %s.", me.fileName)
+		return ok
+	}
+	n := file.WriteCtx(ctx, data, offset)
+	if n > 0 {
+		quota.Add(me.fileName, me.fileInst.file.GetInfo().Size()-size)
+	}
+	return n
 }
 
 func (me *FileObject) Flush() int {
 	if me.fileInst == nil || me.fileInst.file == nil {
-		log.Println("There must be something wrong with file open.")
-		return -1
+		dlog.Errorf("There must be something wrong with file open.")
+		return EBADF
 	}
 
 	//flush is not supported
@@ -226,19 +334,47 @@ func (me *FileObject) Flush() int {
 }
 
 func (me *FileObject) Utimens(Mtime *time.Time) int {
-	return 0
+	if me.fileInst == nil {
+		return EBADF
+	}
+	return me.fileInst.file.Utimens(Mtime)
+}
+
+//set attributes for a file which is going to be created
+func (me *FileObject) SetAttr(attr *DirItem) {
+	if me.fileInst == nil {
+		return
+	}
+	me.fileInst.file.SetAttr(attr)
 }
 
 func (me *FileObject) Truncate(size uint64) int {
+	return me.TruncateCtx(context.Background(), size)
+}
+
+func (me *FileObject) TruncateCtx(ctx context.Context, size uint64) int {
 	if me.fileInst == nil {
-		return -1
+		return EBADF
+	}
+	file := FileWithContext(me.fileInst.file)
+	quota := me.fileMgr.quota
+	if quota == nil {
+		return file.TruncateCtx(ctx, size)
+	}
+	oldSize := me.fileInst.file.GetInfo().Size()
+	if ok := quota.Check(me.fileName, int64(size)-oldSize); ok < 0 {
+		return ok
+	}
+	ok := file.TruncateCtx(ctx, size)
+	if ok == 0 {
+		quota.Add(me.fileName, me.fileInst.file.GetInfo().Size()-oldSize)
 	}
-	return me.fileInst.file.Truncate(size)
+	return ok
 }
 
 func (me *FileObject) GetLength() int64 {
 	if me.fileInst == nil {
-		return -1
+		return EBADF
 	}
 	return me.fileInst.file.GetInfo().Size()
 }
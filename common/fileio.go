@@ -11,4 +11,9 @@ type FileIO interface {
 	ListFile(path string) ([]os.FileInfo, int)
 	ZeroFile(name string) int
 	Unlink(path string) int
+
+	//user meta data of an object
+	//SetMeta keeps existing keys which are not in meta, keys with empty value get removed
+	GetMeta(name string) (ObjectMeta, int)
+	SetMeta(name string, meta ObjectMeta) int
 }
@@ -1,28 +1,48 @@
 package fscommon
 
 import (
-	"log"
 	"os"
 	"time"
+
+	"github.com/allspace/csmgr/util"
 )
 
+var dlog = util.GetLogger("common")
+
 const (
 	S_IFUNKOWN = 0
 	S_IFREG    = 1
 	S_IFDIR    = 2
+	S_IFLNK    = 3
 )
 
+//error codes are negative linux errno values, see errors.go for the typed error
 const (
-	OK      = 0
-	EPERM   = -1
-	ENOENT  = -2
-	EIO     = -5
-	EBUSY   = -16
-	EEXIST  = -17
-	ENOTDIR = -20
-	EISDIR  = -21
-	EINVAL  = -22
-	ENOSYS  = -38
+	OK           = 0
+	EPERM        = -1
+	ENOENT       = -2
+	EIO          = -5
+	E2BIG        = -7
+	EBADF        = -9
+	EAGAIN       = -11 //throttled or temporarily unavailable, try again later
+	ENOMEM       = -12
+	EACCES       = -13
+	EBUSY        = -16
+	EEXIST       = -17
+	EXDEV        = -18
+	ENOTDIR      = -20
+	EISDIR       = -21
+	EINVAL       = -22
+	EFBIG        = -27
+	ENOSPC       = -28 //quota exceeded
+	EROFS        = -30
+	ENAMETOOLONG = -36
+	ENOSYS       = -38
+	ENOTEMPTY    = -39
+	ENODATA      = -61 //no such extended attribute
+	ENOTSUP      = -95
+	ETIMEDOUT    = -110
+	ECANCELED    = -125
 )
 
 const (
@@ -34,9 +54,11 @@ type DirItem struct {
 	DiSize  int64
 	DiMode  os.FileMode
 	DiMtime time.Time
+	DiAtime time.Time
 	DiUid   uint32
 	DiGid   uint32
 	DiType  int
+	DiMeta  ObjectMeta //all user meta data of the object
 }
 
 func (me *DirItem) Name() string {
@@ -50,8 +72,13 @@ func (me *DirItem) Size() int64 {
 func (me *DirItem) Mode() os.FileMode {
 	if me.DiType == S_IFDIR {
 		me.DiMode |= os.ModeDir
+	} else if me.DiType == S_IFLNK {
+		me.DiMode |= os.ModeSymlink
+	}
+	//no POSIX attributes saved for the object, allow everything
+	if me.DiMode.Perm() == 0 {
+		me.DiMode |= os.ModePerm
 	}
-	me.DiMode |= os.ModePerm
 	return me.DiMode
 }
 
@@ -82,6 +109,12 @@ type ClientImpl interface {
 	Mount(bucketName string) (FileSystemImpl, int)
 }
 
+//optional interface of a FileSystemImpl whose settings can be changed without remount
+//cfg has the same keys as ClientImpl.Set, see csmgr/factory.go
+type Reconfigurable interface {
+	Reconfigure(cfg map[string]string) int
+}
+
 type FileImpl interface {
 	GetInfo() os.FileInfo
 	Read(dest []byte, off int64) int
@@ -91,6 +124,9 @@ type FileImpl interface {
 	Utimens(Mtime *time.Time) int
 	Truncate(size uint64) int
 
+	//set POSIX attributes which will be saved with file data
+	SetAttr(attr *DirItem)
+
 	//no I/O should be involved in these functions
 	//they are run in big lock context
 	Release() int
@@ -102,9 +138,29 @@ type FileSystemImpl interface {
 	ReadDir(path string) ([]os.FileInfo, int)
 	GetAttr(path string) (os.FileInfo, int)
 	Open(path string, flags uint32) (*FileObject, int)
+	Create(path string, flags uint32, attr *DirItem) (*FileObject, int)
 	StatFs(name string) (*FsInfo, int)
 	Unlink(path string) int
 	Mkdir(path string, mode uint32) int
+	Rmdir(path string) int
+
+	//update POSIX attributes saved in object meta data
+	Chmod(path string, mode uint32) int
+	Chown(path string, uid uint32, gid uint32) int
+	Utimens(path string, Atime *time.Time, Mtime *time.Time) int
+
+	//extended attributes
+	GetXAttr(path string, name string) ([]byte, int)
+	SetXAttr(path string, name string, data []byte, flags int) int
+	ListXAttr(path string) ([]string, int)
+	RemoveXAttr(path string, name string) int
+
+	//remove a file or a directory tree, including helper objects of the files
+	RemoveAll(path string) int
+
+	//symbolic link is saved as a small object whose content is the target
+	Symlink(target string, linkPath string) int
+	Readlink(path string) (string, int)
 }
 
 //trim the last slash if there is
@@ -127,6 +183,6 @@ func GetLastPathComp(path string) string {
 		}
 	}
 
-	log.Println("***", path, ": idx=", idx, ", end=", end)
+	dlog.Debugf("%s: idx=%d, end=%d", path, idx, end)
 	return path[idx : end+1]
 }
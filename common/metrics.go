@@ -0,0 +1,373 @@
+package fscommon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//metrics in Prometheus text format, served by front-ends, e.g. on /$metrics$ of the WebDAV server
+
+const (
+	METRIC_COUNTER   = "counter"
+	METRIC_GAUGE     = "gauge"
+	METRIC_HISTOGRAM = "histogram"
+)
+
+//latency buckets in seconds
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+	counts []uint64 //histogram only, count of each bucket
+	count  uint64
+}
+
+//a metric with labels, each set of label values is a series
+type MetricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+	mtx     sync.Mutex
+}
+
+var metricsList []*MetricVec
+var metricsMtx sync.Mutex
+
+func newMetricVec(kind string, name string, help string, buckets []float64, labels []string) *MetricVec {
+	me := &MetricVec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+	//a metric without labels is reported from the start
+	if len(labels) == 0 {
+		me.get(nil)
+	}
+	metricsMtx.Lock()
+	metricsList = append(metricsList, me)
+	metricsMtx.Unlock()
+	return me
+}
+
+func NewCounterVec(name string, help string, labels ...string) *MetricVec {
+	return newMetricVec(METRIC_COUNTER, name, help, nil, labels)
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *MetricVec {
+	return newMetricVec(METRIC_GAUGE, name, help, nil, labels)
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *MetricVec {
+	return newMetricVec(METRIC_HISTOGRAM, name, help, buckets, labels)
+}
+
+//caller must hold the lock
+func (me *MetricVec) get(values []string) *metricSeries {
+	key := strings.Join(values, "\x00")
+	s, ok := me.series[key]
+	if !ok {
+		s = &metricSeries{labels: append([]string(nil), values...)}
+		if me.kind == METRIC_HISTOGRAM {
+			s.counts = make([]uint64, len(me.buckets))
+		}
+		me.series[key] = s
+	}
+	return s
+}
+
+//add to a counter or gauge
+func (me *MetricVec) Add(v float64, values ...string) {
+	me.mtx.Lock()
+	me.get(values).value += v
+	me.mtx.Unlock()
+}
+
+func (me *MetricVec) Inc(values ...string) {
+	me.Add(1, values...)
+}
+
+func (me *MetricVec) Set(v float64, values ...string) {
+	me.mtx.Lock()
+	me.get(values).value = v
+	me.mtx.Unlock()
+}
+
+//add a sample to a histogram, value is the sum of samples
+func (me *MetricVec) Observe(v float64, values ...string) {
+	me.mtx.Lock()
+	s := me.get(values)
+	for i, b := range me.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+	me.mtx.Unlock()
+}
+
+func escapeLabel(val string) string {
+	val = strings.Replace(val, `\`, `\\`, -1)
+	val = strings.Replace(val, `"`, `\"`, -1)
+	return strings.Replace(val, "\n", `\n`, -1)
+}
+
+func formatLabels(names []string, values []string, extra string) string {
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		val := ""
+		if i < len(values) {
+			val = values[i]
+		}
+		parts = append(parts, name+`="`+escapeLabel(val)+`"`)
+	}
+	if len(extra) > 0 {
+		parts = append(parts, extra)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (me *MetricVec) write(w io.Writer) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", me.name, me.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", me.name, me.kind)
+
+	keys := make([]string, 0, len(me.series))
+	for key := range me.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := me.series[key]
+		if me.kind != METRIC_HISTOGRAM {
+			fmt.Fprintf(w, "%s%s %s\n", me.name, formatLabels(me.labels, s.labels, ""), formatFloat(s.value))
+			continue
+		}
+		for i, b := range me.buckets {
+			le := `le="` + formatFloat(b) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", me.name, formatLabels(me.labels, s.labels, le), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", me.name, formatLabels(me.labels, s.labels, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", me.name, formatLabels(me.labels, s.labels, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", me.name, formatLabels(me.labels, s.labels, ""), s.count)
+	}
+}
+
+//write all metrics in Prometheus text format
+func WriteMetrics(w io.Writer) {
+	metricsMtx.Lock()
+	list := append([]*MetricVec(nil), metricsList...)
+	metricsMtx.Unlock()
+
+	for _, m := range list {
+		m.write(w)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//Metrics of file systems
+///////////////////////////////////////////////////////////////////////////////
+
+var (
+	metricBackendRequests = NewCounterVec("csmgr_backend_requests_total",
+		"Backend requests by FileIO method.", "method")
+	metricBackendErrors = NewCounterVec("csmgr_backend_errors_total",
+		"Failed backend requests by FileIO method and errno.", "method", "errno")
+	metricBackendLatency = NewHistogramVec("csmgr_backend_request_duration_seconds",
+		"Latency of backend requests by FileIO method.", DefaultLatencyBuckets, "method")
+	metricBackendBytes = NewCounterVec("csmgr_backend_bytes_total",
+		"Bytes transferred to or from the backend by FileIO method.", "method")
+
+	metricDirCache = NewCounterVec("csmgr_dircache_lookups_total",
+		"Directory cache lookups by result, hit or miss.", "result")
+	metricReadCache = NewCounterVec("csmgr_readcache_lookups_total",
+		"Read buffer lookups by result, hit or miss.", "result")
+
+	metricOpenFiles = NewGaugeVec("csmgr_open_file_instances",
+		"Open file instances.")
+	metricPendingUpload = NewGaugeVec("csmgr_pending_upload_bytes",
+		"Bytes in write buffers which are not uploaded yet.")
+
+	metricFrontRequests = NewCounterVec("csmgr_frontend_requests_total",
+		"Front-end requests by protocol, method and status.", "protocol", "method", "status")
+	metricFrontLatency = NewHistogramVec("csmgr_frontend_request_duration_seconds",
+		"Latency of front-end requests by protocol and method.", DefaultLatencyBuckets, "protocol", "method")
+)
+
+func cacheResult(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+//count a request of a front-end, e.g. a WebDAV method
+func ObserveFrontRequest(protocol string, method string, status int, start time.Time) {
+	metricFrontRequests.Inc(protocol, method, strconv.Itoa(status))
+	metricFrontLatency.Observe(time.Since(start).Seconds(), protocol, method)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+//FileIO wrapper which records count, latency, bytes and errors of every backend request, and a span for it
+//it goes inside RetryIO and RateLimitIO, so that each attempt is measured without waiting time
+type MetricsIO struct {
+	io FileIO
+}
+
+func NewMetricsIO(io FileIO) *MetricsIO {
+	return &MetricsIO{io: io}
+}
+
+//the wrapped FileIO, for driver specific operations
+func (me *MetricsIO) Base() FileIO {
+	return me.io
+}
+
+//count a backend request which doesn't go through FileIO, e.g. multipart upload
+func ObserveBackendRequest(method string, start time.Time, rc int, bytes int) {
+	observeIO(context.Background(), nil, method, "", start, rc, bytes)
+}
+
+//a client span for each backend call, a child of the front-end request
+func startIOSpan(ctx context.Context, method string, name string) (context.Context, *Span) {
+	return StartSpanKind(ctx, SPAN_KIND_CLIENT, "io."+method, "object", name)
+}
+
+//the call is logged with the request id of the context, to correlate it with the front-end request
+func observeIO(ctx context.Context, span *Span, method string, name string, start time.Time, rc int, bytes int) {
+	span.SetAttr("bytes", bytes)
+	span.End(rc)
+	dlog.WithCtx(ctx).Debugf("%s %s: rc=%d, bytes=%d, %v", method, name, rc, bytes, time.Since(start))
+	metricBackendRequests.Inc(method)
+	metricBackendLatency.Observe(time.Since(start).Seconds(), method)
+	if rc < 0 {
+		metricBackendErrors.Inc(method, strconv.Itoa(-rc))
+	} else if bytes > 0 {
+		metricBackendBytes.Add(float64(bytes), method)
+	}
+}
+
+func (me *MetricsIO) PutBuffer(name string, data []byte) int {
+	return me.PutBufferCtx(context.Background(), name, data)
+}
+
+func (me *MetricsIO) PutBufferCtx(ctx context.Context, name string, data []byte) int {
+	ctx, span := startIOSpan(ctx, "PutBuffer", name)
+	start := time.Now()
+	rc := IOWithContext(me.io).PutBufferCtx(ctx, name, data)
+	observeIO(ctx, span, "PutBuffer", name, start, rc, len(data))
+	return rc
+}
+
+func (me *MetricsIO) GetBuffer(name string, dest []byte, offset int64) int {
+	return me.GetBufferCtx(context.Background(), name, dest, offset)
+}
+
+func (me *MetricsIO) GetBufferCtx(ctx context.Context, name string, dest []byte, offset int64) int {
+	ctx, span := startIOSpan(ctx, "GetBuffer", name)
+	start := time.Now()
+	rc := IOWithContext(me.io).GetBufferCtx(ctx, name, dest, offset)
+	observeIO(ctx, span, "GetBuffer", name, start, rc, rc)
+	return rc
+}
+
+func (me *MetricsIO) GetAttr(path string) (os.FileInfo, int) {
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+func (me *MetricsIO) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	ctx, span := startIOSpan(ctx, "GetAttr", path)
+	start := time.Now()
+	fi, rc := IOWithContext(me.io).GetAttrCtx(ctx, path)
+	observeIO(ctx, span, "GetAttr", path, start, rc, 0)
+	return fi, rc
+}
+
+func (me *MetricsIO) ListFile(path string) ([]os.FileInfo, int) {
+	return me.ListFileCtx(context.Background(), path)
+}
+
+func (me *MetricsIO) ListFileCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
+	ctx, span := startIOSpan(ctx, "ListFile", path)
+	start := time.Now()
+	fis, rc := IOWithContext(me.io).ListFileCtx(ctx, path)
+	observeIO(ctx, span, "ListFile", path, start, rc, 0)
+	return fis, rc
+}
+
+func (me *MetricsIO) ZeroFile(name string) int {
+	return me.ZeroFileCtx(context.Background(), name)
+}
+
+func (me *MetricsIO) ZeroFileCtx(ctx context.Context, name string) int {
+	ctx, span := startIOSpan(ctx, "ZeroFile", name)
+	start := time.Now()
+	rc := IOWithContext(me.io).ZeroFileCtx(ctx, name)
+	observeIO(ctx, span, "ZeroFile", name, start, rc, 0)
+	return rc
+}
+
+func (me *MetricsIO) Unlink(path string) int {
+	return me.UnlinkCtx(context.Background(), path)
+}
+
+func (me *MetricsIO) UnlinkCtx(ctx context.Context, path string) int {
+	ctx, span := startIOSpan(ctx, "Unlink", path)
+	start := time.Now()
+	rc := IOWithContext(me.io).UnlinkCtx(ctx, path)
+	observeIO(ctx, span, "Unlink", path, start, rc, 0)
+	return rc
+}
+
+func (me *MetricsIO) GetMeta(name string) (ObjectMeta, int) {
+	return me.GetMetaCtx(context.Background(), name)
+}
+
+func (me *MetricsIO) GetMetaCtx(ctx context.Context, name string) (ObjectMeta, int) {
+	ctx, span := startIOSpan(ctx, "GetMeta", name)
+	start := time.Now()
+	meta, rc := IOWithContext(me.io).GetMetaCtx(ctx, name)
+	observeIO(ctx, span, "GetMeta", name, start, rc, 0)
+	return meta, rc
+}
+
+func (me *MetricsIO) SetMeta(name string, meta ObjectMeta) int {
+	return me.SetMetaCtx(context.Background(), name, meta)
+}
+
+func (me *MetricsIO) SetMetaCtx(ctx context.Context, name string, meta ObjectMeta) int {
+	ctx, span := startIOSpan(ctx, "SetMeta", name)
+	start := time.Now()
+	rc := IOWithContext(me.io).SetMetaCtx(ctx, name, meta)
+	observeIO(ctx, span, "SetMeta", name, start, rc, 0)
+	return rc
+}
@@ -0,0 +1,386 @@
+package fscommon
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+//encryption of object names, so that listings of the bucket don't leak file names
+//each path component is encrypted on its own and deterministically, a path always maps to the same key,
+//and a directory is still listed by the prefix of its key
+//a component is encrypted by AES-CTR with a synthetic IV, the first 16 bytes of HMAC-SHA256 of the name,
+//the IV is checked on decryption, names which are not encrypted by the key are hidden from listings
+//encrypted names are encoded by base64 for URLs without padding, which is the shortest encoding safe for object keys
+//a name grows by about a third plus 22 bytes, paths whose keys exceed MAX_KEY_LENGTH get ENAMETOOLONG
+//keys leave room for helper objects of files, e.g. $cache$/<key>/blocks/<offset>
+//patterns of object policies and compression and prefixes of quotas are of plain paths, see PlainPath
+const (
+	MAX_KEY_LENGTH = 1024 //of S3 and OSS
+
+	nameIVSize = 16
+
+	//the longest helper object is a temporary copy of a slice, $tmp$/$slice$/<key>/files/<n>.dat.tmp3
+	maxHelperKeyOverhead = len("$tmp$/$slice$/") + len("/files/") + 19 + len(".dat.tmp3")
+)
+
+var nameEncoding = base64.RawURLEncoding
+
+type NameCipher struct {
+	block  cipher.Block
+	macKey []byte
+}
+
+//keys of name encryption are derived from the master key, so one key file is enough for both
+func NewNameCipher(key []byte) (*NameCipher, error) {
+	block, err := aes.NewCipher(deriveKey(key, "csmgr name encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return &NameCipher{block: block, macKey: deriveKey(key, "csmgr name authentication")}, nil
+}
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func (me *NameCipher) iv(name []byte) []byte {
+	mac := hmac.New(sha256.New, me.macKey)
+	mac.Write(name)
+	return mac.Sum(nil)[:nameIVSize]
+}
+
+func (me *NameCipher) EncryptName(name string) string {
+	iv := me.iv([]byte(name))
+	buf := make([]byte, nameIVSize+len(name))
+	copy(buf, iv)
+	cipher.NewCTR(me.block, iv).XORKeyStream(buf[nameIVSize:], []byte(name))
+	return nameEncoding.EncodeToString(buf)
+}
+
+func (me *NameCipher) DecryptName(name string) (string, error) {
+	buf, err := nameEncoding.DecodeString(name)
+	if err != nil || len(buf) < nameIVSize {
+		return "", fmt.Errorf("not an encrypted name")
+	}
+	iv := buf[:nameIVSize]
+	plain := make([]byte, len(buf)-nameIVSize)
+	cipher.NewCTR(me.block, iv).XORKeyStream(plain, buf[nameIVSize:])
+	if !hmac.Equal(iv, me.iv(plain)) {
+		return "", fmt.Errorf("not encrypted by the key")
+	}
+	return string(plain), nil
+}
+
+//encrypt every component of a path, slashes are kept
+func (me *NameCipher) EncryptPath(path string) (string, int) {
+	comps := strings.Split(path, "/")
+	for i, comp := range comps {
+		if len(comp) > 0 {
+			comps[i] = me.EncryptName(comp)
+		}
+	}
+	key := strings.Join(comps, "/")
+	if len(key)+maxHelperKeyOverhead > MAX_KEY_LENGTH {
+		return "", ENAMETOOLONG
+	}
+	return key, 0
+}
+
+//decrypt every component of a key which is encrypted by the key, others are kept, e.g. $cache$ and blocks
+func (me *NameCipher) PlainPath(key string) string {
+	comps := strings.Split(key, "/")
+	for i, comp := range comps {
+		if name, err := me.DecryptName(comp); len(comp) > 0 && err == nil {
+			comps[i] = name
+		}
+	}
+	return strings.Join(comps, "/")
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+//a file system whose names are encrypted, paths are encrypted before they are passed to fs
+//and names of entries are decrypted before they are returned
+type NameCryptFS struct {
+	fs    FileSystemImpl
+	names *NameCipher
+}
+
+func NewNameCryptFS(fs FileSystemImpl, names *NameCipher) *NameCryptFS {
+	return &NameCryptFS{fs: fs, names: names}
+}
+
+func (me *NameCryptFS) Base() FileSystemImpl {
+	return me.fs
+}
+
+//the entry is copied, it may be cached by fs
+func (me *NameCryptFS) plainInfo(fi os.FileInfo) os.FileInfo {
+	di, ok := fi.(*DirItem)
+	if !ok || len(di.DiName) == 0 {
+		return fi
+	}
+	name, err := me.names.DecryptName(di.DiName)
+	if err != nil {
+		dlog.Debugf("Hide %s: %s", di.DiName, err)
+		return nil
+	}
+	plain := *di
+	plain.DiName = name
+	return &plain
+}
+
+func (me *NameCryptFS) NewFileImpl(path string) (FileImpl, int) {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return nil, ok
+	}
+	return me.fs.NewFileImpl(key)
+}
+
+func (me *NameCryptFS) ReadDir(path string) ([]os.FileInfo, int) {
+	return me.ReadDirCtx(context.Background(), path)
+}
+
+//entries which can't be decrypted are left nil, like other skipped entries
+func (me *NameCryptFS) ReadDirCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return nil, ok
+	}
+	dis, n := FsWithContext(me.fs).ReadDirCtx(ctx, key)
+	if n < 0 {
+		return nil, n
+	}
+	plain := make([]os.FileInfo, len(dis))
+	for i, fi := range dis {
+		if fi != nil {
+			plain[i] = me.plainInfo(fi)
+		}
+	}
+	return plain, n
+}
+
+func (me *NameCryptFS) GetAttr(path string) (os.FileInfo, int) {
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+func (me *NameCryptFS) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return nil, ok
+	}
+	fi, ok := FsWithContext(me.fs).GetAttrCtx(ctx, key)
+	if ok < 0 {
+		return nil, ok
+	}
+	if di, isDi := fi.(*DirItem); isDi && len(di.DiName) > 0 {
+		plain := *di
+		plain.DiName = GetLastPathComp(path)
+		return &plain, ok
+	}
+	return fi, ok
+}
+
+func (me *NameCryptFS) Open(path string, flags uint32) (*FileObject, int) {
+	return me.OpenCtx(context.Background(), path, flags)
+}
+
+func (me *NameCryptFS) OpenCtx(ctx context.Context, path string, flags uint32) (*FileObject, int) {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return nil, ok
+	}
+	return FsWithContext(me.fs).OpenCtx(ctx, key, flags)
+}
+
+func (me *NameCryptFS) Create(path string, flags uint32, attr *DirItem) (*FileObject, int) {
+	return me.CreateCtx(context.Background(), path, flags, attr)
+}
+
+func (me *NameCryptFS) CreateCtx(ctx context.Context, path string, flags uint32, attr *DirItem) (*FileObject, int) {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return nil, ok
+	}
+	if attr != nil {
+		encAttr := *attr
+		encAttr.DiName = GetLastPathComp(key)
+		attr = &encAttr
+	}
+	return FsWithContext(me.fs).CreateCtx(ctx, key, flags, attr)
+}
+
+func (me *NameCryptFS) StatFs(name string) (*FsInfo, int) {
+	key, ok := me.names.EncryptPath(name)
+	if ok < 0 {
+		return nil, ok
+	}
+	return me.fs.StatFs(key)
+}
+
+func (me *NameCryptFS) Unlink(path string) int {
+	return me.UnlinkCtx(context.Background(), path)
+}
+
+func (me *NameCryptFS) UnlinkCtx(ctx context.Context, path string) int {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return ok
+	}
+	return FsWithContext(me.fs).UnlinkCtx(ctx, key)
+}
+
+func (me *NameCryptFS) Mkdir(path string, mode uint32) int {
+	return me.MkdirCtx(context.Background(), path, mode)
+}
+
+func (me *NameCryptFS) MkdirCtx(ctx context.Context, path string, mode uint32) int {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return ok
+	}
+	return FsWithContext(me.fs).MkdirCtx(ctx, key, mode)
+}
+
+func (me *NameCryptFS) Rmdir(path string) int {
+	return me.RmdirCtx(context.Background(), path)
+}
+
+func (me *NameCryptFS) RmdirCtx(ctx context.Context, path string) int {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return ok
+	}
+	return FsWithContext(me.fs).RmdirCtx(ctx, key)
+}
+
+func (me *NameCryptFS) RemoveAll(path string) int {
+	return me.RemoveAllCtx(context.Background(), path)
+}
+
+func (me *NameCryptFS) RemoveAllCtx(ctx context.Context, path string) int {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return ok
+	}
+	return FsWithContext(me.fs).RemoveAllCtx(ctx, key)
+}
+
+func (me *NameCryptFS) Chmod(path string, mode uint32) int {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return ok
+	}
+	return me.fs.Chmod(key, mode)
+}
+
+func (me *NameCryptFS) Chown(path string, uid uint32, gid uint32) int {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return ok
+	}
+	return me.fs.Chown(key, uid, gid)
+}
+
+func (me *NameCryptFS) Utimens(path string, Atime *time.Time, Mtime *time.Time) int {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return ok
+	}
+	return me.fs.Utimens(key, Atime, Mtime)
+}
+
+func (me *NameCryptFS) GetXAttr(path string, name string) ([]byte, int) {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return nil, ok
+	}
+	return me.fs.GetXAttr(key, name)
+}
+
+func (me *NameCryptFS) SetXAttr(path string, name string, data []byte, flags int) int {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return ok
+	}
+	return me.fs.SetXAttr(key, name, data, flags)
+}
+
+func (me *NameCryptFS) ListXAttr(path string) ([]string, int) {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return nil, ok
+	}
+	return me.fs.ListXAttr(key)
+}
+
+func (me *NameCryptFS) RemoveXAttr(path string, name string) int {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return ok
+	}
+	return me.fs.RemoveXAttr(key, name)
+}
+
+func (me *NameCryptFS) LoadXAttrs(path string) (XAttrs, int) {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return nil, ok
+	}
+	return LoadXAttrs(me.fs, key)
+}
+
+func (me *NameCryptFS) UpdateXAttrs(path string, set XAttrs, remove []string) int {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return ok
+	}
+	return UpdateXAttrs(me.fs, key, set, remove)
+}
+
+//the target is encrypted as a whole, it may be outside of the file system
+//its length is checked before encryption, drivers take the encrypted target up to MAX_LINK_OBJECT_SIZE
+func (me *NameCryptFS) Symlink(target string, linkPath string) int {
+	if len(target) == 0 || len(target) > MAX_LINK_SIZE {
+		return EINVAL
+	}
+	key, ok := me.names.EncryptPath(linkPath)
+	if ok < 0 {
+		return ok
+	}
+	return me.fs.Symlink(me.names.EncryptName(target), key)
+}
+
+//targets of links created without name encryption are returned as they are
+func (me *NameCryptFS) Readlink(path string) (string, int) {
+	key, ok := me.names.EncryptPath(path)
+	if ok < 0 {
+		return "", ok
+	}
+	target, ok := me.fs.Readlink(key)
+	if ok < 0 {
+		return "", ok
+	}
+	if plain, err := me.names.DecryptName(target); err == nil {
+		return plain, 0
+	}
+	return target, 0
+}
+
+func (me *NameCryptFS) Reconfigure(cfg map[string]string) int {
+	if rfs, ok := me.fs.(Reconfigurable); ok {
+		return rfs.Reconfigure(cfg)
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+package fscommon
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNamePatterns(t *testing.T) {
+	names := testCryptKey(t).NameCipher()
+	key, ok := names.EncryptPath("/logs/app.log")
+	if ok < 0 {
+		t.Fatalf("EncryptPath: %d", ok)
+	}
+	if plain := names.PlainPath(key); plain != "/logs/app.log" {
+		t.Fatalf("PlainPath: %s", plain)
+	}
+	block := fmt.Sprintf("$cache$/%s/blocks/0", strings.Trim(key, "/"))
+
+	policy, _ := NewObjectPolicy(map[string]string{"ObjectPolicy": "logs:storage_class=IA"})
+	comp, _ := NewCompressor(map[string]string{"Compression": COMPRESS_GZIP, "CompressionPatterns": "*.log"})
+	policy.SetNames(names)
+	comp.SetNames(names)
+	for _, k := range []string{key, block} {
+		if opts := policy.Options(k); k == key && opts.StorageClass != STORAGE_IA {
+			t.Errorf("object policy of %s: %+v", k, opts)
+		}
+		if !comp.Match(k) {
+			t.Errorf("%s is not compressed", k)
+		}
+	}
+
+	//quota prefixes are encrypted, keys are matched with them
+	mgr := NewQuotaMgr(0, 0, 0, func(prefix string) (int64, int64, int) {
+		return 100, 1, 0
+	})
+	mgr.SetKeyMapper(names.EncryptPath)
+	mgr.AddPrefixes("/logs:1000")
+	mgr.Refresh()
+	if ok := mgr.Check(key, 901); ok != ENOSPC {
+		t.Errorf("Check %s: %d, expected ENOSPC", key, ok)
+	}
+}
+
+func TestNameLength(t *testing.T) {
+	names := testCryptKey(t).NameCipher()
+	for n := 100; n < MAX_KEY_LENGTH; n += 10 {
+		key, ok := names.EncryptPath(strings.Repeat("a/", n/2))
+		if ok == ENAMETOOLONG {
+			break
+		}
+		//the longest helper object of the file fits in the limit
+		helper := fmt.Sprintf("$tmp$/$slice$/%s/files/%d.dat.tmp3", key, int64(1)<<62)
+		if len(helper) > MAX_KEY_LENGTH {
+			t.Fatalf("helper key of %d bytes", len(helper))
+		}
+	}
+}
+
+//links stored as a driver does, targets up to MAX_LINK_OBJECT_SIZE are taken
+type linkFS struct {
+	FileSystemImpl
+	links map[string]string
+}
+
+func (me *linkFS) Symlink(target string, linkPath string) int {
+	if len(target) == 0 || len(target) > MAX_LINK_OBJECT_SIZE {
+		return EINVAL
+	}
+	me.links[linkPath] = target
+	return 0
+}
+
+func (me *linkFS) Readlink(path string) (string, int) {
+	target, ok := me.links[path]
+	if !ok {
+		return "", ENOENT
+	}
+	return target, 0
+}
+
+func TestNameSymlink(t *testing.T) {
+	fs := NewNameCryptFS(&linkFS{links: make(map[string]string)}, testCryptKey(t).NameCipher())
+	for _, target := range []string{"../a", "/" + strings.Repeat("long/", (MAX_LINK_SIZE-1)/5)} {
+		if ok := fs.Symlink(target, "/link"); ok < 0 {
+			t.Fatalf("Symlink to %d bytes: %d", len(target), ok)
+		}
+		if plain, ok := fs.Readlink("/link"); ok < 0 || plain != target {
+			t.Fatalf("Readlink of %d bytes: %d, target mismatch", len(target), ok)
+		}
+	}
+	if ok := fs.Symlink(strings.Repeat("a", MAX_LINK_SIZE+1), "/link"); ok != EINVAL {
+		t.Errorf("Symlink to a target too long: %d, expected EINVAL", ok)
+	}
+}
@@ -0,0 +1,247 @@
+package fscommon
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"path"
+	"strings"
+)
+
+//server-side encryption and storage class of new objects
+//they are set per mount, and may be overridden by rules of path patterns (driver key ObjectPolicy)
+//rules are separated by semicolons, a rule is pattern:option=value,option=value,...
+//options are sse (none, s3, kms, c), kms_key_id, sse_c_key_file and storage_class
+//e.g. archive:storage_class=ARCHIVE;secret/*:sse=kms,kms_key_id=alias/secret
+//a pattern matches an object or any of its parent directories, see path.Match,
+//a pattern without a slash matches the base name, the first matching rule wins
+//helper objects (e.g. cache blocks) follow the rules of their files, but they are kept in the default storage class
+const (
+	SSE_NONE = "none"
+	SSE_S3   = "s3"  //keys managed by the storage, SSE-S3 or SSE-OSS
+	SSE_KMS  = "kms" //keys in KMS, the default key if KmsKeyId is not set
+	SSE_C    = "c"   //customer key, it's sent with every request of the object
+
+	//generic storage classes, drivers map them to their own names, others are passed as they are
+	STORAGE_STANDARD     = "STANDARD"
+	STORAGE_IA           = "IA"
+	STORAGE_ARCHIVE      = "ARCHIVE"
+	STORAGE_COLD_ARCHIVE = "COLD_ARCHIVE"
+
+	//read-only extended attributes of the settings an object is stored with
+	XATTR_STORAGE_PREFIX = "user.storage."
+	XATTR_SSE            = XATTR_STORAGE_PREFIX + "sse"
+	XATTR_KMS_KEY_ID     = XATTR_STORAGE_PREFIX + "kms_key_id"
+	XATTR_STORAGE_CLASS  = XATTR_STORAGE_PREFIX + "class"
+)
+
+type ObjectOptions struct {
+	SSE          string
+	KmsKeyId     string
+	CustomerKey  []byte //32 bytes, SSE-C only
+	StorageClass string
+}
+
+type objectRule struct {
+	pattern string
+	opts    ObjectOptions
+}
+
+type ObjectPolicy struct {
+	dft   ObjectOptions
+	rules []objectRule
+	names *NameCipher //keys are decrypted before they are matched, nil if names are not encrypted
+}
+
+//create the policy from driver config, see csmgr/factory.go for the keys
+//it's nil if nothing is set, objects get the defaults of the bucket then
+func NewObjectPolicy(cfg map[string]string) (*ObjectPolicy, int) {
+	me := &ObjectPolicy{}
+	set := false
+	for key, opt := range map[string]string{
+		"Sse":                "sse",
+		"SseKmsKeyId":        "kms_key_id",
+		"SseCustomerKeyFile": "sse_c_key_file",
+		"StorageClass":       "storage_class",
+	} {
+		if val := cfg[key]; len(val) > 0 {
+			if ok := me.dft.set(opt, val); ok < 0 {
+				return nil, ok
+			}
+			set = true
+		}
+	}
+	if ok := me.dft.check(); ok < 0 {
+		return nil, ok
+	}
+
+	for _, rule := range strings.Split(cfg["ObjectPolicy"], ";") {
+		rule = strings.TrimSpace(rule)
+		if len(rule) == 0 {
+			continue
+		}
+		idx := strings.Index(rule, ":")
+		if idx <= 0 || len(strings.Trim(rule[:idx], "/")) == 0 {
+			dlog.Errorf("Invalid object policy: %s", rule)
+			return nil, EINVAL
+		}
+		pattern := strings.Trim(rule[:idx], "/")
+		if _, err := path.Match(pattern, ""); err != nil {
+			dlog.Errorf("Invalid pattern of object policy %s: %s", rule, err)
+			return nil, EINVAL
+		}
+		r := objectRule{pattern: pattern, opts: me.dft}
+		for _, opt := range strings.Split(rule[idx+1:], ",") {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 {
+				dlog.Errorf("Invalid object policy: %s", rule)
+				return nil, EINVAL
+			}
+			if ok := r.opts.set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])); ok < 0 {
+				return nil, ok
+			}
+		}
+		if ok := r.opts.check(); ok < 0 {
+			return nil, ok
+		}
+		me.rules = append(me.rules, r)
+		set = true
+	}
+
+	if !set {
+		return nil, 0
+	}
+	return me, 0
+}
+
+func (me *ObjectOptions) set(opt string, val string) int {
+	switch opt {
+	case "sse":
+		val = strings.ToLower(val)
+		if val != SSE_NONE && val != SSE_S3 && val != SSE_KMS && val != SSE_C {
+			dlog.Errorf("Unknown server-side encryption: %s", val)
+			return EINVAL
+		}
+		me.SSE = val
+	case "kms_key_id":
+		me.KmsKeyId = val
+	case "sse_c_key_file":
+		key, err := loadKeyFile(val)
+		if err != nil {
+			dlog.Errorf("Failed to load SSE-C key %s: %s", val, err)
+			return EINVAL
+		}
+		me.CustomerKey = key
+	case "storage_class":
+		me.StorageClass = val
+		switch strings.ToUpper(val) {
+		case STORAGE_STANDARD, STORAGE_IA, STORAGE_ARCHIVE, STORAGE_COLD_ARCHIVE:
+			me.StorageClass = strings.ToUpper(val)
+		}
+	default:
+		dlog.Errorf("Unknown object option: %s", opt)
+		return EINVAL
+	}
+	return 0
+}
+
+func (me *ObjectOptions) check() int {
+	if me.SSE == SSE_C && len(me.CustomerKey) != CRYPT_KEY_SIZE {
+		dlog.Errorf("SSE-C requires a key file of %d bytes", CRYPT_KEY_SIZE)
+		return EINVAL
+	}
+	return 0
+}
+
+//patterns are matched with plain paths of encrypted keys, see NameCryptFS
+func (me *ObjectPolicy) SetNames(names *NameCipher) {
+	if me != nil {
+		me.names = names
+	}
+}
+
+//options of an object key, nil if the policy is nil
+func (me *ObjectPolicy) Options(key string) *ObjectOptions {
+	if me == nil {
+		return nil
+	}
+	if me.names != nil {
+		key = me.names.PlainPath(key)
+	}
+	key, helper := helperFile(key)
+	opts := me.dft
+	for _, r := range me.rules {
+		if MatchPath(r.pattern, key) {
+			opts = r.opts
+			break
+		}
+	}
+	if helper {
+		opts.StorageClass = ""
+	}
+	return &opts
+}
+
+//path of the file a helper object belongs to, e.g. a/b of $cache$/a/b/blocks/0
+//the key is returned without slashes around if it's not a helper object
+func helperFile(key string) (string, bool) {
+	key = strings.Trim(key, "/")
+	if idx := strings.Index(key, "/"); idx > 0 && key[0] == '$' && key[idx-1] == '$' {
+		return key[idx+1:], true
+	}
+	return key, false
+}
+
+//check if a key is a helper object, e.g. slice data or cache blocks, rather than a file
+func IsHelperKey(key string) bool {
+	_, helper := helperFile(key)
+	return helper
+}
+
+//check if a pattern matches a path or any of its parent directories, see path.Match
+//a pattern without a slash matches base names
+func MatchPath(pattern string, key string) bool {
+	byName := !strings.Contains(pattern, "/")
+	for p := key; len(p) > 0 && p != "." && p != "/"; p = path.Dir(p) {
+		name := p
+		if byName {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//server-side encryption of the options, SSE_NONE is not set
+func (me *ObjectOptions) Encryption() string {
+	if me == nil || me.SSE == SSE_NONE {
+		return ""
+	}
+	return me.SSE
+}
+
+//base64 of the customer key and its MD5, as they are sent in headers
+func (me *ObjectOptions) CustomerKeyHeaders() (string, string) {
+	sum := md5.Sum(me.CustomerKey)
+	return base64.StdEncoding.EncodeToString(me.CustomerKey), base64.StdEncoding.EncodeToString(sum[:])
+}
+
+//read-only extended attributes of the settings an object is stored with
+func (me *ObjectOptions) XAttrs() XAttrs {
+	xa := make(XAttrs)
+	if len(me.SSE) > 0 {
+		xa[XATTR_SSE] = []byte(me.SSE)
+	}
+	if len(me.KmsKeyId) > 0 {
+		xa[XATTR_KMS_KEY_ID] = []byte(me.KmsKeyId)
+	}
+	if len(me.StorageClass) > 0 {
+		xa[XATTR_STORAGE_CLASS] = []byte(me.StorageClass)
+	}
+	return xa
+}
+
+func IsStorageXAttr(name string) bool {
+	return strings.HasPrefix(name, XATTR_STORAGE_PREFIX)
+}
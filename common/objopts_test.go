@@ -0,0 +1,78 @@
+package fscommon
+
+import (
+	"testing"
+)
+
+func TestObjectPolicy(t *testing.T) {
+	policy, ok := NewObjectPolicy(map[string]string{
+		"Sse":          "S3",
+		"ObjectPolicy": "archive:storage_class=archive; secret/*:sse=kms,kms_key_id=alias/secret ;*.log:storage_class=IA;secret/*.log:storage_class=GLACIER",
+	})
+	if ok < 0 {
+		t.Fatalf("NewObjectPolicy: %d", ok)
+	}
+	names := testCryptKey(t).NameCipher()
+	encrypted, _ := NewObjectPolicy(map[string]string{"ObjectPolicy": "secret/*:sse=kms"})
+	encrypted.SetNames(names)
+	key, _ := names.EncryptPath("/secret/a.txt")
+
+	for _, c := range []struct {
+		policy       *ObjectPolicy
+		key          string
+		sse          string
+		kmsKeyId     string
+		storageClass string
+	}{
+		//no match, the defaults of the mount
+		{policy, "a.txt", SSE_S3, "", ""},
+		{policy, "/", SSE_S3, "", ""},
+		//a pattern without a slash matches base names of the key and its parent directories
+		{policy, "archive", SSE_S3, "", STORAGE_ARCHIVE},
+		{policy, "/a/archive/b/c.txt", SSE_S3, "", STORAGE_ARCHIVE},
+		{policy, "archived", SSE_S3, "", ""},
+		{policy, "a/b.log", SSE_S3, "", STORAGE_IA},
+		//a pattern with a slash matches from the root
+		{policy, "secret/a.txt", SSE_KMS, "alias/secret", ""},
+		{policy, "a/secret/a.txt", SSE_S3, "", ""},
+		//the first match wins
+		{policy, "secret/b.log", SSE_KMS, "alias/secret", ""},
+		{policy, "archive/b.log", SSE_S3, "", STORAGE_ARCHIVE},
+		//helper objects follow their files, in the default storage class
+		{policy, "$cache$/archive/blocks/0", SSE_S3, "", ""},
+		{policy, "$cache$/secret/a.txt/blocks/0", SSE_KMS, "alias/secret", ""},
+		//encrypted keys are matched with their plain paths
+		{encrypted, key, SSE_KMS, "", ""},
+		{encrypted, "secret/a.txt", SSE_KMS, "", ""},
+		{encrypted, "/" + names.EncryptName("a.txt"), "", "", ""},
+	} {
+		opts := c.policy.Options(c.key)
+		if opts.SSE != c.sse || opts.KmsKeyId != c.kmsKeyId || opts.StorageClass != c.storageClass {
+			t.Errorf("options of %s: %+v, expected sse %s, kms key %s, storage class %s", c.key, opts, c.sse, c.kmsKeyId, c.storageClass)
+		}
+	}
+}
+
+func TestObjectPolicyInvalid(t *testing.T) {
+	if policy, ok := NewObjectPolicy(map[string]string{}); policy != nil || ok < 0 {
+		t.Errorf("empty policy: %v, %d", policy, ok)
+	}
+	if opts := (*ObjectPolicy)(nil).Options("a"); opts != nil {
+		t.Errorf("options of a nil policy: %+v", opts)
+	}
+	for _, cfg := range []map[string]string{
+		{"Sse": "aes"},
+		{"Sse": "c"},
+		{"ObjectPolicy": "archive"},
+		{"ObjectPolicy": ":storage_class=IA"},
+		{"ObjectPolicy": "/:storage_class=IA"},
+		{"ObjectPolicy": "[a:storage_class=IA"},
+		{"ObjectPolicy": "a:storage_class"},
+		{"ObjectPolicy": "a:class=IA"},
+		{"ObjectPolicy": "a:sse=c"},
+	} {
+		if _, ok := NewObjectPolicy(cfg); ok != EINVAL {
+			t.Errorf("NewObjectPolicy(%v): %d, expected EINVAL", cfg, ok)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package fscommon
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//POSIX attributes are saved as object user meta data
+//we use the same keys and formats as s3fs, e.g. x-amz-meta-mode, x-amz-meta-mtime
+//so that a bucket can be shared with s3fs/goofys mounts
+const (
+	META_UID   = "uid"
+	META_GID   = "gid"
+	META_MODE  = "mode"
+	META_MTIME = "mtime"
+	META_ATIME = "atime"
+)
+
+//file type bits of unix mode, s3fs saves them together with permission bits
+const (
+	UNIX_S_IFMT  = 0170000
+	UNIX_S_IFDIR = 0040000
+	UNIX_S_IFREG = 0100000
+	UNIX_S_IFLNK = 0120000
+)
+
+const (
+	DEFAULT_FILE_PERM = 0644
+	DEFAULT_DIR_PERM  = 0755
+	DEFAULT_LINK_PERM = 0777
+
+	//max length of symbolic link target
+	MAX_LINK_SIZE = 4096
+	//max size of the object of a link, the target is stored encrypted with name encryption, see NameCryptFS
+	MAX_LINK_OBJECT_SIZE = ((nameIVSize+MAX_LINK_SIZE)*4 + 2) / 3
+
+	//max concurrent requests when loading attributes for directory entries
+	MAX_STAT_WORKERS = 16
+	//max objects in ListMetaCache, it's emptied when it's full
+	MAX_LIST_META = 100000
+)
+
+//object user meta data
+//keys are in lower case, without vendor prefix (x-amz-meta-/x-oss-meta-)
+type ObjectMeta map[string]string
+
+//convert http style meta data headers to ObjectMeta
+func NewObjectMeta(headers map[string][]string, prefix string) ObjectMeta {
+	md := make(ObjectMeta)
+	prefix = strings.ToLower(prefix)
+	for key, vals := range headers {
+		key = strings.ToLower(key)
+		if !strings.HasPrefix(key, prefix) || len(vals) == 0 {
+			continue
+		}
+		md[key[len(prefix):]] = vals[0]
+	}
+	return md
+}
+
+//merge meta data from another map, existing keys get overwritten
+func (me ObjectMeta) Merge(md ObjectMeta) ObjectMeta {
+	for key, val := range md {
+		me[key] = val
+	}
+	return me
+}
+
+//remove keys with empty value
+func (me ObjectMeta) Compact() ObjectMeta {
+	for key, val := range me {
+		if len(val) == 0 {
+			delete(me, key)
+		}
+	}
+	return me
+}
+
+//size of meta data in request headers, vendors limit it
+func (me ObjectMeta) Size() int {
+	n := 0
+	for key, val := range me {
+		n += len(key) + len(val)
+	}
+	return n
+}
+
+//get attributes for a newly created file or directory
+//owner is the user running csmgr, like what s3fs does when there is no uid/gid meta data
+func NewAttr(name string, iType int) *DirItem {
+	di := &DirItem{
+		DiName:  name,
+		DiType:  iType,
+		DiMtime: time.Now(),
+	}
+	switch iType {
+	case S_IFDIR:
+		di.DiMode = DEFAULT_DIR_PERM
+	case S_IFLNK:
+		di.DiMode = DEFAULT_LINK_PERM
+	default:
+		di.DiMode = DEFAULT_FILE_PERM
+	}
+	if uid := os.Getuid(); uid > 0 {
+		di.DiUid = uint32(uid)
+	}
+	if gid := os.Getgid(); gid > 0 {
+		di.DiGid = uint32(gid)
+	}
+	return di
+}
+
+//get unix style mode, include file type bits
+func (me *DirItem) UnixMode() uint32 {
+	mode := uint32(me.DiMode.Perm())
+	switch me.DiType {
+	case S_IFDIR:
+		if mode == 0 {
+			mode = DEFAULT_DIR_PERM
+		}
+		mode |= UNIX_S_IFDIR
+	case S_IFLNK:
+		if mode == 0 {
+			mode = DEFAULT_LINK_PERM
+		}
+		mode |= UNIX_S_IFLNK
+	default:
+		if mode == 0 {
+			mode = DEFAULT_FILE_PERM
+		}
+		mode |= UNIX_S_IFREG
+	}
+	return mode
+}
+
+//POSIX attributes and other user meta data of the object
+func (me *DirItem) ToMeta() ObjectMeta {
+	md := make(ObjectMeta).Merge(me.DiMeta)
+	md[META_UID] = strconv.FormatUint(uint64(me.DiUid), 10)
+	md[META_GID] = strconv.FormatUint(uint64(me.DiGid), 10)
+	md[META_MODE] = strconv.FormatUint(uint64(me.UnixMode()), 10)
+	if !me.DiMtime.IsZero() {
+		md[META_MTIME] = strconv.FormatInt(me.DiMtime.Unix(), 10)
+	}
+	if !me.DiAtime.IsZero() {
+		md[META_ATIME] = strconv.FormatInt(me.DiAtime.Unix(), 10)
+	}
+	return md
+}
+
+//load POSIX attributes from object meta data
+//attributes which are not in meta data are left unchanged
+func (me *DirItem) FromMeta(md ObjectMeta) {
+	me.DiMeta = md
+	if val, ok := md[META_UID]; ok {
+		if n, err := strconv.ParseUint(val, 10, 32); err == nil {
+			me.DiUid = uint32(n)
+		}
+	}
+	if val, ok := md[META_GID]; ok {
+		if n, err := strconv.ParseUint(val, 10, 32); err == nil {
+			me.DiGid = uint32(n)
+		}
+	}
+	if val, ok := md[META_MODE]; ok {
+		if n, err := strconv.ParseUint(val, 10, 32); err == nil {
+			me.DiMode = (me.DiMode &^ os.ModePerm) | os.FileMode(n).Perm()
+			//symbolic link is a regular object with S_IFLNK in mode, like s3fs does
+			if (n & UNIX_S_IFMT) == UNIX_S_IFLNK {
+				me.DiType = S_IFLNK
+			}
+		}
+	}
+	if val, ok := md[META_MTIME]; ok {
+		if tm, ok := parseMetaTime(val); ok {
+			me.DiMtime = tm
+		}
+	}
+	if val, ok := md[META_ATIME]; ok {
+		if tm, ok := parseMetaTime(val); ok {
+			me.DiAtime = tm
+		}
+	}
+}
+
+//s3fs saves time as seconds, some other tools save it with fraction part
+func parseMetaTime(val string) (time.Time, bool) {
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+}
+
+//a listed entry may be a symbolic link, its object is as small as the target
+//links are told by mode in meta data, which list requests don't return
+func MayBeLink(di *DirItem) bool {
+	return di.DiType == S_IFREG && di.DiSize > 0 && di.DiSize <= MAX_LINK_OBJECT_SIZE
+}
+
+//load attributes for directory entries in parallel
+//list requests do not return user meta data, so we have to check entries one by one
+//stat is called with index of the entry in the list
+func StatDirItems(dis []os.FileInfo, stat func(i int, di *DirItem)) {
+	var wg sync.WaitGroup
+	sem := make(chan bool, MAX_STAT_WORKERS)
+	for i, fi := range dis {
+		di, ok := fi.(*DirItem)
+		if !ok || di == nil {
+			continue
+		}
+		wg.Add(1)
+		sem <- true
+		go func(i int, di *DirItem) {
+			defer wg.Done()
+			stat(i, di)
+			<-sem
+		}(i, di)
+	}
+	wg.Wait()
+}
+
+//meta data of listed objects, so that an object isn't checked again each time its directory is listed
+//an entry is used while the object has the same ETag and modification time,
+//a copy which replaces meta data keeps the ETag but changes the time
+type ListMetaCache struct {
+	items map[string]listedMeta
+	mtx   sync.Mutex
+}
+
+type listedMeta struct {
+	tag   string
+	mtime time.Time
+	meta  ObjectMeta
+}
+
+func (me *ListMetaCache) Get(key, tag string, mtime time.Time) (ObjectMeta, bool) {
+	if me == nil || len(tag) == 0 {
+		return nil, false
+	}
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	it, ok := me.items[key]
+	if !ok || it.tag != tag || !it.mtime.Equal(mtime) {
+		return nil, false
+	}
+	return make(ObjectMeta).Merge(it.meta), true
+}
+
+func (me *ListMetaCache) Put(key, tag string, mtime time.Time, meta ObjectMeta) {
+	if me == nil || len(tag) == 0 {
+		return
+	}
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	if me.items == nil || len(me.items) >= MAX_LIST_META {
+		me.items = make(map[string]listedMeta)
+	}
+	me.items[key] = listedMeta{tag: tag, mtime: mtime, meta: make(ObjectMeta).Merge(meta)}
+}
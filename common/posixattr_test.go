@@ -0,0 +1,35 @@
+package fscommon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListMetaCache(t *testing.T) {
+	var cache ListMetaCache
+	mtime := time.Unix(1000, 0)
+	cache.Put("a", `"tag"`, mtime, ObjectMeta{META_SIZE: "10"})
+
+	if md, ok := cache.Get("a", `"tag"`, mtime); !ok || md[META_SIZE] != "10" {
+		t.Fatalf("Get: %v, %v", md, ok)
+	}
+	//meta data replaced by a copy, or data written again
+	for _, r := range []struct {
+		tag   string
+		mtime time.Time
+	}{{`"tag"`, mtime.Add(time.Second)}, {`"other"`, mtime}, {"", mtime}} {
+		if _, ok := cache.Get("a", r.tag, r.mtime); ok {
+			t.Errorf("Get with ETag %s at %v: found", r.tag, r.mtime)
+		}
+	}
+	if _, ok := cache.Get("b", `"tag"`, mtime); ok {
+		t.Error("Get of another object: found")
+	}
+
+	//meta data returned can be changed
+	md, _ := cache.Get("a", `"tag"`, mtime)
+	md[META_SIZE] = "20"
+	if md, _ = cache.Get("a", `"tag"`, mtime); md[META_SIZE] != "10" {
+		t.Errorf("cached meta data is changed: %s", md[META_SIZE])
+	}
+}
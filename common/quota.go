@@ -0,0 +1,299 @@
+package fscommon
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//StatFs reports usage of the bucket against a configured quota
+//usage is tracked incrementally with writes, and reconciled in background by a scan function,
+//which may list objects under the prefix or use statistics provided by the vendor, e.g. aliyun bucket stat
+const (
+	STATFS_BLOCK_SIZE  = 1024 * 128
+	STATFS_FAKE_BLOCKS = 1024 * 1024 * 1024 //reported when there is no quota
+	STATFS_FAKE_FILES  = 1024 * 1024 * 1024
+
+	DEFAULT_USAGE_SCAN_INTERVAL = 300 //seconds
+)
+
+//returns total size and object count under the prefix, empty prefix for the whole bucket
+//prefix is a directory like "a/b/" without leading slash, keys of files may have a leading slash or not,
+//both should be counted, helper objects (see IsHelperKey) should not
+type UsageScanFunc func(prefix string) (size int64, count int64, rc int)
+
+//usage and quota of a path prefix
+type UsageCounter struct {
+	Prefix    string //path prefix without slashes around, empty for the whole mount
+	Quota     int64  //hard limit in bytes, writes fail when exceeded, 0 means no limit
+	SoftQuota int64  //soft limit in bytes, only warnings are logged when exceeded
+
+	size       int64
+	count      int64
+	loaded     bool
+	softWarned bool
+
+	mtx sync.Mutex
+}
+
+func NewUsageCounter(prefix string, quota int64, softQuota int64) *UsageCounter {
+	return &UsageCounter{
+		Prefix:    strings.Trim(prefix, "/"),
+		Quota:     quota,
+		SoftQuota: softQuota,
+	}
+}
+
+//check if path is under the prefix of this counter
+func (me *UsageCounter) Match(path string) bool {
+	if len(me.Prefix) == 0 {
+		return true
+	}
+	//match whole path components only
+	path = strings.Trim(path, "/")
+	return path == me.Prefix || strings.HasPrefix(path, me.Prefix+"/")
+}
+
+//prefix of keys to scan
+func (me *UsageCounter) scanPrefix() string {
+	if len(me.Prefix) == 0 {
+		return ""
+	}
+	return me.Prefix + "/"
+}
+
+//replace tracked usage with a scan result
+func (me *UsageCounter) Reconcile(size int64, count int64) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	if me.loaded && me.size != size {
+		dlog.Infof("Usage of \"%s\" is reconciled: %d -> %d bytes", me.Prefix, me.size, size)
+	}
+	me.size = size
+	me.count = count
+	me.loaded = true
+}
+
+//track usage change between scans
+func (me *UsageCounter) Add(delta int64) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	me.size += delta
+	if me.size < 0 {
+		me.size = 0
+	}
+}
+
+func (me *UsageCounter) Get() (size int64, count int64) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	return me.size, me.count
+}
+
+//check if another n bytes can be written
+//writes are allowed before the first scan completes
+func (me *UsageCounter) Check(n int64) int {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	if !me.loaded || n <= 0 {
+		return 0
+	}
+	if me.Quota > 0 && me.size+n > me.Quota {
+		return ENOSPC
+	}
+	//warn once each time soft quota is crossed
+	if me.SoftQuota > 0 {
+		if me.size+n > me.SoftQuota {
+			if !me.softWarned {
+				dlog.Warnf("Soft quota of \"%s\" is exceeded: %d of %d bytes", me.Prefix, me.size+n, me.SoftQuota)
+				me.softWarned = true
+			}
+		} else {
+			me.softWarned = false
+		}
+	}
+	return 0
+}
+
+func (me *UsageCounter) StatFs() *FsInfo {
+	size, count := me.Get()
+	used := uint64((size + STATFS_BLOCK_SIZE - 1) / STATFS_BLOCK_SIZE)
+
+	blocks := uint64(STATFS_FAKE_BLOCKS)
+	if me.Quota > 0 {
+		blocks = uint64(me.Quota / STATFS_BLOCK_SIZE)
+	}
+	free := uint64(0)
+	if blocks > used {
+		free = blocks - used
+	}
+
+	files := uint64(STATFS_FAKE_FILES)
+	ffree := uint64(0)
+	if files > uint64(count) {
+		ffree = files - uint64(count)
+	}
+
+	return &FsInfo{
+		Blocks: blocks,
+		Bfree:  free,
+		Bavail: free,
+		Files:  files,
+		Ffree:  ffree,
+		Bsize:  STATFS_BLOCK_SIZE,
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+//quotas of a mount, one counter for the whole mount and one for each configured prefix
+type QuotaMgr struct {
+	mount    *UsageCounter
+	prefixes []*UsageCounter
+
+	scan     UsageScanFunc
+	mapKey   func(path string) (string, int) //paths of prefix rules to keys, nil if they're the same
+	interval time.Duration
+	stop     chan bool
+	mtx      sync.Mutex
+}
+
+func NewQuotaMgr(quota int64, softQuota int64, interval int, scan UsageScanFunc) *QuotaMgr {
+	if interval <= 0 {
+		interval = DEFAULT_USAGE_SCAN_INTERVAL
+	}
+	return &QuotaMgr{
+		mount:    NewUsageCounter("", quota, softQuota),
+		scan:     scan,
+		interval: time.Duration(interval) * time.Second,
+	}
+}
+
+//add quota for a path prefix, should be called before Start
+func (me *QuotaMgr) AddPrefix(prefix string, quota int64, softQuota int64) {
+	me.prefixes = append(me.prefixes, NewUsageCounter(prefix, quota, softQuota))
+}
+
+//map paths of prefix rules to object keys, e.g. when names are encrypted
+//it must be set before the rules are added
+func (me *QuotaMgr) SetKeyMapper(mapKey func(path string) (string, int)) {
+	me.mapKey = mapKey
+}
+
+//add prefix quotas in format "prefix:hard[:soft],...", sizes are in bytes
+func (me *QuotaMgr) AddPrefixes(rules string) int {
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if len(rule) == 0 {
+			continue
+		}
+		parts := strings.Split(rule, ":")
+		if len(parts) < 2 || len(parts) > 3 || len(strings.Trim(parts[0], "/")) == 0 {
+			dlog.Errorf("Invalid prefix quota: %s", rule)
+			return EINVAL
+		}
+		var limits [2]int64
+		for i, val := range parts[1:] {
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || n < 0 {
+				dlog.Errorf("Invalid prefix quota: %s", rule)
+				return EINVAL
+			}
+			limits[i] = n
+		}
+		prefix := parts[0]
+		if me.mapKey != nil {
+			var ok int
+			if prefix, ok = me.mapKey(prefix); ok < 0 {
+				dlog.Errorf("Invalid prefix quota: %s", rule)
+				return ok
+			}
+		}
+		me.AddPrefix(prefix, limits[0], limits[1])
+	}
+	return 0
+}
+
+//start background reconciliation, the first scan is run immediately
+func (me *QuotaMgr) Start() {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	if me.stop != nil || me.scan == nil {
+		return
+	}
+	me.stop = make(chan bool)
+	go me.run(me.stop)
+}
+
+func (me *QuotaMgr) Stop() {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	if me.stop != nil {
+		close(me.stop)
+		me.stop = nil
+	}
+}
+
+func (me *QuotaMgr) run(stop chan bool) {
+	ticker := time.NewTicker(me.interval)
+	defer ticker.Stop()
+	for {
+		me.Refresh()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+//load usage of the mount and all prefixes from remote now
+func (me *QuotaMgr) Refresh() int {
+	rc := 0
+	for _, uc := range me.counters() {
+		size, count, ok := me.scan(uc.scanPrefix())
+		if ok < 0 {
+			dlog.Warnf("Failed to load usage of \"%s\": %d", uc.Prefix, ok)
+			rc = ok
+			continue
+		}
+		uc.Reconcile(size, count)
+		dlog.Infof("Usage of \"%s\": %d bytes, %d objects", uc.Prefix, size, count)
+	}
+	return rc
+}
+
+func (me *QuotaMgr) counters() []*UsageCounter {
+	return append([]*UsageCounter{me.mount}, me.prefixes...)
+}
+
+//check if another n bytes can be written to path
+func (me *QuotaMgr) Check(path string, n int64) int {
+	for _, uc := range me.counters() {
+		if !uc.Match(path) {
+			continue
+		}
+		if ok := uc.Check(n); ok < 0 {
+			dlog.Warnf("Quota of \"%s\" is exceeded by %s.", uc.Prefix, path)
+			return ok
+		}
+	}
+	return 0
+}
+
+//track size change of path
+func (me *QuotaMgr) Add(path string, delta int64) {
+	if delta == 0 {
+		return
+	}
+	for _, uc := range me.counters() {
+		if uc.Match(path) {
+			uc.Add(delta)
+		}
+	}
+}
+
+func (me *QuotaMgr) StatFs() *FsInfo {
+	return me.mount.StatFs()
+}
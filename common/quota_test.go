@@ -0,0 +1,49 @@
+package fscommon
+
+import (
+	"testing"
+)
+
+func TestQuotaPrefix(t *testing.T) {
+	var scanned []string
+	mgr := NewQuotaMgr(0, 0, 0, func(prefix string) (int64, int64, int) {
+		scanned = append(scanned, prefix)
+		return 100, 1, 0
+	})
+	if ok := mgr.AddPrefixes("/team-a/:1000"); ok < 0 {
+		t.Fatalf("AddPrefixes: %d", ok)
+	}
+	mgr.Refresh()
+	if len(scanned) != 2 || scanned[0] != "" || scanned[1] != "team-a/" {
+		t.Fatalf("scanned prefixes: %q", scanned)
+	}
+
+	//keys by WebDAV have a leading slash, keys by FUSE don't
+	for _, path := range []string{"/team-a/x", "team-a/x", "/team-a"} {
+		if ok := mgr.Check(path, 901); ok != ENOSPC {
+			t.Fatalf("Check %s: %d, expected ENOSPC", path, ok)
+		}
+	}
+	if ok := mgr.Check("/team-ab/x", 901); ok < 0 {
+		t.Fatalf("Check /team-ab/x: %d", ok)
+	}
+	mgr.Add("/team-a/x", -100)
+	if ok := mgr.Check("team-a/y", 901); ok < 0 {
+		t.Fatalf("Check after Add: %d", ok)
+	}
+}
+
+func TestIsHelperKey(t *testing.T) {
+	for key, helper := range map[string]bool{
+		"$slice$//a/b/meta":  true,
+		"$cache$/a/blocks/0": true,
+		"$chunk$/ab/abcdef":  true,
+		"/a/b":               false,
+		"$a/b":               false,
+		"a$/$b$/c":           false,
+	} {
+		if IsHelperKey(key) != helper {
+			t.Errorf("IsHelperKey(%s) != %v", key, helper)
+		}
+	}
+}
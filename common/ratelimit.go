@@ -0,0 +1,362 @@
+package fscommon
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//limits of backend traffic, per mount and optionally per client
+//bandwidth is in bytes per second, requests in requests per second, 0 for no limit
+const (
+	DEFAULT_CLIENT_IDLE_TIME = 10 * 60 //seconds before limits of an idle client are dropped
+)
+
+//token bucket, tokens are refilled at rate per second up to burst
+//a request larger than burst runs into debt, and later requests wait for it to be paid
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mtx    sync.Mutex
+}
+
+func NewTokenBucket(rate int64, burst int64) *TokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+//take n tokens, wait until they are available or ctx is done
+//a nil bucket means no limit
+func (me *TokenBucket) WaitN(ctx context.Context, n int64) int {
+	if me == nil || n <= 0 {
+		return 0
+	}
+
+	me.mtx.Lock()
+	now := time.Now()
+	me.tokens += now.Sub(me.last).Seconds() * me.rate
+	if me.tokens > me.burst {
+		me.tokens = me.burst
+	}
+	me.last = now
+	me.tokens -= float64(n)
+	wait := time.Duration(0)
+	if me.tokens < 0 {
+		wait = time.Duration(-me.tokens / me.rate * float64(time.Second))
+	}
+	me.mtx.Unlock()
+
+	if wait == 0 {
+		return 0
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return 0
+	case <-ctx.Done():
+		//the request is not going to be sent
+		me.refund(n)
+		return CtxErrno(ctx)
+	}
+}
+
+//give back n tokens taken by WaitN
+func (me *TokenBucket) refund(n int64) {
+	if me == nil || n <= 0 {
+		return
+	}
+	me.mtx.Lock()
+	me.tokens += float64(n)
+	if me.tokens > me.burst {
+		me.tokens = me.burst
+	}
+	me.mtx.Unlock()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+type RateLimits struct {
+	Upload   *TokenBucket
+	Download *TokenBucket
+	Requests *TokenBucket
+
+	lastUsed time.Time //for clients only
+}
+
+//nil if there is no limit at all
+func NewRateLimits(upload int64, download int64, rps int64) *RateLimits {
+	if upload <= 0 && download <= 0 && rps <= 0 {
+		return nil
+	}
+	me := &RateLimits{}
+	if upload > 0 {
+		me.Upload = NewTokenBucket(upload, 0)
+	}
+	if download > 0 {
+		me.Download = NewTokenBucket(download, 0)
+	}
+	if rps > 0 {
+		me.Requests = NewTokenBucket(rps, 0)
+	}
+	return me
+}
+
+func (me *RateLimits) wait(ctx context.Context, upload int64, download int64) int {
+	if me == nil {
+		return 0
+	}
+	if ok := me.Requests.WaitN(ctx, 1); ok < 0 {
+		return ok
+	}
+	if ok := me.Upload.WaitN(ctx, upload); ok < 0 {
+		me.refund(0, 0)
+		return ok
+	}
+	if ok := me.Download.WaitN(ctx, download); ok < 0 {
+		me.refund(upload, 0)
+		return ok
+	}
+	return 0
+}
+
+//give back tokens of a request which is not sent, a bucket which failed to wait has given back its own
+func (me *RateLimits) refund(upload int64, download int64) {
+	if me == nil {
+		return
+	}
+	me.Requests.refund(1)
+	me.Upload.refund(upload)
+	me.Download.refund(download)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+type clientKey struct{}
+
+//attach the client id, e.g. WebDAV user or FTP session, to the context of a request
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+func ClientOf(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+//limits of a mount, and limits of each client which are created on first use
+//limits can be changed by Update when config is reloaded
+type RateLimiter struct {
+	mount *RateLimits
+
+	clientUpload   int64
+	clientDownload int64
+	clientRps      int64
+	clients        map[string]*RateLimits
+	lastSweep      time.Time
+	mtx            sync.Mutex
+}
+
+//create a limiter from driver config, see csmgr/factory.go for the keys
+func NewRateLimiter(cfg map[string]string) *RateLimiter {
+	me := &RateLimiter{
+		clients:   make(map[string]*RateLimits),
+		lastSweep: time.Now(),
+	}
+	me.Update(cfg)
+	return me
+}
+
+//set limits from driver config, limits of clients are created again on their next request
+func (me *RateLimiter) Update(cfg map[string]string) {
+	getInt := func(key string) int64 {
+		n, _ := strconv.ParseInt(cfg[key], 10, 64)
+		return n
+	}
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	me.mount = NewRateLimits(getInt("RateUpload"), getInt("RateDownload"), getInt("RateRps"))
+	me.clientUpload = getInt("RateClientUpload")
+	me.clientDownload = getInt("RateClientDownload")
+	me.clientRps = getInt("RateClientRps")
+	me.clients = make(map[string]*RateLimits)
+}
+
+//limits of the client of ctx and the mount
+func (me *RateLimiter) limits(ctx context.Context) (*RateLimits, *RateLimits) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	id := ClientOf(ctx)
+	if len(id) == 0 || (me.clientUpload <= 0 && me.clientDownload <= 0 && me.clientRps <= 0) {
+		return nil, me.mount
+	}
+	now := time.Now()
+
+	//drop idle clients once in a while
+	if now.Sub(me.lastSweep) > DEFAULT_CLIENT_IDLE_TIME*time.Second {
+		for key, cl := range me.clients {
+			if now.Sub(cl.lastUsed) > DEFAULT_CLIENT_IDLE_TIME*time.Second {
+				delete(me.clients, key)
+			}
+		}
+		me.lastSweep = now
+	}
+
+	cl, ok := me.clients[id]
+	if !ok {
+		cl = NewRateLimits(me.clientUpload, me.clientDownload, me.clientRps)
+		me.clients[id] = cl
+	}
+	cl.lastUsed = now
+	return cl, me.mount
+}
+
+//wait for a request which sends upload bytes and receives download bytes
+//client limits are applied first, so a busy client doesn't hold tokens of the mount
+func (me *RateLimiter) Wait(ctx context.Context, upload int64, download int64) int {
+	if me == nil {
+		return 0
+	}
+	client, mount := me.limits(ctx)
+	if ok := client.wait(ctx, upload, download); ok < 0 {
+		return ok
+	}
+	if ok := mount.wait(ctx, upload, download); ok < 0 {
+		client.refund(upload, download)
+		return ok
+	}
+	return 0
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+//FileIO wrapper which applies rate limits to every operation
+//it goes inside RetryIO, so that each retry is counted
+type RateLimitIO struct {
+	io      FileIO
+	limiter *RateLimiter
+}
+
+func NewRateLimitIO(io FileIO, limiter *RateLimiter) *RateLimitIO {
+	return &RateLimitIO{io: io, limiter: limiter}
+}
+
+//the wrapped FileIO, for driver specific operations
+func (me *RateLimitIO) Base() FileIO {
+	return me.io
+}
+
+func (me *RateLimitIO) PutBuffer(name string, data []byte) int {
+	return me.PutBufferCtx(context.Background(), name, data)
+}
+
+func (me *RateLimitIO) PutBufferCtx(ctx context.Context, name string, data []byte) int {
+	if ok := me.limiter.Wait(ctx, int64(len(data)), 0); ok < 0 {
+		return ok
+	}
+	return IOWithContext(me.io).PutBufferCtx(ctx, name, data)
+}
+
+func (me *RateLimitIO) GetBuffer(name string, dest []byte, offset int64) int {
+	return me.GetBufferCtx(context.Background(), name, dest, offset)
+}
+
+//the object may be shorter than dest, tokens are taken for the whole buffer anyway
+func (me *RateLimitIO) GetBufferCtx(ctx context.Context, name string, dest []byte, offset int64) int {
+	if ok := me.limiter.Wait(ctx, 0, int64(len(dest))); ok < 0 {
+		return ok
+	}
+	return IOWithContext(me.io).GetBufferCtx(ctx, name, dest, offset)
+}
+
+func (me *RateLimitIO) GetAttr(path string) (os.FileInfo, int) {
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+func (me *RateLimitIO) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	if ok := me.limiter.Wait(ctx, 0, 0); ok < 0 {
+		return nil, ok
+	}
+	return IOWithContext(me.io).GetAttrCtx(ctx, path)
+}
+
+func (me *RateLimitIO) ListFile(path string) ([]os.FileInfo, int) {
+	return me.ListFileCtx(context.Background(), path)
+}
+
+func (me *RateLimitIO) ListFileCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
+	if ok := me.limiter.Wait(ctx, 0, 0); ok < 0 {
+		return nil, ok
+	}
+	return IOWithContext(me.io).ListFileCtx(ctx, path)
+}
+
+func (me *RateLimitIO) ZeroFile(name string) int {
+	return me.ZeroFileCtx(context.Background(), name)
+}
+
+func (me *RateLimitIO) ZeroFileCtx(ctx context.Context, name string) int {
+	if ok := me.limiter.Wait(ctx, 0, 0); ok < 0 {
+		return ok
+	}
+	return IOWithContext(me.io).ZeroFileCtx(ctx, name)
+}
+
+func (me *RateLimitIO) Unlink(path string) int {
+	return me.UnlinkCtx(context.Background(), path)
+}
+
+func (me *RateLimitIO) UnlinkCtx(ctx context.Context, path string) int {
+	if ok := me.limiter.Wait(ctx, 0, 0); ok < 0 {
+		return ok
+	}
+	return IOWithContext(me.io).UnlinkCtx(ctx, path)
+}
+
+func (me *RateLimitIO) GetMeta(name string) (ObjectMeta, int) {
+	return me.GetMetaCtx(context.Background(), name)
+}
+
+func (me *RateLimitIO) GetMetaCtx(ctx context.Context, name string) (ObjectMeta, int) {
+	if ok := me.limiter.Wait(ctx, 0, 0); ok < 0 {
+		return nil, ok
+	}
+	return IOWithContext(me.io).GetMetaCtx(ctx, name)
+}
+
+func (me *RateLimitIO) SetMeta(name string, meta ObjectMeta) int {
+	return me.SetMetaCtx(context.Background(), name, meta)
+}
+
+func (me *RateLimitIO) SetMetaCtx(ctx context.Context, name string, meta ObjectMeta) int {
+	if ok := me.limiter.Wait(ctx, 0, 0); ok < 0 {
+		return ok
+	}
+	return IOWithContext(me.io).SetMetaCtx(ctx, name, meta)
+}
+
+//get the innermost FileIO of wrappers like RetryIO and RateLimitIO
+func BaseIO(io FileIO) FileIO {
+	for {
+		w, ok := io.(interface {
+			Base() FileIO
+		})
+		if !ok {
+			return io
+		}
+		io = w.Base()
+	}
+}
@@ -0,0 +1,105 @@
+package fscommon
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func (me *TokenBucket) available() float64 {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	return me.tokens
+}
+
+func TestTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	b := NewTokenBucket(10000, 100)
+
+	//the burst is taken at once
+	start := time.Now()
+	if ok := b.WaitN(ctx, 100); ok < 0 {
+		t.Fatalf("WaitN: %d", ok)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("burst waited %v", d)
+	}
+
+	//tokens are refilled at the rate
+	time.Sleep(10 * time.Millisecond)
+	start = time.Now()
+	if ok := b.WaitN(ctx, 100); ok < 0 {
+		t.Fatalf("WaitN after refill: %d", ok)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("refilled tokens waited %v", d)
+	}
+
+	//a wait larger than burst runs into debt, the next wait pays it
+	start = time.Now()
+	b.WaitN(ctx, 1000)
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("a wait of 1000 tokens took %v, expected about 100ms", d)
+	}
+	b.WaitN(ctx, 1000)
+	if d := time.Since(start); d < 180*time.Millisecond {
+		t.Fatalf("two waits of 1000 tokens took %v, expected about 200ms", d)
+	}
+
+	//a nil bucket has no limit
+	var none *TokenBucket
+	if ok := none.WaitN(ctx, 1<<40); ok != 0 {
+		t.Fatalf("WaitN of a nil bucket: %d", ok)
+	}
+}
+
+func TestTokenBucketCanceled(t *testing.T) {
+	b := NewTokenBucket(1, 1)
+	b.WaitN(context.Background(), 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if ok := b.WaitN(ctx, 1); ok != ETIMEDOUT {
+		t.Fatalf("WaitN with a deadline: %d, expected ETIMEDOUT", ok)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("canceled wait took %v", d)
+	}
+	if n := b.available(); n < -0.1 {
+		t.Fatalf("tokens of a canceled wait are not given back: %f", n)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if ok := b.WaitN(ctx, 1); ok != ECANCELED {
+		t.Fatalf("WaitN of a canceled context: %d, expected ECANCELED", ok)
+	}
+}
+
+func TestRateLimitsRefund(t *testing.T) {
+	//the request token is given back when the wait for bytes is canceled
+	limits := NewRateLimits(100, 0, 10)
+	limits.Upload.WaitN(context.Background(), 100)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if ok := limits.wait(ctx, 100, 0); ok != ETIMEDOUT {
+		t.Fatalf("wait: %d, expected ETIMEDOUT", ok)
+	}
+	if n := limits.Requests.available(); n < 9.9 {
+		t.Fatalf("request tokens: %f, expected 10", n)
+	}
+
+	//tokens of the client are given back when the mount limit is canceled
+	limiter := NewRateLimiter(map[string]string{"RateUpload": "100", "RateClientRps": "10"})
+	limiter.mount.Upload.WaitN(context.Background(), 100)
+	ctx, cancel = context.WithTimeout(WithClient(context.Background(), "a"), 10*time.Millisecond)
+	defer cancel()
+	if ok := limiter.Wait(ctx, 100, 0); ok != ETIMEDOUT {
+		t.Fatalf("Wait: %d, expected ETIMEDOUT", ok)
+	}
+	client, _ := limiter.limits(ctx)
+	if n := client.Requests.available(); n < 9.9 {
+		t.Fatalf("request tokens of the client: %f, expected 10", n)
+	}
+}
@@ -0,0 +1,401 @@
+package fscommon
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//retry policy for backend requests
+//throttling and timeouts (EAGAIN/ETIMEDOUT), and errors reported as retryable by drivers (5xx responses,
+//connection errors, see ReportError) are retried with jittered exponential backoff, for idempotent operations only
+//other errors, e.g. a checksum mismatch or a corrupt object, fail at once and don't count for the circuit breaker
+const (
+	DEFAULT_RETRY_MAX        = 3
+	DEFAULT_RETRY_BASE_DELAY = 100  //milliseconds
+	DEFAULT_RETRY_MAX_DELAY  = 5000 //milliseconds
+
+	DEFAULT_BREAKER_THRESHOLD = 5  //consecutive failures to open the circuit
+	DEFAULT_BREAKER_COOLDOWN  = 30 //seconds before a trial request is allowed
+)
+
+//operation classes, each class may have its own timeout
+const (
+	OP_READ   = "read"
+	OP_WRITE  = "write"
+	OP_META   = "meta"
+	OP_LIST   = "list"
+	OP_DELETE = "delete"
+)
+
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Timeouts   map[string]time.Duration //per operation class, no timeout if not set
+
+	breaker *CircuitBreaker
+}
+
+//create a policy from driver config, see csmgr/factory.go for the keys
+//values are in milliseconds for delays, seconds for timeouts and cool down
+func NewRetryPolicy(cfg map[string]string) *RetryPolicy {
+	getInt := func(key string, dft int) int {
+		if n, err := strconv.Atoi(cfg[key]); err == nil && n >= 0 {
+			return n
+		}
+		return dft
+	}
+
+	me := &RetryPolicy{
+		MaxRetries: getInt("RetryMax", DEFAULT_RETRY_MAX),
+		BaseDelay:  time.Duration(getInt("RetryBaseDelay", DEFAULT_RETRY_BASE_DELAY)) * time.Millisecond,
+		MaxDelay:   time.Duration(getInt("RetryMaxDelay", DEFAULT_RETRY_MAX_DELAY)) * time.Millisecond,
+		Timeouts:   make(map[string]time.Duration),
+	}
+
+	dft := getInt("IoTimeout", 0)
+	for key, op := range map[string]string{
+		"IoTimeoutRead":   OP_READ,
+		"IoTimeoutWrite":  OP_WRITE,
+		"IoTimeoutMeta":   OP_META,
+		"IoTimeoutList":   OP_LIST,
+		"IoTimeoutDelete": OP_DELETE,
+	} {
+		if n := getInt(key, dft); n > 0 {
+			me.Timeouts[op] = time.Duration(n) * time.Second
+		}
+	}
+
+	if threshold := getInt("BreakerThreshold", DEFAULT_BREAKER_THRESHOLD); threshold > 0 {
+		me.breaker = NewCircuitBreaker(threshold,
+			time.Duration(getInt("BreakerCooldown", DEFAULT_BREAKER_COOLDOWN))*time.Second)
+	}
+	return me
+}
+
+func IsRetryableCode(code int) bool {
+	return code == EAGAIN || code == ETIMEDOUT
+}
+
+//EIO is retried only if it's the error of a backend request which the driver reported as transient
+func isTransient(rc int, trace *ErrorTrace) bool {
+	if IsRetryableCode(rc) {
+		return true
+	}
+	fe := trace.Last()
+	return rc < 0 && fe != nil && fe.Retryable && fe.Errno == rc
+}
+
+//delay before the n-th retry, "full jitter" of exponential backoff
+func (me *RetryPolicy) backoff(n int) time.Duration {
+	d := me.BaseDelay << uint(n)
+	if d <= 0 || d > me.MaxDelay {
+		d = me.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+type opResult struct {
+	val interface{}
+	rc  int
+}
+
+//run fn with timeout of the operation class
+//fn gets a context with the deadline, but it may still keep running after it, e.g. an adapted driver
+//so fn must not write to anything shared, results are passed by return value
+func (me *RetryPolicy) runWithTimeout(ctx context.Context, class string, fn func(ctx context.Context) (interface{}, int)) (interface{}, int) {
+	if timeout, ok := me.Timeouts[class]; ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if ctx.Done() == nil {
+		return fn(ctx)
+	}
+	ch := make(chan opResult, 1)
+	go func() {
+		val, rc := fn(ctx)
+		ch <- opResult{val, rc}
+	}()
+	select {
+	case res := <-ch:
+		return res.val, res.rc
+	case <-ctx.Done():
+		return nil, CtxErrno(ctx)
+	}
+}
+
+//run a backend operation with retries
+//non-idempotent operations are tried once, but still count for the circuit breaker
+//a nil policy runs fn once
+func (me *RetryPolicy) Do(op string, class string, idempotent bool, fn func() int) int {
+	_, rc := me.DoValueCtx(context.Background(), op, class, idempotent, func(ctx context.Context) (interface{}, int) {
+		return nil, fn()
+	})
+	return rc
+}
+
+//same as Do, for operations which return a value
+func (me *RetryPolicy) DoValue(op string, class string, idempotent bool, fn func() (interface{}, int)) (interface{}, int) {
+	return me.DoValueCtx(context.Background(), op, class, idempotent, func(ctx context.Context) (interface{}, int) {
+		return fn()
+	})
+}
+
+//same as DoValue, retries stop once ctx is done
+func (me *RetryPolicy) DoValueCtx(ctx context.Context, op string, class string, idempotent bool, fn func(ctx context.Context) (interface{}, int)) (interface{}, int) {
+	if me == nil {
+		return fn(ctx)
+	}
+
+	for n := 0; ; n++ {
+		if ok := CtxErrno(ctx); ok < 0 {
+			return nil, ok
+		}
+		trial := false
+		if me.breaker != nil {
+			var ok bool
+			if ok, trial = me.breaker.allow(); !ok {
+				dlog.WithCtx(ctx).Warnf("%s: backend is unavailable, circuit is open", op)
+				return nil, EAGAIN
+			}
+		}
+		actx, trace := WithErrorTrace(ctx)
+		val, rc := me.runWithTimeout(actx, class, fn)
+		//canceled by the caller, it says nothing about the backend, but another trial is allowed
+		if ok := CtxErrno(ctx); ok < 0 {
+			if trial {
+				me.breaker.Abort()
+			}
+			return nil, ok
+		}
+		if !isTransient(rc, trace) {
+			if me.breaker != nil {
+				me.breaker.Success()
+			}
+			return val, rc
+		}
+		if me.breaker != nil {
+			me.breaker.Failure()
+		}
+		if !idempotent || n >= me.MaxRetries {
+			return val, rc
+		}
+		delay := me.backoff(n)
+		dlog.WithCtx(ctx).Warnf("%s failed with %d, retry %d in %v", op, rc, n+1, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, CtxErrno(ctx)
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+//fail fast when the backend is down
+//the circuit opens after a number of consecutive failures, and allows a trial request after cool down
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	failures int
+	openAt   time.Time
+	trial    bool //a trial request is running in half-open state
+	mtx      sync.Mutex
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+func (me *CircuitBreaker) Allow() bool {
+	ok, _ := me.allow()
+	return ok
+}
+
+//trial is true if the request is the trial one in half-open state
+func (me *CircuitBreaker) allow() (ok bool, trial bool) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	if me.failures < me.threshold {
+		return true, false
+	}
+	//half-open, allow one request to check if the backend is back
+	if time.Since(me.openAt) >= me.cooldown && !me.trial {
+		me.trial = true
+		return true, true
+	}
+	return false, false
+}
+
+//the trial request ends without a result, e.g. it's canceled by the caller, it's not counted
+func (me *CircuitBreaker) Abort() {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	me.trial = false
+}
+
+func (me *CircuitBreaker) Success() {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	if me.failures >= me.threshold {
+		dlog.Infof("Backend is back, circuit is closed.")
+	}
+	me.failures = 0
+	me.trial = false
+}
+
+func (me *CircuitBreaker) Failure() {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	me.failures++
+	if me.failures == me.threshold || me.trial {
+		dlog.Errorf("Backend failed %d times, circuit is open.", me.failures)
+		me.openAt = time.Now()
+	}
+	me.trial = false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+//FileIO wrapper which runs every operation with a retry policy
+type RetryIO struct {
+	io     FileIO
+	policy *RetryPolicy
+}
+
+func NewRetryIO(io FileIO, policy *RetryPolicy) *RetryIO {
+	return &RetryIO{io: io, policy: policy}
+}
+
+//the wrapped FileIO, for driver specific operations
+func (me *RetryIO) Base() FileIO {
+	return me.io
+}
+
+func (me *RetryIO) Policy() *RetryPolicy {
+	return me.policy
+}
+
+//the whole object is replaced, so it is safe to retry
+func (me *RetryIO) PutBuffer(name string, data []byte) int {
+	return me.PutBufferCtx(context.Background(), name, data)
+}
+
+func (me *RetryIO) PutBufferCtx(ctx context.Context, name string, data []byte) int {
+	_, ok := me.policy.DoValueCtx(ctx, "PutBuffer "+name, OP_WRITE, true, func(ctx context.Context) (interface{}, int) {
+		return nil, IOWithContext(me.io).PutBufferCtx(ctx, name, data)
+	})
+	return ok
+}
+
+func (me *RetryIO) GetBuffer(name string, dest []byte, offset int64) int {
+	return me.GetBufferCtx(context.Background(), name, dest, offset)
+}
+
+func (me *RetryIO) GetBufferCtx(ctx context.Context, name string, dest []byte, offset int64) int {
+	//a request which times out or gets canceled may still write to its buffer later
+	direct := me.policy == nil || (me.policy.Timeouts[OP_READ] == 0 && ctx.Done() == nil)
+	val, n := me.policy.DoValueCtx(ctx, "GetBuffer "+name, OP_READ, true, func(ctx context.Context) (interface{}, int) {
+		buf := dest
+		if !direct {
+			buf = make([]byte, len(dest))
+		}
+		return buf, IOWithContext(me.io).GetBufferCtx(ctx, name, buf, offset)
+	})
+	if n > 0 && !direct {
+		copy(dest, val.([]byte)[:n])
+	}
+	return n
+}
+
+func (me *RetryIO) GetAttr(path string) (os.FileInfo, int) {
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+func (me *RetryIO) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	val, ok := me.policy.DoValueCtx(ctx, "GetAttr "+path, OP_META, true, func(ctx context.Context) (interface{}, int) {
+		return IOWithContext(me.io).GetAttrCtx(ctx, path)
+	})
+	fi, _ := val.(os.FileInfo)
+	return fi, ok
+}
+
+func (me *RetryIO) ListFile(path string) ([]os.FileInfo, int) {
+	return me.ListFileCtx(context.Background(), path)
+}
+
+func (me *RetryIO) ListFileCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
+	val, ok := me.policy.DoValueCtx(ctx, "ListFile "+path, OP_LIST, true, func(ctx context.Context) (interface{}, int) {
+		return IOWithContext(me.io).ListFileCtx(ctx, path)
+	})
+	dis, _ := val.([]os.FileInfo)
+	return dis, ok
+}
+
+func (me *RetryIO) ZeroFile(name string) int {
+	return me.ZeroFileCtx(context.Background(), name)
+}
+
+func (me *RetryIO) ZeroFileCtx(ctx context.Context, name string) int {
+	_, ok := me.policy.DoValueCtx(ctx, "ZeroFile "+name, OP_WRITE, true, func(ctx context.Context) (interface{}, int) {
+		return nil, IOWithContext(me.io).ZeroFileCtx(ctx, name)
+	})
+	return ok
+}
+
+func (me *RetryIO) Unlink(path string) int {
+	return me.UnlinkCtx(context.Background(), path)
+}
+
+//the object may be gone by a previous attempt which failed to respond
+func (me *RetryIO) UnlinkCtx(ctx context.Context, path string) int {
+	var tries int32
+	_, ok := me.policy.DoValueCtx(ctx, "Unlink "+path, OP_DELETE, true, func(ctx context.Context) (interface{}, int) {
+		n := atomic.AddInt32(&tries, 1)
+		ok := IOWithContext(me.io).UnlinkCtx(ctx, path)
+		if ok == ENOENT && n > 1 {
+			return nil, 0
+		}
+		return nil, ok
+	})
+	return ok
+}
+
+func (me *RetryIO) GetMeta(name string) (ObjectMeta, int) {
+	return me.GetMetaCtx(context.Background(), name)
+}
+
+func (me *RetryIO) GetMetaCtx(ctx context.Context, name string) (ObjectMeta, int) {
+	val, ok := me.policy.DoValueCtx(ctx, "GetMeta "+name, OP_META, true, func(ctx context.Context) (interface{}, int) {
+		return IOWithContext(me.io).GetMetaCtx(ctx, name)
+	})
+	md, _ := val.(ObjectMeta)
+	return md, ok
+}
+
+func (me *RetryIO) SetMeta(name string, meta ObjectMeta) int {
+	return me.SetMetaCtx(context.Background(), name, meta)
+}
+
+//meta data is merged and written as a whole, so it is safe to retry
+func (me *RetryIO) SetMetaCtx(ctx context.Context, name string, meta ObjectMeta) int {
+	_, ok := me.policy.DoValueCtx(ctx, "SetMeta "+name, OP_META, true, func(ctx context.Context) (interface{}, int) {
+		return nil, IOWithContext(me.io).SetMetaCtx(ctx, name, meta)
+	})
+	return ok
+}
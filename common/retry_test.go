@@ -0,0 +1,57 @@
+package fscommon
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBreakerTrialCanceled(t *testing.T) {
+	policy := &RetryPolicy{breaker: NewCircuitBreaker(1, 0)}
+	policy.breaker.Failure()
+
+	//the trial request is canceled by the caller after it's sent
+	ctx, cancel := context.WithCancel(context.Background())
+	_, rc := policy.DoValueCtx(ctx, "trial", OP_READ, true, func(ctx context.Context) (interface{}, int) {
+		cancel()
+		return nil, EIO
+	})
+	if rc != ECANCELED {
+		t.Fatalf("rc = %d, expected ECANCELED", rc)
+	}
+	if !policy.breaker.Allow() {
+		t.Fatal("no trial is allowed after a canceled one")
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	policy := &RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond,
+		breaker: NewCircuitBreaker(10, time.Minute)}
+
+	//EIO of a 5xx response reported by the driver
+	tries := 0
+	_, rc := policy.DoValueCtx(context.Background(), "5xx", OP_READ, true, func(ctx context.Context) (interface{}, int) {
+		tries++
+		fe := NewError(EIO, "GetObject", "a", nil)
+		fe.Retryable = true
+		ReportError(ctx, fe)
+		return nil, EIO
+	})
+	if rc != EIO || tries != 3 {
+		t.Fatalf("rc = %d, tries = %d, expected EIO after 3 tries", rc, tries)
+	}
+
+	//EIO of a checksum mismatch is not retried, and it's not a failure of the backend
+	policy.breaker.Success()
+	tries = 0
+	_, rc = policy.DoValueCtx(context.Background(), "checksum", OP_READ, true, func(ctx context.Context) (interface{}, int) {
+		tries++
+		return nil, EIO
+	})
+	if rc != EIO || tries != 1 {
+		t.Fatalf("rc = %d, tries = %d, expected EIO after 1 try", rc, tries)
+	}
+	if policy.breaker.failures != 0 {
+		t.Fatalf("%d failures are counted", policy.breaker.failures)
+	}
+}
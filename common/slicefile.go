@@ -1,9 +1,9 @@
 package fscommon
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 )
 
 const (
@@ -21,6 +21,12 @@ type ISliceFile interface {
 	Append(blocks []int64, data []byte) int
 }
 
+//optional for slice files, read and append with context of the request
+type ISliceFileCtx interface {
+	ReadCtx(ctx context.Context, data []byte, offset int64) int
+	AppendCtx(ctx context.Context, blocks []int64, data []byte) int
+}
+
 type SliceMeta struct {
 	SliceSize        int64
 	SliceCount       int64
@@ -38,6 +44,15 @@ type SliceFile struct {
 	isSlicedFile bool
 }
 
+//get prefixes of helper objects (slice data/meta, cache blocks) which belong to a path
+//for a directory, the prefixes cover helper objects of all files under it
+func GetHelperDirs(path string) []string {
+	return []string{
+		fmt.Sprintf("$slice$/%s/", path),
+		fmt.Sprintf("$cache$/%s/", path),
+	}
+}
+
 func (me *SliceMeta) AppendLength(aLen int64) {
 	me.CurSliceFileLen += aLen
 	me.FileLen += aLen
@@ -56,20 +71,25 @@ func (me *SliceFile) SetIO(io FileIO) {
 }
 
 func (me *SliceFile) GetCacheBlockFileName(blkId int64) string {
-	return fmt.Sprintf("/$cache$/%s/blocks/%d", me.FileName, blkId)
+	return fmt.Sprintf("$cache$/%s/blocks/%d", me.FileName, blkId)
 }
 
 func (me *SliceFile) GetLength() int64 {
 	return me.meta.FileLen
 }
 
+//n bytes are appended to the current slice by the driver
+func (me *SliceFile) AppendLength(n int64) {
+	me.meta.AppendLength(n)
+}
+
 func (me *SliceFile) Open(path string, flags uint32) int {
 	me.FileName = path
-	me.metaFileName = fmt.Sprintf("/$slice$/%s/meta", path)
+	me.metaFileName = fmt.Sprintf("$slice$/%s/meta", path)
 
 	ok := me.tryRecovery(path)
 	if ok < 0 {
-		log.Println("Unable recover file ", path)
+		dlog.Errorf("Unable to recover file %s", path)
 		return ok
 	}
 
@@ -115,7 +135,7 @@ func (me *SliceFile) tryRecovery(path string) int {
 	//no meta data file, not a slice file, no need recover
 	if ok == ENOENT {
 		me.isSlicedFile = false
-		log.Printf("%s is not a sliced file.\n", path)
+		dlog.Debugf("%s is not a sliced file.", path)
 		return 0
 	}
 	//other failure, cannot go further
@@ -127,8 +147,8 @@ func (me *SliceFile) tryRecovery(path string) int {
 	me.isSlicedFile = true
 
 	if me.meta.CurSliceFileName != path {
-		log.Printf("Slice meta data mismatch: file name = %s, current slice name = %s\n", path, me.meta.CurSliceFileName)
-		return -1
+		dlog.Errorf("Slice meta data mismatch: file name = %s, current slice name = %s", path, me.meta.CurSliceFileName)
+		return EIO
 	}
 
 	//check if me.meta.CurSliceFileLen is updated
@@ -151,8 +171,8 @@ func (me *SliceFile) tryRecovery(path string) int {
 			continue
 		}
 		if di.Size() != me.meta.SliceSize {
-			log.Printf("Mismatched file slice size: file %s's size: %d, expected size: %d", di.Name, di.Size, me.meta.SliceSize)
-			return -1
+			dlog.Errorf("Mismatched file slice size: file %s's size: %d, expected size: %d", di.Name, di.Size, me.meta.SliceSize)
+			return EIO
 		}
 		count++
 	}
@@ -196,12 +216,12 @@ func (me *SliceFile) loadMeta() int {
 		return ok
 	}
 	if data[0] != '\x01' || data[1] != '\x00' {
-		return -1
+		return EIO
 	}
 	err := json.Unmarshal(data[2:], me.meta)
 	if err != nil {
-		log.Println("error: ", err)
-		return -1
+		dlog.Errorf("Invalid slice meta data: %s", err)
+		return EIO
 	}
 	return 0
 }
@@ -215,8 +235,8 @@ func (me *SliceFile) SaveMeta() int {
 
 	b, err := json.Marshal(me.meta)
 	if err != nil {
-		log.Println("error:", err)
-		return -1
+		dlog.Errorf("Failed to encode slice meta data: %s", err)
+		return EIO
 	}
 	data := make([]byte, len(b)+2)
 	copy(data[2:], b)
@@ -243,14 +263,19 @@ func (me *SliceFile) Truncate(size uint64) int {
 }
 
 func (me *SliceFile) Read(data []byte, offset int64) int {
+	return me.ReadCtx(context.Background(), data, offset)
+}
+
+func (me *SliceFile) ReadCtx(ctx context.Context, data []byte, offset int64) int {
+	io := IOWithContext(me.io)
 	if offset >= me.meta.FileLen {
 		return 0 //EOF
 	}
 
 	//case #1: there is no addtional full slice
-	log.Printf("me.meta.SliceCount=%d", me.meta.SliceCount)
+	dlog.Debugf("me.meta.SliceCount=%d", me.meta.SliceCount)
 	if me.meta.SliceCount == 0 {
-		return me.io.GetBuffer(me.FileName, data, offset)
+		return io.GetBufferCtx(ctx, me.FileName, data, offset)
 	}
 
 	//case #2: there is at least one full slice
@@ -268,7 +293,7 @@ func (me *SliceFile) Read(data []byte, offset int64) int {
 
 	//the first part
 	name := fmt.Sprintf("$slice$/%s/files/%d.dat", me.FileName, sliceNum)
-	rc = me.io.GetBuffer(name, data[0:n], sliceOffset)
+	rc = io.GetBufferCtx(ctx, name, data[0:n], sliceOffset)
 	if n == int64(reqLen) {
 		return rc
 	}
@@ -282,7 +307,7 @@ func (me *SliceFile) Read(data []byte, offset int64) int {
 	sliceNum++
 	n = int64(reqLen) - n
 	name = fmt.Sprintf("$slice$/%s/files/%d.dat", me.FileName, sliceNum)
-	rc = me.io.GetBuffer(name, data[n:], 0)
+	rc = io.GetBufferCtx(ctx, name, data[n:], 0)
 	if rc == int(n) {
 		return reqLen
 	} else if rc >= 0 && rc < int(n) {
@@ -294,6 +319,10 @@ func (me *SliceFile) Read(data []byte, offset int64) int {
 	return 0
 }
 
+func (me *SliceFile) AppendCtx(ctx context.Context, blocks []int64, data []byte) int {
+	return me.Append(blocks, data)
+}
+
 //append a block to slice file
 func (me *SliceFile) Append(blocks []int64, data []byte) int {
 
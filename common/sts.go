@@ -0,0 +1,222 @@
+package fscommon
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//temporary credentials from STS of AWS and Aliyun
+//web identity: AssumeRoleWithWebIdentity (AWS) or AssumeRoleWithOIDC (Aliyun) with a token file, e.g. of a Kubernetes service account
+//the token file is read again on each refresh, as it's rotated by its issuer
+//Aliyun AssumeRole: a role is assumed with long-lived keys from other providers
+const (
+	DEFAULT_AWS_STS_ENDPOINT    = "https://sts.amazonaws.com"
+	DEFAULT_ALIYUN_STS_ENDPOINT = "https://sts.aliyuncs.com"
+
+	STS_TIMEOUT = 30 * time.Second
+)
+
+var stsClient = &http.Client{Timeout: STS_TIMEOUT}
+
+type webIdentityCredProvider struct {
+	vendor      string
+	endpoint    string
+	region      string
+	roleArn     string
+	tokenFile   string
+	oidcArn     string //aliyun only
+	sessionName string
+	duration    int
+}
+
+func (me *webIdentityCredProvider) Name() string {
+	return "web_identity"
+}
+
+func (me *webIdentityCredProvider) Retrieve() (*Credential, error) {
+	if len(me.roleArn) == 0 || len(me.tokenFile) == 0 {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadFile(me.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(buf))
+
+	if me.vendor == CRED_VENDOR_ALIYUN {
+		if len(me.oidcArn) == 0 {
+			return nil, fmt.Errorf("OIDC provider arn is required")
+		}
+		params := url.Values{}
+		params.Set("Action", "AssumeRoleWithOIDC")
+		params.Set("RoleArn", me.roleArn)
+		params.Set("OIDCProviderArn", me.oidcArn)
+		params.Set("OIDCToken", token)
+		params.Set("RoleSessionName", me.sessionName)
+		params.Set("DurationSeconds", strconv.Itoa(me.duration))
+		return aliyunStsCall(me.endpoint, params)
+	}
+
+	endpoint := me.endpoint
+	if len(endpoint) == 0 {
+		endpoint = DEFAULT_AWS_STS_ENDPOINT
+		if len(me.region) > 0 {
+			endpoint = "https://sts." + me.region + ".amazonaws.com"
+		}
+	}
+	params := url.Values{}
+	params.Set("Action", "AssumeRoleWithWebIdentity")
+	params.Set("Version", "2011-06-15")
+	params.Set("RoleArn", me.roleArn)
+	params.Set("RoleSessionName", me.sessionName)
+	params.Set("WebIdentityToken", token)
+	params.Set("DurationSeconds", strconv.Itoa(me.duration))
+	body, err := stsGet(endpoint + "/?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("invalid STS response: %s", err)
+	}
+	if len(resp.Credentials.AccessKeyId) == 0 {
+		return nil, fmt.Errorf("no credentials in STS response")
+	}
+	return &Credential{
+		KeyId:   resp.Credentials.AccessKeyId,
+		KeyData: resp.Credentials.SecretAccessKey,
+		Token:   resp.Credentials.SessionToken,
+		Expires: resp.Credentials.Expiration,
+	}, nil
+}
+
+//AssumeRole of Aliyun with credentials of the source chain
+type aliyunStsCredProvider struct {
+	source      *CredentialChain
+	endpoint    string
+	roleArn     string
+	sessionName string
+	duration    int
+}
+
+func (me *aliyunStsCredProvider) Name() string {
+	return "sts"
+}
+
+func (me *aliyunStsCredProvider) Retrieve() (*Credential, error) {
+	src, err := me.source.Get()
+	if err != nil {
+		return nil, fmt.Errorf("no source credentials: %s", err)
+	}
+	params := url.Values{}
+	params.Set("Action", "AssumeRole")
+	params.Set("RoleArn", me.roleArn)
+	params.Set("RoleSessionName", me.sessionName)
+	params.Set("DurationSeconds", strconv.Itoa(me.duration))
+	params.Set("AccessKeyId", src.KeyId)
+	params.Set("SignatureMethod", "HMAC-SHA1")
+	params.Set("SignatureVersion", "1.0")
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	params.Set("SignatureNonce", hex.EncodeToString(nonce))
+	if len(src.Token) > 0 {
+		params.Set("SecurityToken", src.Token)
+	}
+	return aliyunStsCall(me.endpoint, params, src.KeyData)
+}
+
+//RPC call of Aliyun STS, signed if the secret is given
+func aliyunStsCall(endpoint string, params url.Values, secret ...string) (*Credential, error) {
+	if len(endpoint) == 0 {
+		endpoint = DEFAULT_ALIYUN_STS_ENDPOINT
+	}
+	params.Set("Format", "JSON")
+	params.Set("Version", "2015-04-01")
+	params.Set("Timestamp", time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, aliyunEscape(key)+"="+aliyunEscape(params.Get(key)))
+	}
+	query := strings.Join(pairs, "&")
+	if len(secret) > 0 {
+		mac := hmac.New(sha1.New, []byte(secret[0]+"&"))
+		mac.Write([]byte("GET&%2F&" + aliyunEscape(query)))
+		query += "&Signature=" + aliyunEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	}
+
+	body, err := stsGet(endpoint + "/?" + query)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Credentials struct {
+			AccessKeyId     string
+			AccessKeySecret string
+			SecurityToken   string
+			Expiration      time.Time
+		}
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("invalid STS response: %s", err)
+	}
+	if len(resp.Credentials.AccessKeyId) == 0 {
+		return nil, fmt.Errorf("no credentials in STS response")
+	}
+	return &Credential{
+		KeyId:   resp.Credentials.AccessKeyId,
+		KeyData: resp.Credentials.AccessKeySecret,
+		Token:   resp.Credentials.SecurityToken,
+		Expires: resp.Credentials.Expiration,
+	}, nil
+}
+
+//percent encoding of Aliyun signatures, RFC 3986
+func aliyunEscape(s string) string {
+	s = url.QueryEscape(s)
+	s = strings.Replace(s, "+", "%20", -1)
+	s = strings.Replace(s, "*", "%2A", -1)
+	return strings.Replace(s, "%7E", "~", -1)
+}
+
+func stsGet(u string) ([]byte, error) {
+	resp, err := stsClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("STS returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
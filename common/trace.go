@@ -0,0 +1,484 @@
+package fscommon
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//tracing of operations, a span for each front-end request with child spans for cache lookups and backend calls
+//spans are exported in OTLP JSON format, to an OTLP/HTTP collector or to a local file
+//tracing is off until StartTracing is called, StartSpan returns a nil span then and nil spans ignore all calls
+
+const (
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_SERVER   = 2
+	SPAN_KIND_CLIENT   = 3
+)
+
+const (
+	TRACE_BATCH_SIZE     = 512
+	TRACE_QUEUE_SIZE     = 4096
+	TRACE_FLUSH_INTERVAL = 5 //seconds
+)
+
+type SpanData struct {
+	TraceId  string
+	SpanId   string
+	ParentId string
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]interface{}
+	Errno    int //0 for success
+	Error    string
+}
+
+type Span struct {
+	data  SpanData
+	ended bool
+	mtx   sync.Mutex
+}
+
+type SpanExporter interface {
+	Export(spans []*SpanData) error
+	Close() error
+}
+
+type tracer struct {
+	exporter SpanExporter
+	ratio    float64 //sample ratio of new traces
+	queue    chan *SpanData
+	flush    chan chan bool
+	done     chan bool
+}
+
+var curTracer *tracer
+var tracerMtx sync.RWMutex
+
+type spanKey struct{}
+
+//a trace which is not sampled, its spans are not recorded
+type unsampledKey struct{}
+
+func getTracer() *tracer {
+	tracerMtx.RLock()
+	defer tracerMtx.RUnlock()
+	return curTracer
+}
+
+//start exporting spans, ratio is the part of new traces which are sampled, from 0 to 1
+//a running exporter is flushed and closed
+func StartTracing(exporter SpanExporter, ratio float64) {
+	t := &tracer{
+		exporter: exporter,
+		ratio:    ratio,
+		queue:    make(chan *SpanData, TRACE_QUEUE_SIZE),
+		flush:    make(chan chan bool),
+		done:     make(chan bool),
+	}
+	go t.run()
+
+	tracerMtx.Lock()
+	old := curTracer
+	curTracer = t
+	if old != nil {
+		close(old.queue)
+	}
+	tracerMtx.Unlock()
+
+	if old != nil {
+		old.wait()
+	}
+}
+
+//flush pending spans and stop tracing
+func StopTracing() {
+	tracerMtx.Lock()
+	old := curTracer
+	curTracer = nil
+	if old != nil {
+		close(old.queue)
+	}
+	tracerMtx.Unlock()
+
+	if old != nil {
+		old.wait()
+	}
+}
+
+//export pending spans now
+func FlushTracing() {
+	if t := getTracer(); t != nil {
+		ch := make(chan bool)
+		select {
+		case t.flush <- ch:
+			<-ch
+		case <-t.done:
+		}
+	}
+}
+
+//the queue is closed under lock, so that no span is sent to a closed queue
+func (me *tracer) wait() {
+	<-me.done
+	me.exporter.Close()
+}
+
+func (me *tracer) run() {
+	ticker := time.NewTicker(TRACE_FLUSH_INTERVAL * time.Second)
+	defer ticker.Stop()
+
+	batch := make([]*SpanData, 0, TRACE_BATCH_SIZE)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := me.exporter.Export(batch); err != nil {
+			dlog.Warnf("Failed to export %d spans: %s", len(batch), err)
+		}
+		batch = make([]*SpanData, 0, TRACE_BATCH_SIZE)
+	}
+
+	for {
+		select {
+		case sd, ok := <-me.queue:
+			if !ok {
+				export()
+				close(me.done)
+				return
+			}
+			batch = append(batch, sd)
+			if len(batch) >= TRACE_BATCH_SIZE {
+				export()
+			}
+		case ch := <-me.flush:
+			for len(me.queue) > 0 {
+				batch = append(batch, <-me.queue)
+			}
+			export()
+			close(ch)
+		case <-ticker.C:
+			export()
+		}
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (me *tracer) sample() bool {
+	if me.ratio >= 1 {
+		return true
+	}
+	if me.ratio <= 0 {
+		return false
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	n := uint64(0)
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return float64(n>>11)/float64(1<<53) < me.ratio
+}
+
+func SpanOf(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+//start an internal span, attrs are key and value pairs
+func StartSpan(ctx context.Context, name string, attrs ...interface{}) (context.Context, *Span) {
+	return StartSpanKind(ctx, SPAN_KIND_INTERNAL, name, attrs...)
+}
+
+//start a span as a child of the span in ctx, or a new trace
+func StartSpanKind(ctx context.Context, kind int, name string, attrs ...interface{}) (context.Context, *Span) {
+	t := getTracer()
+	if t == nil || ctx.Value(unsampledKey{}) != nil {
+		return ctx, nil
+	}
+
+	span := &Span{data: SpanData{
+		SpanId: randomHex(8),
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+	}}
+	if parent := SpanOf(ctx); parent != nil {
+		span.data.TraceId = parent.data.TraceId
+		span.data.ParentId = parent.data.SpanId
+	} else if !t.sample() {
+		return context.WithValue(ctx, unsampledKey{}, true), nil
+	} else {
+		span.data.TraceId = randomHex(16)
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		span.SetAttr(fmt.Sprint(attrs[i]), attrs[i+1])
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+//continue a trace of a W3C traceparent header, e.g. 00-<trace id>-<span id>-01
+//the returned context is used to start the server span of the request
+func WithTraceParent(ctx context.Context, header string) context.Context {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return ctx
+	}
+	if flags, err := strconv.ParseUint(parts[3], 16, 8); err != nil || flags&1 == 0 {
+		return context.WithValue(ctx, unsampledKey{}, true)
+	}
+	//a span which is never exported, it only carries ids of the remote parent
+	remote := &Span{data: SpanData{TraceId: strings.ToLower(parts[1]), SpanId: strings.ToLower(parts[2])}, ended: true}
+	return context.WithValue(ctx, spanKey{}, remote)
+}
+
+func (me *Span) SetAttr(key string, val interface{}) {
+	if me == nil {
+		return
+	}
+	me.mtx.Lock()
+	if me.data.Attrs == nil {
+		me.data.Attrs = make(map[string]interface{})
+	}
+	me.data.Attrs[key] = val
+	me.mtx.Unlock()
+}
+
+//end the span, rc is an error code, negative for a failure
+func (me *Span) End(rc int) {
+	if me == nil {
+		return
+	}
+	me.mtx.Lock()
+	if me.ended {
+		me.mtx.Unlock()
+		return
+	}
+	me.ended = true
+	me.data.End = time.Now()
+	if rc < 0 {
+		me.data.Errno = rc
+		me.data.Error = ErrorString(rc)
+	}
+	sd := me.data
+	me.mtx.Unlock()
+
+	tracerMtx.RLock()
+	if curTracer != nil {
+		select {
+		case curTracer.queue <- &sd:
+		default: //drop the span rather than block the request
+		}
+	}
+	tracerMtx.RUnlock()
+}
+
+//end the span with an error returned by a backend sdk
+func (me *Span) EndErr(err error) {
+	if me == nil {
+		return
+	}
+	if err == nil {
+		me.End(0)
+		return
+	}
+	me.SetAttr("error.message", err.Error())
+	me.End(ErrnoOf(err))
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//Exporters
+///////////////////////////////////////////////////////////////////////////////
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string     `json:"traceId"`
+	SpanId            string     `json:"spanId"`
+	ParentSpanId      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func toOtlpValue(val interface{}) otlpValue {
+	switch v := val.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case uint32:
+		s := strconv.FormatUint(uint64(v), 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	}
+	s := fmt.Sprint(val)
+	return otlpValue{StringValue: &s}
+}
+
+//encode spans as an OTLP/HTTP JSON export request
+func encodeOtlp(service string, spans []*SpanData) ([]byte, error) {
+	ss := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(spans))}
+	ss.Scope.Name = "csmgr"
+	for _, sd := range spans {
+		osp := otlpSpan{
+			TraceId:           sd.TraceId,
+			SpanId:            sd.SpanId,
+			ParentSpanId:      sd.ParentId,
+			Name:              sd.Name,
+			Kind:              sd.Kind,
+			StartTimeUnixNano: strconv.FormatInt(sd.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sd.End.UnixNano(), 10),
+		}
+		for k, v := range sd.Attrs {
+			osp.Attributes = append(osp.Attributes, otlpAttr{Key: k, Value: toOtlpValue(v)})
+		}
+		if sd.Errno < 0 {
+			osp.Attributes = append(osp.Attributes, otlpAttr{Key: "errno", Value: toOtlpValue(-sd.Errno)})
+			osp.Status = otlpStatus{Code: 2, Message: sd.Error}
+		}
+		ss.Spans = append(ss.Spans, osp)
+	}
+
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{ss}}
+	rs.Resource.Attributes = []otlpAttr{{Key: "service.name", Value: toOtlpValue(service)}}
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{rs}})
+}
+
+//write spans to a local file, one OTLP JSON export request per line
+//the file can be replayed to a collector, or read with jq
+type FileSpanExporter struct {
+	service string
+	out     io.WriteCloser
+}
+
+func NewFileSpanExporter(path string, service string) (*FileSpanExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSpanExporter{service: service, out: f}, nil
+}
+
+func (me *FileSpanExporter) Export(spans []*SpanData) error {
+	data, err := encodeOtlp(me.service, spans)
+	if err != nil {
+		return err
+	}
+	_, err = me.out.Write(append(data, '\n'))
+	return err
+}
+
+func (me *FileSpanExporter) Close() error {
+	return me.out.Close()
+}
+
+//send spans to an OTLP/HTTP collector, e.g. http://localhost:4318/v1/traces
+type OtlpSpanExporter struct {
+	service  string
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func NewOtlpSpanExporter(endpoint string, service string, headers map[string]string) *OtlpSpanExporter {
+	return &OtlpSpanExporter{
+		service:  service,
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (me *OtlpSpanExporter) Export(spans []*SpanData) error {
+	data, err := encodeOtlp(me.service, spans)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", me.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range me.headers {
+		req.Header.Set(k, v)
+	}
+	rsp, err := me.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", rsp.Status)
+	}
+	return nil
+}
+
+func (me *OtlpSpanExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,192 @@
+package fscommon
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"unicode/utf8"
+)
+
+const (
+	//s3fs saves all extended attributes in one meta data key
+	META_XATTR = "xattr"
+
+	//flags for SetXAttr, same as setxattr(2)
+	XATTR_CREATE  = 1
+	XATTR_REPLACE = 2
+
+	//extended attributes with this prefix are saved as object tags instead of meta data
+	XATTR_TAG_PREFIX = "user.tag."
+
+	//S3 limits user meta data of an object to 2 KB
+	MAX_META_SIZE = 2048
+)
+
+type XAttrs map[string][]byte
+
+//load extended attributes from object meta data
+//the format is the same as s3fs: url encoded json, values are base64 encoded
+func (me *DirItem) GetXAttrs() XAttrs {
+	xa := make(XAttrs)
+	val, ok := me.DiMeta[META_XATTR]
+	if !ok || len(val) == 0 {
+		return xa
+	}
+
+	js, err := url.QueryUnescape(val)
+	if err != nil {
+		dlog.Warnf("Invalid xattr meta data: %s", err)
+		return xa
+	}
+	raw := make(map[string]string)
+	err = json.Unmarshal([]byte(js), &raw)
+	if err != nil {
+		dlog.Warnf("Invalid xattr meta data: %s", err)
+		return xa
+	}
+	for name, v := range raw {
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			dlog.Warnf("Invalid value for xattr %s: %s", name, err)
+			continue
+		}
+		xa[name] = data
+	}
+	return xa
+}
+
+//save extended attributes to object meta data
+func (me *DirItem) SetXAttrs(xa XAttrs) int {
+	md := make(ObjectMeta).Merge(me.DiMeta)
+	if len(xa) == 0 {
+		md[META_XATTR] = "" //empty value removes the key
+	} else {
+		raw := make(map[string]string, len(xa))
+		for name, data := range xa {
+			raw[name] = base64.StdEncoding.EncodeToString(data)
+		}
+		js, err := json.Marshal(raw)
+		if err != nil {
+			dlog.Warnf("%s", err)
+			return EINVAL
+		}
+		md[META_XATTR] = url.QueryEscape(string(js))
+	}
+
+	if md.Size() > MAX_META_SIZE {
+		return E2BIG
+	}
+	me.DiMeta = md
+	return 0
+}
+
+//get extended attributes from object tags
+func NewXAttrsFromTags(tags map[string]string) XAttrs {
+	xa := make(XAttrs, len(tags))
+	for key, val := range tags {
+		xa[XATTR_TAG_PREFIX+key] = []byte(val)
+	}
+	return xa
+}
+
+//convert extended attributes to object tags, tag values must be text
+func (me XAttrs) Tags() (map[string]string, int) {
+	tags := make(map[string]string, len(me))
+	for name, data := range me {
+		if !utf8.Valid(data) {
+			return nil, EINVAL
+		}
+		tags[name[len(XATTR_TAG_PREFIX):]] = string(data)
+	}
+	return tags, 0
+}
+
+//set an attribute, flags are the same as setxattr(2)
+func (me XAttrs) Set(name string, data []byte, flags int) int {
+	_, exist := me[name]
+	if (flags&XATTR_CREATE) != 0 && exist {
+		return EEXIST
+	}
+	if (flags&XATTR_REPLACE) != 0 && !exist {
+		return ENODATA
+	}
+	me[name] = append([]byte(nil), data...)
+	return 0
+}
+
+func (me XAttrs) Remove(name string) int {
+	if _, exist := me[name]; !exist {
+		return ENODATA
+	}
+	delete(me, name)
+	return 0
+}
+
+func (me XAttrs) Names() []string {
+	names := make([]string, 0, len(me))
+	for name := range me {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//apply changes at once, removing a missing attribute is not an error
+func (me XAttrs) Update(set XAttrs, remove []string) {
+	for _, name := range remove {
+		delete(me, name)
+	}
+	for name, data := range set {
+		me[name] = append([]byte(nil), data...)
+	}
+}
+
+//optional for file systems, extended attributes in meta data are loaded and saved as a whole
+//e.g. WebDAV PROPFIND loads them by one request, and all changes of PROPPATCH succeed or fail together
+//attributes saved as tags and settings of storage are not loaded, and they can't be updated
+type XAttrUpdater interface {
+	LoadXAttrs(path string) (XAttrs, int)
+	UpdateXAttrs(path string, set XAttrs, remove []string) int
+}
+
+//load extended attributes of a path, one by one if fs is not an XAttrUpdater
+func LoadXAttrs(fs FileSystemImpl, path string) (XAttrs, int) {
+	if u, ok := fs.(XAttrUpdater); ok {
+		return u.LoadXAttrs(path)
+	}
+	names, ok := fs.ListXAttr(path)
+	if ok < 0 {
+		return nil, ok
+	}
+	xa := make(XAttrs, len(names))
+	for _, name := range names {
+		data, ok := fs.GetXAttr(path, name)
+		if ok == ENODATA {
+			continue
+		}
+		if ok < 0 {
+			return nil, ok
+		}
+		xa[name] = data
+	}
+	return xa, 0
+}
+
+//apply changes of extended attributes, one by one if fs is not an XAttrUpdater
+func UpdateXAttrs(fs FileSystemImpl, path string, set XAttrs, remove []string) int {
+	if u, ok := fs.(XAttrUpdater); ok {
+		return u.UpdateXAttrs(path, set, remove)
+	}
+	for _, name := range remove {
+		if ok := fs.RemoveXAttr(path, name); ok < 0 && ok != ENODATA {
+			return ok
+		}
+	}
+	for name, data := range set {
+		if ok := fs.SetXAttr(path, name, data, 0); ok < 0 {
+			return ok
+		}
+	}
+	return 0
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"log"
+	"strconv"
 	"strings"
+	"time"
 	//"os"
 
 	"github.com/allspace/csmgr/common"
@@ -11,8 +12,10 @@ import (
 	cfg "github.com/allspace/csmgr/util"
 )
 
-func NewFileSystem(name string) (fscommon.FileSystemImpl, int) {
+//create a file system from the global config, or the config of a mount section
+func NewFileSystem(ac *cfg.AppCfg) (fscommon.FileSystemImpl, int) {
 	var client fscommon.ClientImpl
+	name := ac.GetStringEx("VENDOR_TYPE", "")
 	switch strings.ToLower(name) {
 	case "s3":
 		client = s3impl.NewClient()
@@ -21,23 +24,207 @@ func NewFileSystem(name string) (fscommon.FileSystemImpl, int) {
 		client = aliyunimpl.NewClient()
 		break
 	default:
-		log.Printf("Unknown vendor type: %s.", name)
-		return nil, -1
+		dlog.Errorf("Unknown vendor type: %s.", name)
+		return nil, fscommon.EINVAL
 	}
 
-	endPoint, _ := cfg.Default.GetString("ENDPOINT")
-	keyId, _ := cfg.Default.GetString("KEY_ID")
-	key, _ := cfg.Default.GetString("KEY_DATA")
-	bucket, _ := cfg.Default.GetString("BUCKET")
-	region, _ := cfg.Default.GetString("REGION")
+	endPoint, _ := ac.GetString("ENDPOINT")
+	keyId, _ := ac.GetString("KEY_ID")
+	key, _ := ac.GetString("KEY_DATA")
+	bucket, _ := ac.GetString("BUCKET")
+	region, _ := ac.GetString("REGION")
 
-	log.Println(endPoint)
+	dlog.Infof("Endpoint: %s", endPoint)
 
+	dc, ok := driverCfg(ac)
+	if ok < 0 {
+		return nil, ok
+	}
+	for k, v := range dc {
+		client.Set(k, v)
+	}
+	if ok := client.Connect(region, keyId, key); ok < 0 {
+		return nil, ok
+	}
+	fs, ok := client.Mount(bucket)
+	if ok < 0 {
+		return nil, ok
+	}
+	return fs, 0
+}
+
+//driver config from the global config or a mount section, the keys of ClientImpl.Set
+//it's built again when config is reloaded, see fscommon.Reconfigurable
+func driverCfg(ac *cfg.AppCfg) (map[string]string, int) {
+	dc := make(map[string]string)
+	endPoint, _ := ac.GetString("ENDPOINT")
 	if len(endPoint) > 0 {
-		client.Set("EndPoint", endPoint)
+		dc["EndPoint"] = endPoint
+	}
+	//credential provider chain, see fscommon.NewCredentialChain, keys are not required in the config
+	for key, name := range map[string]string{
+		"CREDENTIALS":             "Credentials",
+		"CREDENTIALS_FILE":        "CredentialsFile",
+		"CREDENTIALS_PROFILE":     "CredentialsProfile",
+		"CREDENTIALS_COMMAND":     "CredentialsCommand",
+		"ROLE_ARN":                "RoleArn",
+		"ROLE_SESSION_NAME":       "RoleSessionName",
+		"WEB_IDENTITY_TOKEN_FILE": "WebIdentityTokenFile",
+		"OIDC_PROVIDER_ARN":       "OidcProviderArn",
+		"STS_ENDPOINT":            "StsEndpoint",
+	} {
+		if val, err := ac.GetString(key); err == nil && len(val) > 0 {
+			dc[name] = val
+		}
+	}
+	if d, err := ac.GetDuration("CREDENTIALS_DURATION"); err == nil {
+		dc["CredentialsDuration"] = strconv.Itoa(int(d / time.Second))
+	}
+	//client-side encryption, see fscommon.CryptIO
+	if keyFile, _ := ac.GetString("ENCRYPTION_KEY_FILE"); len(keyFile) > 0 {
+		dc["EncryptionKeyFile"] = keyFile
+	}
+	if migration, _ := ac.GetBool("ENCRYPTION_MIGRATION"); migration {
+		dc["EncryptionMigration"] = "1"
+	}
+	if nameEnc, _ := ac.GetBool("NAME_ENCRYPTION"); nameEnc {
+		dc["NameEncryption"] = "1"
+	}
+	//server-side encryption and storage class, see fscommon.ObjectPolicy
+	for key, name := range map[string]string{
+		"SSE":            "Sse",
+		"SSE_KMS_KEY_ID": "SseKmsKeyId",
+		"SSE_C_KEY_FILE": "SseCustomerKeyFile",
+		"STORAGE_CLASS":  "StorageClass",
+		"OBJECT_POLICY":  "ObjectPolicy",
+	} {
+		if val, err := ac.GetString(key); err == nil && len(val) > 0 {
+			dc[name] = val
+		}
+	}
+	//transparent compression, see fscommon.CompressIO
+	for key, name := range map[string]string{
+		"COMPRESSION":          "Compression",
+		"COMPRESSION_PATTERNS": "CompressionPatterns",
+		"COMPRESSION_LEVEL":    "CompressionLevel",
+	} {
+		if val, err := ac.GetString(key); err == nil && len(val) > 0 {
+			dc[name] = val
+		}
+	}
+	//end-to-end checksums, see fscommon.Checksummer
+	for key, name := range map[string]string{
+		"CHECKSUM":        "Checksum",
+		"CHECKSUM_VERIFY": "ChecksumVerify",
+	} {
+		if val, err := ac.GetString(key); err == nil && len(val) > 0 {
+			dc[name] = val
+		}
+	}
+	//list requests don't return POSIX attributes, load them for every entry if required
+	if readDirStat, _ := ac.GetBool("READDIR_STAT"); readDirStat {
+		dc["ReadDirStat"] = "1"
 	}
-	client.Connect(region, keyId, key)
-	fs, _ := client.Mount(bucket)
+	//save "user.tag.*" extended attributes as object tags
+	if xattrTags, _ := ac.GetBool("XATTR_TAGS"); xattrTags {
+		dc["XAttrTags"] = "1"
+	}
+	//store files as manifests of deduplicated chunks, see fscommon.DedupIO
+	if dedup, _ := ac.GetBool("DEDUP"); dedup {
+		dc["Dedup"] = "1"
+	}
+	//StatFs reports usage against quota, writes fail with ENOSPC once quota is exceeded
+	if quota, err := ac.GetSize("QUOTA"); err == nil && quota > 0 {
+		dc["Quota"] = strconv.FormatInt(quota, 10)
+	}
+	if softQuota, err := ac.GetSize("QUOTA_SOFT"); err == nil && softQuota > 0 {
+		dc["QuotaSoft"] = strconv.FormatInt(softQuota, 10)
+	}
+	//per directory quotas, e.g. QUOTA_PREFIX=/team-a:100G:80G,/team-b:50G
+	if prefixQuota, err := ac.GetString("QUOTA_PREFIX"); err == nil {
+		rules, err := parsePrefixQuota(prefixQuota)
+		if err != nil {
+			dlog.Errorf("Invalid QUOTA_PREFIX %s: %s", prefixQuota, err)
+			return nil, fscommon.EINVAL
+		}
+		dc["QuotaPrefix"] = rules
+	}
+	if statFsUsage, _ := ac.GetBool("STATFS_USAGE"); statFsUsage {
+		dc["StatFsUsage"] = "1"
+	}
+	if interval, err := ac.GetDuration("USAGE_SCAN_INTERVAL"); err == nil {
+		dc["UsageScanInterval"] = strconv.Itoa(int(interval / time.Second))
+	}
+	//aliyun only: "stat" (default) or "list"
+	if source, err := ac.GetString("USAGE_SOURCE"); err == nil {
+		dc["UsageSource"] = strings.ToLower(source)
+	}
+	//retry of backend requests, drivers take delays in milliseconds, timeouts and cool down in seconds
+	for key, name := range map[string]string{
+		"RETRY_MAX":         "RetryMax",
+		"BREAKER_THRESHOLD": "BreakerThreshold",
+	} {
+		if n, err := ac.GetInt(key); err == nil {
+			dc[name] = strconv.Itoa(n)
+		}
+	}
+	for key, name := range map[string]string{
+		"RETRY_BASE_DELAY":  "RetryBaseDelay",
+		"RETRY_MAX_DELAY":   "RetryMaxDelay",
+		"IO_TIMEOUT":        "IoTimeout",
+		"IO_TIMEOUT_READ":   "IoTimeoutRead",
+		"IO_TIMEOUT_WRITE":  "IoTimeoutWrite",
+		"IO_TIMEOUT_META":   "IoTimeoutMeta",
+		"IO_TIMEOUT_LIST":   "IoTimeoutList",
+		"IO_TIMEOUT_DELETE": "IoTimeoutDelete",
+		"BREAKER_COOLDOWN":  "BreakerCooldown",
+	} {
+		if d, err := ac.GetDuration(key); err == nil {
+			unit := time.Second
+			if strings.HasPrefix(key, "RETRY_") {
+				unit = time.Millisecond
+			}
+			dc[name] = strconv.FormatInt(int64(d/unit), 10)
+		}
+	}
+	//rate limits per mount, and per client (WebDAV user or remote address), 0 for no limit
+	//bandwidth in bytes per second, e.g. RATE_UPLOAD=10M, requests per second as an integer
+	for key, name := range map[string]string{
+		"RATE_UPLOAD":          "RateUpload",
+		"RATE_DOWNLOAD":        "RateDownload",
+		"RATE_CLIENT_UPLOAD":   "RateClientUpload",
+		"RATE_CLIENT_DOWNLOAD": "RateClientDownload",
+	} {
+		if n, err := ac.GetSize(key); err == nil {
+			dc[name] = strconv.FormatInt(n, 10)
+		}
+	}
+	if rps, err := ac.GetInt("RATE_RPS"); err == nil {
+		dc["RateRps"] = strconv.Itoa(rps)
+	}
+	if rps, err := ac.GetInt("RATE_CLIENT_RPS"); err == nil {
+		dc["RateClientRps"] = strconv.Itoa(rps)
+	}
+	return dc, 0
+}
 
-	return fs, 0
+//convert sizes in prefix quota rules "prefix:hard[:soft],..." to bytes
+func parsePrefixQuota(val string) (string, error) {
+	rules := make([]string, 0)
+	for _, rule := range strings.Split(val, ",") {
+		rule = strings.TrimSpace(rule)
+		if len(rule) == 0 {
+			continue
+		}
+		parts := strings.Split(rule, ":")
+		for i := 1; i < len(parts); i++ {
+			n, err := cfg.ParseSize(parts[i])
+			if err != nil {
+				return "", err
+			}
+			parts[i] = strconv.FormatInt(n, 10)
+		}
+		rules = append(rules, strings.Join(parts, ":"))
+	}
+	return strings.Join(rules, ","), nil
 }
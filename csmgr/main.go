@@ -2,30 +2,210 @@ package main
 
 import (
 	//"fmt"
-	"flag"
+	"bufio"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 
+	"github.com/allspace/csmgr/common"
 	"github.com/allspace/csmgr/fsvc"
 	cfg "github.com/allspace/csmgr/util"
 )
 
-func main() {
-	flag.String("vendor_type", "S3", "file system type")
-	flag.Parse()
-	if len(flag.Args()) < 1 {
-		//log.Fatal("Usage:\n  hello MOUNTPOINT")
-	}
+var dlog = cfg.GetLogger("main")
 
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile) //for libraries using the standard logger
 
 	cfg.Default.Init("")
+	if args := cfg.Default.Args(); len(args) > 0 {
+		os.Exit(runCommand(args))
+	}
+	if err := cfg.Default.Validate(); err != nil {
+		log.Fatalf("Invalid config: %s", err)
+	}
+	if err := cfg.InitLog(&cfg.Default); err != nil {
+		log.Fatalf("Invalid log config: %s", err)
+	}
 	cfg.Default.PrintAll()
 
-	fs, _ := NewFileSystem(cfg.Default.GetStringEx("VENDOR_TYPE", ""))
-	if fs == nil {
-		log.Println("Failed to create file system instance.")
+	mounts, auditFs := newMounts()
+	if mounts == nil {
 		return
 	}
+	if size, err := cfg.Default.GetSize("READ_BUFFER_SIZE"); err == nil {
+		fscommon.SetReadBufferSize(size)
+	}
+	//requests to the backend are canceled after the timeout
+	if timeout, err := cfg.Default.GetDuration("REQUEST_TIMEOUT"); err == nil && timeout > 0 {
+		fsvc.RequestTimeout = timeout
+	}
+	//Prometheus metrics are served on the WebDAV port or a separate one, an empty path disables them
+	if path, err := cfg.Default.GetString("METRICS_PATH"); err == nil {
+		fsvc.MetricsPath = path
+	}
+	fsvc.MetricsAddr = cfg.Default.GetStringEx("METRICS_ADDR", "")
+	if err := startTracing(); err != nil {
+		dlog.Errorf("Failed to start tracing: %s", err)
+		return
+	}
+	if err := startAudit(auditFs); err != nil {
+		dlog.Errorf("Failed to start audit log: %s", err)
+		return
+	}
+	startReload()
 	//fsvc.FileSystemMainLoop(fs, flag.Arg(0))
-	fsvc.Http_MainLoop(fs)
+	fsvc.Http_MainLoopMounts(mounts)
+}
+
+//one mount from the global config, or a mount for each [mount.<name>] section
+//a mount is served by WebDAV under PREFIX, /<name> by default, and by FUSE at MOUNT_POINT if it's set
+//rotated audit logs are uploaded into the mount AUDIT_UPLOAD_MOUNT, the first one by default
+func newMounts() (map[string]fscommon.FileSystemImpl, fscommon.FileSystemImpl) {
+	names := cfg.Default.Sections("mount.")
+	if len(names) == 0 {
+		fs, _ := NewFileSystem(&cfg.Default)
+		if fs == nil {
+			dlog.Errorf("Failed to create file system instance.")
+			return nil, nil
+		}
+		mountSections[""] = fs
+		return map[string]fscommon.FileSystemImpl{"/": fs}, fs
+	}
+
+	mounts := make(map[string]fscommon.FileSystemImpl)
+	var auditFs fscommon.FileSystemImpl
+	auditMount := cfg.Default.GetStringEx("AUDIT_UPLOAD_MOUNT", names[0])
+	for _, name := range names {
+		//PREFIX and MOUNT_POINT are not inherited from global keys
+		prefix := cfg.Default.GetStringEx("mount."+name+".PREFIX", "/"+name)
+		if _, ok := mounts[prefix]; ok {
+			dlog.Errorf("Duplicated prefix %s of mount %s.", prefix, name)
+			return nil, nil
+		}
+		fs, _ := NewFileSystem(cfg.Default.Section("mount." + name))
+		if fs == nil {
+			dlog.Errorf("Failed to create file system instance of mount %s.", name)
+			return nil, nil
+		}
+		mounts[prefix] = fs
+		mountSections["mount."+name] = fs
+		if name == auditMount {
+			auditFs = fs
+		}
+		if mnt, err := cfg.Default.GetString("mount." + name + ".MOUNT_POINT"); err == nil && len(mnt) > 0 {
+			go fsvc.FileSystemMainLoop(fs, mnt)
+		}
+	}
+	return mounts, auditFs
+}
+
+//TRACE_EXPORTER is otlp, file or none (default)
+//TRACE_ENDPOINT is the OTLP/HTTP traces url, TRACE_HEADERS are sent with it, e.g. authorization=Bearer xxx
+//TRACE_FILE is the file for the file exporter, TRACE_SAMPLE_RATIO is the ratio of traced requests, 1 by default
+func startTracing() error {
+	service := cfg.Default.GetStringEx("TRACE_SERVICE", "csmgr")
+	var exporter fscommon.SpanExporter
+	switch strings.ToLower(cfg.Default.GetStringEx("TRACE_EXPORTER", "none")) {
+	case "none", "":
+		return nil
+	case "otlp":
+		headers := make(map[string]string)
+		for _, item := range strings.Split(cfg.Default.GetStringEx("TRACE_HEADERS", ""), ",") {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) == 2 {
+				headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		}
+		endpoint := cfg.Default.GetStringEx("TRACE_ENDPOINT", "http://localhost:4318/v1/traces")
+		exporter = fscommon.NewOtlpSpanExporter(endpoint, service, headers)
+	case "file":
+		path, err := cfg.Default.GetString("TRACE_FILE")
+		if err != nil {
+			return fmt.Errorf("TRACE_FILE is required by the file exporter")
+		}
+		fe, err := fscommon.NewFileSpanExporter(path, service)
+		if err != nil {
+			return err
+		}
+		exporter = fe
+	default:
+		return fmt.Errorf("unknown trace exporter %s", cfg.Default.GetStringEx("TRACE_EXPORTER", ""))
+	}
+
+	ratio, err := cfg.Default.GetFloat("TRACE_SAMPLE_RATIO")
+	if err != nil {
+		return fmt.Errorf("invalid TRACE_SAMPLE_RATIO: %s", err)
+	}
+	fscommon.StartTracing(exporter, ratio)
+	return nil
+}
+
+//AUDIT_FILE enables the audit log, AUDIT_FORMAT is json (default) or text
+//the file is rotated at AUDIT_MAX_SIZE, and AUDIT_MAX_FILES rotated files are kept
+//rotated files are uploaded into the bucket under AUDIT_UPLOAD_PREFIX if it's set, e.g. .audit/
+func startAudit(fs fscommon.FileSystemImpl) error {
+	path, err := cfg.Default.GetString("AUDIT_FILE")
+	if err != nil || len(path) == 0 {
+		return nil
+	}
+	maxSize, err := cfg.Default.GetSize("AUDIT_MAX_SIZE")
+	if err != nil {
+		return fmt.Errorf("invalid AUDIT_MAX_SIZE: %s", err)
+	}
+	format := strings.ToLower(cfg.Default.GetStringEx("AUDIT_FORMAT", fscommon.AUDIT_FORMAT_JSON))
+	audit, err := fscommon.NewAuditLog(path, format, maxSize, cfg.Default.GetIntEx("AUDIT_MAX_FILES", 0))
+	if err != nil {
+		return err
+	}
+	if prefix := cfg.Default.GetStringEx("AUDIT_UPLOAD_PREFIX", ""); len(prefix) > 0 && fs != nil {
+		audit.SetUploader(fs, prefix)
+	}
+	fscommon.StartAudit(audit)
+	return nil
+}
+
+//csmgr config print: print effective config, secrets are redacted
+//csmgr config check: validate config
+//csmgr config help: print all config keys
+//csmgr config encrypt [value]: encrypt a value read from stdin if it's not given, with CONFIG_KEY_FILE or $CS_CONFIG_PASSPHRASE
+func runCommand(args []string) int {
+	if len(args) < 2 || args[0] != "config" {
+		fmt.Fprintf(os.Stderr, "Usage: csmgr [--key=value ...] [config print|check|help|encrypt [value]]\n")
+		return 2
+	}
+	switch args[1] {
+	case "print":
+		cfg.Default.Print(os.Stdout)
+	case "check":
+		if err := cfg.Default.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid config: %s\n", err)
+			return 1
+		}
+	case "help":
+		cfg.PrintCfgHelp(os.Stdout)
+	case "encrypt":
+		var val string
+		if len(args) > 2 {
+			val = args[2]
+		} else {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && len(line) == 0 {
+				fmt.Fprintf(os.Stderr, "Failed to read value: %s\n", err)
+				return 1
+			}
+			val = strings.TrimRight(line, "\r\n")
+		}
+		enc, err := cfg.Default.Encrypt(val)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to encrypt: %s\n", err)
+			return 1
+		}
+		fmt.Println(enc)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: config %s\n", args[1])
+		return 2
+	}
+	return 0
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/allspace/csmgr/common"
+	cfg "github.com/allspace/csmgr/util"
+)
+
+//file system of each mount by its config section, "" for the global config
+var mountSections = make(map[string]fscommon.FileSystemImpl)
+
+//reload config on SIGHUP, and when the config file is modified if CONFIG_WATCH_INTERVAL is set
+//open files are not affected, see keys declared with Reload in schema.go for what can be changed
+func startReload() {
+	cfg.Default.OnReload(applyReload)
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			dlog.Infof("Got SIGHUP, reloading config.")
+			cfg.Default.Reload()
+		}
+	}()
+
+	if interval, err := cfg.Default.GetDuration("CONFIG_WATCH_INTERVAL"); err == nil && interval > 0 {
+		cfg.Default.Watch(interval)
+	}
+}
+
+func applyReload(changed []string) {
+	if err := cfg.InitLog(&cfg.Default); err != nil {
+		dlog.Errorf("Invalid log config, it's not changed: %s", err)
+	}
+	if size, err := cfg.Default.GetSize("READ_BUFFER_SIZE"); err == nil {
+		fscommon.SetReadBufferSize(size)
+	}
+
+	for section, fs := range mountSections {
+		rfs, ok := fs.(fscommon.Reconfigurable)
+		if !ok {
+			continue
+		}
+		ac := &cfg.Default
+		if len(section) > 0 {
+			ac = cfg.Default.Section(section)
+		}
+		dc, rc := driverCfg(ac)
+		if rc < 0 {
+			dlog.Errorf("Failed to reconfigure mount %s.", section)
+			continue
+		}
+		rfs.Reconfigure(dc)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"time"
+
+	cfg "github.com/allspace/csmgr/util"
+)
+
+//all config keys of csmgr, keys of a mount can also be set in its [mount.<name>] section
+//keys with Reload can be changed by SIGHUP or CONFIG_WATCH_INTERVAL, see reload.go
+func init() {
+	cfg.RegisterCfg(
+		//backend
+		&cfg.CfgKey{Name: "VENDOR_TYPE", Desc: "storage vendor", Values: []string{"s3", "aliyun"}},
+		&cfg.CfgKey{Name: "ENDPOINT", Desc: "endpoint of the storage service"},
+		&cfg.CfgKey{Name: "REGION", Desc: "region of the bucket"},
+		&cfg.CfgKey{Name: "KEY_ID", Desc: "access key id"},
+		&cfg.CfgKey{Name: "KEY_DATA", Desc: "secret access key", Secret: true},
+		&cfg.CfgKey{Name: "BUCKET", Desc: "bucket to mount"},
+
+		//credentials, tried in order of CREDENTIALS until one of them is found
+		&cfg.CfgKey{Name: "CREDENTIALS", Default: "static,env,shared,web_identity,process", Desc: "credential providers, static is KEY_ID/KEY_DATA"},
+		&cfg.CfgKey{Name: "CREDENTIALS_FILE", Desc: "shared credentials file, ~/.aws/credentials or ~/.alibabacloud/credentials by default"},
+		&cfg.CfgKey{Name: "CREDENTIALS_PROFILE", Desc: "profile in the shared credentials file, default by default"},
+		&cfg.CfgKey{Name: "CREDENTIALS_COMMAND", Desc: "command printing credentials as JSON, in the format of AWS credential_process"},
+		&cfg.CfgKey{Name: "CREDENTIALS_DURATION", Type: cfg.CFG_DURATION, Default: "1h", Desc: "lifetime of temporary credentials from STS"},
+		&cfg.CfgKey{Name: "ROLE_ARN", Desc: "role assumed with the web identity token, or by AssumeRole of aliyun STS without a token file"},
+		&cfg.CfgKey{Name: "ROLE_SESSION_NAME", Desc: "session name of the assumed role, csmgr by default"},
+		&cfg.CfgKey{Name: "WEB_IDENTITY_TOKEN_FILE", Desc: "web identity (OIDC) token file, read again on each refresh"},
+		&cfg.CfgKey{Name: "OIDC_PROVIDER_ARN", Desc: "OIDC provider of the web identity token, aliyun only"},
+		&cfg.CfgKey{Name: "STS_ENDPOINT", Desc: "STS endpoint, the public one of the vendor by default"},
+		&cfg.CfgKey{Name: "READDIR_STAT", Type: cfg.CFG_BOOL, Desc: "load POSIX attributes of every entry when a directory is listed"},
+		&cfg.CfgKey{Name: "XATTR_TAGS", Type: cfg.CFG_BOOL, Desc: "save user.tag.* extended attributes as object tags"},
+
+		//client-side encryption, objects which are not encrypted are refused unless ENCRYPTION_MIGRATION is set
+		&cfg.CfgKey{Name: "ENCRYPTION_KEY_FILE", Desc: "master key file of client-side encryption, 32 bytes raw, in hex or base64"},
+		&cfg.CfgKey{Name: "ENCRYPTION_MIGRATION", Type: cfg.CFG_BOOL, Desc: "read objects which are not encrypted as plain text, while a bucket is migrated to ENCRYPTION_KEY_FILE"},
+		&cfg.CfgKey{Name: "NAME_ENCRYPTION", Type: cfg.CFG_BOOL, Desc: "encrypt object names with the key of ENCRYPTION_KEY_FILE, objects with plain names are hidden"},
+
+		//server-side encryption and storage class of new objects
+		&cfg.CfgKey{Name: "SSE", Desc: "server-side encryption, c is SSE-C with the key of SSE_C_KEY_FILE", Values: []string{"none", "s3", "kms", "c"}},
+		&cfg.CfgKey{Name: "SSE_KMS_KEY_ID", Desc: "KMS key of SSE=kms, the default key of the service if it's not set"},
+		&cfg.CfgKey{Name: "SSE_C_KEY_FILE", Desc: "customer key file of SSE=c, 32 bytes raw, in hex or base64"},
+		&cfg.CfgKey{Name: "STORAGE_CLASS", Desc: "storage class, STANDARD, IA, ARCHIVE, COLD_ARCHIVE or a class name of the vendor"},
+		&cfg.CfgKey{Name: "OBJECT_POLICY", Desc: "settings of path patterns, e.g. logs:storage_class=IA;secret/*:sse=kms,kms_key_id=alias/secret"},
+
+		//compression of files matching patterns, files written without it are still readable
+		&cfg.CfgKey{Name: "COMPRESSION", Default: "none", Desc: "compression of file data", Values: []string{"none", "gzip", "zstd"}},
+		&cfg.CfgKey{Name: "COMPRESSION_PATTERNS", Desc: "patterns of compressed files separated by commas, e.g. *.log,data/*, all files by default"},
+		&cfg.CfgKey{Name: "COMPRESSION_LEVEL", Type: cfg.CFG_INT, Desc: "gzip level from 1 (fastest) to 9 (best) or zstd level from 1 to 22, the default level of the codec if it's not set"},
+
+		//checksums of blocks of object data, saved with objects and verified by reads of whole blocks
+		&cfg.CfgKey{Name: "CHECKSUM", Default: "none", Desc: "checksum of blocks of objects, Content-MD5 is sent with uploads too", Values: []string{"none", "crc32c", "sha256"}},
+		&cfg.CfgKey{Name: "CHECKSUM_VERIFY", Default: "fail", Desc: "on a mismatch of checksum or multipart ETag, fail fails the request with EIO; fail also refuses writes of objects with too many blocks for checksums in meta data, others write them without checksums", Values: []string{"off", "warn", "fail"}},
+
+		//deduplication, a bucket in this mode should be written by one mount
+		&cfg.CfgKey{Name: "DEDUP", Type: cfg.CFG_BOOL, Desc: "store files as manifests of content-defined chunks, chunks are shared under $chunk$/"},
+
+		//quota
+		&cfg.CfgKey{Name: "QUOTA", Type: cfg.CFG_SIZE, Desc: "hard quota of the mount, e.g. 100G"},
+		&cfg.CfgKey{Name: "QUOTA_SOFT", Type: cfg.CFG_SIZE, Desc: "soft quota of the mount, a warning is logged once it's exceeded"},
+		&cfg.CfgKey{Name: "QUOTA_PREFIX", Desc: "quotas of directories, e.g. /team-a:100G:80G,/team-b:50G"},
+		&cfg.CfgKey{Name: "STATFS_USAGE", Type: cfg.CFG_BOOL, Desc: "report bucket usage in StatFs without a quota"},
+		&cfg.CfgKey{Name: "USAGE_SCAN_INTERVAL", Type: cfg.CFG_DURATION, Desc: "interval of usage reconciliation"},
+		&cfg.CfgKey{Name: "USAGE_SOURCE", Desc: "how usage is scanned, aliyun only", Values: []string{"stat", "list"}},
+
+		//retry and timeouts
+		&cfg.CfgKey{Name: "REQUEST_TIMEOUT", Type: cfg.CFG_DURATION, Desc: "deadline of a front-end request, 0 for no limit"},
+		&cfg.CfgKey{Name: "RETRY_MAX", Type: cfg.CFG_INT, Desc: "max retries of a backend request"},
+		&cfg.CfgKey{Name: "RETRY_BASE_DELAY", Type: cfg.CFG_DURATION, Unit: time.Millisecond, Desc: "delay before the first retry"},
+		&cfg.CfgKey{Name: "RETRY_MAX_DELAY", Type: cfg.CFG_DURATION, Unit: time.Millisecond, Desc: "max delay between retries"},
+		&cfg.CfgKey{Name: "IO_TIMEOUT", Type: cfg.CFG_DURATION, Desc: "timeout of a backend request"},
+		&cfg.CfgKey{Name: "IO_TIMEOUT_READ", Type: cfg.CFG_DURATION, Desc: "timeout of a backend read"},
+		&cfg.CfgKey{Name: "IO_TIMEOUT_WRITE", Type: cfg.CFG_DURATION, Desc: "timeout of a backend write"},
+		&cfg.CfgKey{Name: "IO_TIMEOUT_META", Type: cfg.CFG_DURATION, Desc: "timeout of a backend metadata request"},
+		&cfg.CfgKey{Name: "IO_TIMEOUT_LIST", Type: cfg.CFG_DURATION, Desc: "timeout of a backend list"},
+		&cfg.CfgKey{Name: "IO_TIMEOUT_DELETE", Type: cfg.CFG_DURATION, Desc: "timeout of a backend delete"},
+		&cfg.CfgKey{Name: "BREAKER_THRESHOLD", Type: cfg.CFG_INT, Desc: "failures in a row to open the circuit breaker, 0 to disable it"},
+		&cfg.CfgKey{Name: "BREAKER_COOLDOWN", Type: cfg.CFG_DURATION, Desc: "time before an open circuit breaker is tried again"},
+
+		//rate limits
+		&cfg.CfgKey{Name: "RATE_UPLOAD", Type: cfg.CFG_SIZE, Desc: "upload bandwidth of the mount per second", Reload: true},
+		&cfg.CfgKey{Name: "RATE_DOWNLOAD", Type: cfg.CFG_SIZE, Desc: "download bandwidth of the mount per second", Reload: true},
+		&cfg.CfgKey{Name: "RATE_RPS", Type: cfg.CFG_INT, Desc: "backend requests of the mount per second", Reload: true},
+		&cfg.CfgKey{Name: "RATE_CLIENT_UPLOAD", Type: cfg.CFG_SIZE, Desc: "upload bandwidth of a client per second", Reload: true},
+		&cfg.CfgKey{Name: "RATE_CLIENT_DOWNLOAD", Type: cfg.CFG_SIZE, Desc: "download bandwidth of a client per second", Reload: true},
+		&cfg.CfgKey{Name: "RATE_CLIENT_RPS", Type: cfg.CFG_INT, Desc: "backend requests of a client per second", Reload: true},
+
+		//cache
+		&cfg.CfgKey{Name: "READ_BUFFER_SIZE", Type: cfg.CFG_SIZE, Default: "1M", Desc: "read buffer of an open file", Reload: true},
+
+		//mounts, in [mount.<name>] sections only
+		&cfg.CfgKey{Name: "PREFIX", Desc: "WebDAV path prefix of a mount, /<name> by default"},
+		&cfg.CfgKey{Name: "MOUNT_POINT", Desc: "FUSE mount point of a mount"},
+
+		//config
+		&cfg.CfgKey{Name: "CONFIG_KEY_FILE", Desc: "key file of enc: values, $CS_CONFIG_PASSPHRASE is used if it's not set"},
+		&cfg.CfgKey{Name: "CONFIG_WATCH_INTERVAL", Type: cfg.CFG_DURATION, Desc: "interval to check if the config file is modified, 0 to reload on SIGHUP only"},
+
+		//logging
+		&cfg.CfgKey{Name: "LOG_LEVEL", Default: "info", Desc: "default log level", Values: []string{"debug", "info", "warn", "warning", "error", "off"}, Reload: true},
+		&cfg.CfgKey{Name: "LOG_LEVELS", Desc: "log levels of subsystems, e.g. s3=debug,webdav=warn", Reload: true},
+		&cfg.CfgKey{Name: "LOG_FORMAT", Default: "text", Desc: "log format", Values: []string{"text", "json"}, Reload: true},
+		&cfg.CfgKey{Name: "LOG_FILE", Desc: "log file, stderr if it's not set", Reload: true},
+
+		//metrics and tracing
+		&cfg.CfgKey{Name: "METRICS_PATH", Default: "/$metrics$", Desc: "path of Prometheus metrics, empty to disable"},
+		&cfg.CfgKey{Name: "METRICS_ADDR", Desc: "listen address of a separate server of metrics, e.g. :9100, they are served on the WebDAV server if it's not set"},
+		&cfg.CfgKey{Name: "TRACE_EXPORTER", Default: "none", Desc: "span exporter", Values: []string{"none", "otlp", "file"}},
+		&cfg.CfgKey{Name: "TRACE_ENDPOINT", Default: "http://localhost:4318/v1/traces", Desc: "OTLP/HTTP traces url"},
+		&cfg.CfgKey{Name: "TRACE_HEADERS", Desc: "headers sent to the OTLP endpoint, e.g. authorization=Bearer xxx", Secret: true},
+		&cfg.CfgKey{Name: "TRACE_FILE", Desc: "file of the file exporter"},
+		&cfg.CfgKey{Name: "TRACE_SAMPLE_RATIO", Type: cfg.CFG_FLOAT, Default: "1", Desc: "ratio of traced requests"},
+		&cfg.CfgKey{Name: "TRACE_SERVICE", Default: "csmgr", Desc: "service name of spans"},
+
+		//audit
+		&cfg.CfgKey{Name: "AUDIT_FILE", Desc: "audit log file, audit is off if it's not set"},
+		&cfg.CfgKey{Name: "AUDIT_FORMAT", Default: "json", Desc: "audit log format", Values: []string{"json", "text"}},
+		&cfg.CfgKey{Name: "AUDIT_MAX_SIZE", Type: cfg.CFG_SIZE, Default: "100M", Desc: "size to rotate the audit log"},
+		&cfg.CfgKey{Name: "AUDIT_MAX_FILES", Type: cfg.CFG_INT, Default: "10", Desc: "rotated audit logs kept locally"},
+		&cfg.CfgKey{Name: "AUDIT_UPLOAD_PREFIX", Desc: "upload rotated audit logs into the bucket under the prefix, e.g. .audit/"},
+		&cfg.CfgKey{Name: "AUDIT_UPLOAD_MOUNT", Desc: "mount to upload audit logs into, the first one by default"},
+	)
+}
@@ -2,13 +2,22 @@ package aliyunimpl
 
 import (
 	//"os"
-	"log"
+	"context"
+	"strconv"
 
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 
 	"github.com/allspace/csmgr/common"
+	"github.com/allspace/csmgr/util"
 )
 
+var dlog = util.GetLogger("aliyun")
+
+//client span of a call to the OSS api, end it with span.EndErr(err)
+func ossSpan(ctx context.Context, op string, key string) (context.Context, *fscommon.Span) {
+	return fscommon.StartSpanKind(ctx, fscommon.SPAN_KIND_CLIENT, "oss."+op, "key", key)
+}
+
 type AliyunClientImpl struct {
 	client *oss.Client
 
@@ -28,14 +37,60 @@ func (me *AliyunClientImpl) Connect(region string, keyId string, keyData string)
 
 	endPoint := region + ".aliyuncs.com"
 
-	me.client, err = oss.New(endPoint, keyId, keyData)
+	chain, ok := fscommon.NewCredentialChain(me.cfg, fscommon.CRED_VENDOR_ALIYUN, keyId, keyData)
+	if ok < 0 {
+		return ok
+	}
+	if _, err = chain.Get(); err != nil {
+		dlog.Errorf("Failed to get credentials: %s", err)
+		return fscommon.EACCES
+	}
+	me.client, err = oss.New(endPoint, "", "", oss.SetCredentialsProvider(&chainProvider{chain}))
 	if err != nil {
-		log.Println(err)
+		dlog.Errorf("Failed to create client for %s: %s", endPoint, err)
 		return fscommon.EIO //EIO
 	}
 	return 0
 }
 
+//oss.CredentialsProvider of the credential chain, it's called for each request
+type chainProvider struct {
+	chain *fscommon.CredentialChain
+}
+
+type chainCredentials struct {
+	cred *fscommon.Credential
+}
+
+func (me *chainCredentials) GetAccessKeyID() string {
+	return me.cred.KeyId
+}
+
+func (me *chainCredentials) GetAccessKeySecret() string {
+	return me.cred.KeyData
+}
+
+func (me *chainCredentials) GetSecurityToken() string {
+	return me.cred.Token
+}
+
+func (me *chainProvider) GetCredentials() oss.Credentials {
+	cred, _ := me.GetCredentialsE()
+	if cred == nil {
+		return &chainCredentials{&fscommon.Credential{}}
+	}
+	return cred
+}
+
+func (me *chainProvider) GetCredentialsE() (oss.Credentials, error) {
+	cred, err := me.chain.Get()
+	if err != nil {
+		dlog.Errorf("Failed to get credentials: %s", err)
+		return nil, err
+	}
+	return &chainCredentials{cred}, nil
+}
+
 func (me *AliyunClientImpl) Disconnect() int {
 	return 0
 }
@@ -43,15 +98,82 @@ func (me *AliyunClientImpl) Disconnect() int {
 func (me *AliyunClientImpl) Mount(bucketName string) (fscommon.FileSystemImpl, int) {
 	bucket, err := me.client.Bucket(bucketName)
 	if err != nil {
-		log.Println(err)
+		dlog.Errorf("Failed to open bucket %s: %s", bucketName, err)
 		return nil, fscommon.EIO //EIO
 	}
-	log.Println("Connected to bucket ", bucketName)
+	dlog.Infof("Connected to bucket %s", bucketName)
 	vol := &AliyunFSImpl{
 		client: me.client,
 		bucket: bucket,
+
+		readDirStat: me.cfg["ReadDirStat"] == "1",
+		xattrTags:   me.cfg["XAttrTags"] == "1",
+		usageByList: me.cfg["UsageSource"] == "list",
+		dedup:       me.cfg["Dedup"] == "1",
+
+		retry:   fscommon.NewRetryPolicy(me.cfg),
+		limiter: fscommon.NewRateLimiter(me.cfg),
+	}
+	//client-side encryption, see fscommon.CryptIO
+	if file := me.cfg["EncryptionKeyFile"]; len(file) > 0 {
+		key, err := fscommon.LoadCryptKey(file)
+		if err != nil {
+			dlog.Errorf("Failed to load encryption key %s: %s", file, err)
+			return nil, fscommon.EINVAL
+		}
+		key.AllowPlain(me.cfg["EncryptionMigration"] == "1")
+		vol.crypt = key
+	}
+	//names are encrypted with the master key too, see fscommon.NameCryptFS
+	var names *fscommon.NameCipher
+	if me.cfg["NameEncryption"] == "1" {
+		if vol.crypt == nil {
+			dlog.Errorf("Name encryption requires an encryption key")
+			return nil, fscommon.EINVAL
+		}
+		names = vol.crypt.NameCipher()
 	}
+	policy, ok := fscommon.NewObjectPolicy(me.cfg)
+	if ok < 0 {
+		return nil, ok
+	}
+	vol.policy = policy
+	compress, ok := fscommon.NewCompressor(me.cfg)
+	if ok < 0 {
+		return nil, ok
+	}
+	vol.compress = compress
+	//patterns are of plain paths, keys are decrypted to match them
+	if names != nil {
+		policy.SetNames(names)
+		compress.SetNames(names)
+	}
+	checksum, ok := fscommon.NewChecksummer(me.cfg)
+	if ok < 0 {
+		return nil, ok
+	}
+	vol.checksum = checksum
 	vol.Init(bucketName)
+
+	//track bucket usage for StatFs and quota check
+	quota, _ := strconv.ParseInt(me.cfg["Quota"], 10, 64)
+	softQuota, _ := strconv.ParseInt(me.cfg["QuotaSoft"], 10, 64)
+	prefixQuota := me.cfg["QuotaPrefix"]
+	if quota > 0 || softQuota > 0 || len(prefixQuota) > 0 || me.cfg["StatFsUsage"] == "1" {
+		interval, _ := strconv.Atoi(me.cfg["UsageScanInterval"])
+		qm := fscommon.NewQuotaMgr(quota, softQuota, interval, vol.scanUsage)
+		if names != nil {
+			qm.SetKeyMapper(names.EncryptPath)
+		}
+		if ok := qm.AddPrefixes(prefixQuota); ok < 0 {
+			return nil, ok
+		}
+		vol.SetQuota(qm)
+	}
+
+	if names != nil {
+		return fscommon.NewNameCryptFS(vol, names), 0
+	}
 	return vol, 0
 }
 
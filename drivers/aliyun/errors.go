@@ -0,0 +1,49 @@
+package aliyunimpl
+
+import (
+	"context"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+
+	"github.com/allspace/csmgr/common"
+)
+
+//classify an error returned by oss sdk, the error is logged here
+func toFsError(op string, path string, err error) *fscommon.FsError {
+	errno, retryable := fscommon.EIO, false
+	switch e := err.(type) {
+	case oss.ServiceError:
+		errno, retryable = fscommon.ErrnoFromHttp(e.StatusCode, e.Code)
+	case *oss.ServiceError:
+		errno, retryable = fscommon.ErrnoFromHttp(e.StatusCode, e.Code)
+	case oss.UnexpectedStatusCodeError:
+		errno, retryable = fscommon.ErrnoFromHttp(e.Got(), "")
+	default:
+		retryable = fscommon.IsTransientNetError(err)
+	}
+
+	fe := fscommon.NewError(errno, op, path, err)
+	fe.Retryable = retryable
+	if errno == fscommon.ENOENT {
+		dlog.Debugf("%s", fe.Error())
+	} else {
+		dlog.Warnf("%s", fe.Error())
+	}
+	return fe
+}
+
+//get errno of an error returned by oss sdk
+func toErrno(op string, path string, err error) int {
+	return toFsError(op, path, err).Errno
+}
+
+//a request canceled by its context is not a backend failure
+//the error is reported to the context, so that the retry layer knows if it's transient
+func ctxErrno(ctx context.Context, op string, path string, err error) int {
+	if ok := fscommon.CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	fe := toFsError(op, path, err)
+	fscommon.ReportError(ctx, fe)
+	return fe.Errno
+}
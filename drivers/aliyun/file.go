@@ -1,8 +1,9 @@
 package aliyunimpl
 
 import (
-	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/allspace/csmgr/common"
 )
@@ -28,10 +29,14 @@ func (me *AliyunFile) Open(fileName string, flags uint32) int {
 
 	var ok int = 0
 
+	//PutBuffer strips leading slash, so does the file name here
+	me.io.fileName = strings.TrimPrefix(fileName, "/")
+	me.io.fileAttr = &me.Attr
+
 	if me.File == nil {
 		me.mtxOpen.Lock()
 		if me.File == nil {
-			me.File = NewSliceFile(me.io)
+			me.File = NewSliceFile(me.io.fs.dataIO(me.io))
 			ok = me.File.Open(fileName, flags)
 			if ok == 0 {
 				me.FileLen = me.File.GetLength()
@@ -50,7 +55,7 @@ func (me *AliyunFile) Write(data []byte, offset int64) int {
 	me.mtxWrite.Lock()
 	defer me.mtxWrite.Unlock()
 
-	log.Printf("Write is called for file %s, offset=%d, data length=%d\n", me.FileName, offset, len(data))
+	dlog.Debugf("Write is called for file %s, offset=%d, data length=%d", me.FileName, offset, len(data))
 
 	count := len(data)
 	if count > 0 {
@@ -58,14 +63,14 @@ func (me *AliyunFile) Write(data []byte, offset int64) int {
 	}
 
 	//append case
-	log.Printf("me.FileLen=%d\n", me.FileLen)
+	dlog.Debugf("me.FileLen=%d", me.FileLen)
 	//IMPORTANT: the offset may not continous
 	if offset >= me.AppendBuffer.BaseOffset {
-		log.Printf("Append file, file length=%d\n", me.FileLen)
+		dlog.Debugf("Append file, file length=%d", me.FileLen)
 		//return me.appendFile(data, offset)
 	}
 
-	log.Println("Run into unsupported cases for file ", me.FileName)
+	dlog.Warnf("Run into unsupported cases for file %s", me.FileName)
 
 	//random write case
 	//if offset < me.appendBuffer.BaseOffset {
@@ -74,14 +79,14 @@ func (me *AliyunFile) Write(data []byte, offset int64) int {
 
 	//truncate to enlarge case, not support for now
 	if offset > me.FileLen {
-		return -1
+		return fscommon.ENOTSUP
 	}
 
-	return -1
+	return fscommon.ENOTSUP
 }
 
 func (me *AliyunFile) Flush() int {
-	log.Printf("Flush is called for file %s\n", me.FileName)
+	dlog.Debugf("Flush is called for file %s", me.FileName)
 
 	//readonly
 	if me.Modified != true {
@@ -89,10 +94,15 @@ func (me *AliyunFile) Flush() int {
 	}
 
 	dataLen := me.AppendBuffer.MaxOffset - me.AppendBuffer.BaseOffset
+	me.Attr.DiMtime = time.Now()
 
-	log.Printf("Flush pendding write: dataLen=%d\n", dataLen)
+	dlog.Debugf("Flush pendding write: dataLen=%d", dataLen)
 
-	return me.File.Append(nil, me.AppendBuffer.Buffer[0:dataLen])
+	ok := me.File.Append(nil, me.AppendBuffer.Buffer[0:dataLen])
+	if ok == 0 {
+		me.AppendBuffer.MarkUploaded()
+	}
+	return ok
 
 	//run parts combination
 	//tc := taskCmd{cmd: TASK_COMBINE_T2, waitChan: make(chan int)}
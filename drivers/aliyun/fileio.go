@@ -1,12 +1,14 @@
 package aliyunimpl
 
 import (
+	"context"
 	"io"
+	"net/http"
 	"os"
+	"strconv"
 	//"os"
 	//"time"
 	"bytes"
-	"log"
 
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 
@@ -18,6 +20,25 @@ type AliyunIO struct {
 	bucketName string
 
 	fs *AliyunFSImpl
+
+	fileName string            //name of the file object
+	fileAttr *fscommon.DirItem //POSIX attributes saved with the file object
+
+	blocks fscommon.BlockCache //verified blocks of the last read
+}
+
+//get options to save meta data with an object
+//only the file object itself has POSIX attributes, helper objects don't
+func (me *AliyunIO) objectMeta(ctx context.Context, name string) []oss.Option {
+	md := fscommon.ObjectMetaOf(ctx, name)
+	if me.fileAttr != nil && name == me.fileName {
+		//meta data of old data is not kept, wrappers add it for new data
+		md = me.fileAttr.ToMeta().DropDataMeta().Merge(md)
+	}
+	if md == nil {
+		return nil
+	}
+	return metaOptions(md.Compact())
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -25,59 +46,113 @@ type AliyunIO struct {
 ///////////////////////////////////////////////////////////////////////////////
 
 func (me *AliyunIO) PutBuffer(name string, data []byte) int {
+	return me.PutBufferCtx(context.Background(), name, data)
+}
+
+func (me *AliyunIO) PutBufferCtx(ctx context.Context, name string, data []byte) int {
 	if name[0] == '/' {
 		name = name[1:]
 	}
 
-	err := me.bucket.PutObject(name, bytes.NewReader(data))
+	options := append(me.objectMeta(ctx, name), me.fs.putOptions(name)...)
+	//the storage verifies the upload by Content-MD5
+	if sum := me.fs.checksum; sum != nil {
+		if value, ok := sum.Value(data); ok == 0 {
+			options = append(options, oss.Meta(fscommon.META_CHECKSUM, value))
+		} else if ok = sum.Unchecked(name, ok); ok < 0 {
+			return ok
+		}
+		options = append(options, oss.ContentMD5(fscommon.ContentMD5(data)))
+	}
+	options = append(options, oss.WithContext(ctx))
+	me.blocks.Forget(name)
+	err := me.bucket.PutObject(name, bytes.NewReader(data), options...)
 	if err != nil {
-		log.Println(err)
-		return fscommon.EIO
+		return ctxErrno(ctx, "PutObject", name, err)
 	}
 	return 0
 }
 
 func (me *AliyunIO) GetBuffer(name string, dest []byte, offset int64) int {
+	return me.GetBufferCtx(context.Background(), name, dest, offset)
+}
+
+//with checksums, whole blocks are read and verified, see fscommon.Checksummer
+func (me *AliyunIO) GetBufferCtx(ctx context.Context, name string, dest []byte, offset int64) int {
 	if name[0] == '/' {
 		name = name[1:]
 	}
+	sum := me.fs.checksum
+	if !sum.Verifying() {
+		n, _ := me.getObject(ctx, name, dest, offset)
+		return n
+	}
+
+	return sum.ReadBlocks(&me.blocks, name, dest, offset, func(buf []byte, start int64) (int, string, int64) {
+		n, headers := me.getObject(ctx, name, buf, start)
+		if n <= 0 {
+			return n, "", 0
+		}
+		//the whole object is returned without Content-Range
+		total := fscommon.RangeTotal(headers.Get("Content-Range"))
+		if total < 0 {
+			total, _ = strconv.ParseInt(headers.Get(oss.HTTPHeaderContentLength), 10, 64)
+		}
+		return n, headers.Get(oss.HTTPHeaderOssMetaPrefix + fscommon.META_CHECKSUM), total
+	})
+}
+
+//read a range of an object, headers of the response are returned with the data, they are required for checksums
+func (me *AliyunIO) getObject(ctx context.Context, name string, dest []byte, offset int64) (int, http.Header) {
 	//log.Printf("GetBuffer: offset %d length %d", offset, len(dest))
-	body, err := me.bucket.GetObject(name, oss.Range(offset, offset+int64(len(dest))))
+	options := append(me.fs.readOptions(name), oss.Range(offset, offset+int64(len(dest))), oss.WithContext(ctx))
+	result, err := me.bucket.DoGetObject(&oss.GetObjectRequest{ObjectKey: name}, options)
 	if err != nil {
-		log.Println(name + " : " + err.Error())
 		if se, ok := err.(oss.ServiceError); ok {
 			if se.StatusCode == 404 {
-				return fscommon.ENOENT
+				return fscommon.ENOENT, nil
 			}
 		}
-		return fscommon.EIO
+		return ctxErrno(ctx, "GetObject", name, err), nil
 	}
 
-	n, _ := io.ReadFull(body, dest)
+	body := result.Response
+	n, err := io.ReadFull(body, dest)
 	body.Close()
+	if err != nil && fscommon.CtxErrno(ctx) < 0 {
+		return fscommon.CtxErrno(ctx), nil
+	}
 	//log.Printf("n=%d", n)
-	return n
+	return n, body.Headers
 }
 
 func (me *AliyunIO) AppendBuffer(name string, dest []byte, offset int64) int64 {
-	nextPos, err := me.bucket.AppendObject(name, bytes.NewReader(dest), offset)
+	//settings of the object are given by the first append
+	options := me.fs.readOptions(name)
+	if offset == 0 {
+		options = me.fs.putOptions(name)
+	}
+	me.blocks.Forget(name)
+	nextPos, err := me.bucket.AppendObject(name, bytes.NewReader(dest), offset, options...)
 	if err != nil {
-		log.Println(err)
-		return fscommon.EIO
+		return int64(toErrno("AppendObject", name, err))
 	}
 	return nextPos
 }
 
 func (me *AliyunIO) ListFile(path string) ([]os.FileInfo, int) {
+	return me.ListFileCtx(context.Background(), path)
+}
+
+func (me *AliyunIO) ListFileCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
 	prefix := path
 	if len(prefix) != 0 && prefix[0] == '/' {
 		prefix = prefix[1:]
 	}
 
-	lsRes, err := me.bucket.ListObjects(oss.Prefix(prefix), oss.Delimiter("/"))
+	lsRes, err := me.bucket.ListObjects(oss.Prefix(prefix), oss.Delimiter("/"), oss.WithContext(ctx))
 	if err != nil {
-		log.Println(err)
-		return nil, fscommon.EIO
+		return nil, ctxErrno(ctx, "ListObjects", path, err)
 	}
 
 	dis := make([]os.FileInfo, len(lsRes.Objects))
@@ -103,15 +178,19 @@ func (me *AliyunIO) ListFile(path string) ([]os.FileInfo, int) {
 }
 
 func (me *AliyunIO) Unlink(path string) int {
+	return me.UnlinkCtx(context.Background(), path)
+}
+
+func (me *AliyunIO) UnlinkCtx(ctx context.Context, path string) int {
 	//check if it's a file. we only deal with file here
 	if path[len(path)-1] == '/' {
 		return fscommon.EINVAL
 	}
 
-	err := me.bucket.DeleteObject(path)
+	me.blocks.Forget(path)
+	err := me.bucket.DeleteObject(path, oss.WithContext(ctx))
 	if err != nil {
-		log.Println(err)
-		return fscommon.EIO
+		return ctxErrno(ctx, "DeleteObject", path, err)
 	}
 	return 0
 }
@@ -120,6 +199,43 @@ func (me *AliyunIO) ZeroFile(name string) int {
 	return 0
 }
 
+func (me *AliyunIO) ZeroFileCtx(ctx context.Context, name string) int {
+	return 0
+}
+
 func (me *AliyunIO) GetAttr(path string) (os.FileInfo, int) {
-	return me.fs.getAttrFromRemote(path, fscommon.S_IFREG)
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+func (me *AliyunIO) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	return me.fs.getAttrFromRemote(ctx, path, fscommon.S_IFREG)
+}
+
+func (me *AliyunIO) GetMeta(name string) (fscommon.ObjectMeta, int) {
+	if name[0] == '/' {
+		name = name[1:]
+	}
+	return me.fs.getObjectMeta(name)
+}
+
+func (me *AliyunIO) SetMeta(name string, meta fscommon.ObjectMeta) int {
+	if name[0] == '/' {
+		name = name[1:]
+	}
+	return me.fs.setObjectMeta(name, meta)
+}
+
+//meta data requests are small, the context is checked before them only
+func (me *AliyunIO) GetMetaCtx(ctx context.Context, name string) (fscommon.ObjectMeta, int) {
+	if ok := fscommon.CtxErrno(ctx); ok < 0 {
+		return nil, ok
+	}
+	return me.GetMeta(name)
+}
+
+func (me *AliyunIO) SetMetaCtx(ctx context.Context, name string, meta fscommon.ObjectMeta) int {
+	if ok := fscommon.CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.SetMeta(name, meta)
 }
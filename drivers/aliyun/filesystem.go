@@ -1,7 +1,10 @@
 package aliyunimpl
 
 import (
-	"log"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -12,10 +15,28 @@ import (
 	"github.com/allspace/csmgr/common"
 )
 
+const (
+	ALIYUN_MAX_KEYS = 1000 //max keys in one list or multi-object delete request
+)
+
 type AliyunFSImpl struct {
 	fscommon.FSImplBase
 	client *oss.Client
 	bucket *oss.Bucket
+
+	readDirStat bool //load POSIX attributes for every directory entry
+	xattrTags   bool //save extended attributes with tag prefix as object tags
+	usageByList bool //get usage by listing the bucket instead of bucket stat
+	dedup       bool //store files as manifests of deduplicated chunks, see fscommon.DedupIO
+
+	listMetas fscommon.ListMetaCache //meta data of listed objects, see statDirItem
+
+	retry    *fscommon.RetryPolicy //retry policy for object IO
+	limiter  *fscommon.RateLimiter
+	crypt    *fscommon.CryptKey     //master key of client-side encryption, nil if it's off
+	compress *fscommon.Compressor   //nil if compression is off
+	checksum *fscommon.Checksummer  //nil if checksums are off
+	policy   *fscommon.ObjectPolicy //encryption and storage class of new objects, nil for bucket defaults
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -26,13 +47,13 @@ func (me *AliyunFSImpl) addDirCache(key string, di *fscommon.DirItem) {
 	if key[len(key)-1] == '/' {
 		key = key[:len(key)-1]
 	}
-	log.Println("Add dir cache: ", key)
+	dlog.Debugf("Add dir cache: %s", key)
 	me.DirCache.Add(key, di, fscommon.CACHE_LIFE_SHORT)
 }
 
 //get attributes for path/file
 //it can also be used to check if path/file exists
-func (me *AliyunFSImpl) getAttrFromRemote(path string, iType int) (os.FileInfo, int) {
+func (me *AliyunFSImpl) getAttrFromRemote(ctx context.Context, path string, iType int) (os.FileInfo, int) {
 	key := path
 	if len(path) != 0 && path[0] == '/' {
 		key = path[1:]
@@ -41,79 +62,502 @@ func (me *AliyunFSImpl) getAttrFromRemote(path string, iType int) (os.FileInfo,
 	if iType == fscommon.S_IFDIR {
 		key = key + "/"
 	}
-	log.Printf("Get object detail for %s", key)
-	meta, err := me.bucket.GetObjectDetailedMeta(key)
+	dlog.Debugf("Get object detail for %s", key)
+	sctx, span := ossSpan(ctx, "GetObjectDetailedMeta", key)
+	meta, err := me.bucket.GetObjectDetailedMeta(key, append(me.readOptions(key), oss.WithContext(sctx))...)
+	span.EndErr(err)
 	if err != nil {
 		// Print the error, cast err to awserr.Error to get the Code and
 		// Message from an error.
 		if reqerr, ok := err.(oss.ServiceError); ok {
-			log.Printf("reqerr.StatusCode=%d", reqerr.StatusCode)
+			dlog.Debugf("reqerr.StatusCode=%d", reqerr.StatusCode)
 			if reqerr.StatusCode == 404 {
 				if iType == fscommon.S_IFUNKOWN {
-					return me.getAttrFromRemote(key, fscommon.S_IFDIR)
+					return me.getAttrFromRemote(ctx, key, fscommon.S_IFDIR)
 				} else {
 					return nil, fscommon.ENOENT
 				}
 			}
 		}
-		log.Println(path, " : ", err.Error())
-		return nil, fscommon.ENOENT //fail to get attributes
+		return nil, ctxErrno(ctx, "GetObjectDetailedMeta", key, err)
 	}
 	if iType != fscommon.S_IFDIR {
 		iType = fscommon.S_IFREG
 	}
 	var size int64
-	size, err = strconv.ParseInt(meta["Content-Length"][0], 10, 64)
+	size, err = strconv.ParseInt(meta.Get(oss.HTTPHeaderContentLength), 10, 64)
 	if err != nil {
 		size = 0
 	}
-	const longForm = "Jan 2, 2006 at 3:04pm (MST)"
 
-	//log.Println(path)
-	//log.Println(meta["LastModified"])
-
-	var mtime time.Time
-	if len(meta["LastModified"]) > 0 {
-		mtime, _ = time.Parse(longForm, meta["LastModified"][0])
-	}
-	return &fscommon.DirItem{
+	mtime, _ := http.ParseTime(meta.Get(oss.HTTPHeaderLastModified))
+	di := &fscommon.DirItem{
 		DiName:  fscommon.GetLastPathComp(path),
 		DiType:  iType,
 		DiSize:  size,
 		DiMtime: mtime,
-	}, 0
+	}
+	di.FromMeta(fscommon.NewObjectMeta(meta, oss.HTTPHeaderOssMetaPrefix))
+	return di, 0
+}
+
+//convert meta data to aliyun options
+func metaOptions(md fscommon.ObjectMeta) []oss.Option {
+	options := make([]oss.Option, 0, len(md))
+	for key, val := range md {
+		options = append(options, oss.Meta(key, val))
+	}
+	return options
+}
+
+//options of server-side encryption and storage class of a new object, see fscommon.ObjectPolicy
+func (me *AliyunFSImpl) putOptions(key string) []oss.Option {
+	opts := me.policy.Options(key)
+	if opts == nil {
+		return nil
+	}
+	var options []oss.Option
+	switch opts.Encryption() {
+	case fscommon.SSE_S3:
+		options = append(options, oss.ServerSideEncryption("AES256"))
+	case fscommon.SSE_KMS:
+		options = append(options, oss.ServerSideEncryption("KMS"))
+		if len(opts.KmsKeyId) > 0 {
+			options = append(options, oss.ServerSideEncryptionKeyID(opts.KmsKeyId))
+		}
+	}
+	if len(opts.StorageClass) > 0 {
+		options = append(options, oss.ObjectStorageClass(ossStorageClass(opts.StorageClass)))
+	}
+	return append(options, me.readOptions(key)...)
+}
+
+//options to access an object encrypted with a customer key
+func (me *AliyunFSImpl) readOptions(key string) []oss.Option {
+	opts := me.policy.Options(key)
+	if opts.Encryption() != fscommon.SSE_C {
+		return nil
+	}
+	ckey, md5 := opts.CustomerKeyHeaders()
+	return []oss.Option{oss.SSECAlgorithm("AES256"), oss.SSECKey(ckey), oss.SSECKeyMd5(md5)}
+}
+
+func ossStorageClass(class string) oss.StorageClassType {
+	switch class {
+	case fscommon.STORAGE_STANDARD:
+		return oss.StorageStandard
+	case fscommon.STORAGE_IA:
+		return oss.StorageIA
+	case fscommon.STORAGE_ARCHIVE:
+		return oss.StorageArchive
+	case fscommon.STORAGE_COLD_ARCHIVE:
+		return oss.StorageColdArchive
+	}
+	return oss.StorageClassType(class)
+}
+
+//settings an object is stored with, from its meta data headers
+func storageOptions(meta http.Header) *fscommon.ObjectOptions {
+	opts := &fscommon.ObjectOptions{
+		KmsKeyId:     meta.Get(oss.HTTPHeaderOssServerSideEncryptionKeyID),
+		StorageClass: meta.Get(oss.HTTPHeaderOssStorageClass),
+	}
+	switch meta.Get(oss.HTTPHeaderOssServerSideEncryption) {
+	case "AES256":
+		opts.SSE = fscommon.SSE_S3
+	case "KMS":
+		opts.SSE = fscommon.SSE_KMS
+	}
+	if len(meta.Get(oss.HTTPHeaderSSECAlgorithm)) > 0 {
+		opts.SSE = fscommon.SSE_C
+	}
+	return opts
+}
+
+//get user meta data of an object
+func (me *AliyunFSImpl) getObjectMeta(key string) (fscommon.ObjectMeta, int) {
+	meta, err := me.bucket.GetObjectDetailedMeta(key, me.readOptions(key)...)
+	if err != nil {
+		if reqerr, ok := err.(oss.ServiceError); ok && reqerr.StatusCode == 404 {
+			return nil, fscommon.ENOENT
+		}
+		return nil, toErrno("GetObjectDetailedMeta", key, err)
+	}
+	return fscommon.NewObjectMeta(meta, oss.HTTPHeaderOssMetaPrefix), 0
+}
+
+//replace user meta data of an object by copying the object to itself
+//existing meta data which is not in md is kept, so are encryption and storage class
+func (me *AliyunFSImpl) setObjectMeta(key string, md fscommon.ObjectMeta) int {
+	meta, err := me.bucket.GetObjectDetailedMeta(key, me.readOptions(key)...)
+	if err != nil {
+		if reqerr, ok := err.(oss.ServiceError); ok && reqerr.StatusCode == 404 {
+			return fscommon.ENOENT
+		}
+		return toErrno("GetObjectDetailedMeta", key, err)
+	}
+
+	//meta data of the data, e.g. the checksum, is kept as it is
+	old := fscommon.NewObjectMeta(meta, oss.HTTPHeaderOssMetaPrefix)
+	options := metaOptions(make(fscommon.ObjectMeta).Merge(old).Merge(md).KeepDataMeta(old).Compact())
+	if ctype := meta.Get(oss.HTTPHeaderContentType); len(ctype) > 0 {
+		options = append(options, oss.ContentType(ctype))
+	}
+	if sse := meta.Get(oss.HTTPHeaderOssServerSideEncryption); len(sse) > 0 {
+		options = append(options, oss.ServerSideEncryption(sse))
+		if keyId := meta.Get(oss.HTTPHeaderOssServerSideEncryptionKeyID); len(keyId) > 0 {
+			options = append(options, oss.ServerSideEncryptionKeyID(keyId))
+		}
+	}
+	if class := meta.Get(oss.HTTPHeaderOssStorageClass); len(class) > 0 {
+		options = append(options, oss.ObjectStorageClass(oss.StorageClassType(class)))
+	}
+	options = append(options, me.readOptions(key)...)
+	err = me.bucket.SetObjectMeta(key, options...)
+	if err != nil {
+		return toErrno("SetObjectMeta", key, err)
+	}
+	return 0
+}
+
+//load attributes with all meta data, from open file or remote
+func (me *AliyunFSImpl) loadAttr(path string) (*fscommon.DirItem, int) {
+	fi, ok := me.FileMgr.GetFileInfo(path)
+	if !ok {
+		var rc int
+		fi, rc = me.getAttrFromRemote(context.Background(), path, fscommon.S_IFUNKOWN)
+		if rc < 0 {
+			return nil, rc
+		}
+	}
+	di := *(fi.(*fscommon.DirItem))
+	return &di, 0
+}
+
+//get object key for a path, directory key has a slash suffix
+func (me *AliyunFSImpl) attrKey(path string, di *fscommon.DirItem) string {
+	key := strings.TrimSuffix(path, "/")
+	if di.DiType == fscommon.S_IFDIR {
+		key = key + "/"
+	}
+	return key
+}
+
+//load POSIX attributes of a path, apply changes and save them back
+func (me *AliyunFSImpl) updateAttr(path string, update func(di *fscommon.DirItem) int) int {
+	//no leading slash for aliyun
+	if len(path) > 1 && path[0] == '/' {
+		path = path[1:]
+	}
+
+	di, ok := me.loadAttr(path)
+	if ok < 0 {
+		return ok
+	}
+	ok = update(di)
+	if ok < 0 {
+		return ok
+	}
+
+	//an open file saves its attributes again at flush
+	me.FileMgr.SetFileAttr(path, di)
+
+	me.DirCache.Remove(strings.TrimSuffix(path, "/"))
+	return me.setObjectMeta(me.attrKey(path, di), di.ToMeta())
+}
+
+func (me *AliyunFSImpl) getObjectTags(key string) (map[string]string, int) {
+	res, err := me.bucket.GetObjectTagging(key)
+	if err != nil {
+		return nil, toErrno("GetObjectTagging", key, err)
+	}
+	tags := make(map[string]string, len(res.Tags))
+	for _, tag := range res.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	return tags, 0
+}
+
+//replace all tags of an object
+func (me *AliyunFSImpl) setObjectTags(key string, tags map[string]string) int {
+	var err error
+	if len(tags) == 0 {
+		err = me.bucket.DeleteObjectTagging(key)
+	} else {
+		tagging := oss.Tagging{Tags: make([]oss.Tag, 0, len(tags))}
+		for k, v := range tags {
+			tagging.Tags = append(tagging.Tags, oss.Tag{Key: k, Value: v})
+		}
+		err = me.bucket.PutObjectTagging(key, tagging)
+	}
+	if err != nil {
+		return toErrno("PutObjectTagging", key, err)
+	}
+	return 0
+}
+
+func (me *AliyunFSImpl) isTagXAttr(name string) bool {
+	return me.xattrTags && strings.HasPrefix(name, fscommon.XATTR_TAG_PREFIX)
+}
+
+//load extended attributes from meta data, and from tags if enabled
+//settings of storage are read-only attributes of files, see fscommon.XATTR_STORAGE_PREFIX
+func (me *AliyunFSImpl) loadXAttrs(path string, withTags bool, withStorage bool) (fscommon.XAttrs, int) {
+	//no leading slash for aliyun
+	if len(path) > 1 && path[0] == '/' {
+		path = path[1:]
+	}
+
+	di, ok := me.loadAttr(path)
+	if ok < 0 {
+		return nil, ok
+	}
+	xa := di.GetXAttrs()
+	if withStorage && di.DiType == fscommon.S_IFREG {
+		key := me.attrKey(path, di)
+		meta, err := me.bucket.GetObjectDetailedMeta(key, me.readOptions(key)...)
+		if err != nil {
+			return nil, toErrno("GetObjectDetailedMeta", key, err)
+		}
+		for name, data := range storageOptions(meta).XAttrs() {
+			xa[name] = data
+		}
+	}
+	if withTags {
+		tags, ok := me.getObjectTags(me.attrKey(path, di))
+		if ok < 0 {
+			return nil, ok
+		}
+		for name, data := range fscommon.NewXAttrsFromTags(tags) {
+			xa[name] = data
+		}
+	}
+	return xa, 0
+}
+
+//load extended attributes saved as tags, apply changes and save them back
+func (me *AliyunFSImpl) updateTagXAttrs(path string, update func(xa fscommon.XAttrs) int) int {
+	//no leading slash for aliyun
+	if len(path) > 1 && path[0] == '/' {
+		path = path[1:]
+	}
+
+	di, ok := me.loadAttr(path)
+	if ok < 0 {
+		return ok
+	}
+	key := me.attrKey(path, di)
+	tags, ok := me.getObjectTags(key)
+	if ok < 0 {
+		return ok
+	}
+	xa := fscommon.NewXAttrsFromTags(tags)
+	ok = update(xa)
+	if ok < 0 {
+		return ok
+	}
+	tags, ok = xa.Tags()
+	if ok < 0 {
+		return ok
+	}
+	return me.setObjectTags(key, tags)
+}
+
+//load POSIX attributes for a directory entry
+//meta data of an object listed before is taken from me.listMetas while its ETag is the same
+func (me *AliyunFSImpl) statDirItem(key string, tag string, di *fscommon.DirItem) {
+	if md, ok := me.listMetas.Get(key, tag, di.DiMtime); ok {
+		di.FromMeta(md)
+		return
+	}
+	md, ok := me.getObjectMeta(key)
+	if ok == 0 {
+		me.listMetas.Put(key, tag, di.DiMtime, md)
+		di.FromMeta(md)
+	}
+}
+
+//list all object keys and their sizes under the prefix, include keys in sub directories
+func (me *AliyunFSImpl) listAllKeys(ctx context.Context, prefix string) ([]string, []int64, int) {
+	keys := make([]string, 0)
+	sizes := make([]int64, 0)
+	marker := ""
+	for {
+		sctx, span := ossSpan(ctx, "ListObjects", prefix)
+		lsRes, err := me.bucket.ListObjects(oss.Prefix(prefix), oss.Marker(marker), oss.MaxKeys(ALIYUN_MAX_KEYS), oss.WithContext(sctx))
+		span.EndErr(err)
+		if err != nil {
+			return nil, nil, ctxErrno(ctx, "ListObjects", prefix, err)
+		}
+		for _, obj := range lsRes.Objects {
+			keys = append(keys, obj.Key)
+			sizes = append(sizes, obj.Size)
+		}
+		if !lsRes.IsTruncated {
+			break
+		}
+		marker = lsRes.NextMarker
+	}
+	return keys, sizes, 0
+}
+
+//total size and count of all files under the prefix
+//bucket stat is cheap but updated with delay, listing is used for prefixes or if it is not available
+//bucket stat also counts helper objects, they are listed and subtracted, keys of them all start with $
+func (me *AliyunFSImpl) scanUsage(prefix string) (int64, int64, int) {
+	if !me.usageByList && len(prefix) == 0 {
+		stat, err := me.client.GetBucketStat(me.BucketName)
+		if err == nil {
+			hsize, hcount, ok := me.listUsage("$", true)
+			if ok < 0 {
+				return 0, 0, ok
+			}
+			return stat.Storage - hsize, stat.ObjectCount - hcount, 0
+		}
+		dlog.Warnf("Failed to get bucket stat: %s", err)
+	}
+	return me.listUsage(prefix, false)
+}
+
+//total size and count of files or helper objects under the prefix
+func (me *AliyunFSImpl) listUsage(prefix string, helpers bool) (int64, int64, int) {
+	var size, count int64
+	marker := ""
+	for {
+		lsRes, err := me.bucket.ListObjects(oss.Prefix(prefix), oss.Marker(marker), oss.MaxKeys(ALIYUN_MAX_KEYS))
+		if err != nil {
+			return 0, 0, toErrno("ListObjects", prefix, err)
+		}
+		for _, obj := range lsRes.Objects {
+			if fscommon.IsHelperKey(obj.Key) != helpers {
+				continue
+			}
+			size += obj.Size
+			count++
+		}
+		if !lsRes.IsTruncated {
+			break
+		}
+		marker = lsRes.NextMarker
+	}
+	return size, count, 0
+}
+
+//delete objects with multi-object delete requests
+func (me *AliyunFSImpl) deleteKeys(ctx context.Context, keys []string) int {
+	for start := 0; start < len(keys); start += ALIYUN_MAX_KEYS {
+		end := start + ALIYUN_MAX_KEYS
+		if end > len(keys) {
+			end = len(keys)
+		}
+		sctx, span := ossSpan(ctx, "DeleteObjects", keys[start])
+		_, err := me.bucket.DeleteObjects(keys[start:end], oss.DeleteObjectsQuiet(true), oss.WithContext(sctx))
+		span.EndErr(err)
+		for _, key := range keys[start:end] {
+			me.DirCache.Remove(strings.TrimSuffix(key, "/"))
+		}
+		if err != nil {
+			return ctxErrno(ctx, "DeleteObjects", keys[start], err)
+		}
+	}
+	return 0
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 //Exported functions
 ///////////////////////////////////////////////////////////////////////////////
 
+//apply settings which can be changed without remount, see fscommon.Reconfigurable
+func (me *AliyunFSImpl) Reconfigure(cfg map[string]string) int {
+	me.limiter.Update(cfg)
+	return 0
+}
+
 func (me *AliyunFSImpl) GetAttr(path string) (os.FileInfo, int) {
-	log.Printf("GetAttr is called for %s", path)
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+func (me *AliyunFSImpl) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	dlog.Debugf("GetAttr is called for %s", path)
 	if len(path) > 1 && path[0] == '/' {
 		path = path[1:]
 	}
 
-	di, ok := me.FSImplBase.GetAttr(path)
+	di, ok := me.FSImplBase.GetAttrCtx(ctx, path)
 	if di != nil || ok != 0 {
 		return di, ok
 	}
 
 	//get attributes from remote
-	di, ok = me.getAttrFromRemote(path, fscommon.S_IFUNKOWN)
+	di, ok = me.getAttrFromRemote(ctx, path, fscommon.S_IFUNKOWN)
 	if ok == fscommon.ENOENT {
 		me.NotExistCache.Add(path, &fscommon.DirItem{}, fscommon.CACHE_LIFE_SHORT)
+	} else if ok == 0 {
+		me.plainAttr(di.(*fscommon.DirItem))
 	}
 	return di, ok
 }
 
+//report the plain text size of a regular file, the object may be encrypted, compressed or a chunk manifest
+//the size of file data is saved in meta data when it's written, objects without it are in plain text
+func (me *AliyunFSImpl) plainAttr(di *fscommon.DirItem) {
+	//links are saved as they are
+	if di.DiType != fscommon.S_IFREG {
+		return
+	}
+	if size, ok := di.DataSize(); ok {
+		di.DiSize = size
+	} else if me.crypt != nil && !me.crypt.PlainAllowed() {
+		fscommon.CryptPlainAttr(di)
+	}
+}
+
+//chunks of deduplicated files are released after the files are deleted, see fscommon.DedupRefs
+func (me *AliyunFSImpl) dedupRefs(ctx context.Context, keys ...string) (*fscommon.DedupRefs, int) {
+	refs := &fscommon.DedupRefs{}
+	if !me.dedup {
+		return refs, 0
+	}
+	fio := &AliyunIO{
+		bucket:     me.bucket,
+		fs:         me,
+		bucketName: me.BucketName,
+	}
+	dio := me.dataIO(fio).(*fscommon.DedupIO)
+	for _, key := range keys {
+		if ok := dio.AddRefs(ctx, refs, key); ok < 0 {
+			return nil, ok
+		}
+	}
+	return refs, 0
+}
+
+//wrap io of a file with retry, rate limit, metrics, encryption, compression and deduplication
+func (me *AliyunFSImpl) dataIO(io *AliyunIO) fscommon.FileIO {
+	var fio fscommon.FileIO = fscommon.NewRetryIO(fscommon.NewRateLimitIO(fscommon.NewMetricsIO(io), me.limiter), me.retry)
+	if me.crypt != nil {
+		fio = fscommon.NewCryptIO(fio, me.crypt)
+	}
+	if me.compress != nil {
+		fio = fscommon.NewCompressIO(fio, me.compress)
+	}
+	if me.dedup {
+		fio = fscommon.NewDedupIO(fio, me.crypt)
+	}
+	return fio
+}
+
 func (me *AliyunFSImpl) OpenDir(path string) int {
 	return 0
 }
 
 func (me *AliyunFSImpl) ReadDir(path string) ([]os.FileInfo, int) {
+	return me.ReadDirCtx(context.Background(), path)
+}
+
+func (me *AliyunFSImpl) ReadDirCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
 
-	log.Println("AliyunFSImpl::ReadDir = ", path)
+	dlog.Debugf("AliyunFSImpl::ReadDir = %s", path)
 
 	prefix := path
 	if len(prefix) != 0 && prefix[0] == '/' {
@@ -123,15 +567,18 @@ func (me *AliyunFSImpl) ReadDir(path string) ([]os.FileInfo, int) {
 		prefix = prefix + "/"
 	}
 
-	lsRes, err := me.bucket.ListObjects(oss.Prefix(prefix), oss.Delimiter("/"))
+	sctx, span := ossSpan(ctx, "ListObjects", prefix)
+	lsRes, err := me.bucket.ListObjects(oss.Prefix(prefix), oss.Delimiter("/"), oss.WithContext(sctx))
+	span.EndErr(err)
 	if err != nil {
-		log.Println(err)
-		return nil, fscommon.EIO
+		return nil, ctxErrno(ctx, "ListObjects", path, err)
 	}
 
 	diCount := len(lsRes.CommonPrefixes) + len(lsRes.Objects)
 
 	dis := make([]os.FileInfo, diCount)
+	keys := make([]string, diCount)
+	tags := make([]string, diCount)
 
 	//collect directories
 	for i := 0; i < len(lsRes.CommonPrefixes); i++ {
@@ -149,8 +596,7 @@ func (me *AliyunFSImpl) ReadDir(path string) ([]os.FileInfo, int) {
 			DiType: fscommon.S_IFDIR,
 			DiSize: 0,
 		}
-		//add to cache
-		me.addDirCache(key, dis[i].(*fscommon.DirItem))
+		keys[i] = key
 	}
 
 	//collect files
@@ -165,16 +611,35 @@ func (me *AliyunFSImpl) ReadDir(path string) ([]os.FileInfo, int) {
 			DiName:  fscommon.GetLastPathComp(key), //need remove common prefix
 			DiSize:  lsRes.Objects[i].Size,
 			DiMtime: lsRes.Objects[i].LastModified,
-			//lsRes.Objects[i].ETag
-			DiType: fscommon.S_IFREG,
+			DiType:  fscommon.S_IFREG,
 		}
-
-		//add to cache
-		me.addDirCache(key, dis[j].(*fscommon.DirItem))
+		keys[j] = key
+		tags[j] = lsRes.Objects[i].ETag
 		j++
 	}
 
-	log.Println("Directories and files: ", diCount)
+	//list result does not contain user meta data
+	//without READDIR_STAT, only small objects are checked, they may be symbolic links
+	//objects are checked when plain text is allowed, only the meta data tells encrypted ones
+	//compressed and deduplicated files are checked too, the meta data has their plain text size
+	//objects are checked in parallel, and only once while they aren't changed
+	migrating := me.crypt != nil && me.crypt.PlainAllowed()
+	fscommon.StatDirItems(dis, func(i int, di *fscommon.DirItem) {
+		sized := di.DiType == fscommon.S_IFREG && (me.dedup || me.compress != nil && me.compress.Match(keys[i]))
+		if me.readDirStat || migrating || sized || fscommon.MayBeLink(di) {
+			me.statDirItem(keys[i], tags[i], di)
+		}
+		me.plainAttr(di)
+	})
+
+	//add to cache
+	for i, fi := range dis {
+		if fi != nil {
+			me.addDirCache(keys[i], fi.(*fscommon.DirItem))
+		}
+	}
+
+	dlog.Debugf("Directories and files: %d", diCount)
 	return []os.FileInfo(dis), diCount
 }
 
@@ -190,40 +655,69 @@ func (me *AliyunFSImpl) NewFileImpl(path string) (fscommon.FileImpl, int) {
 }
 
 func (me *AliyunFSImpl) Open(path string, flags uint32) (*fscommon.FileObject, int) {
+	return me.open(context.Background(), path, flags, nil)
+}
+
+func (me *AliyunFSImpl) OpenCtx(ctx context.Context, path string, flags uint32) (*fscommon.FileObject, int) {
+	return me.open(ctx, path, flags, nil)
+}
+
+func (me *AliyunFSImpl) Create(path string, flags uint32, attr *fscommon.DirItem) (*fscommon.FileObject, int) {
+	return me.open(context.Background(), path, flags|fscommon.O_CREAT, attr)
+}
+
+func (me *AliyunFSImpl) CreateCtx(ctx context.Context, path string, flags uint32, attr *fscommon.DirItem) (*fscommon.FileObject, int) {
+	return me.open(ctx, path, flags|fscommon.O_CREAT, attr)
+}
+
+//attr is used only when the file is created
+//the file is opened in background, only the existence check is bound to ctx
+//a file instance is shared by requests, so it must not be bound to one of them
+func (me *AliyunFSImpl) open(ctx context.Context, path string, flags uint32, attr *fscommon.DirItem) (*fscommon.FileObject, int) {
 	if len(path) != 0 && path[0] == '/' {
 		path = path[1:]
 	}
 	//look in file instance manager first
 	//if successful, this will increase instance reference count
-	log.Println("Try to find existing object for file", path)
+	dlog.Debugf("Try to find existing object for file %s", path)
 
 	fo, ok := me.FileMgr.GetInstance(path)
 	if ok == 0 {
-		log.Println("Found existing instance for file ", path)
+		dlog.Debugf("Found existing instance for file %s", path)
 		return fo, 0
 	}
-	log.Println("Verify existing for file", path)
+	dlog.Debugf("Verify existing for file %s", path)
 	//var fileNotExist bool = false
 
 	//verify if the file exists, and if user has permission to open the file in selected mode
-	_, ok = me.getAttrFromRemote(path, fscommon.S_IFREG)
+	di, ok := me.getAttrFromRemote(ctx, path, fscommon.S_IFREG)
 	switch ok {
-	case fscommon.EIO:
-		return nil, ok
 	case fscommon.ENOENT:
 		if (flags & fscommon.O_CREAT) == 0 {
-			log.Printf("File %s does not exist, but open it without O_CREAT flag\n", path)
+			dlog.Debugf("File %s does not exist, but open it without O_CREAT flag", path)
 			return nil, ok
 		}
 		//fileNotExist = true
 		break
+	default:
+		if ok < 0 {
+			return nil, ok
+		}
+	}
+
+	//existing file keeps its attributes
+	if di != nil {
+		attr = di.(*fscommon.DirItem)
+	} else if attr == nil {
+		attr = fscommon.NewAttr(fscommon.GetLastPathComp(path), fscommon.S_IFREG)
 	}
 
-	log.Println("Trying to allocate a file instance for file ", path)
+	dlog.Debugf("Trying to allocate a file instance for file %s", path)
 	fo, ok = me.FileMgr.Allocate(me, path)
 	if ok != 0 {
 		return nil, ok
 	}
+	fo.SetAttr(attr)
 	/* 	if ok==0 && fileNotExist==true {
 		me.dirCache.Add(path,&fscommon.DirItem{
 			Name : path,
@@ -243,14 +737,125 @@ func (me *AliyunFSImpl) Open(path string, flags uint32) (*fscommon.FileObject, i
 }
 
 func (me *AliyunFSImpl) Chmod(name string, mode uint32) int {
-	return 0
+	return me.updateAttr(name, func(di *fscommon.DirItem) int {
+		di.DiMode = (di.DiMode &^ os.ModePerm) | os.FileMode(mode).Perm()
+		return 0
+	})
 }
 
-func (me *AliyunFSImpl) Utimens(name string, Mtime *time.Time) int {
-	return 0
+func (me *AliyunFSImpl) Chown(name string, uid uint32, gid uint32) int {
+	return me.updateAttr(name, func(di *fscommon.DirItem) int {
+		//-1 means no change
+		if uid != ^uint32(0) {
+			di.DiUid = uid
+		}
+		if gid != ^uint32(0) {
+			di.DiGid = gid
+		}
+		return 0
+	})
+}
+
+func (me *AliyunFSImpl) Utimens(name string, Atime *time.Time, Mtime *time.Time) int {
+	return me.updateAttr(name, func(di *fscommon.DirItem) int {
+		if Atime != nil {
+			di.DiAtime = *Atime
+		}
+		if Mtime != nil {
+			di.DiMtime = *Mtime
+		}
+		return 0
+	})
+}
+
+func (me *AliyunFSImpl) GetXAttr(path string, name string) ([]byte, int) {
+	xa, ok := me.loadXAttrs(path, me.isTagXAttr(name), fscommon.IsStorageXAttr(name))
+	if ok < 0 {
+		return nil, ok
+	}
+	data, exist := xa[name]
+	if !exist {
+		return nil, fscommon.ENODATA
+	}
+	return data, 0
+}
+
+func (me *AliyunFSImpl) ListXAttr(path string) ([]string, int) {
+	xa, ok := me.loadXAttrs(path, me.xattrTags, true)
+	if ok < 0 {
+		return nil, ok
+	}
+	return xa.Names(), 0
+}
+
+func (me *AliyunFSImpl) SetXAttr(path string, name string, data []byte, flags int) int {
+	if fscommon.IsStorageXAttr(name) {
+		return fscommon.EPERM
+	}
+	if me.isTagXAttr(name) {
+		return me.updateTagXAttrs(path, func(xa fscommon.XAttrs) int {
+			return xa.Set(name, data, flags)
+		})
+	}
+	return me.updateAttr(path, func(di *fscommon.DirItem) int {
+		xa := di.GetXAttrs()
+		ok := xa.Set(name, data, flags)
+		if ok < 0 {
+			return ok
+		}
+		return di.SetXAttrs(xa)
+	})
+}
+
+func (me *AliyunFSImpl) RemoveXAttr(path string, name string) int {
+	if fscommon.IsStorageXAttr(name) {
+		return fscommon.EPERM
+	}
+	if me.isTagXAttr(name) {
+		return me.updateTagXAttrs(path, func(xa fscommon.XAttrs) int {
+			return xa.Remove(name)
+		})
+	}
+	return me.updateAttr(path, func(di *fscommon.DirItem) int {
+		xa := di.GetXAttrs()
+		ok := xa.Remove(name)
+		if ok < 0 {
+			return ok
+		}
+		return di.SetXAttrs(xa)
+	})
+}
+
+func (me *AliyunFSImpl) LoadXAttrs(path string) (fscommon.XAttrs, int) {
+	return me.loadXAttrs(path, false, false)
+}
+
+//all changes are saved by one meta data update
+func (me *AliyunFSImpl) UpdateXAttrs(path string, set fscommon.XAttrs, remove []string) int {
+	names := append([]string(nil), remove...)
+	for name := range set {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if fscommon.IsStorageXAttr(name) {
+			return fscommon.EPERM
+		}
+		if me.isTagXAttr(name) {
+			return fscommon.ENOTSUP
+		}
+	}
+	return me.updateAttr(path, func(di *fscommon.DirItem) int {
+		xa := di.GetXAttrs()
+		xa.Update(set, remove)
+		return di.SetXAttrs(xa)
+	})
 }
 
 func (me *AliyunFSImpl) Mkdir(path string, mode uint32) int {
+	return me.MkdirCtx(context.Background(), path, mode)
+}
+
+func (me *AliyunFSImpl) MkdirCtx(ctx context.Context, path string, mode uint32) int {
 	var key string
 	//make sure we are going to create a directory
 	if path[len(path)-1] != '/' {
@@ -269,15 +874,25 @@ func (me *AliyunFSImpl) Mkdir(path string, mode uint32) int {
 		return fscommon.EINVAL
 	}
 
-	err := me.bucket.PutObject(key, strings.NewReader(""))
+	attr := fscommon.NewAttr(fscommon.GetLastPathComp(key), fscommon.S_IFDIR)
+	if mode != 0 {
+		attr.DiMode = os.FileMode(mode).Perm()
+	}
+	sctx, span := ossSpan(ctx, "PutObject", key)
+	options := append(metaOptions(attr.ToMeta()), me.putOptions(key)...)
+	err := me.bucket.PutObject(key, strings.NewReader(""), append(options, oss.WithContext(sctx))...)
+	span.EndErr(err)
 	if err != nil {
-		log.Println(path, " : ", err)
-		return fscommon.EIO
+		return ctxErrno(ctx, "PutObject", path, err)
 	}
 	return 0
 }
 
 func (me *AliyunFSImpl) Unlink(path string) int {
+	return me.UnlinkCtx(context.Background(), path)
+}
+
+func (me *AliyunFSImpl) UnlinkCtx(ctx context.Context, path string) int {
 	//check if it's a file. we only deal with file here
 	if path[len(path)-1] == '/' {
 		return fscommon.EINVAL
@@ -293,10 +908,168 @@ func (me *AliyunFSImpl) Unlink(path string) int {
 		path = path[1:]
 	}
 
-	err := me.bucket.DeleteObject(path)
+	//size of the file is needed for usage tracking
+	var size int64
+	if me.Quota != nil {
+		if fi, ok := me.GetAttrCtx(ctx, path); ok == 0 && fi != nil {
+			size = fi.Size()
+		}
+	}
+	refs, ok := me.dedupRefs(ctx, path)
+	if ok < 0 {
+		return ok
+	}
+
+	sctx, span := ossSpan(ctx, "DeleteObject", path)
+	err := me.bucket.DeleteObject(path, oss.WithContext(sctx))
+	span.EndErr(err)
 	if err != nil {
-		log.Println(err)
-		return fscommon.EIO
+		return ctxErrno(ctx, "DeleteObject", path, err)
+	}
+
+	refs.Release(ctx)
+
+	if me.Quota != nil {
+		me.Quota.Add(path, -size)
 	}
 	return 0
 }
+
+func (me *AliyunFSImpl) Rmdir(path string) int {
+	return me.RmdirCtx(context.Background(), path)
+}
+
+func (me *AliyunFSImpl) RmdirCtx(ctx context.Context, path string) int {
+	//no leading slash for aliyun
+	key := strings.Trim(path, "/")
+	if len(key) == 0 { //not allow remove root directory
+		return fscommon.EINVAL
+	}
+	key = key + "/"
+
+	//two keys are enough to tell if there is anything other than the folder object
+	sctx, span := ossSpan(ctx, "ListObjects", key)
+	lsRes, err := me.bucket.ListObjects(oss.Prefix(key), oss.MaxKeys(2), oss.WithContext(sctx))
+	span.EndErr(err)
+	if err != nil {
+		return ctxErrno(ctx, "ListObjects", path, err)
+	}
+	if len(lsRes.Objects) == 0 {
+		return fscommon.ENOENT
+	}
+	for _, obj := range lsRes.Objects {
+		if obj.Key != key {
+			return fscommon.ENOTEMPTY
+		}
+	}
+
+	return me.deleteKeys(ctx, []string{key})
+}
+
+func (me *AliyunFSImpl) RemoveAll(path string) int {
+	return me.RemoveAllCtx(context.Background(), path)
+}
+
+func (me *AliyunFSImpl) RemoveAllCtx(ctx context.Context, path string) int {
+	//no leading slash for aliyun
+	key := strings.Trim(path, "/")
+	if len(key) == 0 { //not allow remove root directory
+		return fscommon.EINVAL
+	}
+
+	//collect everything under the path if it's a directory
+	keys, sizes, ok := me.listAllKeys(ctx, key+"/")
+	if ok < 0 {
+		return ok
+	}
+	//the path may also be a file
+	fi, ok := me.getAttrFromRemote(ctx, key, fscommon.S_IFREG)
+	if ok == 0 {
+		keys = append(keys, key)
+		sizes = append(sizes, fi.Size())
+	}
+	if len(keys) == 0 {
+		return fscommon.ENOENT
+	}
+
+	//do nothing if any file is being open
+	for _, k := range keys {
+		if me.FileMgr.Exist(k) {
+			dlog.Infof("RemoveAll %s: file %s is being open.", path, k)
+			return fscommon.EBUSY
+		}
+	}
+
+	refs, ok := me.dedupRefs(ctx, keys...)
+	if ok < 0 {
+		return ok
+	}
+
+	//helper objects of the files
+	files := len(keys)
+	for _, dir := range fscommon.GetHelperDirs(key) {
+		hkeys, _, ok := me.listAllKeys(ctx, dir)
+		if ok < 0 {
+			return ok
+		}
+		keys = append(keys, hkeys...)
+	}
+
+	if ok := me.deleteKeys(ctx, keys); ok < 0 {
+		return ok
+	}
+	refs.Release(ctx)
+
+	if me.Quota != nil {
+		for i, k := range keys[:files] {
+			me.Quota.Add(k, -sizes[i])
+		}
+	}
+	return 0
+}
+
+func (me *AliyunFSImpl) Symlink(target string, linkPath string) int {
+	//no leading slash for aliyun
+	key := strings.TrimPrefix(linkPath, "/")
+	if len(key) == 0 || len(target) == 0 || len(target) > fscommon.MAX_LINK_OBJECT_SIZE {
+		return fscommon.EINVAL
+	}
+	_, ok := me.getAttrFromRemote(context.Background(), key, fscommon.S_IFUNKOWN)
+	if ok == 0 {
+		return fscommon.EEXIST
+	}
+
+	//same as s3fs: link target as content, S_IFLNK in mode meta data
+	attr := fscommon.NewAttr(fscommon.GetLastPathComp(key), fscommon.S_IFLNK)
+	err := me.bucket.PutObject(key, strings.NewReader(target), append(metaOptions(attr.ToMeta()), me.putOptions(key)...)...)
+	me.DirCache.Remove(key)
+	me.NotExistCache.Remove(key)
+	if err != nil {
+		return toErrno("PutObject", linkPath, err)
+	}
+	return 0
+}
+
+func (me *AliyunFSImpl) Readlink(path string) (string, int) {
+	//no leading slash for aliyun
+	key := strings.TrimPrefix(path, "/")
+	di, ok := me.getAttrFromRemote(context.Background(), key, fscommon.S_IFREG)
+	if ok < 0 {
+		return "", ok
+	}
+	if di.(*fscommon.DirItem).DiType != fscommon.S_IFLNK {
+		return "", fscommon.EINVAL
+	}
+
+	body, err := me.bucket.GetObject(key, me.readOptions(key)...)
+	if err != nil {
+		return "", toErrno("GetObject", path, err)
+	}
+	defer body.Close()
+
+	target, err := ioutil.ReadAll(io.LimitReader(body, fscommon.MAX_LINK_OBJECT_SIZE))
+	if err != nil {
+		return "", toErrno("GetObject", path, err)
+	}
+	return string(target), 0
+}
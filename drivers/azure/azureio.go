@@ -1,7 +1,6 @@
 package azureimpl
 import (
     "fmt"
-    "log"
     "encoding/base64"
     az "github.com/Azure/azure-sdk-for-go/storage"
 )
@@ -18,15 +17,15 @@ func (me *AzureIO) ReadDir(path string)int{
     }
     rsp,err := me.client.ListBlobs(me.containerName, params)
     if err != nil {
-        log.Println(err)
+        dlog.Errorf("%s", err)
         return -5 //EIO
     }
     
     for _,file := range rsp.Blobs {
-        log.Println(file.Name)
+        dlog.Debugf("%s", file.Name)
     }
     for _,folder := range rsp.BlobPrefixes {
-        log.Println(folder)
+        dlog.Debugf("%s", folder)
     }
 
     return 0
@@ -45,12 +44,12 @@ func (me *AzureIO) PutBuffer(path string, data []byte)int {
     blocks[0].Status = az.BlockStatusUncommitted  
     err = me.client.PutBlock(me.containerName, path, bid, data)
     if err != nil {
-        log.Println(err)
+        dlog.Errorf("%s", err)
         return -5//EIO
     }
     err = me.client.PutBlockList(me.containerName, path, blocks)
     if err != nil {
-        log.Println(err)
+        dlog.Errorf("%s", err)
         return -5//EIO
     }
     return len(data)
@@ -60,7 +59,7 @@ func (me *AzureIO) GetBuffer(path string, data []byte, offset int64)int {
     byteRange := fmt.Sprintf("%d-%d", offset, offset + int64(len(data)))
     io,err := me.client.GetBlobRange(me.containerName, path, byteRange, nil)
     if err != nil {
-        log.Println(err)
+        dlog.Errorf("%s", err)
         return -5
     }
     n,err := io.Read(data)
@@ -1,10 +1,12 @@
 package azureimpl
 
 import (
-    "log"
     az "github.com/Azure/azure-sdk-for-go/storage" 
+    "github.com/allspace/csmgr/util"
 )
 
+var dlog = util.GetLogger("azure")
+
 type AzureClientImpl struct {
     client az.BlobStorageClient   
 }
@@ -17,7 +19,7 @@ func (me *AzureClientImpl) Connect(endPoint string, keyId string, keyData string
 
     clt,err := az.NewClient(keyId, keyData, az.DefaultBaseURL, az.DefaultAPIVersion, true)
     if err != nil {
-        log.Println(err)
+        dlog.Errorf("%s", err)
         return -1
     }
     me.client = clt.GetBlobService()
@@ -1,16 +1,26 @@
 package s3impl
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
 	//"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/allspace/csmgr/common"
+	"github.com/allspace/csmgr/util"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+var dlog = util.GetLogger("s3")
+
+//client span of a call to the S3 api, end it with span.EndErr(err)
+func s3Span(ctx context.Context, op string, key string) (context.Context, *fscommon.Span) {
+	return fscommon.StartSpanKind(ctx, fscommon.SPAN_KIND_CLIENT, "s3."+op, "key", key)
+}
+
 type S3ClientImpl struct {
 	cfg       map[string]string
 	awsConfig *aws.Config
@@ -27,18 +37,33 @@ func (me *S3ClientImpl) Set(key string, value string) {
 }
 
 func (me *S3ClientImpl) Connect(region string, keyId string, skey string) int {
+	me.cfg["Region"] = region
+	chain, ok := fscommon.NewCredentialChain(me.cfg, fscommon.CRED_VENDOR_AWS, keyId, skey)
+	if ok < 0 {
+		return ok
+	}
+	if _, err := chain.Get(); err != nil {
+		dlog.Errorf("Failed to get credentials: %s", err)
+		return fscommon.EACCES
+	}
 	config := &aws.Config{
 		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(keyId, skey, ""),
+		Credentials: credentials.NewCredentials(&chainProvider{chain}),
 	}
 
 	//set end point if user specified it
 	if endPoint, ok := me.cfg["EndPoint"]; ok {
 		config.WithEndpoint(endPoint)
 	}
-	log.Println(region)
+	dlog.Infof("Region: %s", region)
 
-	config.WithLogLevel(aws.LogDebug)
+	//sdk requests and responses are logged at debug level of s3
+	if dlog.Enabled(util.LOG_DEBUG) {
+		config.WithLogLevel(aws.LogDebug)
+		config.WithLogger(aws.LoggerFunc(func(args ...interface{}) {
+			dlog.Debugf("%s", fmt.Sprint(args...))
+		}))
+	}
 
 	me.sess = session.New(config)
 	me.s3 = s3.New(me.sess)
@@ -46,6 +71,28 @@ func (me *S3ClientImpl) Connect(region string, keyId string, skey string) int {
 	return 0
 }
 
+//credentials.Provider of the credential chain, the sdk retrieves again once IsExpired is true
+type chainProvider struct {
+	chain *fscommon.CredentialChain
+}
+
+func (me *chainProvider) Retrieve() (credentials.Value, error) {
+	cred, err := me.chain.Get()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	return credentials.Value{
+		AccessKeyID:     cred.KeyId,
+		SecretAccessKey: cred.KeyData,
+		SessionToken:    cred.Token,
+		ProviderName:    cred.Provider,
+	}, nil
+}
+
+func (me *chainProvider) IsExpired() bool {
+	return me.chain.Expired()
+}
+
 func (me *S3ClientImpl) Disconnect() int {
 	return 0
 }
@@ -56,6 +103,73 @@ func (me *S3ClientImpl) Mount(bucketName string) (fscommon.FileSystemImpl, int)
 		bucketName: bucketName,
 		dirCache:   fscommon.NewDirCache(),
 		fileMgr:    fscommon.NewFileInstanceMgr(),
+
+		readDirStat: me.cfg["ReadDirStat"] == "1",
+		xattrTags:   me.cfg["XAttrTags"] == "1",
+		dedup:       me.cfg["Dedup"] == "1",
+
+		retry:   fscommon.NewRetryPolicy(me.cfg),
+		limiter: fscommon.NewRateLimiter(me.cfg),
+	}
+	//client-side encryption, see fscommon.CryptIO
+	if file := me.cfg["EncryptionKeyFile"]; len(file) > 0 {
+		key, err := fscommon.LoadCryptKey(file)
+		if err != nil {
+			dlog.Errorf("Failed to load encryption key %s: %s", file, err)
+			return nil, fscommon.EINVAL
+		}
+		key.AllowPlain(me.cfg["EncryptionMigration"] == "1")
+		vol.crypt = key
+	}
+	//names are encrypted with the master key too, see fscommon.NameCryptFS
+	var names *fscommon.NameCipher
+	if me.cfg["NameEncryption"] == "1" {
+		if vol.crypt == nil {
+			dlog.Errorf("Name encryption requires an encryption key")
+			return nil, fscommon.EINVAL
+		}
+		names = vol.crypt.NameCipher()
+	}
+	policy, ok := fscommon.NewObjectPolicy(me.cfg)
+	if ok < 0 {
+		return nil, ok
+	}
+	vol.policy = policy
+	compress, ok := fscommon.NewCompressor(me.cfg)
+	if ok < 0 {
+		return nil, ok
+	}
+	vol.compress = compress
+	//patterns are of plain paths, keys are decrypted to match them
+	if names != nil {
+		policy.SetNames(names)
+		compress.SetNames(names)
+	}
+	checksum, ok := fscommon.NewChecksummer(me.cfg)
+	if ok < 0 {
+		return nil, ok
+	}
+	vol.checksum = checksum
+
+	//track bucket usage for StatFs and quota check
+	quota, _ := strconv.ParseInt(me.cfg["Quota"], 10, 64)
+	softQuota, _ := strconv.ParseInt(me.cfg["QuotaSoft"], 10, 64)
+	prefixQuota := me.cfg["QuotaPrefix"]
+	if quota > 0 || softQuota > 0 || len(prefixQuota) > 0 || me.cfg["StatFsUsage"] == "1" {
+		interval, _ := strconv.Atoi(me.cfg["UsageScanInterval"])
+		vol.quota = fscommon.NewQuotaMgr(quota, softQuota, interval, vol.scanUsage)
+		if names != nil {
+			vol.quota.SetKeyMapper(names.EncryptPath)
+		}
+		if ok := vol.quota.AddPrefixes(prefixQuota); ok < 0 {
+			return nil, ok
+		}
+		vol.fileMgr.SetQuota(vol.quota)
+		vol.quota.Start()
+	}
+
+	if names != nil {
+		return fscommon.NewNameCryptFS(vol, names), 0
 	}
 	return vol, 0
 }
@@ -0,0 +1,62 @@
+package s3impl
+
+import (
+	"context"
+
+	"github.com/allspace/csmgr/common"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+//classify an error returned by aws sdk, the error is logged here
+func toFsError(op string, path string, err error) *fscommon.FsError {
+	errno, retryable := fscommon.EIO, false
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		errno, retryable = fscommon.ErrnoFromHttp(reqErr.StatusCode(), reqErr.Code())
+	} else if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case request.CanceledErrorCode:
+			errno = fscommon.ECANCELED
+		case request.ErrCodeSerialization, request.ErrCodeRead, "RequestError":
+			//no valid response, e.g. connection reset
+			errno, retryable = fscommon.EIO, true
+		default:
+			errno, retryable = fscommon.ErrnoFromHttp(-1, awsErr.Code())
+		}
+	} else {
+		retryable = fscommon.IsTransientNetError(err)
+	}
+
+	fe := fscommon.NewError(errno, op, path, err)
+	fe.Retryable = retryable
+	if errno == fscommon.ENOENT {
+		dlog.Debugf("%s", fe.Error())
+	} else {
+		dlog.Warnf("%s", fe.Error())
+	}
+	return fe
+}
+
+//get errno of an error returned by aws sdk
+func toErrno(op string, path string, err error) int {
+	return toFsError(op, path, err).Errno
+}
+
+//errno of a request which may succeed, 0 if err is nil
+func errnoOf(ctx context.Context, op string, path string, err error) int {
+	if err == nil {
+		return 0
+	}
+	return ctxErrno(ctx, op, path, err)
+}
+
+//a request canceled by its context is not a backend failure
+//the error is reported to the context, so that the retry layer knows if it's transient
+func ctxErrno(ctx context.Context, op string, path string, err error) int {
+	if ok := fscommon.CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	fe := toFsError(op, path, err)
+	fscommon.ReportError(ctx, fe)
+	return fe.Errno
+}
@@ -1,12 +1,13 @@
 package s3impl
 
 import (
+	"context"
 	"os"
 	//"syscall"
 	"bytes"
 	"fmt"
 	"io"
-	"log"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -24,24 +25,255 @@ type S3FileIO struct {
 	svc        *s3.S3
 	fs         *S3FileSystemImpl
 	bucketName string
+
+	fileName string            //name of the file object
+	fileAttr *fscommon.DirItem //POSIX attributes saved with the file object
+
+	blocks fscommon.BlockCache //verified blocks of the last read
+}
+
+//convert meta data to the format of aws sdk
+func toAwsMeta(md fscommon.ObjectMeta) map[string]*string {
+	if len(md) == 0 {
+		return nil
+	}
+	meta := make(map[string]*string, len(md))
+	for key, val := range md {
+		meta[key] = aws.String(val)
+	}
+	return meta
+}
+
+//aws sdk returns meta data keys in canonical header format, e.g. "Mtime"
+func fromAwsMeta(meta map[string]*string) fscommon.ObjectMeta {
+	md := make(fscommon.ObjectMeta, len(meta))
+	for key, val := range meta {
+		if val != nil {
+			md[strings.ToLower(key)] = *val
+		}
+	}
+	return md
+}
+
+//request fields of server-side encryption and storage class, nil fields are not sent
+type s3ObjectOptions struct {
+	sse          *string
+	kmsKeyId     *string
+	storageClass *string
+	sseCAlg      *string //SSE-C, the key is required by reads of the object too
+	sseCKey      *string
+}
+
+//options of an object by the policy of the mount, see fscommon.ObjectPolicy
+func (me *S3FileSystemImpl) objectOptions(key string) s3ObjectOptions {
+	var o s3ObjectOptions
+	opts := me.policy.Options(key)
+	if opts == nil {
+		return o
+	}
+	switch opts.Encryption() {
+	case fscommon.SSE_S3:
+		o.sse = aws.String(s3.ServerSideEncryptionAes256)
+	case fscommon.SSE_KMS:
+		o.sse = aws.String(s3.ServerSideEncryptionAwsKms)
+		if len(opts.KmsKeyId) > 0 {
+			o.kmsKeyId = aws.String(opts.KmsKeyId)
+		}
+	case fscommon.SSE_C:
+		//the sdk encodes the key and adds its MD5
+		o.sseCAlg = aws.String(s3.ServerSideEncryptionAes256)
+		o.sseCKey = aws.String(string(opts.CustomerKey))
+	}
+	if len(opts.StorageClass) > 0 {
+		o.storageClass = aws.String(s3StorageClass(opts.StorageClass))
+	}
+	return o
 }
 
-func (me *S3FileIO) startUpload(name string) (string, int) {
+func s3StorageClass(class string) string {
+	switch class {
+	case fscommon.STORAGE_IA:
+		return s3.StorageClassStandardIa
+	case fscommon.STORAGE_ARCHIVE:
+		return s3.StorageClassGlacier
+	case fscommon.STORAGE_COLD_ARCHIVE:
+		return s3.StorageClassDeepArchive
+	}
+	return class
+}
+
+//settings an object is stored with, STANDARD is not returned by HEAD
+func storageOptions(rsp *s3.HeadObjectOutput) *fscommon.ObjectOptions {
+	opts := &fscommon.ObjectOptions{
+		KmsKeyId:     aws.StringValue(rsp.SSEKMSKeyId),
+		StorageClass: aws.StringValue(rsp.StorageClass),
+	}
+	switch aws.StringValue(rsp.ServerSideEncryption) {
+	case s3.ServerSideEncryptionAes256:
+		opts.SSE = fscommon.SSE_S3
+	case s3.ServerSideEncryptionAwsKms:
+		opts.SSE = fscommon.SSE_KMS
+	}
+	if rsp.SSECustomerAlgorithm != nil {
+		opts.SSE = fscommon.SSE_C
+	}
+	if len(opts.StorageClass) == 0 {
+		opts.StorageClass = s3.StorageClassStandard
+	}
+	return opts
+}
 
+//get meta data to be saved with an object
+//only the file object itself has POSIX attributes, helper objects don't
+func (me *S3FileIO) objectMeta(ctx context.Context, name string) map[string]*string {
+	md := fscommon.ObjectMetaOf(ctx, name)
+	if me.fileAttr != nil && name == me.fileName {
+		//meta data of old data is not kept, wrappers add it for new data
+		md = me.fileAttr.ToMeta().DropDataMeta().Merge(md)
+	}
+	if md == nil {
+		return nil
+	}
+	return toAwsMeta(md.Compact())
+}
+
+func (me *S3FileIO) startUpload(ctx context.Context, name string) (string, int) {
+	o := me.fs.objectOptions(name)
 	params := &s3.CreateMultipartUploadInput{
-		Bucket: aws.String(me.bucketName), // Required
-		Key:    aws.String(name),          // Required
+		Bucket:               aws.String(me.bucketName), // Required
+		Key:                  aws.String(name),          // Required
+		Metadata:             me.objectMeta(ctx, name),
+		ServerSideEncryption: o.sse,
+		SSEKMSKeyId:          o.kmsKeyId,
+		SSECustomerAlgorithm: o.sseCAlg,
+		SSECustomerKey:       o.sseCKey,
+		StorageClass:         o.storageClass,
 	}
-	rsp, err := me.svc.CreateMultipartUpload(params)
-	if err != nil {
-		log.Println(err.Error())
-		return "", fscommon.EIO
+	val, ok := me.fs.retry.DoValueCtx(ctx, "CreateMultipartUpload "+name, fscommon.OP_WRITE, false, func(ctx context.Context) (interface{}, int) {
+		if ok := me.fs.limiter.Wait(ctx, 0, 0); ok < 0 {
+			return nil, ok
+		}
+		sctx, span := s3Span(ctx, "CreateMultipartUpload", name)
+		start := time.Now()
+		rsp, err := me.svc.CreateMultipartUploadWithContext(sctx, params)
+		ok := errnoOf(ctx, "CreateMultipartUpload", name, err)
+		fscommon.ObserveBackendRequest("CreateMultipartUpload", start, ok, 0)
+		span.End(ok)
+		if ok < 0 {
+			return nil, ok
+		}
+		return rsp.UploadId, 0
+	})
+	if ok < 0 {
+		return "", ok
 	}
 
-	return *rsp.UploadId, 0
+	uploadId := *val.(*string)
+	if me.fs.checksum != nil {
+		me.fs.uploads.Store(uploadId, &uploadSums{w: me.fs.checksum.NewWriter(), next: 1})
+	}
+	return uploadId, 0
+}
+
+//checksums of the parts of a multipart upload, parts are added in order of their numbers
+type uploadSums struct {
+	w    *fscommon.ChecksumWriter
+	next int64 //number of the next part
+}
+
+//checksums of a part are added to the writer, it's nil if checksums are off or the part is out of order
+func (me *S3FileIO) partSums(uploadId string, pnum int64) *fscommon.ChecksumWriter {
+	val, ok := me.fs.uploads.Load(uploadId)
+	if !ok {
+		return nil
+	}
+	us := val.(*uploadSums)
+	if pnum != us.next {
+		us.w.Fail()
+		return nil
+	}
+	us.next++
+	return us.w
 }
 
-func (me *S3FileIO) completeUpload(name string, uploadId string, plist []*s3.CompletedPart) int {
+//add checksums of a part copied from src, whole blocks of src are taken from its meta data, others are read
+func (me *S3FileIO) sumCopy(ctx context.Context, w *fscommon.ChecksumWriter, src string, byteRange string) {
+	src = strings.TrimPrefix(src, "/")
+	head, ok := me.fs.headObject(src)
+	if ok < 0 {
+		w.Fail()
+		return
+	}
+	start, end := int64(0), aws.Int64Value(head.ContentLength)
+	if len(byteRange) > 0 {
+		var last int64
+		if _, err := fmt.Sscanf(byteRange, "bytes=%d-%d", &start, &last); err != nil {
+			w.Fail()
+			return
+		}
+		if last+1 < end {
+			end = last + 1
+		}
+	}
+	read := func(from int64, to int64) bool {
+		if to <= from {
+			return true
+		}
+		buf := make([]byte, to-from)
+		if n := me.GetBufferCtx(ctx, src, buf, from); n != len(buf) {
+			return false
+		}
+		w.Write(buf)
+		return true
+	}
+
+	const blockSize = fscommon.CHECKSUM_BLOCK_SIZE
+	if end-start <= 2*blockSize {
+		if !read(start, end) {
+			w.Fail()
+		}
+		return
+	}
+	//blocks are copied whole if the part is in line with them
+	first := (start + blockSize - 1) / blockSize * blockSize
+	last := end / blockSize * blockSize
+	value := fromAwsMeta(head.Metadata)[fscommon.META_CHECKSUM]
+	if (w.Size()-start)%blockSize != 0 || !read(start, first) || !w.AddBlocks(value, first, int((last-first)/blockSize)) || !read(last, end) {
+		w.Fail()
+	}
+}
+
+//checksums of a multipart upload, they are empty if checksums are off or not known
+//the upload is refused if they are required but don't fit in meta data, see fscommon.Checksummer.Unchecked
+func (me *S3FileIO) uploadSums(name string, uploadId string) (string, int) {
+	val, ok := me.fs.uploads.Load(uploadId)
+	if !ok {
+		return "", 0
+	}
+	value, rc := val.(*uploadSums).w.Value()
+	if rc < 0 {
+		return "", me.fs.checksum.Unchecked(name, rc)
+	}
+	return value, 0
+}
+
+//checksums of a multipart upload are saved when it completes, the object is copied to itself with them
+func (me *S3FileIO) saveUploadSums(name string, value string) {
+	if len(value) == 0 {
+		return
+	}
+	if ok := me.fs.setDataMeta(name, fscommon.ObjectMeta{fscommon.META_CHECKSUM: value}); ok < 0 {
+		dlog.Warnf("Failed to save checksums of %s: %d", name, ok)
+	}
+}
+
+func (me *S3FileIO) completeUpload(ctx context.Context, name string, uploadId string, plist []*s3.CompletedPart) int {
+	defer me.fs.uploads.Delete(uploadId)
+	value, ok := me.uploadSums(name, uploadId)
+	if ok < 0 {
+		return ok
+	}
+	me.blocks.Forget(name)
 	params := &s3.CompleteMultipartUploadInput{
 		Bucket:   aws.String(me.bucketName), // Required
 		Key:      aws.String(name),          // Required
@@ -50,46 +282,110 @@ func (me *S3FileIO) completeUpload(name string, uploadId string, plist []*s3.Com
 			Parts: plist,
 		},
 	}
-	_, err := me.svc.CompleteMultipartUpload(params)
-	if err != nil {
-		log.Println(err.Error())
-		return fscommon.EIO
+	val, ok := me.fs.retry.DoValueCtx(ctx, "CompleteMultipartUpload "+name, fscommon.OP_WRITE, false, func(ctx context.Context) (interface{}, int) {
+		if ok := me.fs.limiter.Wait(ctx, 0, 0); ok < 0 {
+			return nil, ok
+		}
+		sctx, span := s3Span(ctx, "CompleteMultipartUpload", name)
+		start := time.Now()
+		rsp, err := me.svc.CompleteMultipartUploadWithContext(sctx, params)
+		ok := errnoOf(ctx, "CompleteMultipartUpload", name, err)
+		fscommon.ObserveBackendRequest("CompleteMultipartUpload", start, ok, 0)
+		span.End(ok)
+		if ok < 0 {
+			return nil, ok
+		}
+		return rsp.ETag, 0
+	})
+	if ok < 0 {
+		return ok
 	}
-
+	if ok = me.checkUploadETag(name, aws.StringValue(val.(*string)), plist); ok < 0 {
+		return ok
+	}
+	me.saveUploadSums(name, value)
 	return 0
 }
 
-func (me *S3FileIO) copyPart(tgtName string, srcName string, byteRange string, uploadId string, pnum int64) (*s3.CompletedPart, int) {
+//the ETag of a multipart upload is made of ETags of its parts, a mismatch means the object is not assembled of them
+func (me *S3FileIO) checkUploadETag(name string, etag string, plist []*s3.CompletedPart) int {
+	if me.fs.checksum == nil || len(etag) == 0 {
+		return 0
+	}
+	etags := make([]string, 0, len(plist))
+	for _, cp := range plist {
+		if cp != nil {
+			etags = append(etags, aws.StringValue(cp.ETag))
+		}
+	}
+	expected := fscommon.MultipartETag(etags)
+	if len(expected) == 0 || expected == fscommon.TrimETag(etag) {
+		return 0
+	}
+	if !me.fs.checksum.Strict() {
+		dlog.Warnf("ETag mismatch of multipart upload %s: %s, expected %s", name, etag, expected)
+		return 0
+	}
+	dlog.Errorf("ETag mismatch of multipart upload %s: %s, expected %s", name, etag, expected)
+	return fscommon.EIO
+}
+
+func (me *S3FileIO) copyPart(ctx context.Context, tgtName string, srcName string, byteRange string, uploadId string, pnum int64) (*s3.CompletedPart, int) {
 	var copySrc string
 	if srcName[0] == '/' {
 		copySrc = "/" + me.bucketName + srcName
 	} else {
 		copySrc = "/" + me.bucketName + "/" + srcName
 	}
+	tgtOpts, srcOpts := me.fs.objectOptions(tgtName), me.fs.objectOptions(srcName)
 	params := &s3.UploadPartCopyInput{
-		Bucket:     aws.String(me.bucketName), // Required
-		CopySource: aws.String(copySrc),
-		Key:        aws.String(tgtName),  // Required
-		PartNumber: aws.Int64(pnum),      // Required
-		UploadId:   aws.String(uploadId), // Required
+		Bucket:                         aws.String(me.bucketName), // Required
+		CopySource:                     aws.String(copySrc),
+		Key:                            aws.String(tgtName),  // Required
+		PartNumber:                     aws.Int64(pnum),      // Required
+		UploadId:                       aws.String(uploadId), // Required
+		SSECustomerAlgorithm:           tgtOpts.sseCAlg,
+		SSECustomerKey:                 tgtOpts.sseCKey,
+		CopySourceSSECustomerAlgorithm: srcOpts.sseCAlg,
+		CopySourceSSECustomerKey:       srcOpts.sseCKey,
 	}
-	log.Println(copySrc)
+	dlog.Debugf("Copy source: %s", copySrc)
 	if len(byteRange) > 0 {
 		params.CopySourceRange = aws.String(byteRange)
 	}
 
-	rsp, err := me.svc.UploadPartCopy(params)
-	if err != nil {
-		log.Println(err.Error())
-		return nil, fscommon.EIO
+	//a part can be uploaded again with the same number
+	val, ok := me.fs.retry.DoValueCtx(ctx, "UploadPartCopy "+tgtName, fscommon.OP_WRITE, true, func(ctx context.Context) (interface{}, int) {
+		//data is copied within the bucket, only the request is counted
+		if ok := me.fs.limiter.Wait(ctx, 0, 0); ok < 0 {
+			return nil, ok
+		}
+		sctx, span := s3Span(ctx, "CopyPart", tgtName)
+		span.SetAttr("part", pnum)
+		start := time.Now()
+		rsp, err := me.svc.UploadPartCopyWithContext(sctx, params)
+		ok := errnoOf(ctx, "UploadPartCopy", tgtName, err)
+		fscommon.ObserveBackendRequest("UploadPartCopy", start, ok, 0)
+		span.End(ok)
+		if ok < 0 {
+			return nil, ok
+		}
+		return rsp, 0
+	})
+	if ok < 0 {
+		return nil, ok
 	}
+	rsp := val.(*s3.UploadPartCopyOutput)
 
-	log.Println(rsp.CopyPartResult.ETag)
+	dlog.Debugf("Copied part ETag: %s", aws.StringValue(rsp.CopyPartResult.ETag))
+	if w := me.partSums(uploadId, pnum); w != nil {
+		me.sumCopy(ctx, w, srcName, byteRange)
+	}
 
 	return &s3.CompletedPart{PartNumber: &pnum, ETag: rsp.CopyPartResult.ETag}, 0
 }
 
-func (me *S3FileIO) copyBigPart(tgt string, src string, srcLen int64, uploadId string, pnum int64) ([]*s3.CompletedPart, int64) {
+func (me *S3FileIO) copyBigPart(ctx context.Context, tgt string, src string, srcLen int64, uploadId string, pnum int64) ([]*s3.CompletedPart, int64) {
 	plist := make([]*s3.CompletedPart, (srcLen/S3_MAX_BLOCK_SIZE)+10)
 	remainLen := srcLen
 	var start, end int64 = 0, 0
@@ -108,7 +404,7 @@ func (me *S3FileIO) copyBigPart(tgt string, src string, srcLen int64, uploadId s
 			remainLen = 0
 		}
 		byteRange := fmt.Sprintf("bytes=%d-%d", start, end)
-		cp, ok := me.copyPart(tgt, src, byteRange, uploadId, pnum)
+		cp, ok := me.copyPart(ctx, tgt, src, byteRange, uploadId, pnum)
 		if ok < 0 {
 			me.cleanMultipartUpload(tgt, uploadId)
 			return nil, int64(ok)
@@ -120,73 +416,124 @@ func (me *S3FileIO) copyBigPart(tgt string, src string, srcLen int64, uploadId s
 	return plist, pnum
 }
 
-func (me *S3FileIO) uploadPart(tgtName string, data []byte, uploadId string, pnum int64) (*s3.CompletedPart, int) {
-	params := &s3.UploadPartInput{
-		Bucket:        aws.String(me.bucketName), // Required
-		Key:           aws.String(tgtName),       // Required
-		PartNumber:    aws.Int64(pnum),           // Required
-		UploadId:      aws.String(uploadId),      // Required
-		Body:          bytes.NewReader(data),
-		ContentLength: aws.Int64(int64(len(data))),
+func (me *S3FileIO) uploadPart(ctx context.Context, tgtName string, data []byte, uploadId string, pnum int64) (*s3.CompletedPart, int) {
+	o := me.fs.objectOptions(tgtName)
+	val, ok := me.fs.retry.DoValueCtx(ctx, "UploadPart "+tgtName, fscommon.OP_WRITE, true, func(ctx context.Context) (interface{}, int) {
+		if ok := me.fs.limiter.Wait(ctx, int64(len(data)), 0); ok < 0 {
+			return nil, ok
+		}
+		params := &s3.UploadPartInput{
+			Bucket:               aws.String(me.bucketName), // Required
+			Key:                  aws.String(tgtName),       // Required
+			PartNumber:           aws.Int64(pnum),           // Required
+			UploadId:             aws.String(uploadId),      // Required
+			Body:                 bytes.NewReader(data),
+			ContentLength:        aws.Int64(int64(len(data))),
+			SSECustomerAlgorithm: o.sseCAlg,
+			SSECustomerKey:       o.sseCKey,
+		}
+		if me.fs.checksum != nil {
+			params.ContentMD5 = aws.String(fscommon.ContentMD5(data))
+		}
+		sctx, span := s3Span(ctx, "UploadPart", tgtName)
+		span.SetAttr("part", pnum)
+		start := time.Now()
+		rsp, err := me.svc.UploadPartWithContext(sctx, params)
+		ok := errnoOf(ctx, "UploadPart", tgtName, err)
+		fscommon.ObserveBackendRequest("UploadPart", start, ok, len(data))
+		span.End(ok)
+		if ok < 0 {
+			return nil, ok
+		}
+		return rsp.ETag, 0
+	})
+	if ok < 0 {
+		return nil, ok
 	}
-
-	rsp, err := me.svc.UploadPart(params)
-	if err != nil {
-		log.Println(err.Error())
-		return nil, fscommon.EIO
+	if w := me.partSums(uploadId, pnum); w != nil {
+		w.Write(data)
 	}
-	return &s3.CompletedPart{PartNumber: &pnum, ETag: rsp.ETag}, 0
+	return &s3.CompletedPart{PartNumber: &pnum, ETag: val.(*string)}, 0
 }
 
 func (me *S3FileIO) copyFile(tgt string, src string) int {
+	o := me.fs.objectOptions(tgt)
 	params := &s3.CopyObjectInput{
-		Bucket:     aws.String(me.bucketName), // Required
-		CopySource: aws.String(src),           // Required
-		Key:        aws.String(tgt),           // Required
+		Bucket:               aws.String(me.bucketName), // Required
+		CopySource:           aws.String(src),           // Required
+		Key:                  aws.String(tgt),           // Required
+		ServerSideEncryption: o.sse,
+		SSEKMSKeyId:          o.kmsKeyId,
+		SSECustomerAlgorithm: o.sseCAlg,
+		SSECustomerKey:       o.sseCKey,
+		StorageClass:         o.storageClass,
 	}
 
 	_, err := me.svc.CopyObject(params)
 	if err != nil {
-		log.Println(err.Error())
-		return fscommon.EIO
+		return toErrno("CopyObject", tgt, err)
 	}
 
 	return 0
 }
 
-func (me *S3FileIO) copyFileByRange(tgt string, src string, byteRange string) int {
-	uploadId, ok := me.startUpload(tgt)
+func (me *S3FileIO) copyFileByRange(ctx context.Context, tgt string, src string, byteRange string) int {
+	uploadId, ok := me.startUpload(ctx, tgt)
 	if ok != 0 {
 		return ok
 	}
 
-	cp, ok := me.copyPart(tgt, src, byteRange, uploadId, 1)
+	cp, ok := me.copyPart(ctx, tgt, src, byteRange, uploadId, 1)
 	if ok != 0 {
 		return ok
 	}
 
 	plist := make([]*s3.CompletedPart, 1)
 	plist = append(plist, cp)
-	ok = me.completeUpload(tgt, uploadId, plist)
+	ok = me.completeUpload(ctx, tgt, uploadId, plist)
 	return ok
 }
 
 func (me *S3FileIO) PutBuffer(name string, data []byte) int {
-	/* 	md := map[string]*string{
-	        "x-csm-file-slice-size": 	aws.String(string(FILE_SLICE_SIZE)),
-			"x-csm-slice-file"	   :    aws.String("1"),
-	    } */
+	return me.PutBufferCtx(context.Background(), name, data)
+}
+
+func (me *S3FileIO) PutBufferCtx(ctx context.Context, name string, data []byte) int {
+	o := me.fs.objectOptions(name)
 	params := &s3.PutObjectInput{
-		Bucket: aws.String(me.bucketName), // Required
-		Key:    aws.String(name),          // Required
-		Body:   bytes.NewReader(data),
-		//Metadata:			md,
+		Bucket:               aws.String(me.bucketName), // Required
+		Key:                  aws.String(name),          // Required
+		Body:                 bytes.NewReader(data),
+		Metadata:             me.objectMeta(ctx, name),
+		ServerSideEncryption: o.sse,
+		SSEKMSKeyId:          o.kmsKeyId,
+		SSECustomerAlgorithm: o.sseCAlg,
+		SSECustomerKey:       o.sseCKey,
+		StorageClass:         o.storageClass,
+	}
+	//the storage verifies the upload by the headers
+	if sum := me.fs.checksum; sum != nil {
+		if params.Metadata == nil {
+			params.Metadata = make(map[string]*string)
+		}
+		if value, ok := sum.Value(data); ok == 0 {
+			params.Metadata[fscommon.META_CHECKSUM] = aws.String(value)
+		} else if ok = sum.Unchecked(name, ok); ok < 0 {
+			return ok
+		}
+		params.ContentMD5 = aws.String(fscommon.ContentMD5(data))
+		switch sum.Algorithm() {
+		case fscommon.CHECKSUM_CRC32C:
+			params.ChecksumCRC32C = aws.String(sum.Sum(data))
+		case fscommon.CHECKSUM_SHA256:
+			params.ChecksumSHA256 = aws.String(sum.Sum(data))
+		}
 	}
 
-	_, err := me.svc.PutObject(params)
+	me.blocks.Forget(name)
+	_, err := me.svc.PutObjectWithContext(ctx, params)
 	if err != nil {
-		log.Println(err.Error())
-		return fscommon.EIO
+		return ctxErrno(ctx, "PutObject", name, err)
 	}
 
 	return len(data)
@@ -196,49 +543,103 @@ func (me *S3FileIO) ZeroFile(name string) int {
 	return me.PutBuffer(name, make([]byte, 0))
 }
 
+func (me *S3FileIO) ZeroFileCtx(ctx context.Context, name string) int {
+	return me.PutBufferCtx(ctx, name, make([]byte, 0))
+}
+
 func (me *S3FileIO) GetBuffer(name string, dest []byte, offset int64) int {
+	return me.GetBufferCtx(context.Background(), name, dest, offset)
+}
 
+//with checksums, whole blocks are read and verified, see fscommon.Checksummer
+func (me *S3FileIO) GetBufferCtx(ctx context.Context, name string, dest []byte, offset int64) int {
+	sum := me.fs.checksum
+	if !sum.Verifying() {
+		n, _ := me.getObject(ctx, name, dest, offset)
+		return n
+	}
+	return sum.ReadBlocks(&me.blocks, name, dest, offset, func(buf []byte, start int64) (int, string, int64) {
+		n, rsp := me.getObject(ctx, name, buf, start)
+		if n <= 0 {
+			return n, "", 0
+		}
+		return n, fromAwsMeta(rsp.Metadata)[fscommon.META_CHECKSUM], fscommon.RangeTotal(aws.StringValue(rsp.ContentRange))
+	})
+}
+
+//read a range of an object, the response is returned with the data, it's nil if nothing is read
+func (me *S3FileIO) getObject(ctx context.Context, name string, dest []byte, offset int64) (int, *s3.GetObjectOutput) {
 	byteRange := fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(dest))-1)
-	log.Println("Read file, range = ", byteRange)
+	dlog.Debugf("Read file, range = %s", byteRange)
 
+	o := me.fs.objectOptions(name)
 	params := &s3.GetObjectInput{
-		Bucket: aws.String(me.bucketName),
-		Key:    aws.String(name),
-		Range:  aws.String(byteRange),
+		Bucket:               aws.String(me.bucketName),
+		Key:                  aws.String(name),
+		Range:                aws.String(byteRange),
+		SSECustomerAlgorithm: o.sseCAlg,
+		SSECustomerKey:       o.sseCKey,
 	}
-	rsp, err := me.svc.GetObject(params)
+	rsp, err := me.svc.GetObjectWithContext(ctx, params)
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
 			//by now, I can only see that AWS S3 return this code when file size is zero
 			if awsErr.Code() == "InvalidRange" {
-				return 0
+				return 0, nil
 			} else if awsErr.Code() == "NoSuchKey" {
-				return fscommon.ENOENT
+				return fscommon.ENOENT, nil
 			}
 		}
-		log.Println(err.Error())
-		return fscommon.EIO
+		return ctxErrno(ctx, "GetObject", name, err), nil
 	}
 
-	//n := rsp.ContentLength
-
-	n, err := rsp.Body.Read(dest)
-	if err != nil && err != io.EOF {
-		log.Println(err.Error())
-		return fscommon.EIO
+	n, err := io.ReadFull(rsp.Body, dest)
+	rsp.Body.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return ctxErrno(ctx, "GetObject", name, err), nil
 	}
-
-	return n
+	if rsp.ContentLength != nil && int64(n) < *rsp.ContentLength && n < len(dest) {
+		dlog.Errorf("Short read of %s: %d of %d bytes", name, n, *rsp.ContentLength)
+		return fscommon.EIO, nil
+	}
+	return n, rsp
 }
 
 func (me *S3FileIO) GetAttr(path string) (os.FileInfo, int) {
-	return me.fs._getAttrFromRemote(path, fscommon.S_IFREG)
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+func (me *S3FileIO) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
+	return me.fs.getAttrFromRemoteCtx(ctx, path, fscommon.S_IFREG)
 	//sliceSize := rsp.Metadata["x-csm-file-slice-size"]
 	//sliceCount := rsp.Metadata["x-csm-file-slice-count"]
 	//isSliced  := rsp.Metadata["x-csm-slice-file"]
 	//fileRealSize := rsp.Metadata["x-csm-file-size"]
 }
 
+func (me *S3FileIO) GetMeta(name string) (fscommon.ObjectMeta, int) {
+	return me.fs.getObjectMeta(name)
+}
+
+func (me *S3FileIO) SetMeta(name string, meta fscommon.ObjectMeta) int {
+	return me.fs.setObjectMeta(name, meta)
+}
+
+//meta data requests are small, the context is checked before them only
+func (me *S3FileIO) GetMetaCtx(ctx context.Context, name string) (fscommon.ObjectMeta, int) {
+	if ok := fscommon.CtxErrno(ctx); ok < 0 {
+		return nil, ok
+	}
+	return me.GetMeta(name)
+}
+
+func (me *S3FileIO) SetMetaCtx(ctx context.Context, name string, meta fscommon.ObjectMeta) int {
+	if ok := fscommon.CtxErrno(ctx); ok < 0 {
+		return ok
+	}
+	return me.SetMeta(name, meta)
+}
+
 func (me *S3FileIO) WaitFileReady(path string) int {
 	ok := fscommon.ENOENT
 	n := 10
@@ -258,7 +659,8 @@ func (me *S3FileIO) WaitFileReady(path string) int {
 }
 
 func (me *S3FileIO) Rename(src string, tgt string) int {
-	uploadId, ok := me.startUpload(tgt)
+	ctx := context.Background()
+	uploadId, ok := me.startUpload(ctx, tgt)
 	if ok < 0 {
 		return ok
 	}
@@ -267,7 +669,7 @@ func (me *S3FileIO) Rename(src string, tgt string) int {
 	partList := make([]*s3.CompletedPart, 2)
 	for true {
 		byteRange := fmt.Sprintf("bytes=%d-%d", start, start+S3_MAX_PART_SIZE-1)
-		part, ok := me.copyPart(tgt, src, byteRange, uploadId, pnum)
+		part, ok := me.copyPart(ctx, tgt, src, byteRange, uploadId, pnum)
 		if ok < 0 {
 			break
 		}
@@ -276,7 +678,7 @@ func (me *S3FileIO) Rename(src string, tgt string) int {
 		start += S3_MAX_PART_SIZE
 	}
 
-	ok = me.completeUpload(tgt, uploadId, partList)
+	ok = me.completeUpload(ctx, tgt, uploadId, partList)
 	if ok < 0 { //cancel the upload
 		//failed to upload? then cancel the upload request
 		params := &s3.AbortMultipartUploadInput{
@@ -286,7 +688,7 @@ func (me *S3FileIO) Rename(src string, tgt string) int {
 		}
 		_, err := me.svc.AbortMultipartUpload(params)
 		if err != nil {
-			log.Println(err.Error())
+			dlog.Warnf("Failed to abort multipart upload of %s: %s", tgt, err)
 		}
 
 		return ok
@@ -301,7 +703,16 @@ func (me *S3FileIO) Unlink(name string) int {
 	return me.fs.Unlink(name)
 }
 
+func (me *S3FileIO) UnlinkCtx(ctx context.Context, name string) int {
+	me.blocks.Forget(name)
+	return me.fs.UnlinkCtx(ctx, name)
+}
+
 func (me *S3FileIO) ListFile(path string) ([]os.FileInfo, int) {
+	return me.ListFileCtx(context.Background(), path)
+}
+
+func (me *S3FileIO) ListFileCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
 
 	prefix := path
 	if len(prefix) != 0 && prefix != "/" {
@@ -318,11 +729,10 @@ func (me *S3FileIO) ListFile(path string) ([]os.FileInfo, int) {
 		Prefix: aws.String(prefix),
 		//StartAfter:        aws.String("StartAfter"),
 	}
-	rsp, err := me.svc.ListObjectsV2(params)
+	rsp, err := me.svc.ListObjectsV2WithContext(ctx, params)
 
 	if err != nil { // resp is not filled
-		log.Println(err)
-		return nil, -1
+		return nil, ctxErrno(ctx, "ListObjectsV2", path, err)
 	}
 
 	diCount := len(rsp.Contents)
@@ -353,5 +763,6 @@ func (me *S3FileIO) ListFile(path string) ([]os.FileInfo, int) {
 }
 
 func (me *S3FileIO) cleanMultipartUpload(path string, uploadId string) int {
+	me.fs.uploads.Delete(uploadId)
 	return 0
 }
@@ -2,11 +2,14 @@ package s3impl
 
 import (
 	//"syscall"
-	"fmt"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
-	//"strings"
-	"log"
 
 	"github.com/allspace/csmgr/common"
 	"github.com/aws/aws-sdk-go/aws"
@@ -24,6 +27,21 @@ type S3FileSystemImpl struct {
 	//dirCache	map[string]fscommon.DirItem
 	dirCache *fscommon.DirCache
 	fileMgr  *fscommon.FileInstanceMgr
+	quota    *fscommon.QuotaMgr //nil if usage is not tracked
+	retry    *fscommon.RetryPolicy
+	limiter  *fscommon.RateLimiter
+	policy   *fscommon.ObjectPolicy //encryption and storage class of new objects, nil for bucket defaults
+	crypt    *fscommon.CryptKey     //master key of client-side encryption, nil if it's off
+	compress *fscommon.Compressor   //nil if compression is off
+	checksum *fscommon.Checksummer  //nil if checksums are off
+
+	readDirStat bool //load POSIX attributes for every directory entry
+	xattrTags   bool //save extended attributes with tag prefix as object tags
+	dedup       bool //store files as manifests of deduplicated chunks, see fscommon.DedupIO
+
+	listMetas fscommon.ListMetaCache //meta data of listed objects, see statDirItem
+
+	uploads sync.Map //checksums of multipart uploads by upload id, see uploadSums
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -40,39 +58,370 @@ func (me *S3FileSystemImpl) addDirCache(key string, di *fscommon.DirItem) {
 //get attributes for path/file
 //it can also be used to check if path/file exists
 func (me *S3FileSystemImpl) _getAttrFromRemote(path string, iType int) (os.FileInfo, int) {
+	return me.getAttrFromRemoteCtx(context.Background(), path, iType)
+}
+
+func (me *S3FileSystemImpl) getAttrFromRemoteCtx(ctx context.Context, path string, iType int) (os.FileInfo, int) {
 	key := path
 	if iType == fscommon.S_IFDIR {
 		key = key + "/"
 	}
+	o := me.objectOptions(key)
 	params := &s3.HeadObjectInput{
-		Bucket: aws.String(me.bucketName), // Required
-		Key:    aws.String(key),           // Required
+		Bucket:               aws.String(me.bucketName), // Required
+		Key:                  aws.String(key),           // Required
+		SSECustomerAlgorithm: o.sseCAlg,
+		SSECustomerKey:       o.sseCKey,
 	}
-	rsp, err := me.svc.HeadObject(params)
+	sctx, span := s3Span(ctx, "HeadObject", key)
+	rsp, err := me.svc.HeadObjectWithContext(sctx, params)
+	span.EndErr(err)
 	if err != nil {
 		// Print the error, cast err to awserr.Error to get the Code and
 		// Message from an error.
 		if reqerr, ok := err.(awserr.RequestFailure); ok {
 			if reqerr.StatusCode() == 404 {
 				if iType == fscommon.S_IFUNKOWN {
-					return me._getAttrFromRemote(key, fscommon.S_IFDIR)
+					return me.getAttrFromRemoteCtx(ctx, key, fscommon.S_IFDIR)
 				} else {
 					return nil, fscommon.ENOENT
 				}
 			}
 		}
-		fmt.Println(err.Error())
-		return nil, fscommon.ENOENT //fail to get attributes
+		return nil, ctxErrno(ctx, "HeadObject", key, err)
 	}
 	if iType != fscommon.S_IFDIR {
 		iType = fscommon.S_IFREG
 	}
-	return &fscommon.DirItem{
+	di := &fscommon.DirItem{
 		DiName:  fscommon.GetLastPathComp(path),
 		DiType:  iType,
 		DiSize:  *rsp.ContentLength,
 		DiMtime: *rsp.LastModified,
-	}, 0
+	}
+	di.FromMeta(fromAwsMeta(rsp.Metadata))
+	return di, 0
+}
+
+//get source for copy requests, key must be URL-encoded
+func (me *S3FileSystemImpl) copySource(key string) string {
+	u := &url.URL{Path: me.bucketName + "/" + strings.TrimPrefix(key, "/")}
+	return u.EscapedPath()
+}
+
+func (me *S3FileSystemImpl) headObject(key string) (*s3.HeadObjectOutput, int) {
+	o := me.objectOptions(key)
+	rsp, err := me.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket:               aws.String(me.bucketName), // Required
+		Key:                  aws.String(key),           // Required
+		SSECustomerAlgorithm: o.sseCAlg,
+		SSECustomerKey:       o.sseCKey,
+	})
+	if err != nil {
+		if reqerr, ok := err.(awserr.RequestFailure); ok && reqerr.StatusCode() == 404 {
+			return nil, fscommon.ENOENT
+		}
+		return nil, toErrno("HeadObject", key, err)
+	}
+	return rsp, 0
+}
+
+//get user meta data of an object
+func (me *S3FileSystemImpl) getObjectMeta(key string) (fscommon.ObjectMeta, int) {
+	rsp, ok := me.headObject(key)
+	if ok < 0 {
+		return nil, ok
+	}
+	return fromAwsMeta(rsp.Metadata), 0
+}
+
+//replace user meta data of an object by copying the object to itself
+//existing meta data which is not in md is kept
+//the copy keeps encryption and storage class of the object
+func (me *S3FileSystemImpl) setObjectMeta(key string, md fscommon.ObjectMeta) int {
+	head, ok := me.headObject(key)
+	if ok < 0 {
+		return ok
+	}
+
+	//meta data of the data, e.g. the checksum, is kept as it is
+	old := fromAwsMeta(head.Metadata)
+	return me.replaceObjectMeta(key, head, make(fscommon.ObjectMeta).Merge(old).Merge(md).KeepDataMeta(old).Compact())
+}
+
+//set meta data of the data of an object, e.g. checksums after a multipart upload
+func (me *S3FileSystemImpl) setDataMeta(key string, md fscommon.ObjectMeta) int {
+	head, ok := me.headObject(key)
+	if ok < 0 {
+		return ok
+	}
+	return me.replaceObjectMeta(key, head, make(fscommon.ObjectMeta).Merge(fromAwsMeta(head.Metadata)).Merge(md).Compact())
+}
+
+func (me *S3FileSystemImpl) replaceObjectMeta(key string, head *s3.HeadObjectOutput, meta fscommon.ObjectMeta) int {
+	o := me.objectOptions(key)
+	params := &s3.CopyObjectInput{
+		Bucket:                         aws.String(me.bucketName),      // Required
+		CopySource:                     aws.String(me.copySource(key)), // Required
+		Key:                            aws.String(key),                // Required
+		ContentType:                    head.ContentType,
+		Metadata:                       toAwsMeta(meta),
+		MetadataDirective:              aws.String(s3.MetadataDirectiveReplace),
+		ServerSideEncryption:           head.ServerSideEncryption,
+		SSEKMSKeyId:                    head.SSEKMSKeyId,
+		StorageClass:                   head.StorageClass,
+		SSECustomerAlgorithm:           o.sseCAlg,
+		SSECustomerKey:                 o.sseCKey,
+		CopySourceSSECustomerAlgorithm: o.sseCAlg,
+		CopySourceSSECustomerKey:       o.sseCKey,
+	}
+	_, err := me.svc.CopyObject(params)
+	if err != nil {
+		return toErrno("CopyObject", key, err)
+	}
+	return 0
+}
+
+//load attributes with all meta data, from open file or remote
+func (me *S3FileSystemImpl) loadAttr(path string) (*fscommon.DirItem, int) {
+	fi, ok := me.fileMgr.GetFileInfo(path)
+	if !ok {
+		var rc int
+		fi, rc = me._getAttrFromRemote(path, fscommon.S_IFUNKOWN)
+		if rc < 0 {
+			return nil, rc
+		}
+	}
+	di := *(fi.(*fscommon.DirItem))
+	return &di, 0
+}
+
+//get object key for a path, directory key has a slash suffix
+func (me *S3FileSystemImpl) attrKey(path string, di *fscommon.DirItem) string {
+	key := strings.TrimSuffix(path, "/")
+	if di.DiType == fscommon.S_IFDIR {
+		key = key + "/"
+	}
+	return key
+}
+
+//load POSIX attributes of a path, apply changes and save them back
+func (me *S3FileSystemImpl) updateAttr(path string, update func(di *fscommon.DirItem) int) int {
+	di, ok := me.loadAttr(path)
+	if ok < 0 {
+		return ok
+	}
+	ok = update(di)
+	if ok < 0 {
+		return ok
+	}
+
+	//an open file saves its attributes again at flush
+	me.fileMgr.SetFileAttr(path, di)
+
+	me.dirCache.Remove(strings.TrimSuffix(path, "/"))
+	return me.setObjectMeta(me.attrKey(path, di), di.ToMeta())
+}
+
+func (me *S3FileSystemImpl) getObjectTags(key string) (map[string]string, int) {
+	params := &s3.GetObjectTaggingInput{
+		Bucket: aws.String(me.bucketName), // Required
+		Key:    aws.String(key),           // Required
+	}
+	rsp, err := me.svc.GetObjectTagging(params)
+	if err != nil {
+		return nil, toErrno("GetObjectTagging", key, err)
+	}
+	tags := make(map[string]string, len(rsp.TagSet))
+	for _, tag := range rsp.TagSet {
+		tags[*tag.Key] = *tag.Value
+	}
+	return tags, 0
+}
+
+//replace all tags of an object
+func (me *S3FileSystemImpl) setObjectTags(key string, tags map[string]string) int {
+	var err error
+	if len(tags) == 0 {
+		_, err = me.svc.DeleteObjectTagging(&s3.DeleteObjectTaggingInput{
+			Bucket: aws.String(me.bucketName), // Required
+			Key:    aws.String(key),           // Required
+		})
+	} else {
+		tagSet := make([]*s3.Tag, 0, len(tags))
+		for k, v := range tags {
+			tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		_, err = me.svc.PutObjectTagging(&s3.PutObjectTaggingInput{
+			Bucket:  aws.String(me.bucketName),   // Required
+			Key:     aws.String(key),             // Required
+			Tagging: &s3.Tagging{TagSet: tagSet}, // Required
+		})
+	}
+	if err != nil {
+		return toErrno("PutObjectTagging", key, err)
+	}
+	return 0
+}
+
+func (me *S3FileSystemImpl) isTagXAttr(name string) bool {
+	return me.xattrTags && strings.HasPrefix(name, fscommon.XATTR_TAG_PREFIX)
+}
+
+//load extended attributes from meta data, and from tags if enabled
+//settings of storage are read-only attributes of files, see fscommon.XATTR_STORAGE_PREFIX
+func (me *S3FileSystemImpl) loadXAttrs(path string, withTags bool, withStorage bool) (fscommon.XAttrs, int) {
+	di, ok := me.loadAttr(path)
+	if ok < 0 {
+		return nil, ok
+	}
+	xa := di.GetXAttrs()
+	if withStorage && di.DiType == fscommon.S_IFREG {
+		head, ok := me.headObject(me.attrKey(path, di))
+		if ok < 0 {
+			return nil, ok
+		}
+		for name, data := range storageOptions(head).XAttrs() {
+			xa[name] = data
+		}
+	}
+	if withTags {
+		tags, ok := me.getObjectTags(me.attrKey(path, di))
+		if ok < 0 {
+			return nil, ok
+		}
+		for name, data := range fscommon.NewXAttrsFromTags(tags) {
+			xa[name] = data
+		}
+	}
+	return xa, 0
+}
+
+//load extended attributes saved as tags, apply changes and save them back
+func (me *S3FileSystemImpl) updateTagXAttrs(path string, update func(xa fscommon.XAttrs) int) int {
+	di, ok := me.loadAttr(path)
+	if ok < 0 {
+		return ok
+	}
+	key := me.attrKey(path, di)
+	tags, ok := me.getObjectTags(key)
+	if ok < 0 {
+		return ok
+	}
+	xa := fscommon.NewXAttrsFromTags(tags)
+	ok = update(xa)
+	if ok < 0 {
+		return ok
+	}
+	tags, ok = xa.Tags()
+	if ok < 0 {
+		return ok
+	}
+	return me.setObjectTags(key, tags)
+}
+
+//load POSIX attributes for a directory entry
+//meta data of an object listed before is taken from me.listMetas while its ETag is the same
+func (me *S3FileSystemImpl) statDirItem(key string, tag string, di *fscommon.DirItem) {
+	if md, ok := me.listMetas.Get(key, tag, di.DiMtime); ok {
+		di.FromMeta(md)
+		return
+	}
+	md, ok := me.getObjectMeta(key)
+	if ok == 0 {
+		me.listMetas.Put(key, tag, di.DiMtime, md)
+		di.FromMeta(md)
+	}
+}
+
+//list all object keys and their sizes under the prefix, include keys in sub directories
+func (me *S3FileSystemImpl) listAllKeys(ctx context.Context, prefix string) ([]string, []int64, int) {
+	keys := make([]string, 0)
+	sizes := make([]int64, 0)
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(me.bucketName), // Required
+		Prefix: aws.String(prefix),
+	}
+	sctx, span := s3Span(ctx, "ListObjectsV2", prefix)
+	err := me.svc.ListObjectsV2PagesWithContext(sctx, params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, *obj.Key)
+			sizes = append(sizes, aws.Int64Value(obj.Size))
+		}
+		return true
+	})
+	span.EndErr(err)
+	if err != nil {
+		return nil, nil, ctxErrno(ctx, "ListObjectsV2", prefix, err)
+	}
+	return keys, sizes, 0
+}
+
+//total size and count of all files under the prefix
+//s3 has no bucket statistics API, so we have to list the objects
+//keys have a leading slash when files are created by WebDAV, so both forms of a prefix are listed
+func (me *S3FileSystemImpl) scanUsage(prefix string) (int64, int64, int) {
+	prefixes := []string{prefix}
+	if len(prefix) > 0 {
+		prefixes = append(prefixes, "/"+prefix)
+	}
+
+	var size, count int64
+	for _, p := range prefixes {
+		params := &s3.ListObjectsV2Input{
+			Bucket: aws.String(me.bucketName), // Required
+			Prefix: aws.String(p),
+		}
+		err := me.svc.ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				if fscommon.IsHelperKey(*obj.Key) {
+					continue
+				}
+				size += aws.Int64Value(obj.Size)
+				count++
+			}
+			return true
+		})
+		if err != nil {
+			return 0, 0, toErrno("ListObjectsV2", p, err)
+		}
+	}
+	return size, count, 0
+}
+
+//delete objects with multi-object delete requests
+func (me *S3FileSystemImpl) deleteKeys(ctx context.Context, keys []string) int {
+	for start := 0; start < len(keys); start += S3_MAX_DELETE_KEYS {
+		end := start + S3_MAX_DELETE_KEYS
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		objs := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objs = append(objs, &s3.ObjectIdentifier{Key: aws.String(key)})
+			me.dirCache.Remove(strings.TrimSuffix(key, "/"))
+		}
+		params := &s3.DeleteObjectsInput{
+			Bucket: aws.String(me.bucketName), // Required
+			Delete: &s3.Delete{ // Required
+				Objects: objs,
+				Quiet:   aws.Bool(true),
+			},
+		}
+		sctx, span := s3Span(ctx, "DeleteObjects", keys[start])
+		rsp, err := me.svc.DeleteObjectsWithContext(sctx, params)
+		span.EndErr(err)
+		if err != nil {
+			return ctxErrno(ctx, "DeleteObjects", keys[start], err)
+		}
+		//in quiet mode, only failed keys are returned
+		if len(rsp.Errors) > 0 {
+			dlog.Warnf("Failed to delete %d objects, first error: %s", len(rsp.Errors), rsp.Errors[0].String())
+			return fscommon.EIO
+		}
+	}
+	return 0
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -84,8 +433,12 @@ func (me *S3FileSystemImpl) OpenDir(path string) int {
 }
 
 func (me *S3FileSystemImpl) ReadDir(path string) ([]os.FileInfo, int) {
+	return me.ReadDirCtx(context.Background(), path)
+}
 
-	fmt.Println("S3FileSystemImpl::ReadDir = ", path)
+func (me *S3FileSystemImpl) ReadDirCtx(ctx context.Context, path string) ([]os.FileInfo, int) {
+
+	dlog.Debugf("S3FileSystemImpl::ReadDir = %s", path)
 
 	prefix := path
 	if len(prefix) != 0 && prefix != "/" {
@@ -102,16 +455,19 @@ func (me *S3FileSystemImpl) ReadDir(path string) ([]os.FileInfo, int) {
 		Prefix: aws.String(prefix),
 		//StartAfter:        aws.String("StartAfter"),
 	}
-	rsp, err := me.svc.ListObjectsV2(params)
+	sctx, span := s3Span(ctx, "ListObjectsV2", prefix)
+	rsp, err := me.svc.ListObjectsV2WithContext(sctx, params)
+	span.EndErr(err)
 
 	if err != nil { // resp is not filled
-		fmt.Println(err)
-		return nil, -1
+		return nil, ctxErrno(ctx, "ListObjectsV2", path, err)
 	}
 
 	diCount := len(rsp.CommonPrefixes) + len(rsp.Contents)
 
 	dis := make([]os.FileInfo, diCount)
+	keys := make([]string, diCount)
+	tags := make([]string, diCount)
 
 	//collect directories
 	for i := 0; i < len(rsp.CommonPrefixes); i++ {
@@ -130,9 +486,7 @@ func (me *S3FileSystemImpl) ReadDir(path string) ([]os.FileInfo, int) {
 			DiSize: 0,
 		}
 		dis[i] = di
-
-		//add to cache
-		me.addDirCache(key, di)
+		keys[i] = key
 	}
 
 	//collect files
@@ -147,16 +501,36 @@ func (me *S3FileSystemImpl) ReadDir(path string) ([]os.FileInfo, int) {
 			DiName:  fscommon.GetLastPathComp(key), //need remove common prefix
 			DiSize:  *(rsp.Contents[i].Size),
 			DiMtime: *rsp.Contents[i].LastModified,
-			//rsp.Contents[i].ETag
-			DiType: fscommon.S_IFREG,
+			DiType:  fscommon.S_IFREG,
 		}
 		dis[j] = di
-		//add to cache
-		me.addDirCache(key, di)
+		keys[j] = key
+		tags[j] = aws.StringValue(rsp.Contents[i].ETag)
 		j++
 	}
 
-	fmt.Println("Directories and files: ", diCount)
+	//list result does not contain user meta data
+	//without READDIR_STAT, only small objects are checked, they may be symbolic links
+	//objects are checked when plain text is allowed, only the meta data tells encrypted ones
+	//compressed and deduplicated files are checked too, the meta data has their plain text size
+	//objects are checked in parallel, and only once while they aren't changed
+	migrating := me.crypt != nil && me.crypt.PlainAllowed()
+	fscommon.StatDirItems(dis, func(i int, di *fscommon.DirItem) {
+		sized := di.DiType == fscommon.S_IFREG && (me.dedup || me.compress != nil && me.compress.Match(keys[i]))
+		if me.readDirStat || migrating || sized || fscommon.MayBeLink(di) {
+			me.statDirItem(keys[i], tags[i], di)
+		}
+		me.plainAttr(di)
+	})
+
+	//add to cache
+	for i, fi := range dis {
+		if fi != nil {
+			me.addDirCache(keys[i], fi.(*fscommon.DirItem))
+		}
+	}
+
+	dlog.Debugf("Directories and files: %d", diCount)
 	return dis, diCount
 }
 
@@ -164,19 +538,85 @@ func (me *S3FileSystemImpl) ReleaseDir() int {
 	return 0
 }
 
+//apply settings which can be changed without remount, see fscommon.Reconfigurable
+func (me *S3FileSystemImpl) Reconfigure(cfg map[string]string) int {
+	me.limiter.Update(cfg)
+	return 0
+}
+
 func (me *S3FileSystemImpl) GetAttr(path string) (os.FileInfo, int) {
+	return me.GetAttrCtx(context.Background(), path)
+}
+
+func (me *S3FileSystemImpl) GetAttrCtx(ctx context.Context, path string) (os.FileInfo, int) {
 	di, ok := me.fileMgr.GetFileInfo(path)
 	if ok {
 		return di, 0
 	}
 
+	_, span := fscommon.StartSpan(ctx, "dircache.get", "path", path)
 	di, ok = me.dirCache.Get(path)
+	span.SetAttr("hit", ok)
+	span.End(0)
 	if ok {
 		return di, 0
 	}
 
 	//get attributes from remote
-	return me._getAttrFromRemote(path, fscommon.S_IFUNKOWN)
+	di, rc := me.getAttrFromRemoteCtx(ctx, path, fscommon.S_IFUNKOWN)
+	if rc == 0 {
+		me.plainAttr(di.(*fscommon.DirItem))
+	}
+	return di, rc
+}
+
+//report the plain text size of a regular file, the object may be encrypted, compressed or a chunk manifest
+//the size of file data is saved in meta data when it's written, objects without it are in plain text
+func (me *S3FileSystemImpl) plainAttr(di *fscommon.DirItem) {
+	//links are saved as they are
+	if di.DiType != fscommon.S_IFREG {
+		return
+	}
+	if size, ok := di.DataSize(); ok {
+		di.DiSize = size
+	} else if me.crypt != nil && !me.crypt.PlainAllowed() {
+		fscommon.CryptPlainAttr(di)
+	}
+}
+
+//chunks of deduplicated files are released after the files are deleted, see fscommon.DedupRefs
+func (me *S3FileSystemImpl) dedupRefs(ctx context.Context, keys ...string) (*fscommon.DedupRefs, int) {
+	refs := &fscommon.DedupRefs{}
+	if !me.dedup {
+		return refs, 0
+	}
+	fio := &S3FileIO{
+		svc:        me.svc,
+		fs:         me,
+		bucketName: me.bucketName,
+	}
+	dio := me.dataIO(fio).(*fscommon.DedupIO)
+	for _, key := range keys {
+		if ok := dio.AddRefs(ctx, refs, key); ok < 0 {
+			return nil, ok
+		}
+	}
+	return refs, 0
+}
+
+//wrap io of a file with retry, rate limit, metrics, encryption, compression and deduplication
+func (me *S3FileSystemImpl) dataIO(io *S3FileIO) fscommon.FileIO {
+	var fio fscommon.FileIO = fscommon.NewRetryIO(fscommon.NewRateLimitIO(fscommon.NewMetricsIO(io), me.limiter), me.retry)
+	if me.crypt != nil {
+		fio = fscommon.NewCryptIO(fio, me.crypt)
+	}
+	if me.compress != nil {
+		fio = fscommon.NewCompressIO(fio, me.compress)
+	}
+	if me.dedup {
+		fio = fscommon.NewDedupIO(fio, me.crypt)
+	}
+	return fio
 }
 
 //this function runs in big lock context
@@ -194,36 +634,65 @@ func (me *S3FileSystemImpl) NewFileImpl(path string) (fscommon.FileImpl, int) {
 }
 
 func (me *S3FileSystemImpl) Open(path string, flags uint32) (*fscommon.FileObject, int) {
+	return me.open(context.Background(), path, flags, nil)
+}
+
+func (me *S3FileSystemImpl) OpenCtx(ctx context.Context, path string, flags uint32) (*fscommon.FileObject, int) {
+	return me.open(ctx, path, flags, nil)
+}
+
+func (me *S3FileSystemImpl) Create(path string, flags uint32, attr *fscommon.DirItem) (*fscommon.FileObject, int) {
+	return me.open(context.Background(), path, flags|fscommon.O_CREAT, attr)
+}
+
+func (me *S3FileSystemImpl) CreateCtx(ctx context.Context, path string, flags uint32, attr *fscommon.DirItem) (*fscommon.FileObject, int) {
+	return me.open(ctx, path, flags|fscommon.O_CREAT, attr)
+}
+
+//attr is used only when the file is created
+//the file is opened in background, only the existence check is bound to ctx
+//a file instance is shared by requests, so it must not be bound to one of them
+func (me *S3FileSystemImpl) open(ctx context.Context, path string, flags uint32, attr *fscommon.DirItem) (*fscommon.FileObject, int) {
 	//look in file instance manager first
 	//if successful, this will increase instance reference count
-	log.Println("Try to find existing object for file", path)
+	dlog.Debugf("Try to find existing object for file %s", path)
 
 	fo, ok := me.fileMgr.GetInstance(path)
 	if ok == 0 {
 		return fo, 0
 	}
-	log.Println("Verify existing for file", path)
+	dlog.Debugf("Verify existing for file %s", path)
 	//var fileNotExist bool = false
 
 	//verify if the file exists, and if user has permission to open the file in selected mode
-	_, ok = me._getAttrFromRemote(path, fscommon.S_IFREG)
+	di, ok := me.getAttrFromRemoteCtx(ctx, path, fscommon.S_IFREG)
 	switch ok {
-	case fscommon.EIO:
-		return nil, ok
 	case fscommon.ENOENT:
 		if (flags & fscommon.O_CREAT) == 0 {
-			log.Printf("File %s does not exist, but open it without O_CREAT flag\n", path)
+			dlog.Debugf("File %s does not exist, but open it without O_CREAT flag", path)
 			return nil, ok
 		}
 		//fileNotExist = true
 		break
+	default:
+		if ok < 0 {
+			return nil, ok
+		}
 	}
 
-	log.Println("Trying to allocate a file instance for file ", path)
+	//existing file keeps its attributes
+	if di != nil {
+		attr = di.(*fscommon.DirItem)
+	} else if attr == nil {
+		attr = fscommon.NewAttr(fscommon.GetLastPathComp(path), fscommon.S_IFREG)
+	}
+
+	dlog.Debugf("Trying to allocate a file instance for file %s", path)
 	fo, ok = me.fileMgr.Allocate(me, path)
 	if ok != 0 {
 		return nil, ok
 	}
+	fo.SetAttr(attr)
 	/* 	if ok==0 && fileNotExist==true {
 		me.dirCache.Add(path,&fscommon.DirItem{
 			Name : path,
@@ -243,14 +712,99 @@ func (me *S3FileSystemImpl) Open(path string, flags uint32) (*fscommon.FileObjec
 }
 
 func (me *S3FileSystemImpl) Chmod(name string, mode uint32) int {
-	return 0
+	return me.updateAttr(name, func(di *fscommon.DirItem) int {
+		di.DiMode = (di.DiMode &^ os.ModePerm) | os.FileMode(mode).Perm()
+		return 0
+	})
 }
 
-func (me *S3FileSystemImpl) Utimens(name string, Mtime *time.Time) int {
-	return 0
+func (me *S3FileSystemImpl) Chown(name string, uid uint32, gid uint32) int {
+	return me.updateAttr(name, func(di *fscommon.DirItem) int {
+		//-1 means no change
+		if uid != ^uint32(0) {
+			di.DiUid = uid
+		}
+		if gid != ^uint32(0) {
+			di.DiGid = gid
+		}
+		return 0
+	})
+}
+
+func (me *S3FileSystemImpl) Utimens(name string, Atime *time.Time, Mtime *time.Time) int {
+	return me.updateAttr(name, func(di *fscommon.DirItem) int {
+		if Atime != nil {
+			di.DiAtime = *Atime
+		}
+		if Mtime != nil {
+			di.DiMtime = *Mtime
+		}
+		return 0
+	})
+}
+
+func (me *S3FileSystemImpl) GetXAttr(path string, name string) ([]byte, int) {
+	xa, ok := me.loadXAttrs(path, me.isTagXAttr(name), fscommon.IsStorageXAttr(name))
+	if ok < 0 {
+		return nil, ok
+	}
+	data, exist := xa[name]
+	if !exist {
+		return nil, fscommon.ENODATA
+	}
+	return data, 0
+}
+
+func (me *S3FileSystemImpl) ListXAttr(path string) ([]string, int) {
+	xa, ok := me.loadXAttrs(path, me.xattrTags, true)
+	if ok < 0 {
+		return nil, ok
+	}
+	return xa.Names(), 0
+}
+
+func (me *S3FileSystemImpl) SetXAttr(path string, name string, data []byte, flags int) int {
+	if fscommon.IsStorageXAttr(name) {
+		return fscommon.EPERM
+	}
+	if me.isTagXAttr(name) {
+		return me.updateTagXAttrs(path, func(xa fscommon.XAttrs) int {
+			return xa.Set(name, data, flags)
+		})
+	}
+	return me.updateAttr(path, func(di *fscommon.DirItem) int {
+		xa := di.GetXAttrs()
+		ok := xa.Set(name, data, flags)
+		if ok < 0 {
+			return ok
+		}
+		return di.SetXAttrs(xa)
+	})
+}
+
+func (me *S3FileSystemImpl) RemoveXAttr(path string, name string) int {
+	if fscommon.IsStorageXAttr(name) {
+		return fscommon.EPERM
+	}
+	if me.isTagXAttr(name) {
+		return me.updateTagXAttrs(path, func(xa fscommon.XAttrs) int {
+			return xa.Remove(name)
+		})
+	}
+	return me.updateAttr(path, func(di *fscommon.DirItem) int {
+		xa := di.GetXAttrs()
+		ok := xa.Remove(name)
+		if ok < 0 {
+			return ok
+		}
+		return di.SetXAttrs(xa)
+	})
 }
 
 func (me *S3FileSystemImpl) StatFs(name string) (*fscommon.FsInfo, int) {
+	if me.quota != nil {
+		return me.quota.StatFs(), 0
+	}
 	return &fscommon.FsInfo{
 		Blocks: 1024 * 1024 * 1024,
 		Bfree:  1024 * 1024 * 1024,
@@ -259,7 +813,36 @@ func (me *S3FileSystemImpl) StatFs(name string) (*fscommon.FsInfo, int) {
 	}, 0
 }
 
+func (me *S3FileSystemImpl) LoadXAttrs(path string) (fscommon.XAttrs, int) {
+	return me.loadXAttrs(path, false, false)
+}
+
+//all changes are saved by one meta data update
+func (me *S3FileSystemImpl) UpdateXAttrs(path string, set fscommon.XAttrs, remove []string) int {
+	names := append([]string(nil), remove...)
+	for name := range set {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if fscommon.IsStorageXAttr(name) {
+			return fscommon.EPERM
+		}
+		if me.isTagXAttr(name) {
+			return fscommon.ENOTSUP
+		}
+	}
+	return me.updateAttr(path, func(di *fscommon.DirItem) int {
+		xa := di.GetXAttrs()
+		xa.Update(set, remove)
+		return di.SetXAttrs(xa)
+	})
+}
+
 func (me *S3FileSystemImpl) Mkdir(path string, mode uint32) int {
+	return me.MkdirCtx(context.Background(), path, mode)
+}
+
+func (me *S3FileSystemImpl) MkdirCtx(ctx context.Context, path string, mode uint32) int {
 	//check parent folder exist
 	//_,ok := me._getAttrFromRemote(parpath, S_IFDIR)
 	//if ok != 0 {
@@ -271,21 +854,36 @@ func (me *S3FileSystemImpl) Mkdir(path string, mode uint32) int {
 	if path[len(path)-1] != '/' {
 		key = path + "/"
 	}
+	attr := fscommon.NewAttr(fscommon.GetLastPathComp(path), fscommon.S_IFDIR)
+	if mode != 0 {
+		attr.DiMode = os.FileMode(mode).Perm()
+	}
 	var length int64 = 0
+	o := me.objectOptions(key)
 	params := &s3.PutObjectInput{
-		Bucket:        aws.String(me.bucketName),
-		Key:           aws.String(key),
-		ContentLength: &length,
+		Bucket:               aws.String(me.bucketName),
+		Key:                  aws.String(key),
+		ContentLength:        &length,
+		Metadata:             toAwsMeta(attr.ToMeta()),
+		ServerSideEncryption: o.sse,
+		SSEKMSKeyId:          o.kmsKeyId,
+		SSECustomerAlgorithm: o.sseCAlg,
+		SSECustomerKey:       o.sseCKey,
 	}
-	_, err := me.svc.PutObject(params)
+	sctx, span := s3Span(ctx, "PutObject", key)
+	_, err := me.svc.PutObjectWithContext(sctx, params)
+	span.EndErr(err)
 	if err != nil {
-		log.Println(err.Error())
-		return fscommon.EIO
+		return ctxErrno(ctx, "PutObject", key, err)
 	}
 	return 0
 }
 
 func (me *S3FileSystemImpl) Unlink(path string) int {
+	return me.UnlinkCtx(context.Background(), path)
+}
+
+func (me *S3FileSystemImpl) UnlinkCtx(ctx context.Context, path string) int {
 	//check if it's a file. we only deal with file here
 	if path[len(path)-1] == '/' {
 		return fscommon.EINVAL
@@ -296,21 +894,195 @@ func (me *S3FileSystemImpl) Unlink(path string) int {
 		return fscommon.EBUSY
 	}
 
+	//size of the file is needed for usage tracking
+	var size int64
+	if me.quota != nil {
+		if fi, ok := me.GetAttrCtx(ctx, path); ok == 0 && fi != nil {
+			size = fi.Size()
+		}
+	}
+	refs, ok := me.dedupRefs(ctx, path)
+	if ok < 0 {
+		return ok
+	}
+
 	//delete the file
 	params := &s3.DeleteObjectInput{
 		Bucket: aws.String(me.bucketName), // Required
 		Key:    aws.String(path),          // Required
 	}
-	_, err := me.svc.DeleteObject(params)
+	sctx, span := s3Span(ctx, "DeleteObject", path)
+	_, err := me.svc.DeleteObjectWithContext(sctx, params)
+	span.EndErr(err)
 
 	//remove dir cache if there is
 	//remove it even previous step gets failed. just to force a refresh when access it next time
 	me.dirCache.Remove(path)
 
 	if err != nil {
-		log.Println(err.Error())
-		return fscommon.EIO
+		return ctxErrno(ctx, "DeleteObject", path, err)
+	}
+
+	refs.Release(ctx)
+
+	if me.quota != nil {
+		me.quota.Add(path, -size)
+	}
+	return 0
+}
+
+func (me *S3FileSystemImpl) Rmdir(path string) int {
+	return me.RmdirCtx(context.Background(), path)
+}
+
+func (me *S3FileSystemImpl) RmdirCtx(ctx context.Context, path string) int {
+	key := strings.TrimSuffix(path, "/")
+	if len(key) == 0 { //not allow remove root directory
+		return fscommon.EINVAL
+	}
+	key = key + "/"
+
+	//two keys are enough to tell if there is anything other than the folder object
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(me.bucketName), // Required
+		Prefix:  aws.String(key),
+		MaxKeys: aws.Int64(2),
+	}
+	sctx, span := s3Span(ctx, "ListObjectsV2", key)
+	rsp, err := me.svc.ListObjectsV2WithContext(sctx, params)
+	span.EndErr(err)
+	if err != nil {
+		return ctxErrno(ctx, "ListObjectsV2", path, err)
+	}
+	if len(rsp.Contents) == 0 {
+		return fscommon.ENOENT
+	}
+	for _, obj := range rsp.Contents {
+		if *obj.Key != key {
+			return fscommon.ENOTEMPTY
+		}
+	}
+
+	return me.deleteKeys(ctx, []string{key})
+}
+
+func (me *S3FileSystemImpl) RemoveAll(path string) int {
+	return me.RemoveAllCtx(context.Background(), path)
+}
+
+func (me *S3FileSystemImpl) RemoveAllCtx(ctx context.Context, path string) int {
+	key := strings.TrimSuffix(path, "/")
+	if len(key) == 0 { //not allow remove root directory
+		return fscommon.EINVAL
+	}
+
+	//collect everything under the path if it's a directory
+	keys, sizes, ok := me.listAllKeys(ctx, key+"/")
+	if ok < 0 {
+		return ok
+	}
+	//the path may also be a file
+	fi, ok := me.getAttrFromRemoteCtx(ctx, key, fscommon.S_IFREG)
+	if ok == 0 {
+		keys = append(keys, key)
+		sizes = append(sizes, fi.Size())
+	}
+	if len(keys) == 0 {
+		return fscommon.ENOENT
+	}
+
+	//do nothing if any file is being open
+	for _, k := range keys {
+		if me.fileMgr.Exist(k) {
+			dlog.Infof("RemoveAll %s: file %s is being open.", path, k)
+			return fscommon.EBUSY
+		}
+	}
+
+	refs, ok := me.dedupRefs(ctx, keys...)
+	if ok < 0 {
+		return ok
+	}
+
+	//helper objects of the files
+	files := len(keys)
+	for _, dir := range fscommon.GetHelperDirs(key) {
+		hkeys, _, ok := me.listAllKeys(ctx, dir)
+		if ok < 0 {
+			return ok
+		}
+		keys = append(keys, hkeys...)
+	}
+
+	if ok := me.deleteKeys(ctx, keys); ok < 0 {
+		return ok
+	}
+	refs.Release(ctx)
+
+	if me.quota != nil {
+		for i, k := range keys[:files] {
+			me.quota.Add(k, -sizes[i])
+		}
+	}
+	return 0
+}
+
+func (me *S3FileSystemImpl) Symlink(target string, linkPath string) int {
+	if len(target) == 0 || len(target) > fscommon.MAX_LINK_OBJECT_SIZE {
+		return fscommon.EINVAL
+	}
+	_, ok := me._getAttrFromRemote(linkPath, fscommon.S_IFUNKOWN)
+	if ok == 0 {
+		return fscommon.EEXIST
 	}
 
+	//same as s3fs: link target as content, S_IFLNK in mode meta data
+	attr := fscommon.NewAttr(fscommon.GetLastPathComp(linkPath), fscommon.S_IFLNK)
+	o := me.objectOptions(linkPath)
+	params := &s3.PutObjectInput{
+		Bucket:               aws.String(me.bucketName), // Required
+		Key:                  aws.String(linkPath),      // Required
+		Body:                 strings.NewReader(target),
+		Metadata:             toAwsMeta(attr.ToMeta()),
+		ServerSideEncryption: o.sse,
+		SSEKMSKeyId:          o.kmsKeyId,
+		SSECustomerAlgorithm: o.sseCAlg,
+		SSECustomerKey:       o.sseCKey,
+		StorageClass:         o.storageClass,
+	}
+	_, err := me.svc.PutObject(params)
+	me.dirCache.Remove(linkPath)
+	if err != nil {
+		return toErrno("PutObject", linkPath, err)
+	}
 	return 0
 }
+
+func (me *S3FileSystemImpl) Readlink(path string) (string, int) {
+	di, ok := me._getAttrFromRemote(path, fscommon.S_IFREG)
+	if ok < 0 {
+		return "", ok
+	}
+	if di.(*fscommon.DirItem).DiType != fscommon.S_IFLNK {
+		return "", fscommon.EINVAL
+	}
+
+	o := me.objectOptions(path)
+	params := &s3.GetObjectInput{
+		Bucket:               aws.String(me.bucketName),
+		Key:                  aws.String(path),
+		SSECustomerAlgorithm: o.sseCAlg,
+		SSECustomerKey:       o.sseCKey,
+	}
+	rsp, err := me.svc.GetObject(params)
+	if err != nil {
+		return "", toErrno("GetObject", path, err)
+	}
+	defer rsp.Body.Close()
+
+	target, err := ioutil.ReadAll(io.LimitReader(rsp.Body, fscommon.MAX_LINK_OBJECT_SIZE))
+	if err != nil {
+		return "", toErrno("GetObject", path, err)
+	}
+	return string(target), 0
+}
@@ -2,10 +2,10 @@ package s3impl
 
 import (
 	//"fmt"
-	"log"
-	//"time"
 	"container/list"
+	"context"
 	"sync"
+	"time"
 
 	"github.com/allspace/csmgr/common"
 )
@@ -16,6 +16,8 @@ const (
 
 	S3_MIN_BLOCK_SIZE = 5 * 1024 * 1024
 	S3_MAX_BLOCK_SIZE = 5 * 1024 * 1024 * 1024
+
+	S3_MAX_DELETE_KEYS = 1000 //max keys in one multi-object delete request
 )
 
 const (
@@ -46,8 +48,9 @@ type remoteCache struct {
 
 	modifyBuffer *fscommon.CacheBuffer
 
-	io *S3FileIO
-	fs *S3FileSystemImpl
+	io  *S3FileIO
+	rio fscommon.FileIO //io with retry, rate limit, metrics, encryption and compression
+	fs  *S3FileSystemImpl
 
 	mtxOpen  sync.Mutex
 	mtxWrite sync.Mutex
@@ -62,8 +65,9 @@ type remoteCache struct {
 
 func newRemoteCache(name string, io *S3FileIO, fs *S3FileSystemImpl) *remoteCache {
 	return &remoteCache{
-		io: io,
-		fs: fs,
+		io:  io,
+		rio: fs.dataIO(io),
+		fs:  fs,
 
 		appendBlocks:           make([]int64, 1024),
 		appendBlockStartOffset: 0,
@@ -79,7 +83,12 @@ func (me *remoteCache) Open(fileName string, flags uint32) int {
 	if me.File == nil {
 		me.mtxOpen.Lock()
 		if me.File == nil {
-			me.File = NewSliceFile(me.io)
+			me.FileName = fileName
+			me.OpenFlags = flags
+			me.io.fileName = fileName
+			me.io.fileAttr = &me.Attr
+
+			me.File = NewSliceFile(me.rio)
 			ok = me.File.Open(fileName, flags)
 			if ok == 0 {
 				me.appendBlockStartOffset = me.File.GetLength()
@@ -95,6 +104,11 @@ func (me *remoteCache) Open(fileName string, flags uint32) int {
 }
 
 func (me *remoteCache) Read(dest []byte, offset int64) int {
+	return me.ReadCtx(context.Background(), dest, offset)
+}
+
+//writes are buffered and uploaded in background, so only reads take the context of a request
+func (me *remoteCache) ReadCtx(ctx context.Context, dest []byte, offset int64) int {
 	remainLen := len(dest)
 	curOffset := offset
 	curDest := dest
@@ -102,7 +116,11 @@ func (me *remoteCache) Read(dest []byte, offset int64) int {
 
 	//offset falls into base file, or even later
 	if curOffset < me.File.GetLength() {
-		n = me.File.Read(curDest, curOffset)
+		if sf, ok := me.File.(fscommon.ISliceFileCtx); ok {
+			n = sf.ReadCtx(ctx, curDest, curOffset)
+		} else {
+			n = me.File.Read(curDest, curOffset)
+		}
 		if n < 0 {
 			return n
 		}
@@ -118,7 +136,7 @@ func (me *remoteCache) Read(dest []byte, offset int64) int {
 		blkOffset := me.appendBlocks[blkIdx]
 		start := curOffset - blkOffset
 		fileName := me.File.GetCacheBlockFileName(blkOffset)
-		n = me.io.GetBuffer(fileName, curDest, start)
+		n = fscommon.IOWithContext(me.rio).GetBufferCtx(ctx, fileName, curDest, start)
 		if n < 0 {
 			return n
 		}
@@ -141,7 +159,7 @@ func (me *remoteCache) Write(data []byte, offset int64) int {
 	me.mtxWrite.Lock()
 	defer me.mtxWrite.Unlock()
 
-	log.Printf("Write is called for file %s, offset=%d, data length=%d\n", me.FileName, offset, len(data))
+	dlog.Debugf("Write is called for file %s, offset=%d, data length=%d", me.FileName, offset, len(data))
 
 	if me.mtTaskStarted == false {
 		//go me.blockMaintainTask()
@@ -154,14 +172,14 @@ func (me *remoteCache) Write(data []byte, offset int64) int {
 	}
 
 	//append case
-	log.Printf("me.fileLen=%d\n", me.FileLen)
+	dlog.Debugf("me.fileLen=%d", me.FileLen)
 	//IMPORTANT: the offset may not continous
 	if offset >= me.FileLen || (me.AppendBuffer != nil && offset >= me.AppendBuffer.BaseOffset) {
-		log.Printf("Append file, file length=%d\n", me.FileLen)
+		dlog.Debugf("Append file, file length=%d", me.FileLen)
 		return me.appendFile(data, offset)
 	}
 
-	log.Println("Run into unsupported cases for file ", me.FileName)
+	dlog.Warnf("Run into unsupported cases for file %s", me.FileName)
 
 	//random write case
 	if offset < me.AppendBuffer.BaseOffset {
@@ -170,14 +188,19 @@ func (me *remoteCache) Write(data []byte, offset int64) int {
 
 	//truncate to enlarge case, not support for now
 	if offset > me.FileLen {
-		return -1
+		return fscommon.ENOTSUP
 	}
 
-	return -1
+	return fscommon.ENOTSUP
 }
 
 func (me *remoteCache) Flush() int {
-	log.Printf("Flush is called for file %s\n", me.FileName)
+	return me.FlushCtx(context.Background())
+}
+
+//pending blocks and buffer are uploaded with the context, e.g. of the request which closes the file
+func (me *remoteCache) FlushCtx(ctx context.Context) int {
+	dlog.Debugf("Flush is called for file %s", me.FileName)
 
 	//readonly
 	if me.Modified != true {
@@ -185,12 +208,21 @@ func (me *remoteCache) Flush() int {
 	}
 
 	dataLen := me.AppendBuffer.GetDataLen()
+	me.Attr.DiMtime = time.Now()
 
-	log.Printf("Flush pendding write: me.appendBlockCount=%d, dataLen=%d\n",
+	dlog.Debugf("Flush pendding write: me.appendBlockCount=%d, dataLen=%d",
 		me.appendBlockCount, dataLen)
 
-	return me.File.Append(me.appendBlocks[0:me.appendBlockCount],
-		me.AppendBuffer.GetData())
+	var ok int
+	if sf, isCtx := me.File.(fscommon.ISliceFileCtx); isCtx {
+		ok = sf.AppendCtx(ctx, me.appendBlocks[0:me.appendBlockCount], me.AppendBuffer.GetData())
+	} else {
+		ok = me.File.Append(me.appendBlocks[0:me.appendBlockCount], me.AppendBuffer.GetData())
+	}
+	if ok == 0 {
+		me.AppendBuffer.MarkUploaded()
+	}
+	return ok
 
 	//run parts combination
 	//tc := taskCmd{cmd: TASK_COMBINE_T2, waitChan: make(chan int)}
@@ -266,7 +298,7 @@ func (me *remoteCache) blockMaintainTask() {
 
 func (me *remoteCache) uploadBlock(data []byte, offset int64) int {
 	name := me.File.GetCacheBlockFileName(offset)
-	ok := me.io.PutBuffer(name, data)
+	ok := me.rio.PutBuffer(name, data)
 	if ok < 0 {
 		return ok
 	}
@@ -276,7 +308,7 @@ func (me *remoteCache) uploadBlock(data []byte, offset int64) int {
 
 func (me *remoteCache) appendFile(data []byte, offset int64) int {
 
-	log.Printf("AppendFile is called for file %s, offset=%d, data length=%d", me.FileName, offset, len(data))
+	dlog.Debugf("AppendFile is called for file %s, offset=%d, data length=%d", me.FileName, offset, len(data))
 
 	ok := me.FileImplBase.Append(data, offset)
 	if ok < 0 {
@@ -294,12 +326,12 @@ func (me *remoteCache) appendFile(data []byte, offset int64) int {
 		//}
 		ok := me.File.Append(me.appendBlocks[:1024], nil)
 		if ok < 0 {
-			log.Printf("Failed to commit cache blocks to file %s.\n", me.FileName)
+			dlog.Errorf("Failed to commit cache blocks to file %s.", me.FileName)
 		} else {
 			//free entries
 			for i := 0; i < 1024; i++ {
 				if me.appendBlocks[i] >= 0 {
-					me.io.Unlink(me.File.GetCacheBlockFileName(me.appendBlocks[i]))
+					me.rio.Unlink(me.File.GetCacheBlockFileName(me.appendBlocks[i]))
 				}
 				me.appendBlocks[i] = -1
 			}
@@ -1,8 +1,9 @@
 package s3impl
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"strconv"
 	//"encoding/json"
 
 	"github.com/allspace/csmgr/common"
@@ -19,7 +20,8 @@ type sliceMeta struct {
 
 type sliceFile struct {
 	fscommon.SliceFile
-	io *S3FileIO
+	io  *S3FileIO       //for multipart operations
+	fio fscommon.FileIO //may be wrapped, e.g. with retry and rate limit
 
 	FileName     string
 	metaFileName string
@@ -28,20 +30,38 @@ type sliceFile struct {
 }
 
 func NewSliceFile(io fscommon.FileIO) fscommon.ISliceFile {
-	return &sliceFile{io: io.(*S3FileIO)}
+	sf := &sliceFile{io: fscommon.BaseIO(io).(*S3FileIO), fio: io}
+	sf.SetIO(io)
+	return sf
 }
 
 //append a block to slice file
 func (me *sliceFile) Append(blocks []int64, data []byte) int {
+	return me.AppendCtx(context.Background(), blocks, data)
+}
+
+//requests of the upload are bound to the context, e.g. of the request which closes the file
+func (me *sliceFile) AppendCtx(ctx context.Context, blocks []int64, data []byte) int {
+	//deduplicated files are manifests, only their last chunks are rewritten
+	if dio, ok := me.fio.(*fscommon.DedupIO); ok {
+		return me.appendDedup(ctx, dio, blocks, data)
+	}
+	//compressed or encrypted objects can't be combined on server side
+	if zio, ok := me.fio.(*fscommon.CompressIO); ok && zio.Match(me.SliceFile.FileName) {
+		return me.appendCompressed(ctx, zio, blocks, data)
+	}
+	if cio := cryptIO(me.fio); cio != nil {
+		return me.appendEncrypted(ctx, cio, blocks, data)
+	}
 
 	appendLen := int64(len(blocks)*FILE_BLOCK_SIZE) + int64(len(data))
 
 	//special case #1: append to zero current slice and total size is less than a slice
 	//no need to use temp file in this case
 	if me.meta.CurSliceFileLen == 0 && appendLen < me.meta.SliceSize {
-		_, ok := me.mergeBlocksAndBuffer(me.meta.CurSliceFileName, "", 0, blocks, data)
+		_, ok := me.mergeBlocksAndBuffer(ctx, me.meta.CurSliceFileName, "", 0, blocks, data)
 		if ok < 0 {
-			log.Println("Failed to append data for ", me.FileName)
+			dlog.Errorf("Failed to append data for %s", me.FileName)
 			return ok
 		}
 		me.meta.CurSliceFileLen += appendLen
@@ -71,7 +91,7 @@ func (me *sliceFile) Append(blocks []int64, data []byte) int {
 	//They all need use temp file
 	tmpFile := fmt.Sprintf("$tmp$/%s.tmp2", me.FileName)
 
-	tmpLen, ok := me.mergeBlocksAndBuffer(tmpFile,
+	tmpLen, ok := me.mergeBlocksAndBuffer(ctx, tmpFile,
 		me.meta.CurSliceFileName,
 		me.meta.CurSliceFileLen,
 		blocks, data)
@@ -83,7 +103,7 @@ func (me *sliceFile) Append(blocks []int64, data []byte) int {
 	if tmpLen >= me.meta.SliceSize {
 		sliceFileName := fmt.Sprintf("$slice$/%s/files/%d.dat", me.meta.SliceCount)
 		byteRange := fmt.Sprintf("bytes=0-%d", me.meta.SliceSize)
-		ok = me.io.copyFileByRange(sliceFileName, tmpFile, byteRange)
+		ok = me.io.copyFileByRange(ctx, sliceFileName, tmpFile, byteRange)
 		if ok < 0 {
 			return ok
 		}
@@ -97,7 +117,7 @@ func (me *sliceFile) Append(blocks []int64, data []byte) int {
 
 	//update current slice
 	byteRange := fmt.Sprintf("bytes=%d-", me.meta.SliceSize)
-	ok = me.io.copyFileByRange(me.meta.CurSliceFileName, tmpFile, byteRange)
+	ok = me.io.copyFileByRange(ctx, me.meta.CurSliceFileName, tmpFile, byteRange)
 	if ok < 0 {
 		return ok
 	}
@@ -108,7 +128,7 @@ func (me *sliceFile) Append(blocks []int64, data []byte) int {
 	me.SaveMeta()
 
 	//remove temp file
-	me.io.Unlink(tmpFile)
+	me.fio.Unlink(tmpFile)
 	return 0
 
 	//save meta data file
@@ -123,22 +143,22 @@ func (me *sliceFile) catBuffer2SmallSlice(rt string, rtLen int64, data []byte) i
 	//it may also mean that remote file does not contains valid data
 	if rtLen == 0 {
 
-		return me.io.PutBuffer(rt, data)
+		return me.fio.PutBuffer(rt, data)
 
 	} else if rtLen < S3_MIN_BLOCK_SIZE { //remote file > 0, but < S3_MIN_BLOCK_SIZE
 
 		tmpBuff := make([]byte, int(rtLen)+len(data))
-		n := me.io.GetBuffer(rt, tmpBuff, 0)
+		n := me.fio.GetBuffer(rt, tmpBuff, 0)
 		if n != int(rtLen) {
-			log.Printf("Something got wrong: rtLen = %d, n = %d\n", rtLen, n)
+			dlog.Errorf("Something got wrong: rtLen = %d, n = %d", rtLen, n)
 			return fscommon.EIO
 		}
 		copy(tmpBuff[n:], data)
-		return me.io.PutBuffer(rt, tmpBuff)
+		return me.fio.PutBuffer(rt, tmpBuff)
 
 	}
 
-	return -1
+	return fscommon.EIO
 }
 
 func (me *sliceFile) combineRemote(tgt string, file1 string, file1Len int64, file2 string, file2Len int64) int {
@@ -146,17 +166,17 @@ func (me *sliceFile) combineRemote(tgt string, file1 string, file1Len int64, fil
 	//download file1
 	var n int = 0
 	if file1Len > 0 {
-		n = me.io.GetBuffer(file1, tmpBuff, 0)
+		n = me.fio.GetBuffer(file1, tmpBuff, 0)
 	} else {
 		n = 0 //for case original file does not exist, or its size is zero
 	}
 
 	//download file2
 	var m int = 0
-	m = me.io.GetBuffer(file2, tmpBuff[n:], 0)
+	m = me.fio.GetBuffer(file2, tmpBuff[n:], 0)
 
 	//upload the combined version
-	ok := me.io.PutBuffer(tgt, tmpBuff[0:n+m])
+	ok := me.fio.PutBuffer(tgt, tmpBuff[0:n+m])
 
 	tmpBuff = nil
 	return ok
@@ -166,13 +186,13 @@ func (me *sliceFile) combineRemote(tgt string, file1 string, file1Len int64, fil
 //1. slice file > 0 and < S3_MIN_BLOCK_SIZE, there is at least one block to append
 //2. slice file >= S3_MIN_BLOCK_SIZE
 //this method does not affect meta data
-func (me *sliceFile) mergeBlocksAndBuffer(tgt string, rt string, rtLen int64, blocks []int64, data []byte) (int64, int) {
-	log.Printf("mergeBlocksAndBuffer is called: rtLen=%d, blocks=%d, data len=%d\n", rtLen, len(blocks), len(data))
+func (me *sliceFile) mergeBlocksAndBuffer(ctx context.Context, tgt string, rt string, rtLen int64, blocks []int64, data []byte) (int64, int) {
+	dlog.Debugf("mergeBlocksAndBuffer is called: rtLen=%d, blocks=%d, data len=%d", rtLen, len(blocks), len(data))
 
 	tmpFile := ""
 
 	if rtLen == 0 && len(blocks) == 0 {
-		ok := me.io.PutBuffer(tgt, data)
+		ok := me.fio.PutBuffer(tgt, data)
 		if ok < 0 {
 			return 0, ok
 		} else {
@@ -195,7 +215,7 @@ func (me *sliceFile) mergeBlocksAndBuffer(tgt string, rt string, rtLen int64, bl
 
 	plist := make([]*s3.CompletedPart, 0)
 
-	uploadId, ok := me.io.startUpload(tgt)
+	uploadId, ok := me.io.startUpload(ctx, tgt)
 	if ok < 0 {
 		return 0, ok
 	}
@@ -203,7 +223,7 @@ func (me *sliceFile) mergeBlocksAndBuffer(tgt string, rt string, rtLen int64, bl
 	//copy remote file if there is
 	var pnum int64 = 1
 	if rtLen > 0 {
-		cps, pnum := me.io.copyBigPart(tgt, rt, rtLen, uploadId, pnum)
+		cps, pnum := me.io.copyBigPart(ctx, tgt, rt, rtLen, uploadId, pnum)
 		if pnum < 0 {
 			return 0, int(pnum)
 		}
@@ -222,7 +242,7 @@ func (me *sliceFile) mergeBlocksAndBuffer(tgt string, rt string, rtLen int64, bl
 				continue
 			}
 			file := me.GetCacheBlockFileName(blkId)
-			cp, ok = me.io.copyPart(tgt, file, "", uploadId, pnum)
+			cp, ok = me.io.copyPart(ctx, tgt, file, "", uploadId, pnum)
 			if ok < 0 {
 				return 0, ok
 			}
@@ -234,7 +254,7 @@ func (me *sliceFile) mergeBlocksAndBuffer(tgt string, rt string, rtLen int64, bl
 
 	//upload local buffer
 	if len(data) > 0 {
-		cp, ok = me.io.uploadPart(tgt, data, uploadId, pnum)
+		cp, ok = me.io.uploadPart(ctx, tgt, data, uploadId, pnum)
 		if ok < 0 {
 			me.io.cleanMultipartUpload(tgt, uploadId)
 			return 0, ok
@@ -244,15 +264,375 @@ func (me *sliceFile) mergeBlocksAndBuffer(tgt string, rt string, rtLen int64, bl
 	}
 
 	//complete multipart upload
-	ok = me.io.completeUpload(tgt, uploadId, plist)
+	ok = me.io.completeUpload(ctx, tgt, uploadId, plist)
 	if ok < 0 {
 		me.io.cleanMultipartUpload(tgt, uploadId)
 		return 0, ok
 	}
 
 	if len(tmpFile) > 0 {
-		me.io.Unlink(tmpFile)
+		me.fio.Unlink(tmpFile)
 	}
 
 	return totalLen, 0
 }
+
+func newFileID() ([]byte, int) {
+	id, err := fscommon.NewFileID()
+	if err != nil {
+		dlog.Errorf("Failed to create file id: %s", err)
+		return nil, fscommon.EIO
+	}
+	return id, 0
+}
+
+//the encryption layer of io, nil if objects are not encrypted
+func cryptIO(io fscommon.FileIO) *fscommon.CryptIO {
+	for {
+		if cio, ok := io.(*fscommon.CryptIO); ok {
+			return cio
+		}
+		w, ok := io.(interface {
+			Base() fscommon.FileIO
+		})
+		if !ok {
+			return nil
+		}
+		io = w.Base()
+	}
+}
+
+//compress the blocks and buffer appended in new segments, segments of the object are kept, see CompressWriter
+//a file which is not compressed yet is compressed entirely
+//compressed files are not sliced, the object is assembled by a multipart upload
+func (me *sliceFile) appendCompressed(ctx context.Context, zio *fscommon.CompressIO, blocks []int64, data []byte) int {
+	name := me.SliceFile.FileName
+	curLen := me.SliceFile.GetLength()
+
+	var newLen int64 = curLen + int64(len(data))
+	for _, blkId := range blocks {
+		if blkId >= 0 && blkId >= curLen {
+			newLen += FILE_BLOCK_SIZE
+		}
+	}
+	if newLen == curLen {
+		return 0
+	}
+
+	w, keep, ok := zio.AppendWriter(ctx, name)
+	if ok < 0 {
+		return ok
+	}
+	ctx = fscommon.WithObjectMeta(ctx, name, fscommon.ObjectMeta{fscommon.META_SIZE: strconv.FormatInt(newLen, 10)})
+	a, ok := me.newAppender(ctx, zio.Base(), name, keep, keep)
+	if ok < 0 {
+		return ok
+	}
+	write := func(src []byte) int {
+		out, err := w.Write(src)
+		if err != nil {
+			dlog.Errorf("Failed to compress %s: %s", name, err)
+			return fscommon.EIO
+		}
+		return a.write(out)
+	}
+
+	block := make([]byte, FILE_BLOCK_SIZE)
+	for off := int64(0); keep == 0 && off < curLen && ok == 0; {
+		n := curLen - off
+		if n > FILE_BLOCK_SIZE {
+			n = FILE_BLOCK_SIZE
+		}
+		if rc := fscommon.IOWithContext(zio).GetBufferCtx(ctx, name, block[:n], off); rc != int(n) {
+			dlog.Errorf("Failed to read %s at %d: n = %d", name, off, rc)
+			ok = fscommon.EIO
+			break
+		}
+		ok = write(block[:n])
+		off += n
+	}
+	for _, blkId := range blocks {
+		if ok < 0 {
+			break
+		}
+		if blkId < 0 || blkId < curLen { //consumed or outdated blocks
+			continue
+		}
+		file := me.GetCacheBlockFileName(blkId)
+		if n := fscommon.IOWithContext(me.fio).GetBufferCtx(ctx, file, block, 0); n != len(block) {
+			dlog.Errorf("Failed to read cache block %s: n = %d", file, n)
+			ok = fscommon.EIO
+			break
+		}
+		ok = write(block)
+	}
+	if ok == 0 {
+		ok = write(data)
+	}
+	if ok == 0 {
+		last, err := w.Close()
+		if err != nil {
+			dlog.Errorf("Failed to compress %s: %s", name, err)
+			ok = fscommon.EIO
+		} else {
+			ok = a.write(last)
+		}
+	}
+	if ok < 0 {
+		a.abort()
+		return ok
+	}
+	if ok = a.finish(); ok < 0 {
+		return ok
+	}
+
+	zio.Forget(name)
+	if cio := cryptIO(me.fio); cio != nil {
+		cio.Forget(name)
+	}
+	me.SliceFile.AppendLength(newLen - curLen)
+	return 0
+}
+
+//append the blocks and buffer to the manifest of a deduplicated file, blocks are read in batches
+func (me *sliceFile) appendDedup(ctx context.Context, dio *fscommon.DedupIO, blocks []int64, data []byte) int {
+	const batchSize = 64 * 1024 * 1024
+	name := me.SliceFile.FileName
+	curLen := me.SliceFile.GetLength()
+
+	var newLen int64 = 0
+	flush := func(buf []byte) int {
+		if len(buf) == 0 {
+			return 0
+		}
+		if n := dio.AppendCtx(ctx, name, buf); n < 0 {
+			dlog.Errorf("Failed to append deduplicated data for %s", name)
+			return n
+		}
+		newLen += int64(len(buf))
+		return 0
+	}
+
+	ok := 0
+	buf := make([]byte, 0, batchSize)
+	for _, blkId := range blocks {
+		if blkId < 0 || blkId < curLen { //consumed or outdated blocks
+			continue
+		}
+		if len(buf)+FILE_BLOCK_SIZE > cap(buf) {
+			if ok = flush(buf); ok < 0 {
+				break
+			}
+			buf = buf[:0]
+		}
+		n := fscommon.IOWithContext(me.fio).GetBufferCtx(ctx, me.GetCacheBlockFileName(blkId), buf[len(buf):len(buf)+FILE_BLOCK_SIZE], 0)
+		if n < 0 {
+			ok = n
+			break
+		}
+		buf = buf[:len(buf)+n]
+	}
+	if ok == 0 {
+		ok = flush(append(buf, data...))
+	}
+
+	//batches appended before a failure are kept
+	me.SliceFile.AppendLength(newLen)
+	return ok
+}
+
+//assemble the file of encrypted segments by a multipart upload, see CryptIO
+//encrypted files are not sliced, they are always kept in one object
+func (me *sliceFile) appendEncrypted(ctx context.Context, cio *fscommon.CryptIO, blocks []int64, data []byte) int {
+	name := me.SliceFile.FileName
+	curLen := me.SliceFile.GetLength()
+
+	var newLen int64 = curLen + int64(len(data))
+	for _, blkId := range blocks {
+		if blkId >= 0 && blkId >= curLen {
+			newLen += FILE_BLOCK_SIZE
+		}
+	}
+	if newLen == curLen {
+		return 0
+	}
+
+	size := strconv.FormatInt(newLen, 10)
+	ctx = fscommon.WithObjectMeta(ctx, name, fscommon.ObjectMeta{fscommon.META_SIZE: size, fscommon.META_CRYPT_SIZE: size})
+	a, ok := me.newAppender(ctx, cio, name, curLen, curLen)
+	if ok < 0 {
+		return ok
+	}
+	for _, blkId := range blocks {
+		if blkId < 0 || blkId < curLen { //consumed or outdated blocks
+			continue
+		}
+		if ok = a.writeBlock(me.GetCacheBlockFileName(blkId)); ok < 0 {
+			break
+		}
+	}
+	if ok == 0 {
+		ok = a.write(data)
+	}
+	if ok < 0 {
+		a.abort()
+		return ok
+	}
+	if ok = a.finish(); ok < 0 {
+		return ok
+	}
+
+	cio.Forget(name)
+	me.SliceFile.AppendLength(newLen - curLen)
+	return 0
+}
+
+//multipart upload of an object which is appended, the object up to keep is copied on server side
+//parts are uploaded in blocks, they are encrypted as segments of the object if io is encrypted, see CryptIO
+type appender struct {
+	sf       *sliceFile
+	ctx      context.Context
+	cio      *fscommon.CryptIO //nil if the object is not encrypted
+	id       []byte            //of the encrypted file
+	seg      int64             //index of the segment in buf
+	name     string
+	uploadId string
+	plist    []*s3.CompletedPart
+	buf      []byte //data of the part being built, in plain text
+}
+
+//the object is read through io from keep to size and uploaded again, size is the size of its data in io
+//an encrypted object is kept in whole segments but the last one, which ends the object,
+//an object in plain text is encrypted entirely, and an object less than a part is not kept
+func (me *sliceFile) newAppender(ctx context.Context, io fscommon.FileIO, name string, keep int64, size int64) (*appender, int) {
+	a := &appender{sf: me, ctx: ctx, cio: cryptIO(io), name: name, buf: make([]byte, 0, FILE_BLOCK_SIZE)}
+	unit, stored := int64(1), keep
+	var ok int
+	if a.cio != nil {
+		if keep > 0 {
+			if a.id, ok = a.cio.FileID(ctx, name); ok < 0 {
+				return nil, ok
+			}
+		}
+		if a.id == nil {
+			keep = 0
+			if a.id, ok = newFileID(); ok < 0 {
+				return nil, ok
+			}
+		}
+		if keep > 0 {
+			keep = (keep - 1) / fscommon.CRYPT_SEGMENT_SIZE * fscommon.CRYPT_SEGMENT_SIZE
+		}
+		unit = fscommon.CryptCipherSize(fscommon.CRYPT_SEGMENT_SIZE)
+		stored = fscommon.CryptCipherSize(keep)
+		a.seg = keep / fscommon.CRYPT_SEGMENT_SIZE
+	} else if keep < S3_MIN_BLOCK_SIZE {
+		keep, stored = 0, 0
+	}
+
+	if a.uploadId, ok = me.io.startUpload(ctx, name); ok < 0 {
+		return nil, ok
+	}
+
+	//copied parts are split evenly in whole units, a part is at most 5GB
+	units := stored / unit
+	maxUnits := S3_MAX_BLOCK_SIZE / unit
+	parts := (units + maxUnits - 1) / maxUnits
+	for i := int64(0); i < parts && ok == 0; i++ {
+		start, end := units*i/parts*unit, units*(i+1)/parts*unit
+		ok = a.addPart(me.io.copyPart(ctx, name, name, fmt.Sprintf("bytes=%d-%d", start, end-1), a.uploadId, a.pnum()))
+	}
+
+	block := make([]byte, FILE_BLOCK_SIZE)
+	for off := keep; off < size && ok == 0; {
+		n := size - off
+		if n > FILE_BLOCK_SIZE {
+			n = FILE_BLOCK_SIZE
+		}
+		if rc := fscommon.IOWithContext(io).GetBufferCtx(ctx, name, block[:n], off); rc != int(n) {
+			dlog.Errorf("Failed to read %s at %d: n = %d", name, off, rc)
+			ok = fscommon.EIO
+			break
+		}
+		ok = a.write(block[:n])
+		off += n
+	}
+	if ok < 0 {
+		a.abort()
+		return nil, ok
+	}
+	return a, 0
+}
+
+func (me *appender) pnum() int64 {
+	return int64(len(me.plist)) + 1
+}
+
+func (me *appender) addPart(cp *s3.CompletedPart, ok int) int {
+	if ok < 0 {
+		return ok
+	}
+	me.plist = append(me.plist, cp)
+	return 0
+}
+
+//a part is uploaded when a block is full and there is more data, the last part is uploaded by finish
+func (me *appender) write(data []byte) int {
+	for len(data) > 0 {
+		if len(me.buf) == cap(me.buf) {
+			if ok := me.flush(false); ok < 0 {
+				return ok
+			}
+		}
+		n := copy(me.buf[len(me.buf):cap(me.buf)], data)
+		me.buf = me.buf[:len(me.buf)+n]
+		data = data[n:]
+	}
+	return 0
+}
+
+//cache blocks are encrypted as objects of their own, they are read and encrypted again as segments of the file
+func (me *appender) writeBlock(file string) int {
+	block := make([]byte, FILE_BLOCK_SIZE)
+	if n := fscommon.IOWithContext(me.sf.fio).GetBufferCtx(me.ctx, file, block, 0); n != len(block) {
+		dlog.Errorf("Failed to read cache block %s: n = %d", file, n)
+		return fscommon.EIO
+	}
+	return me.write(block)
+}
+
+//last tells whether the part ends the object
+func (me *appender) flush(last bool) int {
+	part := me.buf
+	if me.cio != nil {
+		var err error
+		if part, err = me.cio.Key().Encrypt(nil, me.id, me.seg, me.buf, last); err != nil {
+			dlog.Errorf("Failed to encrypt %s: %s", me.name, err)
+			return fscommon.EIO
+		}
+		me.seg++
+	}
+	ok := me.addPart(me.sf.io.uploadPart(me.ctx, me.name, part, me.uploadId, me.pnum()))
+	me.buf = me.buf[:0]
+	return ok
+}
+
+//upload the last part and complete the upload, it's aborted on failures
+func (me *appender) finish() int {
+	ok := 0
+	if len(me.buf) > 0 {
+		ok = me.flush(true)
+	}
+	if ok == 0 {
+		ok = me.sf.io.completeUpload(me.ctx, me.name, me.uploadId, me.plist)
+	}
+	if ok < 0 {
+		me.abort()
+	}
+	return ok
+}
+
+func (me *appender) abort() {
+	dlog.Errorf("Failed to append data for %s", me.name)
+	me.sf.io.cleanMultipartUpload(me.name, me.uploadId)
+}
@@ -3,7 +3,6 @@
 package fsvc
 
 import (
-	"log"
 	"time"
 
 	"context"
@@ -13,18 +12,21 @@ import (
 	"github.com/keybase/kbfs/dokan/winacl"
 
 	"github.com/allspace/csmgr/common"
+	"github.com/allspace/csmgr/util"
 )
 
+var dokanLog = util.GetLogger("dokan")
+
 func FileSystemMainLoop(fs fscommon.FileSystemImpl, mnt string) {
 	csfs := &CSFileSystem{fsbk: fs}
 
 	mp, err := dokan.Mount(&dokan.Config{FileSystem: csfs, Path: "Q:"})
 	if err != nil {
-		log.Fatal("Mount failed:", err)
+		dokanLog.Fatalf("Mount failed: %s", err)
 	}
 	err = mp.BlockTillDone()
 	if err != nil {
-		log.Println("Filesystem exit:", err)
+		dokanLog.Infof("Filesystem exit: %s", err)
 	}
 }
 
@@ -42,12 +44,12 @@ func (me *CSFileSystem) WithContext(ctx context.Context) (context.Context, conte
 }
 
 func (me *CSFileSystem) CreateFile(ctx context.Context, fi *dokan.FileInfo, data *dokan.CreateData) (file dokan.File, isDirectory bool, err error) {
-	log.Println("CreateFile on path: ", fi.Path())
+	dokanLog.Debugf("CreateFile on path: %s", fi.Path())
 
 	path := strings.Replace(fi.Path(), "\\", "/", -1)
 	isDir := ((data.CreateOptions & dokan.FileDirectoryFile) != 0)
 	if len(path) == 0 {
-		log.Printf("%s, %s: Is Dir = %d", fi.Path(), path, isDir)
+		dokanLog.Debugf("%s, %s: Is Dir = %d", fi.Path(), path, isDir)
 		return nil, isDir, dokan.ErrObjectPathNotFound
 	}
 
@@ -59,7 +61,7 @@ func (me *CSFileSystem) CreateFile(ctx context.Context, fi *dokan.FileInfo, data
 				return nil, isDir, dokan.ErrObjectPathNotFound
 			}
 		} else {
-			log.Printf("CreateFile returns ErrAccessDenied")
+			dokanLog.Debugf("CreateFile returns ErrAccessDenied")
 			return nil, isDir, dokan.ErrAccessDenied
 		}
 	}
@@ -69,11 +71,11 @@ func (me *CSFileSystem) CreateFile(ctx context.Context, fi *dokan.FileInfo, data
 
 	//for directory operations
 	if isDir == true {
-		log.Printf("CreateFile on direcotry: %s", path)
+		dokanLog.Debugf("CreateFile on direcotry: %s", path)
 		if data.CreateDisposition == dokan.FileCreate {
 			ok := me.fsbk.Mkdir(path, 0)
 			if ok != 0 {
-				log.Printf("CreateFile returns ErrAccessDenied")
+				dokanLog.Debugf("CreateFile returns ErrAccessDenied")
 				return nil, true, dokan.ErrAccessDenied
 			} else {
 				return &CSFile{fsbk: me.fsbk}, true, nil
@@ -81,7 +83,7 @@ func (me *CSFileSystem) CreateFile(ctx context.Context, fi *dokan.FileInfo, data
 		}
 		return &CSFile{fsbk: me.fsbk}, isDir, nil
 	} else { //for file operations
-		log.Printf("CreateFile on file: %s", path)
+		dokanLog.Debugf("CreateFile on file: %s", path)
 		var flags uint32
 		if data.CreateDisposition == dokan.FileCreate {
 			flags |= fscommon.O_CREAT
@@ -90,7 +92,7 @@ func (me *CSFileSystem) CreateFile(ctx context.Context, fi *dokan.FileInfo, data
 		if ok == 0 {
 			return &CSFile{fsbk: me.fsbk, fibk: fh}, false, nil
 		} else {
-			log.Printf("CreateFile returns ErrAccessDenied")
+			dokanLog.Debugf("CreateFile returns ErrAccessDenied")
 			return nil, false, dokan.ErrAccessDenied
 		}
 	}
@@ -119,13 +121,13 @@ func (me *CSFileSystem) MoveFile(ctx context.Context, source *dokan.FileInfo, ta
 }
 
 func (me *CSFileSystem) ErrorPrint(err error) {
-	log.Println(err)
+	dokanLog.Errorf("%s", err)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 
 func (me *CSFile) FindFiles(ctx context.Context, fi *dokan.FileInfo, pattern string, fillStatCallback func(*dokan.NamedStat) error) error {
-	log.Println("FindFiles on path： ", fi.Path())
+	dokanLog.Debugf("FindFiles on path: %s", fi.Path())
 
 	path := strings.Replace(fi.Path(), "\\", "/", -1)
 
@@ -153,7 +155,7 @@ func (me *CSFile) FindFiles(ctx context.Context, fi *dokan.FileInfo, pattern str
 }
 
 func (me *CSFile) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (*dokan.Stat, error) {
-	log.Println("GetFileInformation on path： ", fi.Path())
+	dokanLog.Debugf("GetFileInformation on path: %s", fi.Path())
 
 	path := strings.Replace(fi.Path(), "\\", "/", -1)
 
@@ -184,7 +186,12 @@ func (me *CSFile) Cleanup(ctx context.Context, fi *dokan.FileInfo) {
 	path := strings.Replace(fi.Path(), "\\", "/", -1)
 
 	if fi.IsDeleteOnClose() {
-		me.fsbk.Unlink(path)
+		//directory has no file object
+		if me.fibk == nil {
+			me.fsbk.Rmdir(path)
+		} else {
+			me.fsbk.Unlink(path)
+		}
 	}
 }
 
@@ -198,29 +205,41 @@ func (me *CSFile) CanDeleteFile(ctx context.Context, fi *dokan.FileInfo) error {
 	return nil
 }
 func (me *CSFile) CanDeleteDirectory(ctx context.Context, fi *dokan.FileInfo) error {
-	log.Println("CanDeleteDirectory is called.")
-	return dokan.ErrAccessDenied
+	dokanLog.Debugf("CanDeleteDirectory is called.")
+	path := strings.Replace(fi.Path(), "\\", "/", -1)
+
+	dis, ok := me.fsbk.ReadDir(path)
+	if ok < 0 {
+		return dokan.ErrAccessDenied
+	}
+	//skipped entries are left nil in the list
+	for _, di := range dis {
+		if di != nil {
+			return dokan.ErrDirectoryNotEmpty
+		}
+	}
+	return nil
 }
 func (me *CSFile) SetEndOfFile(ctx context.Context, fi *dokan.FileInfo, length int64) error {
-	log.Println("emptyFile.SetEndOfFile")
+	dokanLog.Debugf("emptyFile.SetEndOfFile")
 	if me.fibk == nil {
-		log.Printf("SetEndOfFile returns ErrAccessDenied")
+		dokanLog.Debugf("SetEndOfFile returns ErrAccessDenied")
 		return dokan.ErrAccessDenied
 	}
 	ok := me.fibk.Truncate(uint64(length))
 	if ok != 0 {
-		log.Printf("SetEndOfFile returns ErrAccessDenied")
+		dokanLog.Debugf("SetEndOfFile returns ErrAccessDenied")
 		return dokan.ErrAccessDenied
 	}
 	return nil
 }
 func (me *CSFile) SetAllocationSize(ctx context.Context, fi *dokan.FileInfo, length int64) error {
-	log.Println("emptyFile.SetAllocationSize")
+	dokanLog.Debugf("emptyFile.SetAllocationSize")
 
 	return nil
 }
 func (me *CSFile) MoveFile(ctx context.Context, source *dokan.FileInfo, targetPath string, replaceExisting bool) error {
-	log.Println("emptyFS.MoveFile")
+	dokanLog.Debugf("emptyFS.MoveFile")
 	return nil
 }
 func (me *CSFile) ReadFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (int, error) {
@@ -228,7 +247,7 @@ func (me *CSFile) ReadFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, o
 	if n >= 0 {
 		return n, nil
 	} else {
-		log.Printf("ReadFile returns ErrAccessDenied")
+		dokanLog.Debugf("ReadFile returns ErrAccessDenied")
 		return 0, dokan.ErrAccessDenied
 	}
 }
@@ -236,33 +255,33 @@ func (me *CSFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte,
 	return len(bs), nil
 }
 func (me *CSFile) FlushFileBuffers(ctx context.Context, fi *dokan.FileInfo) error {
-	log.Println("emptyFS.FlushFileBuffers")
+	dokanLog.Debugf("emptyFS.FlushFileBuffers")
 	return nil
 }
 
 func (me *CSFile) SetFileTime(context.Context, *dokan.FileInfo, time.Time, time.Time, time.Time) error {
-	log.Println("emptyFile.SetFileTime")
+	dokanLog.Debugf("emptyFile.SetFileTime")
 	return nil
 }
 func (me *CSFile) SetFileAttributes(ctx context.Context, fi *dokan.FileInfo, fileAttributes dokan.FileAttribute) error {
-	log.Println("emptyFile.SetFileAttributes")
+	dokanLog.Debugf("emptyFile.SetFileAttributes")
 	return nil
 }
 
 func (me *CSFile) LockFile(ctx context.Context, fi *dokan.FileInfo, offset int64, length int64) error {
-	log.Println("emptyFile.LockFile")
+	dokanLog.Debugf("emptyFile.LockFile")
 	return nil
 }
 func (me *CSFile) UnlockFile(ctx context.Context, fi *dokan.FileInfo, offset int64, length int64) error {
-	log.Println("emptyFile.UnlockFile")
+	dokanLog.Debugf("emptyFile.UnlockFile")
 	return nil
 }
 
 func (me *CSFile) GetFileSecurity(ctx context.Context, fi *dokan.FileInfo, si winacl.SecurityInformation, sd *winacl.SecurityDescriptor) error {
-	log.Println("emptyFS.GetFileSecurity")
+	dokanLog.Debugf("emptyFS.GetFileSecurity")
 	return nil
 }
 func (me *CSFile) SetFileSecurity(ctx context.Context, fi *dokan.FileInfo, si winacl.SecurityInformation, sd *winacl.SecurityDescriptor) error {
-	log.Println("emptyFS.SetFileSecurity")
+	dokanLog.Debugf("emptyFS.SetFileSecurity")
 	return nil
 }
@@ -1,31 +1,36 @@
 package fsvc
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
 	"time"
 	//"flag"
-	"log"
 
 	"github.com/allspace/csmgr/common"
+	"github.com/allspace/csmgr/util"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 )
 
+var fuseLog = util.GetLogger("fuse")
+
 func FileSystemMainLoop(fs fscommon.FileSystemImpl, mnt string) {
+	//go-fuse traces every operation in debug mode
+	debug := fuseLog.Enabled(util.LOG_DEBUG)
 	nfs := pathfs.NewPathNodeFs(
 		&HelloFs{FileSystem: pathfs.NewDefaultFileSystem(), FileSystemImpl: fs},
-		&pathfs.PathNodeFsOptions{Debug: true})
+		&pathfs.PathNodeFsOptions{Debug: debug})
 
 	server, _, err := nodefs.MountRoot(
 		mnt,
 		nfs.Root(),
-		&nodefs.Options{Debug: true})
+		&nodefs.Options{Debug: debug})
 
 	if err != nil {
-		log.Fatalf("Mount fail: %v\n", err)
+		fuseLog.Fatalf("Mount fail: %v", err)
 	}
 
 	//register signal handler
@@ -40,7 +45,7 @@ func handleSignal(ms *fuse.Server) {
 
 	// Block until a signal is received.
 	s := <-c
-	log.Println("Got signal:", s)
+	fuseLog.Infof("Got signal: %v", s)
 
 	//umount the mount point
 	ms.Unmount()
@@ -51,9 +56,38 @@ type HelloFs struct {
 	FileSystemImpl fscommon.FileSystemImpl
 }
 
+//go-fuse v1 doesn't tell if a request is interrupted, so it is bounded by RequestTimeout only
+//a server span is started for the operation, and ended with the result code by the returned end function
+func fuseRequestCtx(client string, op string, path string) (context.Context, func(ok int)) {
+	ctx := fscommon.WithClient(util.WithRequestId(context.Background(), util.NewRequestId()), client)
+	ctx, span := fscommon.StartSpanKind(ctx, fscommon.SPAN_KIND_SERVER, "fuse."+op, "path", path)
+	ctx, cancel := requestCtx(ctx)
+	return ctx, func(ok int) {
+		cancel()
+		span.End(ok)
+	}
+}
+
+//client of a request for audit and per client rate limits
+func fuseClient(context *fuse.Context) string {
+	if context == nil {
+		return ""
+	}
+	return fmt.Sprintf("uid:%d", context.Uid)
+}
+
 type HelloFile struct {
 	nodefs.File
 	fileObject *fscommon.FileObject
+	client     string //client which opened the file
+}
+
+//error codes are negative linux errno values, which can be passed to fuse directly
+func fuseStatus(ok int) fuse.Status {
+	if ok >= 0 {
+		return fuse.OK
+	}
+	return fuse.Status(-ok)
 }
 
 func (me *HelloFs) getMode(mode int) uint32 {
@@ -64,6 +98,33 @@ func (me *HelloFs) getMode(mode int) uint32 {
 	}
 }
 
+//convert file info to fuse attributes, POSIX attributes come from object meta data
+func (me *HelloFs) getAttr(fi os.FileInfo) *fuse.Attr {
+	attr := &fuse.Attr{
+		Size:  uint64(fi.Size()),
+		Mtime: uint64(fi.ModTime().Unix()),
+		Ctime: uint64(fi.ModTime().Unix()),
+		Atime: uint64(fi.ModTime().Unix()),
+	}
+
+	di, ok := fi.(*fscommon.DirItem)
+	if !ok {
+		if fi.IsDir() {
+			attr.Mode = me.getMode(fscommon.S_IFDIR)
+		} else {
+			attr.Mode = me.getMode(fscommon.S_IFREG)
+		}
+		return attr
+	}
+
+	attr.Mode = di.UnixMode()
+	attr.Owner = fuse.Owner{Uid: di.DiUid, Gid: di.DiGid}
+	if !di.DiAtime.IsZero() {
+		attr.Atime = uint64(di.DiAtime.Unix())
+	}
+	return attr
+}
+
 func (me *HelloFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 
 	//root of mount point
@@ -77,35 +138,38 @@ func (me *HelloFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse
 	}
 
 	//get attributes from cache or remote
-	di, ok := me.FileSystemImpl.GetAttr(name)
+	ctx, end := fuseRequestCtx(fuseClient(context), "GetAttr", name)
+	di, ok := fscommon.FsWithContext(me.FileSystemImpl).GetAttrCtx(ctx, name)
+	end(ok)
 	if ok == 0 {
-		return &fuse.Attr{
-			Mode:  me.getMode(di.Type),
-			Size:  di.Size,
-			Mtime: uint64(di.Mtime.Unix()),
-		}, fuse.OK
+		return me.getAttr(di), fuse.OK
 	} else {
-		return nil, fuse.ENOENT
+		return nil, fuseStatus(ok)
 	}
 }
 
 func (me *HelloFs) OpenDir(name string, context *fuse.Context) (c []fuse.DirEntry, code fuse.Status) {
 	//
-	fmt.Println("***OpenDir: ", name)
+	fuseLog.Debugf("OpenDir: %s", name)
 
-	dirs, n := me.FileSystemImpl.ReadDir(name)
+	ctx, end := fuseRequestCtx(fuseClient(context), "OpenDir", name)
+	dirs, n := fscommon.FsWithContext(me.FileSystemImpl).ReadDirCtx(ctx, name)
+	end(n)
 	if n < 0 {
-		return nil, fuse.ENOENT
+		return nil, fuseStatus(n)
 	}
 
-	c = make([]fuse.DirEntry, n)
+	c = make([]fuse.DirEntry, 0, n)
 	for i := range dirs {
-		//if empty(dirs[i].Name) {
-		//	continue
-		//}
-		c[i].Name = dirs[i].Name
-		c[i].Mode = me.getMode(dirs[i].Type)
-		fmt.Println(dirs[i].Name)
+		//skipped entries are left nil
+		if dirs[i] == nil {
+			continue
+		}
+		c = append(c, fuse.DirEntry{
+			Name: dirs[i].Name(),
+			Mode: me.getAttr(dirs[i]).Mode,
+		})
+		fuseLog.Debugf("%s", dirs[i].Name())
 	}
 
 	return c, fuse.OK
@@ -113,18 +177,36 @@ func (me *HelloFs) OpenDir(name string, context *fuse.Context) (c []fuse.DirEntr
 
 func (me *HelloFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
 
-	fh, ok := me.FileSystemImpl.Open(name, flags)
+	ctx, end := fuseRequestCtx(fuseClient(context), "Open", name)
+	fh, ok := fscommon.FsWithContext(me.FileSystemImpl).OpenCtx(ctx, name, flags)
+	fscommon.Audit(ctx, "open", name, 0, ok)
+	end(ok)
 	if ok == 0 {
-		log.Println("Open file ", name, " successfully.")
-		return &HelloFile{fileObject: fh}, fuse.OK
+		fuseLog.Debugf("Open file %s successfully.", name)
+		return &HelloFile{fileObject: fh, client: fuseClient(context)}, fuse.OK
 	} else {
-		log.Println("Failed to open ", name)
-		return nil, fuse.ENOENT
+		fuseLog.Debugf("Failed to open %s: %d", name, ok)
+		return nil, fuseStatus(ok)
 	}
 }
 
 func (me *HelloFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	return me.Open(name, flags, context)
+	attr := fscommon.NewAttr(fscommon.GetLastPathComp(name), fscommon.S_IFREG)
+	attr.DiMode = os.FileMode(mode).Perm()
+	attr.DiUid = context.Uid
+	attr.DiGid = context.Gid
+
+	ctx, end := fuseRequestCtx(fuseClient(context), "Create", name)
+	fh, ok := fscommon.FsWithContext(me.FileSystemImpl).CreateCtx(ctx, name, flags, attr)
+	fscommon.Audit(ctx, "create", name, 0, ok)
+	end(ok)
+	if ok == 0 {
+		fuseLog.Debugf("Create file %s successfully.", name)
+		return &HelloFile{fileObject: fh, client: fuseClient(context)}, fuse.OK
+	} else {
+		fuseLog.Debugf("Failed to create %s: %d", name, ok)
+		return nil, fuseStatus(ok)
+	}
 }
 
 func (me *HelloFs) StatFs(name string) *fuse.StatfsOut {
@@ -136,31 +218,82 @@ func (me *HelloFs) StatFs(name string) *fuse.StatfsOut {
 			Blocks: fi.Blocks,
 			Bfree:  fi.Bfree,
 			Bavail: fi.Bavail,
+			Files:  fi.Files,
+			Ffree:  fi.Ffree,
 			Bsize:  fi.Bsize,
 		}
 	}
 }
 
 func (me *HelloFs) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	ok := me.FileSystemImpl.Unlink(name)
-	if ok != 0 {
-		return fuse.ENOENT
-	} else {
-		return fuse.OK
-	}
+	ctx, end := fuseRequestCtx(fuseClient(context), "Unlink", name)
+	ok := fscommon.FsWithContext(me.FileSystemImpl).UnlinkCtx(ctx, name)
+	fscommon.Audit(ctx, "delete", name, 0, ok)
+	end(ok)
+	return fuseStatus(ok)
 }
 
 func (me *HelloFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
-	ok := me.FileSystemImpl.Mkdir(name, mode)
-	if ok != 0 {
-		return fuse.ENOENT
-	} else {
-		return fuse.OK
-	}
+	ctx, end := fuseRequestCtx(fuseClient(context), "Mkdir", name)
+	ok := fscommon.FsWithContext(me.FileSystemImpl).MkdirCtx(ctx, name, mode)
+	fscommon.Audit(ctx, "mkdir", name, 0, ok)
+	end(ok)
+	return fuseStatus(ok)
+}
+
+func (me *HelloFs) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	ctx, end := fuseRequestCtx(fuseClient(context), "Rmdir", name)
+	ok := fscommon.FsWithContext(me.FileSystemImpl).RmdirCtx(ctx, name)
+	fscommon.Audit(ctx, "rmdir", name, 0, ok)
+	end(ok)
+	return fuseStatus(ok)
+}
+
+func (me *HelloFs) Symlink(value string, linkName string, context *fuse.Context) (code fuse.Status) {
+	return fuseStatus(me.FileSystemImpl.Symlink(value, linkName))
+}
+
+func (me *HelloFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	target, ok := me.FileSystemImpl.Readlink(name)
+	return target, fuseStatus(ok)
 }
 
 func (me *HelloFs) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	return fuse.OK
+	return fuseStatus(me.FileSystemImpl.Chmod(name, mode))
+}
+
+func (me *HelloFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	return fuseStatus(me.FileSystemImpl.Chown(name, uid, gid))
+}
+
+func (me *HelloFs) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	return fuseStatus(me.FileSystemImpl.Utimens(name, Atime, Mtime))
+}
+
+//convert error code of extended attribute operations
+func (me *HelloFs) xattrStatus(ok int) fuse.Status {
+	if ok == fscommon.ENODATA {
+		return fuse.ENOATTR
+	}
+	return fuseStatus(ok)
+}
+
+func (me *HelloFs) GetXAttr(name string, attribute string, context *fuse.Context) (data []byte, code fuse.Status) {
+	data, ok := me.FileSystemImpl.GetXAttr(name, attribute)
+	return data, me.xattrStatus(ok)
+}
+
+func (me *HelloFs) ListXAttr(name string, context *fuse.Context) (attributes []string, code fuse.Status) {
+	attributes, ok := me.FileSystemImpl.ListXAttr(name)
+	return attributes, me.xattrStatus(ok)
+}
+
+func (me *HelloFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	return me.xattrStatus(me.FileSystemImpl.SetXAttr(name, attr, data, flags))
+}
+
+func (me *HelloFs) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	return me.xattrStatus(me.FileSystemImpl.RemoveXAttr(name, attr))
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -176,52 +309,49 @@ func (me *HelloFile) GetAttr(out *fuse.Attr) fuse.Status {
 }
 
 func (me *HelloFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	me.fileObject.Utimens(mtime)
 	return fuse.OK
 }
 
 func (me *HelloFile) Truncate(size uint64) fuse.Status {
-	rc := me.fileObject.Truncate(size)
-	if rc == 0 {
-		return fuse.OK
-	} else {
-		return fuse.EIO
-	}
+	ctx, end := fuseRequestCtx(me.client, "Truncate", me.fileObject.Name())
+	ok := me.fileObject.TruncateCtx(ctx, size)
+	end(ok)
+	return fuseStatus(ok)
 }
 
 func (me *HelloFile) Flush() fuse.Status {
-	rc := me.fileObject.Flush()
-	if rc == 0 {
-		return fuse.OK
-	} else {
-		return fuse.EIO
-	}
+	return fuseStatus(me.fileObject.Flush())
 }
 
-//there should not be any real IO in this function
+//pending data is uploaded here, it's not bound by the request timeout
 func (me *HelloFile) Release() {
-	me.fileObject.Release()
-	return
+	ctx, end := fuseRequestCtx(me.client, "Release", me.fileObject.Name())
+	end(me.fileObject.ReleaseCtx(context.WithoutCancel(ctx)))
 }
 
 func (me *HelloFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
-	log.Println("Get read request at: ", off, " length ", len(dest))
-	log.Println(me.fileObject)
+	fuseLog.Debugf("Get read request at: %d length %d", off, len(dest))
 
-	n := me.fileObject.Read(dest, off)
+	ctx, end := fuseRequestCtx(me.client, "Read", me.fileObject.Name())
+	n := me.fileObject.ReadCtx(ctx, dest, off)
+	end(n)
 	if n < 0 {
-		return nil, fuse.EIO
+		return nil, fuseStatus(n)
 	}
 
-	log.Println("Read data for ", n)
+	fuseLog.Debugf("Read data for %d", n)
 	return fuse.ReadResultData(dest), fuse.OK
 }
 
 func (me *HelloFile) Write(data []byte, off int64) (written uint32, code fuse.Status) {
-	n := me.fileObject.Write(data, off)
+	ctx, end := fuseRequestCtx(me.client, "Write", me.fileObject.Name())
+	n := me.fileObject.WriteCtx(ctx, data, off)
+	end(n)
 	if n < 0 {
-		return 0, fuse.EIO
+		return 0, fuseStatus(n)
 	}
-	log.Printf("Succesfully write data for offset %d length %d\n", off, n)
+	fuseLog.Debugf("Succesfully write data for offset %d length %d", off, n)
 	return uint32(n), fuse.OK
 }
 
@@ -0,0 +1,29 @@
+package fsvc
+
+import (
+	"testing"
+
+	"github.com/allspace/csmgr/common"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestFuseStatus(t *testing.T) {
+	cases := []struct {
+		ok     int
+		status fuse.Status
+	}{
+		{0, fuse.OK},
+		{5, fuse.OK},
+		{fscommon.ENOENT, fuse.ENOENT},
+		{fscommon.EACCES, fuse.EACCES},
+		{fscommon.EIO, fuse.EIO},
+		{fscommon.EINVAL, fuse.EINVAL},
+		{fscommon.ENOSYS, fuse.ENOSYS},
+		{fscommon.ENODATA, fuse.ENODATA},
+	}
+	for _, c := range cases {
+		if st := fuseStatus(c.ok); st != c.status {
+			t.Errorf("fuseStatus(%d) = %v, expected %v", c.ok, st, c.status)
+		}
+	}
+}
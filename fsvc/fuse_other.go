@@ -0,0 +1,12 @@
+// +build !linux
+
+package fsvc
+
+import (
+	"github.com/allspace/csmgr/common"
+)
+
+//FUSE is only supported on linux, mounts are served by WebDAV only
+func FileSystemMainLoop(fs fscommon.FileSystemImpl, mnt string) {
+	davLog.Errorf("Can't mount %s, FUSE is not supported on this platform.", mnt)
+}
@@ -1,21 +1,62 @@
 package fsvc
 
 import (
+	"context"
+	"encoding/xml"
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/net/webdav"
 
 	"github.com/allspace/csmgr/common"
-	csu "github.com/allspace/csmgr/util"
+	"github.com/allspace/csmgr/util"
 )
 
+var davLog = util.GetLogger("webdav")
+
+//deadline of a request, 0 for no limit
+//backend requests are canceled once it is exceeded, or the client goes away
+var RequestTimeout time.Duration
+
+//path of Prometheus metrics, empty to disable
+//on the WebDAV server it's a reserved name, so that it doesn't hide a file of a mount at the root
+var MetricsPath = "/$metrics$"
+
+//listen address of a separate server of metrics, e.g. :9100, metrics are served on the WebDAV server if it's empty
+var MetricsAddr string
+
+//methods of WebDAV requests in metrics, others are counted as "other"
+var davMethods = map[string]bool{
+	"OPTIONS": true, "GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"MKCOL": true, "COPY": true, "MOVE": true, "LOCK": true, "UNLOCK": true, "PROPFIND": true, "PROPPATCH": true,
+}
+
+func davMethod(method string) string {
+	if davMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+func requestCtx(parent context.Context) (context.Context, context.CancelFunc) {
+	if RequestTimeout > 0 {
+		return context.WithTimeout(parent, RequestTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
 func Http_MainLoop(fs fscommon.FileSystemImpl) {
+	Http_MainLoopMounts(map[string]fscommon.FileSystemImpl{"/": fs})
+}
+
+//serve each file system under its path prefix, e.g. /photos, "/" for the root
+func Http_MainLoopMounts(mounts map[string]fscommon.FileSystemImpl) {
 	//	myHandler := &fsvc_Handler{fs: fs}
 
 	//	s := &http.Server{
@@ -27,45 +68,111 @@ func Http_MainLoop(fs fscommon.FileSystemImpl) {
 	//	}
 	//	s.ListenAndServe()
 
-	h := &webdav.Handler{
-		FileSystem: webDavFS{fs: fs},
-		LockSystem: webDavLS{},
-		Logger: func(r *http.Request, err error) {
-			litmus := r.Header.Get("X-Litmus")
-			if len(litmus) > 19 {
-				litmus = litmus[:16] + "..."
+	logger := func(r *http.Request, err error) {
+		litmus := r.Header.Get("X-Litmus")
+		if len(litmus) > 19 {
+			litmus = litmus[:16] + "..."
+		}
+
+		switch r.Method {
+		case "COPY", "MOVE":
+			dst := ""
+			if u, err := url.Parse(r.Header.Get("Destination")); err == nil {
+				dst = u.Path
 			}
+			o := r.Header.Get("Overwrite")
+			davLog.WithCtx(r.Context()).Infof("%-20s%-10s%-30s%-30so=%-2s%v", litmus, r.Method, r.URL.Path, dst, o, err)
+		default:
+			davLog.WithCtx(r.Context()).Infof("%-20s%-10s%-30s%v", litmus, r.Method, r.URL.Path, err)
+		}
+	}
 
-			switch r.Method {
-			case "COPY", "MOVE":
-				dst := ""
-				if u, err := url.Parse(r.Header.Get("Destination")); err == nil {
-					dst = u.Path
+	if len(MetricsPath) > 0 {
+		metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			fscommon.WriteMetrics(w)
+		})
+		if len(MetricsAddr) > 0 {
+			mux := http.NewServeMux()
+			mux.Handle(MetricsPath, metrics)
+			go func() {
+				davLog.Infof("Serving metrics at %s%s", MetricsAddr, MetricsPath)
+				if err := http.ListenAndServe(MetricsAddr, mux); err != nil {
+					davLog.Errorf("Failed to serve metrics at %s: %s", MetricsAddr, err)
 				}
-				o := r.Header.Get("Overwrite")
-				log.Printf("%-20s%-10s%-30s%-30so=%-2s%v", litmus, r.Method, r.URL.Path, dst, o, err)
-			default:
-				log.Printf("%-20s%-10s%-30s%v", litmus, r.Method, r.URL.Path, err)
-			}
-		},
+			}()
+		} else {
+			http.Handle(MetricsPath, metrics)
+		}
 	}
 
-	http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		h.ServeHTTP(w, r)
-	}))
+	for prefix, fs := range mounts {
+		prefix = strings.TrimSuffix("/"+strings.Trim(prefix, "/"), "/")
+		davLog.Infof("Serving mount at %s/", prefix)
+		http.Handle(prefix+"/", davHandler(fs, prefix, logger))
+	}
 
 	addr := fmt.Sprintf(":%d", 8080)
-	log.Printf("Serving %v", addr)
+	davLog.Infof("Serving %v", addr)
 	http.ListenAndServe(addr, nil)
 
 }
 
+//a handler for each request, so that errors of the request can be tracked
+//prefix is stripped from paths of requests, empty for the root
+func davHandler(fs fscommon.FileSystemImpl, prefix string, logger func(*http.Request, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		req := &webDavReq{}
+		//the request id is returned to the client and logged with backend calls of the request
+		reqId := r.Header.Get("X-Request-Id")
+		if len(reqId) == 0 {
+			reqId = util.NewRequestId()
+		}
+		w.Header().Set("X-Request-Id", reqId)
+		ctx, cancel := requestCtx(util.WithRequestId(fscommon.WithClient(r.Context(), clientOf(r)), reqId))
+		defer cancel()
+		//a server span for the request, a child of the caller's span if traceparent is sent
+		ctx, span := fscommon.StartSpanKind(fscommon.WithTraceParent(ctx, r.Header.Get("traceparent")),
+			fscommon.SPAN_KIND_SERVER, "webdav "+r.Method, "http.method", r.Method, "http.target", r.URL.Path, "request_id", reqId)
+		h := &webdav.Handler{
+			Prefix:     prefix,
+			FileSystem: webDavFS{fs: fs, ctx: ctx, req: req},
+			LockSystem: webDavLS{},
+			Logger:     logger,
+		}
+		rw := &webDavRspWriter{ResponseWriter: w, req: req, status: http.StatusOK}
+		h.ServeHTTP(rw, r.WithContext(ctx))
+		fscommon.ObserveFrontRequest("webdav", davMethod(r.Method), rw.status, start)
+		span.SetAttr("http.status_code", rw.status)
+		rc := 0
+		if rw.status >= 400 {
+			rc = fscommon.EIO
+			if req.err != nil {
+				rc = req.err.Errno
+			}
+		}
+		span.End(rc)
+	})
+}
+
+//client of a request for per client rate limits, the user if basic auth is used, otherwise the remote address
+func clientOf(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && len(user) > 0 {
+		return "user:" + user
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return "addr:" + host
+	}
+	return "addr:" + r.RemoteAddr
+}
+
 type fsvc_Handler struct {
 	fs fscommon.FileSystemImpl
 }
 
 func (me *fsvc_Handler) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
-	log.Println("Request for ", req.URL)
+	davLog.Debugf("Request for %s", req.URL)
 	path := req.URL.Path
 	if path[len(path)-1] == '/' {
 		me.listDir(rsp, path)
@@ -79,7 +186,7 @@ func (me *fsvc_Handler) listDir(rsp http.ResponseWriter, path string) {
 	html := "<html><table>"
 	dis, ok := me.fs.ReadDir(path)
 	if ok < 0 {
-		rsp.WriteHeader(501)
+		rsp.WriteHeader(fscommon.HttpStatus(ok))
 		return
 	}
 
@@ -119,8 +226,50 @@ func (me *fsvc_Handler) downloadFile(rsp http.ResponseWriter, path string) {
 	fo.Release()
 }
 
+//webdav handler maps errors to a few status codes only, e.g. 404 for any failure of OpenFile
+//so the last error of a request is kept to set the response status from its errno
+type webDavReq struct {
+	err *fscommon.FsError
+}
+
+type webDavRspWriter struct {
+	http.ResponseWriter
+	req    *webDavReq
+	status int //status sent to the client, for metrics
+}
+
+func (me *webDavRspWriter) WriteHeader(status int) {
+	if status >= 400 && me.req.err != nil {
+		status = me.req.err.HttpStatus()
+	}
+	me.status = status
+	me.ResponseWriter.WriteHeader(status)
+}
+
 type webDavFS struct {
-	fs fscommon.FileSystemImpl
+	fs  fscommon.FileSystemImpl
+	ctx context.Context //canceled when the client goes away
+	req *webDavReq
+}
+
+func (me webDavFS) cfs() fscommon.FileSystemImplCtx {
+	return fscommon.FsWithContext(me.fs)
+}
+
+//convert an int code to error, and remember it for the response status
+//a successful call clears the error, webdav may ignore errors, e.g. stat before creating a file
+func (me webDavFS) error(op string, path string, code int) error {
+	if code >= 0 {
+		if me.req != nil {
+			me.req.err = nil
+		}
+		return nil
+	}
+	fe := fscommon.NewError(code, op, path, nil)
+	if me.req != nil {
+		me.req.err = fe
+	}
+	return fe.OsError()
 }
 
 type webDavFile struct {
@@ -133,24 +282,28 @@ type webDavFile struct {
 }
 
 func (me webDavFS) Mkdir(name string, perm os.FileMode) error {
-	return csu.ErrorCode(me.fs.Mkdir(name, 0))
+	ok := me.cfs().MkdirCtx(me.ctx, name, 0)
+	fscommon.Audit(me.ctx, "mkdir", name, 0, ok)
+	return me.error("mkdir", name, ok)
 }
 
 func (me webDavFS) OpenFile(path string, flag int, perm os.FileMode) (webdav.File, error) {
-	di, ok := me.fs.GetAttr(path)
+	di, ok := me.cfs().GetAttrCtx(me.ctx, path)
 	if ok != 0 {
 		if (flag & os.O_CREATE) == 0 {
-			return nil, csu.ErrorCode(ok)
+			return nil, me.error("open", path, ok)
 		}
 	}
 
 	var fo *fscommon.FileObject
 	if di == nil || di.IsDir() == false {
-		fo, ok = me.fs.Open(path, uint32(flag))
+		fo, ok = me.cfs().OpenCtx(me.ctx, path, uint32(flag))
+		fscommon.Audit(me.ctx, "open", path, 0, ok)
 		if ok != 0 {
-			return nil, csu.ErrorCode(ok)
+			return nil, me.error("open", path, ok)
 		}
 	}
+	me.error("open", path, 0)
 
 	return &webDavFile{
 		fileName: path,
@@ -161,30 +314,34 @@ func (me webDavFS) OpenFile(path string, flag int, perm os.FileMode) (webdav.Fil
 }
 
 func (me webDavFS) RemoveAll(name string) error {
-	return csu.ErrorCode(me.fs.Unlink(name))
+	ok := me.cfs().RemoveAllCtx(me.ctx, name)
+	fscommon.Audit(me.ctx, "delete", name, 0, ok)
+	return me.error("remove", name, ok)
 }
 
 func (me webDavFS) Rename(oldName, newName string) error {
-	return csu.ErrorMsg("Not support")
+	fscommon.AuditRename(me.ctx, oldName, newName, fscommon.ENOSYS)
+	return me.error("rename", oldName, fscommon.ENOSYS)
 }
 
 func (me webDavFS) Stat(name string) (os.FileInfo, error) {
-	log.Printf("Stat is called for %s", name)
-	di, ok := me.fs.GetAttr(name)
+	davLog.WithCtx(me.ctx).Debugf("Stat is called for %s", name)
+	di, ok := me.cfs().GetAttrCtx(me.ctx, name)
 	if ok < 0 {
-		log.Printf("GetAttr failed with %d", ok)
-		return nil, csu.ErrorCode(ok)
+		davLog.WithCtx(me.ctx).Debugf("GetAttr failed with %d", ok)
+		return nil, me.error("stat", name, ok)
 	}
-	log.Printf("Stat return file %s length: %d", di.Name(), di.Size())
+	me.error("stat", name, 0)
+	davLog.WithCtx(me.ctx).Debugf("Stat return file %s length: %d", di.Name(), di.Size())
 	return di, nil
 }
 
 func (me *webDavFile) Readdir(count int) ([]os.FileInfo, error) {
-	log.Printf("ReadDir is called for %s", me.fileName)
-	dis, ok := me.fs.ReadDir(me.fileName)
+	davLog.WithCtx(me.davFs.ctx).Debugf("ReadDir is called for %s", me.fileName)
+	dis, ok := me.davFs.cfs().ReadDirCtx(me.davFs.ctx, me.fileName)
 	if ok < 0 {
-		log.Printf("Failed to call ReadDir: %d.", ok)
-		return nil, csu.ErrorCode(ok)
+		davLog.WithCtx(me.davFs.ctx).Debugf("Failed to call ReadDir: %d.", ok)
+		return nil, me.davFs.error("readdir", me.fileName, ok)
 	}
 	return dis, nil
 }
@@ -194,25 +351,26 @@ func (me *webDavFile) Stat() (os.FileInfo, error) {
 }
 
 func (me *webDavFile) Close() error {
-	log.Printf("Close is called for file %s", me.fileName)
+	davLog.WithCtx(me.davFs.ctx).Debugf("Close is called for file %s", me.fileName)
+	//pending data is uploaded here, it's not bound by the request timeout
 	if me.fo != nil {
-		me.fo.Release()
+		me.fo.ReleaseCtx(context.WithoutCancel(me.davFs.ctx))
 	}
 	return nil
 }
 
 func (me *webDavFile) Read(data []byte) (int, error) {
-	log.Printf("Read file %s at offset %d length %d", me.fileName, me.filePos, len(data))
-	n := me.fo.Read(data, me.filePos)
+	davLog.WithCtx(me.davFs.ctx).Debugf("Read file %s at offset %d length %d", me.fileName, me.filePos, len(data))
+	n := me.fo.ReadCtx(me.davFs.ctx, data, me.filePos)
 	if n < 0 {
-		return 0, csu.ErrorCode(n)
+		return 0, me.davFs.error("read", me.fileName, n)
 	}
 	me.filePos += int64(n)
 	return n, nil
 }
 
 func (me *webDavFile) Seek(offset int64, whence int) (int64, error) {
-	log.Printf("Seek is called for file %s, offset %d, loc %d", me.fileName, offset, whence)
+	davLog.WithCtx(me.davFs.ctx).Debugf("Seek is called for file %s, offset %d, loc %d", me.fileName, offset, whence)
 	switch whence {
 	case io.SeekStart:
 		me.filePos = offset
@@ -227,35 +385,97 @@ func (me *webDavFile) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (me *webDavFile) Write(data []byte) (int, error) {
-	n := me.fo.Write(data, me.filePos)
+	n := me.fo.WriteCtx(me.davFs.ctx, data, me.filePos)
 	if n < 0 {
-		return 0, csu.ErrorCode(n)
+		return 0, me.davFs.error("write", me.fileName, n)
 	}
 	me.filePos += int64(n)
 	return n, nil
 }
 
+//WebDAV dead properties are saved as extended attributes
+//attribute name is the property name in Clark notation, e.g. user.webdav.{DAV:}displayname
+const (
+	WEBDAV_XATTR_PREFIX = "user.webdav."
+)
+
+func propToXAttr(name xml.Name) string {
+	return WEBDAV_XATTR_PREFIX + "{" + name.Space + "}" + name.Local
+}
+
+func xattrToProp(attr string) (xml.Name, bool) {
+	if !strings.HasPrefix(attr, WEBDAV_XATTR_PREFIX+"{") {
+		return xml.Name{}, false
+	}
+	name := attr[len(WEBDAV_XATTR_PREFIX)+1:]
+	i := strings.LastIndexByte(name, '}')
+	if i == -1 {
+		return xml.Name{}, false
+	}
+	return xml.Name{Space: name[:i], Local: name[i+1:]}, true
+}
+
+//properties are loaded by one request
+func (me *webDavFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	xa, ok := fscommon.LoadXAttrs(me.fs, me.fileName)
+	if ok < 0 {
+		return nil, me.davFs.error("listxattr", me.fileName, ok)
+	}
+
+	props := make(map[xml.Name]webdav.Property)
+	for attr, data := range xa {
+		if name, isProp := xattrToProp(attr); isProp {
+			props[name] = webdav.Property{XMLName: name, InnerXML: data}
+		}
+	}
+	return props, nil
+}
+
+//all changes are saved at once, so they succeed or fail together
+func (me *webDavFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	pstat := webdav.Propstat{Status: http.StatusOK}
+	set := make(fscommon.XAttrs)
+	remove := make([]string, 0)
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+			//a later change of the same property wins
+			attr := propToXAttr(prop.XMLName)
+			if patch.Remove {
+				delete(set, attr)
+				remove = append(remove, attr)
+			} else {
+				set[attr] = prop.InnerXML
+			}
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: prop.XMLName})
+		}
+	}
+	if ok := fscommon.UpdateXAttrs(me.fs, me.fileName, set, remove); ok < 0 {
+		return nil, me.davFs.error("setxattr", me.fileName, ok)
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
 type webDavLS struct{}
 
 func (me webDavLS) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (release func(), err error) {
-	log.Printf("Confirm: %s", name0)
+	davLog.Debugf("Confirm: %s", name0)
 	release = me.Release
 	err = nil
 	return
 }
 
 func (me webDavLS) Create(now time.Time, details webdav.LockDetails) (token string, err error) {
-	log.Printf("Create: %s", details.Root)
+	davLog.Debugf("Create: %s", details.Root)
 	return details.Root, nil
 }
 
 func (me webDavLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
-	log.Printf("Refresh: %s", token)
+	davLog.Debugf("Refresh: %s", token)
 	return webdav.LockDetails{}, nil
 }
 
 func (me webDavLS) Unlock(now time.Time, token string) error {
-	log.Printf("Unlock: %s", token)
+	davLog.Debugf("Unlock: %s", token)
 	return nil
 }
 
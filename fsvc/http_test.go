@@ -0,0 +1,20 @@
+package fsvc
+
+import (
+	"testing"
+)
+
+func TestDavMethod(t *testing.T) {
+	for method, label := range map[string]string{
+		"GET":      "GET",
+		"PROPFIND": "PROPFIND",
+		"MKCOL":    "MKCOL",
+		"get":      "other",
+		"BREW":     "other",
+		"":         "other",
+	} {
+		if m := davMethod(method); m != label {
+			t.Errorf("davMethod(%q) = %s, expected %s", method, m, label)
+		}
+	}
+}
@@ -4,17 +4,20 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	sectionRegex = regexp.MustCompile(`^\[(.*)\]$`)
 	assignRegex  = regexp.MustCompile(`^([^=]+)=(.*)$`)
+
+	cfgLog = GetLogger("cfg")
 )
 
 // ErrSyntax is returned when there is a syntax error in an INI file.
@@ -36,68 +39,66 @@ func NewErr(code int, msg string) *ErrCfg {
 	}
 }
 
+//keys in a section, e.g. [mount.photos], are saved as MOUNT.PHOTOS.KEY
+//see Section for the config of a section
 type AppCfg struct {
-	cfg map[string]string
+	cfg      map[string]string
+	source   map[string]string //where a value comes from, file, env or flag
+	sections []string          //names of sections in the order of the config file
+	args     []string          //command line arguments which are not flags
 
 	fileName string
+	mtx      sync.RWMutex //values are replaced by Reload
+	hooks    []func(changed []string)
+	modTime  time.Time //of the config file, for Watch
 }
 
 var Default AppCfg
 
-func (me *AppCfg) loadEnv() {
-	var val string
-
-	val = os.Getenv("CS_ENDPOINT")
-	if len(val) > 0 {
-		me.cfg["CS_ENDPOINT"] = os.Getenv("CS_ENDPOINT")
-	}
-	val = os.Getenv("CS_REGION")
-	if len(val) > 0 {
-		me.cfg["CS_REGION"] = os.Getenv("CS_REGION")
-	}
-	val = os.Getenv("CS_KEY_ID")
-	if len(val) > 0 {
-		me.cfg["CS_KEY_ID"] = os.Getenv("CS_KEY_ID")
-	}
-	val = os.Getenv("CS_KEY_DATA")
-	if len(val) > 0 {
-		me.cfg["CS_KEY_DATA"] = os.Getenv("CS_KEY_DATA")
-	}
-	val = os.Getenv("CS_BUCKET")
-	if len(val) > 0 {
-		me.cfg["CS_BUCKET"] = os.Getenv("CS_BUCKET")
-	}
-	val = os.Getenv("CS_VENDOR_TYPE")
-	if len(val) > 0 {
-		me.cfg["CS_VENDOR_TYPE"] = os.Getenv("CS_VENDOR_TYPE")
-	}
+func (me *AppCfg) set(key string, val string, source string) {
+	key = strings.ToUpper(key)
+	me.cfg[key] = val
+	me.source[key] = source
 }
 
+//flags are --name=value, or --name for a bool, keys in sections are --mount.photos.bucket=value
 func (me *AppCfg) loadCmdArgs() {
+	me.args = me.args[:0]
 	n := len(os.Args)
 	for i := 1; i < n; i++ { //skip command name itself
 		arg := os.Args[i]
-		if len(arg) < 5 || arg[0] != '-' || arg[1] != '-' {
-			log.Printf("Unrecogonized command line argument %s.", arg)
+		if len(arg) < 3 || arg[0] != '-' || arg[1] != '-' {
+			me.args = append(me.args, arg)
 			continue
 		}
 		arg = arg[2:]
-		j := strings.IndexByte(arg, '=')
-		if j == -1 {
-			key := strings.Replace(arg, "-", "_", -1)
-			me.cfg[strings.ToUpper(key)] = "1"
+		name, val := arg, "1"
+		if j := strings.IndexByte(arg, '='); j != -1 {
+			name, val = arg[0:j], arg[j+1:]
+		}
+		me.set(me.flagKey(name), val, CFG_SOURCE_FLAG)
+	}
+}
 
-		} else {
-			key := strings.Replace(arg[0:j], "-", "_", -1)
-			me.cfg[strings.ToUpper(key)] = arg[j:]
+//key of a command line flag
+func (me *AppCfg) flagKey(name string) string {
+	for _, ck := range schemaOrder {
+		if ck.FlagName() == name {
+			return ck.Name
 		}
 	}
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+//command line arguments which are not flags, e.g. a sub command
+func (me *AppCfg) Args() []string {
+	return me.args
 }
 
 func (me *AppCfg) loadCfgFile(fileName string) {
 	in, err := os.Open(fileName)
 	if err != nil {
-		log.Println(err)
+		cfgLog.Warnf("Failed to load config file: %s", err)
 		return
 	}
 	defer in.Close()
@@ -107,6 +108,7 @@ func (me *AppCfg) loadCfgFile(fileName string) {
 
 func (me *AppCfg) parseFile(in *bufio.Reader) (err error) {
 	lineNum := 0
+	section := ""
 	for done := false; !done; {
 		var line string
 		if line, err = in.ReadString('\n'); err != nil {
@@ -130,27 +132,72 @@ func (me *AppCfg) parseFile(in *bufio.Reader) (err error) {
 		if groups := assignRegex.FindStringSubmatch(line); groups != nil {
 			key, val := groups[1], groups[2]
 			key, val = strings.TrimSpace(key), strings.TrimSpace(val)
-			me.cfg[strings.ToUpper(key)] = val
+			if len(section) > 0 {
+				key = section + "." + key
+			}
+			me.set(key, val, CFG_SOURCE_FILE)
 			//log.Println(val)
-		} /* else if groups := sectionRegex.FindStringSubmatch(line); groups != nil {
-			name := strings.TrimSpace(groups[1])
-			section = name
-			// Create the section if it does not exist
-			file.Section(section)
+		} else if groups := sectionRegex.FindStringSubmatch(line); groups != nil {
+			section = strings.TrimSpace(groups[1])
+			if !me.hasSection(section) {
+				me.sections = append(me.sections, section)
+			}
 		} else {
-			return ErrSyntax{lineNum, line}
-		}*/
+			cfgLog.Warnf("Invalid config on line %d: %s", lineNum, line)
+		}
 
 	}
 	return nil
 }
 
+func (me *AppCfg) hasSection(name string) bool {
+	for _, sec := range me.sections {
+		if strings.EqualFold(sec, name) {
+			return true
+		}
+	}
+	return false
+}
+
+//names of sections with the prefix, prefix excluded, e.g. Sections("mount.") returns photos for [mount.photos]
+func (me *AppCfg) Sections(prefix string) []string {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+	names := make([]string, 0)
+	for _, sec := range me.sections {
+		if len(sec) > len(prefix) && strings.EqualFold(sec[:len(prefix)], prefix) {
+			names = append(names, sec[len(prefix):])
+		}
+	}
+	return names
+}
+
+//config of a section, global keys which are not set in the section are inherited
+func (me *AppCfg) Section(name string) *AppCfg {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+	prefix := strings.ToUpper(name) + "."
+	sec := &AppCfg{cfg: make(map[string]string, len(me.cfg)), source: make(map[string]string, len(me.cfg))}
+	for key, val := range me.cfg {
+		if !strings.Contains(key, ".") {
+			sec.set(key, val, me.source[key])
+		}
+	}
+	for key, val := range me.cfg {
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], ".") {
+			sec.set(key[len(prefix):], val, me.source[key])
+		}
+	}
+	return sec
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
 func (me *AppCfg) Init(fileName string) {
 
 	if me.cfg == nil {
 		me.cfg = make(map[string]string)
+		me.source = make(map[string]string)
 	}
 
 	if len(fileName) > 0 {
@@ -164,19 +211,39 @@ func (me *AppCfg) Init(fileName string) {
 		me.fileName = path.Join(dir, file+".cfg")
 	}
 
-	me.Reload()
+	me.load()
 }
 
-func (me *AppCfg) Reload() {
+//load the config file, environment variables and command line flags, in this order
+//encrypted values are decrypted after all of them are loaded, see secret.go
+func (me *AppCfg) load() {
 	if len(me.fileName) > 0 {
+		if fi, err := os.Stat(me.fileName); err == nil {
+			me.modTime = fi.ModTime()
+		}
 		me.loadCfgFile(me.fileName)
 	}
 	me.loadEnv()
 	me.loadCmdArgs()
+	me.decrypt()
 }
 
-func (me *AppCfg) GetString(key string) (string, error) {
+//value of a key, or its declared default
+func (me *AppCfg) lookup(key string) (string, bool) {
+	me.mtx.RLock()
 	val, ok := me.cfg[strings.ToUpper(key)]
+	me.mtx.RUnlock()
+	if ok {
+		return val, true
+	}
+	if ck := LookupCfg(key); ck != nil && len(ck.Default) > 0 {
+		return ck.Default, true
+	}
+	return "", false
+}
+
+func (me *AppCfg) GetString(key string) (string, error) {
+	val, ok := me.lookup(key)
 	if ok {
 		return val, nil
 	} else {
@@ -194,7 +261,7 @@ func (me *AppCfg) GetStringEx(key string, dft string) string {
 }
 
 func (me *AppCfg) GetInt(key string) (int, error) {
-	val, ok := me.cfg[strings.ToUpper(key)]
+	val, ok := me.lookup(key)
 	if ok {
 		return strconv.Atoi(val)
 	} else {
@@ -212,19 +279,74 @@ func (me *AppCfg) GetIntEx(key string, dft int) int {
 }
 
 func (me *AppCfg) GetBool(key string) (bool, error) {
-	val, ok := me.cfg[strings.ToUpper(key)]
+	val, ok := me.lookup(key)
 	if ok {
-		if val == "1" || strings.ToLower(val) == "true" {
-			return true, nil
-		} else {
-			return false, nil
-		}
+		return ParseBool(val)
 	}
 	return false, NewErr(-1, "Not exists.")
 }
 
+//size with an optional unit suffix, e.g. 512K, 100M, 10G, 2T
+func (me *AppCfg) GetSize(key string) (int64, error) {
+	val, ok := me.lookup(key)
+	if !ok {
+		return 0, NewErr(-1, "Not exists.")
+	}
+	return ParseSize(val)
+}
+
+//duration like 30s, a number without unit is in the unit of the declared key, second by default
+func (me *AppCfg) GetDuration(key string) (time.Duration, error) {
+	val, ok := me.lookup(key)
+	if !ok {
+		return 0, NewErr(-1, "Not exists.")
+	}
+	var unit time.Duration
+	if ck := LookupCfg(key); ck != nil {
+		unit = ck.Unit
+	}
+	return ParseDuration(val, unit)
+}
+
+func (me *AppCfg) GetFloat(key string) (float64, error) {
+	val, ok := me.lookup(key)
+	if !ok {
+		return 0, NewErr(-1, "Not exists.")
+	}
+	return strconv.ParseFloat(val, 64)
+}
+
+func ParseSize(val string) (int64, error) {
+	val = strings.ToUpper(strings.TrimSpace(val))
+	val = strings.TrimSuffix(val, "B")
+	var unit int64 = 1
+	if n := len(val); n > 0 {
+		switch val[n-1] {
+		case 'K':
+			unit = 1024
+		case 'M':
+			unit = 1024 * 1024
+		case 'G':
+			unit = 1024 * 1024 * 1024
+		case 'T':
+			unit = 1024 * 1024 * 1024 * 1024
+		}
+		if unit > 1 {
+			val = val[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * unit, nil
+}
+
+//log all values, secrets are redacted
 func (me *AppCfg) PrintAll() {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
 	for key, val := range me.cfg {
-		log.Printf("%s = %s", key, val)
+		cfgLog.Infof("%s = %s", key, redact(key, val, me.source[key]))
 	}
 }
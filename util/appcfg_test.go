@@ -0,0 +1,127 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	RegisterCfg(
+		&CfgKey{Name: "TEST_FILE_ONLY"},
+		&CfgKey{Name: "TEST_ENV"},
+		&CfgKey{Name: "TEST_FLAG"},
+		&CfgKey{Name: "TEST_EQUAL"},
+		&CfgKey{Name: "TEST_RENAMED", Env: "TEST_RENAMED_ENV", Flag: "renamed"},
+	)
+}
+
+//a config loaded from a file, the environment and command line flags
+func loadTestCfg(t *testing.T, file string, env map[string]string, args ...string) *AppCfg {
+	name := filepath.Join(t.TempDir(), "test.cfg")
+	if err := os.WriteFile(name, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range env {
+		t.Setenv(key, val)
+	}
+	saved := os.Args
+	os.Args = append([]string{"csmgr"}, args...)
+	defer func() { os.Args = saved }()
+
+	cfg := &AppCfg{}
+	cfg.Init(name)
+	return cfg
+}
+
+func TestCfgSources(t *testing.T) {
+	cfg := loadTestCfg(t, `
+TEST_FILE_ONLY = file
+TEST_ENV = file
+TEST_FLAG = file
+TEST_EQUAL = ==file
+[mount.photos]
+TEST_FLAG = photos
+`, map[string]string{
+		"CS_TEST_ENV":      "env",
+		"CS_TEST_FLAG":     "env",
+		"TEST_RENAMED_ENV": "=env",
+	}, "--test-flag=flag", "--mount.photos.test-flag=flag", "--test-equal==a=b", "--debug", "mount", "--renamed")
+
+	for _, c := range []struct {
+		key, val, source string
+	}{
+		{"TEST_FILE_ONLY", "file", CFG_SOURCE_FILE},
+		{"TEST_ENV", "env", CFG_SOURCE_ENV},
+		{"TEST_FLAG", "flag", CFG_SOURCE_FLAG},
+		{"MOUNT.PHOTOS.TEST_FLAG", "flag", CFG_SOURCE_FLAG},
+		{"TEST_EQUAL", "=a=b", CFG_SOURCE_FLAG},
+		{"DEBUG", "1", CFG_SOURCE_FLAG},
+		{"TEST_RENAMED", "1", CFG_SOURCE_FLAG},
+	} {
+		if val, _ := cfg.GetString(c.key); val != c.val || cfg.source[c.key] != c.source {
+			t.Errorf("%s = %q from %s, expected %q from %s", c.key, val, cfg.source[c.key], c.val, c.source)
+		}
+	}
+	if args := cfg.Args(); len(args) != 1 || args[0] != "mount" {
+		t.Errorf("Args: %v", args)
+	}
+
+	//values starting with = in the file and the environment
+	cfg = loadTestCfg(t, "TEST_EQUAL = ==file\n", map[string]string{"TEST_RENAMED_ENV": "=env"})
+	if val, _ := cfg.GetString("TEST_EQUAL"); val != "==file" {
+		t.Errorf("TEST_EQUAL from the file = %q", val)
+	}
+	if val, _ := cfg.GetString("TEST_RENAMED"); val != "=env" {
+		t.Errorf("TEST_RENAMED from the environment = %q", val)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, c := range []struct {
+		val  string
+		size int64
+	}{
+		{"0", 0},
+		{"100", 100},
+		{"512K", 512 * 1024},
+		{"512kb", 512 * 1024},
+		{" 10M ", 10 * 1024 * 1024},
+		{"2G", 2 * 1024 * 1024 * 1024},
+		{"1T", 1024 * 1024 * 1024 * 1024},
+		{"100B", 100},
+	} {
+		if size, err := ParseSize(c.val); err != nil || size != c.size {
+			t.Errorf("ParseSize(%q) = %d, %v, expected %d", c.val, size, err, c.size)
+		}
+	}
+	for _, val := range []string{"", "M", "10X", "1.5G", "-"} {
+		if _, err := ParseSize(val); err == nil {
+			t.Errorf("ParseSize(%q) succeeded", val)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, c := range []struct {
+		val  string
+		unit time.Duration
+		d    time.Duration
+	}{
+		{"30", 0, 30 * time.Second},
+		{"30", time.Millisecond, 30 * time.Millisecond},
+		{" 1m30s ", 0, 90 * time.Second},
+		{"500ms", time.Minute, 500 * time.Millisecond},
+		{"0", 0, 0},
+	} {
+		if d, err := ParseDuration(c.val, c.unit); err != nil || d != c.d {
+			t.Errorf("ParseDuration(%q, %v) = %v, %v, expected %v", c.val, c.unit, d, err, c.d)
+		}
+	}
+	for _, val := range []string{"", "1.5", "10x", "s"} {
+		if _, err := ParseDuration(val, 0); err == nil {
+			t.Errorf("ParseDuration(%q) succeeded", val)
+		}
+	}
+}
@@ -1 +1,286 @@
 package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//leveled structured logger
+//each subsystem, e.g. s3, webdav, has its own logger and level, see InitLog for the config keys
+//a request id is carried in the context of a front-end request, so that backend calls can be correlated
+
+const (
+	LOG_DEBUG = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+	LOG_OFF
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR", "OFF"}
+
+func ParseLogLevel(val string) (int, error) {
+	val = strings.ToUpper(strings.TrimSpace(val))
+	if val == "WARNING" {
+		val = "WARN"
+	}
+	for i, name := range levelNames {
+		if name == val {
+			return i, nil
+		}
+	}
+	return LOG_INFO, fmt.Errorf("unknown log level %s", val)
+}
+
+type logConfig struct {
+	level  int            //default level
+	levels map[string]int //level of each subsystem
+	format string
+	out    io.Writer
+	file   string     //path of out, empty for stderr
+	mtx    sync.Mutex //for writing
+}
+
+var logCfg = &logConfig{
+	level:  LOG_INFO,
+	levels: make(map[string]int),
+	format: LOG_FORMAT_TEXT,
+	out:    os.Stderr,
+}
+var logCfgMtx sync.RWMutex
+
+type Logger struct {
+	subsys string
+	fields []interface{} //key and value pairs
+}
+
+var loggers = make(map[string]*Logger)
+var loggersMtx sync.Mutex
+
+//get the logger of a subsystem
+func GetLogger(subsys string) *Logger {
+	loggersMtx.Lock()
+	defer loggersMtx.Unlock()
+
+	lg, ok := loggers[subsys]
+	if !ok {
+		lg = &Logger{subsys: subsys}
+		loggers[subsys] = lg
+	}
+	return lg
+}
+
+//configure loggers from application config
+//LOG_LEVEL is the default level, debug, info (default), warn, error or off
+//LOG_LEVELS sets levels of subsystems, e.g. s3=debug,webdav=warn
+//LOG_FORMAT is text (default) or json, LOG_FILE is the log file, stderr by default
+//it's called again when config is reloaded, the log file is kept open if it's not changed
+func InitLog(cfg *AppCfg) error {
+	lc := &logConfig{
+		level:  LOG_INFO,
+		levels: make(map[string]int),
+		format: LOG_FORMAT_TEXT,
+		out:    os.Stderr,
+	}
+
+	if val, err := cfg.GetString("LOG_LEVEL"); err == nil {
+		level, err := ParseLogLevel(val)
+		if err != nil {
+			return err
+		}
+		lc.level = level
+	}
+	if val, err := cfg.GetString("LOG_LEVELS"); err == nil {
+		for _, item := range strings.Split(val, ",") {
+			item = strings.TrimSpace(item)
+			if len(item) == 0 {
+				continue
+			}
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid log level %s", item)
+			}
+			level, err := ParseLogLevel(kv[1])
+			if err != nil {
+				return err
+			}
+			lc.levels[strings.TrimSpace(kv[0])] = level
+		}
+	}
+	if val, err := cfg.GetString("LOG_FORMAT"); err == nil {
+		val = strings.ToLower(val)
+		if val != LOG_FORMAT_TEXT && val != LOG_FORMAT_JSON {
+			return fmt.Errorf("unknown log format %s", val)
+		}
+		lc.format = val
+	}
+	old := currentLogCfg()
+	if val, err := cfg.GetString("LOG_FILE"); err == nil && len(val) > 0 {
+		if val == old.file {
+			lc.out = old.out
+		} else {
+			f, err := os.OpenFile(val, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			lc.out = f
+		}
+		lc.file = val
+	}
+
+	logCfgMtx.Lock()
+	logCfg = lc
+	logCfgMtx.Unlock()
+
+	//wait for writes in progress before the old file is closed
+	if len(old.file) > 0 && old.file != lc.file {
+		old.mtx.Lock()
+		if f, ok := old.out.(*os.File); ok {
+			f.Close()
+		}
+		old.mtx.Unlock()
+	}
+	return nil
+}
+
+func currentLogCfg() *logConfig {
+	logCfgMtx.RLock()
+	defer logCfgMtx.RUnlock()
+	return logCfg
+}
+
+func (me *logConfig) levelOf(subsys string) int {
+	if level, ok := me.levels[subsys]; ok {
+		return level
+	}
+	return me.level
+}
+
+//a child logger with additional fields, e.g. lg.With("path", path)
+func (me *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(me.fields)+len(kv))
+	fields = append(fields, me.fields...)
+	fields = append(fields, kv...)
+	return &Logger{subsys: me.subsys, fields: fields}
+}
+
+//a child logger with the request id of the context
+func (me *Logger) WithCtx(ctx context.Context) *Logger {
+	if ctx == nil {
+		return me
+	}
+	id := RequestIdOf(ctx)
+	if len(id) == 0 {
+		return me
+	}
+	return me.With("req", id)
+}
+
+func (me *Logger) Enabled(level int) bool {
+	return level >= currentLogCfg().levelOf(me.subsys)
+}
+
+func (me *Logger) Debugf(format string, args ...interface{}) {
+	me.output(LOG_DEBUG, format, args)
+}
+
+func (me *Logger) Infof(format string, args ...interface{}) {
+	me.output(LOG_INFO, format, args)
+}
+
+func (me *Logger) Warnf(format string, args ...interface{}) {
+	me.output(LOG_WARN, format, args)
+}
+
+func (me *Logger) Errorf(format string, args ...interface{}) {
+	me.output(LOG_ERROR, format, args)
+}
+
+//log at error level and exit
+func (me *Logger) Fatalf(format string, args ...interface{}) {
+	me.output(LOG_ERROR, format, args)
+	os.Exit(1)
+}
+
+func (me *Logger) output(level int, format string, args []interface{}) {
+	lc := currentLogCfg()
+	if level < lc.levelOf(me.subsys) {
+		return
+	}
+
+	now := time.Now()
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	caller := ""
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+
+	var buf []byte
+	if lc.format == LOG_FORMAT_JSON {
+		rec := map[string]interface{}{
+			"time":   now.Format(time.RFC3339Nano),
+			"level":  strings.ToLower(levelNames[level]),
+			"subsys": me.subsys,
+			"caller": caller,
+			"msg":    msg,
+		}
+		for i := 0; i+1 < len(me.fields); i += 2 {
+			rec[fmt.Sprint(me.fields[i])] = me.fields[i+1]
+		}
+		var err error
+		if buf, err = json.Marshal(rec); err != nil {
+			buf = []byte(strconv.Quote(msg))
+		}
+	} else {
+		line := fmt.Sprintf("%s %-5s [%s] %s %s", now.Format("2006-01-02 15:04:05.000"),
+			levelNames[level], me.subsys, caller, msg)
+		for i := 0; i+1 < len(me.fields); i += 2 {
+			line += fmt.Sprintf(" %v=%v", me.fields[i], me.fields[i+1])
+		}
+		buf = []byte(line)
+	}
+	buf = append(buf, '\n')
+
+	lc.mtx.Lock()
+	lc.out.Write(buf)
+	lc.mtx.Unlock()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//Request id
+///////////////////////////////////////////////////////////////////////////////
+
+type requestIdKey struct{}
+
+func NewRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+func RequestIdOf(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+//hot reload of config, triggered by SIGHUP or a change of the config file, see Watch
+//only keys declared with Reload are changed, changes of other keys are logged and ignored until restart
+
+//call fn with changed keys after each reload, keys in sections are like MOUNT.PHOTOS.RATE_UPLOAD
+func (me *AppCfg) OnReload(fn func(changed []string)) {
+	me.mtx.Lock()
+	me.hooks = append(me.hooks, fn)
+	me.mtx.Unlock()
+}
+
+//load config again and apply changes of reloadable keys
+//an invalid config is rejected as a whole, 0 is returned if nothing is changed
+func (me *AppCfg) Reload() int {
+	fresh := &AppCfg{
+		cfg:      make(map[string]string),
+		source:   make(map[string]string),
+		fileName: me.fileName,
+	}
+	fresh.load()
+
+	me.mtx.Lock()
+	if fresh.modTime.After(me.modTime) {
+		me.modTime = fresh.modTime
+	}
+	if err := fresh.Validate(); err != nil {
+		me.mtx.Unlock()
+		cfgLog.Errorf("Config is not reloaded: %s", err)
+		return -1
+	}
+	keys := make(map[string]bool)
+	for key := range me.cfg {
+		keys[key] = true
+	}
+	for key := range fresh.cfg {
+		keys[key] = true
+	}
+	changed := make([]string, 0)
+	for key := range keys {
+		oldVal, oldOk := me.cfg[key]
+		newVal, newOk := fresh.cfg[key]
+		if oldOk == newOk && oldVal == newVal {
+			continue
+		}
+		if ck := LookupCfg(key); ck == nil || !ck.Reload {
+			cfgLog.Errorf("%s can't be changed without restart, the change is ignored.", key)
+			if oldOk {
+				fresh.set(key, oldVal, me.source[key])
+			} else {
+				delete(fresh.cfg, key)
+				delete(fresh.source, key)
+			}
+			continue
+		}
+		cfgLog.Infof("%s is changed to %s.", key, redact(key, newVal, fresh.source[key]))
+		changed = append(changed, key)
+	}
+	if len(changed) > 0 {
+		me.cfg = fresh.cfg
+		me.source = fresh.source
+	}
+	hooks := me.hooks
+	me.mtx.Unlock()
+
+	if len(changed) == 0 {
+		cfgLog.Infof("Config is reloaded, nothing is changed.")
+		return 0
+	}
+	sort.Strings(changed)
+	for _, fn := range hooks {
+		fn(changed)
+	}
+	return len(changed)
+}
+
+//reload when the config file is modified, it's checked every interval
+func (me *AppCfg) Watch(interval time.Duration) {
+	if len(me.fileName) == 0 || interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			fi, err := os.Stat(me.fileName)
+			if err != nil {
+				continue
+			}
+			me.mtx.RLock()
+			modified := fi.ModTime().After(me.modTime)
+			me.mtx.RUnlock()
+			if modified {
+				cfgLog.Infof("Config file %s is modified, reloading.", me.fileName)
+				me.Reload()
+			}
+		}
+	}()
+}
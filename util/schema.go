@@ -0,0 +1,232 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//declared config keys, with their types, defaults, environment variables and command line flags
+//values are loaded from the config file, then environment variables, then command line flags
+//each source overrides the previous one
+
+const (
+	CFG_STRING = iota
+	CFG_INT
+	CFG_BOOL
+	CFG_SIZE     //bytes with an optional unit suffix, e.g. 10M
+	CFG_DURATION //e.g. 30s or 500ms, a bare number is in Unit
+	CFG_FLOAT
+)
+
+var cfgTypeNames = []string{"string", "int", "bool", "size", "duration", "float"}
+
+const (
+	CFG_SOURCE_FILE = "file"
+	CFG_SOURCE_ENV  = "env"
+	CFG_SOURCE_FLAG = "flag"
+)
+
+type CfgKey struct {
+	Name    string //upper case, e.g. ENDPOINT
+	Type    int
+	Default string //empty for no default
+	Env     string //CS_<Name> if empty
+	Flag    string //--<name> in lower case with dashes if empty
+	Desc    string
+	Secret  bool          //redacted when config is printed
+	Values  []string      //allowed values, empty for any
+	Unit    time.Duration //unit of a duration without suffix, second if 0
+	Reload  bool          //can be changed by Reload, other keys need a restart
+}
+
+func (me *CfgKey) EnvName() string {
+	if len(me.Env) > 0 {
+		return me.Env
+	}
+	return "CS_" + me.Name
+}
+
+func (me *CfgKey) FlagName() string {
+	if len(me.Flag) > 0 {
+		return me.Flag
+	}
+	return strings.ToLower(strings.Replace(me.Name, "_", "-", -1))
+}
+
+//check if a value can be parsed as the type of the key
+func (me *CfgKey) Check(val string) error {
+	var err error
+	switch me.Type {
+	case CFG_INT:
+		_, err = strconv.Atoi(val)
+	case CFG_BOOL:
+		_, err = ParseBool(val)
+	case CFG_SIZE:
+		_, err = ParseSize(val)
+	case CFG_DURATION:
+		_, err = ParseDuration(val, me.Unit)
+	case CFG_FLOAT:
+		_, err = strconv.ParseFloat(val, 64)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s value %q of %s", cfgTypeNames[me.Type], val, me.Name)
+	}
+	if len(me.Values) > 0 {
+		for _, v := range me.Values {
+			if strings.EqualFold(v, val) {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid value %q of %s, must be one of %s", val, me.Name, strings.Join(me.Values, ", "))
+	}
+	return nil
+}
+
+var schema = make(map[string]*CfgKey)
+var schemaOrder = make([]*CfgKey, 0)
+
+//declare config keys, usually in init of the application
+func RegisterCfg(keys ...*CfgKey) {
+	for _, key := range keys {
+		key.Name = strings.ToUpper(key.Name)
+		if _, ok := schema[key.Name]; !ok {
+			schemaOrder = append(schemaOrder, key)
+		}
+		schema[key.Name] = key
+	}
+}
+
+//declaration of a key, keys in sections, e.g. MOUNT.PHOTOS.BUCKET, are declared without the section
+func LookupCfg(key string) *CfgKey {
+	key = strings.ToUpper(key)
+	if i := strings.LastIndexByte(key, '.'); i != -1 {
+		key = key[i+1:]
+	}
+	return schema[key]
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func ParseBool(val string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid bool %s", val)
+}
+
+//a Go duration, e.g. 1m30s, or a number in unit, second if unit is 0
+func ParseDuration(val string, unit time.Duration) (time.Duration, error) {
+	val = strings.TrimSpace(val)
+	if unit == 0 {
+		unit = time.Second
+	}
+	if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Duration(n) * unit, nil
+	}
+	return time.ParseDuration(val)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+//check all values against the schema, unknown keys are reported as warnings only
+func (me *AppCfg) Validate() error {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+	errs := make([]string, 0)
+	for key, val := range me.cfg {
+		if strings.HasPrefix(val, ENC_PREFIX) {
+			errs = append(errs, fmt.Sprintf("%s can't be decrypted", key))
+			continue
+		}
+		ck := LookupCfg(key)
+		if ck == nil {
+			cfgLog.Warnf("Unknown config %s.", key)
+			continue
+		}
+		if err := ck.Check(val); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+//secrets and values encrypted in the config file are redacted
+func redact(key string, val string, source string) string {
+	if len(val) == 0 {
+		return val
+	}
+	if ck := LookupCfg(key); (ck != nil && ck.Secret) || strings.HasSuffix(source, ", encrypted") {
+		return "******"
+	}
+	return val
+}
+
+//print effective config with sources, secrets are redacted
+func (me *AppCfg) Print(w io.Writer) {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+	for _, ck := range schemaOrder {
+		val, ok := me.cfg[ck.Name]
+		source := me.source[ck.Name]
+		if !ok {
+			if len(ck.Default) == 0 {
+				continue
+			}
+			val, source = ck.Default, "default"
+		}
+		fmt.Fprintf(w, "%s = %s\t# %s\n", ck.Name, redact(ck.Name, val, source), source)
+	}
+
+	//keys in sections and unknown keys
+	keys := make([]string, 0)
+	for key := range me.cfg {
+		if _, ok := schema[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		source := me.source[key]
+		val := redact(key, me.cfg[key], source)
+		if LookupCfg(key) == nil {
+			source += ", unknown"
+		}
+		fmt.Fprintf(w, "%s = %s\t# %s\n", key, val, source)
+	}
+}
+
+//print help of all declared keys
+func PrintCfgHelp(w io.Writer) {
+	for _, ck := range schemaOrder {
+		fmt.Fprintf(w, "%-24s %-8s --%s, $%s\n", ck.Name, cfgTypeNames[ck.Type], ck.FlagName(), ck.EnvName())
+		desc := ck.Desc
+		if len(ck.Values) > 0 {
+			desc += " (" + strings.Join(ck.Values, ", ") + ")"
+		}
+		if len(ck.Default) > 0 {
+			desc += ", default " + ck.Default
+		}
+		fmt.Fprintf(w, "    %s\n", desc)
+	}
+}
+
+//environment variables of declared keys
+func (me *AppCfg) loadEnv() {
+	for _, ck := range schemaOrder {
+		if val, ok := os.LookupEnv(ck.EnvName()); ok && len(val) > 0 {
+			me.set(ck.Name, val, CFG_SOURCE_ENV)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//encrypted config values, e.g. KEY_DATA = enc:...
+//a value is encrypted by AES-256-GCM with a key derived from a key file (CONFIG_KEY_FILE) or a passphrase ($CS_CONFIG_PASSPHRASE)
+//the key file can be any secret text, e.g. head -c 32 /dev/urandom | base64 > csmgr.key
+//values are decrypted once they are loaded, a value which can't be decrypted fails Validate
+const (
+	ENC_PREFIX = "enc:"
+
+	CONFIG_PASSPHRASE_ENV = "CS_CONFIG_PASSPHRASE"
+
+	encSaltSize   = 16
+	encIterations = 100000 //of PBKDF2-SHA256
+)
+
+//key material from CONFIG_KEY_FILE, or the passphrase if the key file is not set
+func (me *AppCfg) secretKey() ([]byte, error) {
+	if file, ok := me.cfg["CONFIG_KEY_FILE"]; ok && len(file) > 0 {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key := []byte(strings.TrimSpace(string(buf)))
+		if len(key) == 0 {
+			return nil, fmt.Errorf("key file %s is empty", file)
+		}
+		return key, nil
+	}
+	if pass := os.Getenv(CONFIG_PASSPHRASE_ENV); len(pass) > 0 {
+		return []byte(pass), nil
+	}
+	return nil, fmt.Errorf("neither CONFIG_KEY_FILE nor $%s is set", CONFIG_PASSPHRASE_ENV)
+}
+
+//decrypt all enc: values, failures are logged and the values are kept as they are
+func (me *AppCfg) decrypt() {
+	var key []byte
+	for name, val := range me.cfg {
+		if !strings.HasPrefix(val, ENC_PREFIX) {
+			continue
+		}
+		if key == nil {
+			var err error
+			if key, err = me.secretKey(); err != nil {
+				cfgLog.Errorf("Can't decrypt config values: %s", err)
+				return
+			}
+		}
+		plain, err := DecryptValue(val, key)
+		if err != nil {
+			cfgLog.Errorf("Can't decrypt %s: %s", name, err)
+			continue
+		}
+		me.set(name, plain, me.source[name]+", encrypted")
+	}
+}
+
+//encrypt a value with the key of the config, the result can be pasted into the config file
+func (me *AppCfg) Encrypt(plain string) (string, error) {
+	me.mtx.RLock()
+	key, err := me.secretKey()
+	me.mtx.RUnlock()
+	if err != nil {
+		return "", err
+	}
+	return EncryptValue(plain, key)
+}
+
+func EncryptValue(plain string, key []byte) (string, error) {
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	gcm, err := newValueCipher(key, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	buf := append(salt, nonce...)
+	buf = gcm.Seal(buf, nonce, []byte(plain), nil)
+	return ENC_PREFIX + base64.StdEncoding.EncodeToString(buf), nil
+}
+
+func DecryptValue(val string, key []byte) (string, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(val, ENC_PREFIX))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value")
+	}
+	if len(buf) < encSaltSize {
+		return "", fmt.Errorf("invalid encrypted value")
+	}
+	gcm, err := newValueCipher(key, buf[:encSaltSize])
+	if err != nil {
+		return "", err
+	}
+	buf = buf[encSaltSize:]
+	if len(buf) < gcm.NonceSize()+gcm.Overhead() {
+		return "", fmt.Errorf("invalid encrypted value")
+	}
+	plain, err := gcm.Open(nil, buf[:gcm.NonceSize()], buf[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("wrong key or corrupted value")
+	}
+	return string(plain), nil
+}
+
+func newValueCipher(key []byte, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2(key, salt, encIterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//PBKDF2 with HMAC-SHA256, RFC 8018
+func pbkdf2(password []byte, salt []byte, iter int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+	dk := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	var idx [4]byte
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(idx[:], uint32(block))
+		prf.Write(idx[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
@@ -0,0 +1,74 @@
+package util
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptValue(t *testing.T) {
+	key := []byte("secret key")
+	for _, plain := range []string{"", "a", "password with spaces and = signs", strings.Repeat("x", 1000)} {
+		val, err := EncryptValue(plain, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(val, ENC_PREFIX) {
+			t.Fatalf("encrypted value without prefix: %s", val)
+		}
+		if again, _ := EncryptValue(plain, key); again == val {
+			t.Errorf("%q is encrypted to the same value twice", plain)
+		}
+		if out, err := DecryptValue(val, key); err != nil || out != plain {
+			t.Errorf("DecryptValue of %q: %q, %v", plain, out, err)
+		}
+	}
+}
+
+func TestDecryptValueFails(t *testing.T) {
+	key := []byte("secret key")
+	val, _ := EncryptValue("password", key)
+
+	if _, err := DecryptValue(val, []byte("other key")); err == nil {
+		t.Error("a value is decrypted by a wrong key")
+	}
+	buf, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(val, ENC_PREFIX))
+	for _, i := range []int{0, encSaltSize, len(buf) - 1} {
+		bad := append([]byte(nil), buf...)
+		bad[i] ^= 1
+		if _, err := DecryptValue(ENC_PREFIX+base64.StdEncoding.EncodeToString(bad), key); err == nil {
+			t.Errorf("a value changed at %d is decrypted", i)
+		}
+	}
+	for _, bad := range []string{ENC_PREFIX, ENC_PREFIX + "not base64!", ENC_PREFIX + base64.StdEncoding.EncodeToString(buf[:encSaltSize+4])} {
+		if _, err := DecryptValue(bad, key); err == nil {
+			t.Errorf("an invalid value %q is decrypted", bad)
+		}
+	}
+}
+
+//encrypted values are decrypted when the config is loaded, others are kept as they are
+func TestCfgDecrypt(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "test.key")
+	if err := os.WriteFile(keyFile, []byte("secret key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	val, _ := EncryptValue("password", []byte("secret key"))
+	other, _ := EncryptValue("password", []byte("other key"))
+	cfg := loadTestCfg(t, "CONFIG_KEY_FILE = "+keyFile+"\nTEST_FILE_ONLY = "+val+"\nTEST_ENV = plain value\nTEST_FLAG = "+other+"\n", nil)
+
+	if v, _ := cfg.GetString("TEST_FILE_ONLY"); v != "password" {
+		t.Errorf("encrypted value: %q", v)
+	}
+	if v, _ := cfg.GetString("TEST_ENV"); v != "plain value" {
+		t.Errorf("plain value: %q", v)
+	}
+	if v, _ := cfg.GetString("TEST_FLAG"); v != other {
+		t.Errorf("value of another key: %q, expected it kept as it is", v)
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "TEST_FLAG") {
+		t.Errorf("Validate: %v", err)
+	}
+}